@@ -0,0 +1,124 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IP-based access control
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL is the list of client networks, allowed to access devices.
+//
+// Loopback clients are always allowed, so ACL only restricts
+// network clients. nil ACL allows everybody
+type ACL []*net.IPNet
+
+// ConfACL represents a per-device ACL, defined in the [allow]
+// section of the configuration file:
+//
+//	[allow]
+//	  04f9:2d48 = 192.168.1.0/24, 10.0.0.5
+//
+// The first matching entry wins. Devices without matching entry
+// use the global default, defined by the allow parameter of
+// the [network] section
+type ConfACL struct {
+	Match UsbDevMatch // Matching device
+	Allow ACL         // Allowed networks
+}
+
+// ParseACL parses ACL. The syntax is either "all" or comma-separated
+// list of networks in the CIDR notation (i.e., "192.168.1.0/24")
+// or individual IP addresses
+func ParseACL(s string) (ACL, error) {
+	if strings.TrimSpace(s) == "all" {
+		return nil, nil
+	}
+
+	acl := ACL{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			item = fmt.Sprintf("%s/%d", ip, bits)
+		}
+
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q: invalid network", item)
+		}
+
+		acl = append(acl, ipnet)
+	}
+
+	return acl, nil
+}
+
+// Allow tells if client with the specified IP address is allowed
+func (acl ACL) Allow(ip net.IP) bool {
+	if acl == nil || ip.IsLoopback() {
+		return true
+	}
+
+	for _, ipnet := range acl {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns string representation of ACL, for logging
+func (acl ACL) String() string {
+	if acl == nil {
+		return "all"
+	}
+
+	s := make([]string, len(acl))
+	for i, ipnet := range acl {
+		s[i] = ipnet.String()
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// ACLLookup returns ACL for the device
+func ACLLookup(desc UsbDeviceDesc, info UsbDeviceInfo) ACL {
+	getinfo := func() (UsbDeviceInfo, error) { return info, nil }
+
+	for _, conf := range Conf.DeviceACLs {
+		if conf.Match.Match(desc, getinfo) {
+			return conf.Allow
+		}
+	}
+
+	return Conf.ACL
+}
+
+// confLoadACL loads the [allow] section record
+func confLoadACL(rec *IniRecord) error {
+	match, err := ParseUsbDevMatch(rec.Key)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	conf := &ConfACL{Match: match}
+	err = rec.LoadACL(&conf.Allow)
+	if err == nil {
+		Conf.DeviceACLs = append(Conf.DeviceACLs, conf)
+	}
+
+	return err
+}
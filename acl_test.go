@@ -0,0 +1,139 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IP-based access control
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestACL tests ParseACL and ACL.Allow
+func TestACL(t *testing.T) {
+	tests := []struct {
+		acl     string
+		allowed []string
+		denied  []string
+		err     bool
+	}{
+		{
+			acl:     "all",
+			allowed: []string{"192.168.1.5", "2001:db8::1"},
+		},
+		{
+			acl:     "192.168.1.0/24, 10.0.0.5",
+			allowed: []string{"192.168.1.5", "10.0.0.5", "127.0.0.1", "::1"},
+			denied:  []string{"192.168.2.5", "10.0.0.6", "2001:db8::1"},
+		},
+		{
+			acl:     "2001:db8::/32",
+			allowed: []string{"2001:db8::1"},
+			denied:  []string{"2001:db9::1", "192.168.1.5"},
+		},
+		{acl: "192.168.1.0/33", err: true},
+		{acl: "192.168.1.5, ", err: true},
+		{acl: "localhost", err: true},
+	}
+
+	for _, test := range tests {
+		acl, err := ParseACL(test.acl)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: error expected", test.acl)
+			continue
+		case test.err:
+			continue
+		case err != nil:
+			t.Errorf("%q: %s", test.acl, err)
+			continue
+		}
+
+		for _, addr := range test.allowed {
+			if !acl.Allow(net.ParseIP(addr)) {
+				t.Errorf("%q: %s denied", test.acl, addr)
+			}
+		}
+
+		for _, addr := range test.denied {
+			if acl.Allow(net.ParseIP(addr)) {
+				t.Errorf("%q: %s allowed", test.acl, addr)
+			}
+		}
+	}
+}
+
+// TestConfLoadACL tests loading of ACLs from the configuration file
+// and ACLLookup
+func TestConfLoadACL(t *testing.T) {
+	testConf(t)
+
+	err := testConfLoad(t, `
+[network]
+  allow = 192.168.1.0/24
+
+[allow]
+  04f9:2d48 = 10.0.0.0/8
+  03f0:2b17 = all
+`)
+
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tests := []struct {
+		vid, pid uint16
+		acl      string
+	}{
+		{0x04f9, 0x2d48, "10.0.0.0/8"},
+		{0x03f0, 0x2b17, "all"},
+		{0x1234, 0x5678, "192.168.1.0/24"},
+	}
+
+	for _, test := range tests {
+		desc := UsbDeviceDesc{Vendor: test.vid, Product: test.pid}
+		acl := ACLLookup(desc, UsbDeviceInfo{})
+		if s := acl.String(); s != test.acl {
+			t.Errorf("%4.4x:%4.4x: expected %q, present %q",
+				test.vid, test.pid, test.acl, s)
+		}
+	}
+}
+
+// TestACLBeforeLimit tests that requests of not allowed clients
+// are rejected without waiting for the concurrent requests limit
+func TestACLBeforeLimit(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Handler: &UsbEmuPrinter{}})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	transport.acl, _ = ParseACL("10.0.0.0/8")
+	transport.httpLimit = newHTTPLimiter(1, 0)
+
+	// Occupy the limit
+	err := transport.httpLimit.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer transport.httpLimit.release()
+
+	proxy := &HTTPProxy{log: transport.Log(), transport: transport}
+	proxy.Enable()
+
+	rq := httptest.NewRequest("GET", "/", nil)
+	rq.RemoteAddr = "192.0.2.1:40000"
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, rq)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected %d, present %d", http.StatusForbidden, w.Code)
+	}
+}
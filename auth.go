@@ -9,6 +9,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -65,6 +68,63 @@ func (rule *AuthUIDRule) MatchGroup(name string) AuthOps {
 	return 0
 }
 
+// AuthHTTPRule represents a single rule for HTTP Basic
+// authentication
+type AuthHTTPRule struct {
+	User     string  // User name
+	Password string  // Plain text or sha256:HEX
+	Allowed  AuthOps // Operations, protected by this rule
+}
+
+// AuthHTTPRules is the list of AuthHTTPRule
+type AuthHTTPRules []*AuthHTTPRule
+
+// Protects tells if operations are protected by password, i.e.,
+// at least one rule requires password for them
+func (rules AuthHTTPRules) Protects(ops AuthOps) bool {
+	for _, rule := range rules {
+		if rule.Allowed&ops != AuthOpsNone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authHTTPSha256Prefix is the prefix of the SHA-256 hashed password
+const authHTTPSha256Prefix = "sha256:"
+
+// validate checks that AuthHTTPRule is valid
+func (rule *AuthHTTPRule) validate() error {
+	if !strings.HasPrefix(rule.Password, authHTTPSha256Prefix) {
+		return nil
+	}
+
+	hash, err := hex.DecodeString(rule.Password[len(authHTTPSha256Prefix):])
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("%q: invalid SHA-256 password hash", rule.User)
+	}
+
+	return nil
+}
+
+// Match tells if user name and password match the rule
+func (rule *AuthHTTPRule) Match(user, password string) bool {
+	if user != rule.User {
+		return false
+	}
+
+	expected := rule.Password
+	if strings.HasPrefix(expected, authHTTPSha256Prefix) {
+		expected = strings.ToLower(expected[len(authHTTPSha256Prefix):])
+		hash := sha256.Sum256([]byte(password))
+		password = hex.EncodeToString(hash[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected),
+		[]byte(password)) == 1
+}
+
 // AuthOps is bitmask of allowed operations
 type AuthOps int
 
@@ -81,6 +141,31 @@ const (
 	AuthOpsNone AuthOps = 0
 )
 
+// ParseAuthOps parses comma-separated list of operations
+func ParseAuthOps(list string) (AuthOps, error) {
+	ops := AuthOpsNone
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case "none":
+		case "all":
+			ops |= AuthOpsAll
+		case "config":
+			ops |= AuthOpsConfig
+		case "fax":
+			ops |= AuthOpsFax
+		case "print":
+			ops |= AuthOpsPrint
+		case "scan":
+			ops |= AuthOpsScan
+		default:
+			return AuthOpsNone, fmt.Errorf("invalid operation: %q", s)
+		}
+	}
+
+	return ops, nil
+}
+
 // String returns string representation of AuthOps flags, for debugging.
 func (ops AuthOps) String() string {
 	if ops == 0 {
@@ -233,15 +318,104 @@ func authUIDrequiresUID() bool {
 	return false
 }
 
+// authHTTPPassword performs HTTP Basic authentication, if
+// required by the [auth http] rules for the requested operations.
+//
+// The Authorization header, once consumed, is removed from the
+// request, so user's password is not forwarded to the device
+func authHTTPPassword(log *Logger, rq *http.Request,
+	ops AuthOps) (status int, err error) {
+
+	required := false
+	user, password, ok := rq.BasicAuth()
+
+	for _, rule := range Conf.ConfAuthHTTP {
+		if rule.Allowed&ops == AuthOpsNone {
+			continue
+		}
+
+		required = true
+		if ok && rule.Match(user, password) {
+			log.Debug(' ', "auth: password accepted for %q", user)
+			rq.Header.Del("Authorization")
+			return http.StatusOK, nil
+		}
+	}
+
+	if !required {
+		return http.StatusOK, nil
+	}
+
+	if ok {
+		err = fmt.Errorf("Invalid user name or password for %q", user)
+	} else {
+		err = errors.New("Authentication required")
+	}
+
+	log.Error('!', "auth: %s", err)
+
+	return http.StatusUnauthorized, err
+}
+
+// authPolkit performs polkit authorization, if required by
+// the [auth polkit] section for the requested operations.
+//
+// polkit needs the client process, so it only works for local
+// connections. Non-local requests for such operations are denied
+func authPolkit(log *Logger, client, server *net.TCPAddr, local bool,
+	ops AuthOps) (status int, err error) {
+
+	// Client PID lookup scans /proc, so don't do it, unless
+	// polkit check is really required
+	if ops&Conf.AuthPolkit == AuthOpsNone {
+		return http.StatusOK, nil
+	}
+
+	if !local || !TCPClientUIDSupported() {
+		err = errors.New("Operation requires polkit authorization " +
+			"of local client")
+		log.Error('!', "auth: %s", err)
+		return http.StatusForbidden, err
+	}
+
+	pid, err := TCPClientPID(client, server)
+	if err != nil {
+		err = fmt.Errorf("can't get client PID: %s", err)
+		log.Error('!', "auth: %s", err)
+		return http.StatusInternalServerError, err
+	}
+
+	authorized, err := PolkitCheck(pid, ops)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("polkit: %s", err)
+		log.Error('!', "auth: %s", err)
+		return http.StatusInternalServerError, err
+
+	case !authorized:
+		err = errors.New("Operation not authorized by polkit")
+		log.Error('!', "auth: %s denied by polkit for PID %d", ops, pid)
+		return http.StatusForbidden, err
+	}
+
+	log.Debug(' ', "auth: polkit authorized %s for PID %d", ops, pid)
+
+	return http.StatusOK, nil
+}
+
 // AuthHTTPRequest performs authentication for the incoming
 // HTTP request
 //
+// If share is true, request comes to the shared device and non-local
+// clients must authenticate with password. Operations, not protected
+// by the [auth http] rules, are denied to them
+//
 // On success, status is http.StatusOK and err is nil.
 // Otherwise, status is appropriate for HTTP error response,
 // and err explains the reason
 func AuthHTTPRequest(log *Logger,
 	client, server *net.TCPAddr,
-	rq *http.Request) (status int, err error) {
+	rq *http.Request, share bool) (status int, err error) {
 
 	// Guess the operation by URL
 	post := rq.Method == "POST"
@@ -292,6 +466,14 @@ func AuthHTTPRequest(log *Logger,
 	log.Debug(' ', "  client-addr %s local=%v", client.IP, clientIsLocal)
 	log.Debug(' ', "  server-addr %s local=%v", server.IP, serverIsLocal)
 
+	// Network clients of shared device need password
+	if share && !clientIsLocal && !Conf.ConfAuthHTTP.Protects(ops) {
+		err = errors.New("Operation not shared. See ipp-usb.conf for details")
+		log.Error('!', "auth: %s denied for %s: not protected by password",
+			ops, client.IP)
+		return http.StatusForbidden, err
+	}
+
 	// Do we need UID?
 	uid := -1
 	reason := ""
@@ -338,12 +520,23 @@ func AuthHTTPRequest(log *Logger,
 	log.Debug(' ', "auth: allowed operations: %s", allowed)
 
 	if ops&allowed != AuthOpsNone {
+		local := clientIsLocal && serverIsLocal
+		status, err := authPolkit(log, client, server, local, ops)
+		if err != nil {
+			return status, err
+		}
+
+		if status, err := authHTTPPassword(log, rq, ops); err != nil {
+			return status, err
+		}
+
 		log.Debug(' ', "auth: access granted")
 		return http.StatusOK, nil
 	}
 
 	err = errors.New("Operation not allowed. See ipp-usb.conf for details")
-	log.Error('!', "auth: %s", err)
+	log.Error('!', "auth: %s denied for UID %d (%s)", ops, uid,
+		strings.Join(info.UsrNames, ","))
 
 	return http.StatusForbidden, err
 }
@@ -0,0 +1,128 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Authentication tests
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAuthHTTPPassword tests HTTP Basic authentication
+func TestAuthHTTPPassword(t *testing.T) {
+	saveRules := Conf.ConfAuthHTTP
+	defer func() { Conf.ConfAuthHTTP = saveRules }()
+
+	// sha256("secret")
+	rec := &IniRecord{
+		Key: "config",
+		Value: "admin:sha256:2bb80d537b1da3e38bd30361aa855686" +
+			"bde0eacd7162fef6a25fe97bf527a25b, root:toor",
+	}
+
+	Conf.ConfAuthHTTP = nil
+	if err := rec.LoadAuthHTTPRules(&Conf.ConfAuthHTTP); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tests := []struct {
+		ops      AuthOps
+		user     string
+		password string
+		status   int
+	}{
+		{AuthOpsPrint, "", "", http.StatusOK},
+		{AuthOpsConfig, "", "", http.StatusUnauthorized},
+		{AuthOpsConfig, "admin", "secret", http.StatusOK},
+		{AuthOpsConfig, "admin", "wrong", http.StatusUnauthorized},
+		{AuthOpsConfig, "root", "toor", http.StatusOK},
+		{AuthOpsConfig, "root", "secret", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		rq := httptest.NewRequest("GET", "/", nil)
+		if test.user != "" {
+			rq.SetBasicAuth(test.user, test.password)
+		}
+
+		status, _ := authHTTPPassword(NewLogger(), rq, test.ops)
+		if status != test.status {
+			t.Errorf("%s %q:%q: expected %d, present %d", test.ops,
+				test.user, test.password, test.status, status)
+		}
+
+		if status == http.StatusOK && test.user != "" &&
+			rq.Header.Get("Authorization") != "" {
+			t.Errorf("%s %q: Authorization not removed",
+				test.ops, test.user)
+		}
+	}
+
+	// Invalid rules
+	for _, value := range []string{"admin", ":secret", "admin:sha256:xyz"} {
+		rec := &IniRecord{Key: "config", Value: value}
+		var rules AuthHTTPRules
+		if rec.LoadAuthHTTPRules(&rules) == nil {
+			t.Errorf("%q: error expected", value)
+		}
+	}
+}
+
+// TestAuthUID tests UID-based authorization rules
+func TestAuthUID(t *testing.T) {
+	saveRules := Conf.ConfAuthUID
+	defer func() { Conf.ConfAuthUID = saveRules }()
+
+	load := func(records [][2]string) {
+		Conf.ConfAuthUID = nil
+		for _, r := range records {
+			rec := &IniRecord{Key: r[0], Value: r[1]}
+			if err := rec.LoadAuthUIDRules(&Conf.ConfAuthUID); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+	}
+
+	alice := &AuthUIDinfo{
+		UsrNames: []string{"1000", "alice"},
+		GrpNames: []string{"1000", "alice"},
+	}
+
+	lp := &AuthUIDinfo{
+		UsrNames: []string{"7", "lp"},
+		GrpNames: []string{"7", "lp"},
+	}
+
+	// Only members of group lp may print, only alice may scan,
+	// nobody may configure
+	load([][2]string{
+		{"print", "@lp"},
+		{"scan", "alice"},
+	})
+
+	if ops := AuthUID(alice); ops != AuthOpsScan {
+		t.Errorf("alice: %s", ops)
+	}
+
+	if ops := AuthUID(lp); ops != AuthOpsPrint {
+		t.Errorf("lp: %s", ops)
+	}
+
+	// Record that allows nothing still enables authentication
+	load([][2]string{{"config", ""}})
+	if ops := AuthUID(alice); ops != AuthOpsNone {
+		t.Errorf("nobody: %s", ops)
+	}
+
+	// No rules, everything allowed
+	load(nil)
+	if ops := AuthUID(alice); ops != AuthOpsAll {
+		t.Errorf("not configured: %s", ops)
+	}
+}
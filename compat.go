@@ -0,0 +1,135 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Device compatibility report
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	// CompatReportFormat is the version of compatibility report
+	// format. Incremented on incompatible changes
+	CompatReportFormat = 1
+
+	// CompatReportURL is where users may share compatibility reports
+	CompatReportURL = "https://github.com/OpenPrinting/ipp-usb/issues"
+)
+
+// CompatReport is the structured device compatibility report,
+// created from the ConformanceReport.
+//
+// It is intended for sharing: reports from many users make the
+// devices compatibility matrix and help to extend quirks database.
+// So it is saved as JSON and deliberately doesn't include anything,
+// that identifies the particular device or host (serial number,
+// USB address, file paths)
+type CompatReport struct {
+	Format       int           `json:"format"`           // Report format
+	Date         string        `json:"date"`             // YYYY-MM-DD
+	Platform     string        `json:"platform"`         // GOOS/GOARCH
+	Manufacturer string        `json:"manufacturer"`     // Device manufacturer
+	Model        string        `json:"model"`            // Device model
+	UsbID        string        `json:"usb-id"`           // VID:PID
+	Firmware     string        `json:"firmware"`         // Firmware version
+	Interfaces   int           `json:"interfaces"`       // IPP-over-USB interfaces
+	Capabilities string        `json:"capabilities"`     // Basic capabilities
+	Result       string        `json:"result"`           // PASS, WARN or FAIL
+	Checks       []CompatCheck `json:"checks"`           // Results of checks
+	Applied      []CompatQuirk `json:"applied-quirks"`   // Quirks in effect
+	Suggested    []CompatQuirk `json:"suggested-quirks"` // Suggested quirks
+}
+
+// CompatCheck represents result of a single check in the CompatReport
+type CompatCheck struct {
+	Name   string   `json:"name"`   // Check name
+	Status string   `json:"status"` // Check status
+	Notes  []string `json:"notes"`  // Details
+}
+
+// CompatQuirk represents a quirk in the CompatReport
+type CompatQuirk struct {
+	Name   string `json:"name"`             // Quirk name
+	Value  string `json:"value"`            // Quirk value
+	Origin string `json:"origin,omitempty"` // Quirks file name and line
+}
+
+// NewCompatReport creates CompatReport from the ConformanceReport
+func NewCompatReport(report *ConformanceReport) *CompatReport {
+	info := report.Info
+	compat := &CompatReport{
+		Format:       CompatReportFormat,
+		Date:         time.Now().UTC().Format("2006-01-02"),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Manufacturer: info.Manufacturer,
+		Model:        info.MakeAndModel(),
+		UsbID:        fmt.Sprintf("%4.4x:%4.4x", info.Vendor, info.Product),
+		Firmware:     report.Firmware,
+		Interfaces:   len(report.Desc.IfAddrs),
+		Capabilities: info.BasicCaps.String(),
+		Checks:       []CompatCheck{},
+		Applied:      []CompatQuirk{},
+		Suggested:    []CompatQuirk{},
+	}
+
+	// Overall result is the worst of checks
+	result := ConformancePass
+	for _, res := range report.Results {
+		compat.Checks = append(compat.Checks, CompatCheck{
+			Name:   res.Name,
+			Status: res.Status.String(),
+			Notes:  res.Notes,
+		})
+
+		if res.Status != ConformanceSkip && res.Status > result {
+			result = res.Status
+		}
+	}
+
+	compat.Result = result.String()
+
+	// Export quirks. Only base name of the quirks file is
+	// exported, as the full path is not interesting
+	for _, q := range report.Applied {
+		compat.Applied = append(compat.Applied, CompatQuirk{
+			Name:   q.Name,
+			Value:  q.RawValue,
+			Origin: filepath.Base(q.Origin),
+		})
+	}
+
+	for _, q := range report.Quirks {
+		compat.Suggested = append(compat.Suggested, CompatQuirk{
+			Name:  q.Name,
+			Value: q.RawValue,
+		})
+	}
+
+	return compat
+}
+
+// Encode encodes CompatReport into JSON
+func (compat *CompatReport) Encode() []byte {
+	data, _ := json.MarshalIndent(compat, "", "  ")
+	return append(data, '\n')
+}
+
+// Save saves CompatReport into the file
+func (compat *CompatReport) Save(path string) error {
+	err := ioutil.WriteFile(path, compat.Encode(), 0644)
+	if err != nil {
+		err = fmt.Errorf("compatibility report: %s", err)
+	}
+
+	return err
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -27,16 +28,58 @@ type Configuration struct {
 	HTTPMinPort        int            // Starting port number for HTTP to bind to
 	HTTPMaxPort        int            // Ending port number for HTTP to bind to
 	DNSSdEnable        bool           // Enable DNS-SD advertising
+	DNSSdASCII         bool           // Transliterate DNS-SD names to ASCII
 	LoopbackOnly       bool           // Use only loopback interface
+	Interface          string         // Use only this interface (name or addr)
 	IPV6Enable         bool           // Enable IPv6 advertising
+	TestDevicePort     int            // Test device HTTP port, 0 if disabled
+	HTTPMaxSessions    uint           // Max concurrent requests, 0 if unlimited
+	HTTPMaxQueue       uint           // Max requests, waiting above the limit
+	HTTPCacheTTL       time.Duration  // Capabilities cache TTL, 0 if disabled
+	HTTPRequestTimeout time.Duration  // Per-request deadline, 0 if none
+	HTTPCompress       bool           // Compress textual responses
+	HTTPSEnable        bool           // Enable HTTPS listeners
+	HTTPSCert          string         // HTTPS certificate, "" if auto
+	HTTPSKey           string         // HTTPS private key, "" if auto
+	ACL                ACL            // Default ACL, nil if not restricted
+	DeviceACLs         []*ConfACL     // Per-device ACLs
+	DeviceShares       []*ConfShare   // Per-device network sharing
 	ConfAuthUID        []*AuthUIDRule // [auth uid], parsed
+	ConfAuthHTTP       AuthHTTPRules  // [auth http], parsed
+	AuthPolkit         AuthOps        // Operations, authorized by polkit
 	LogDevice          LogLevel       // Per-device LogLevel mask
 	LogMain            LogLevel       // Main log LogLevel mask
 	LogConsole         LogLevel       // Console  LogLevel mask
 	LogMaxFileSize     int64          // Maximum log file size
 	LogMaxBackupFiles  uint           // Count of files preserved during rotation
+	LogMaxDiskUsage    int64          // Total log disk budget, 0 if unlimited
+	LogBackupCompress  LogCompress    // Compressor of rotated files
+	LogFormat          LogFormat      // Format of log files
+	LogJournal         bool           // Log to systemd journal, not files
+	LogAsync           bool           // Write log files asynchronously
+	LogTraceBuffer     int64          // Per-device trace ring buffer size
+	LogRemoteNetwork   string         // Remote collector network, "" if none
+	LogRemoteAddr      string         // Remote collector address
+	LogRemoteBuffer    int64          // Remote forwarding queue size
+	OtlpEndpoint       string         // OTLP/HTTP collector URL, "" if none
 	LogAllPrinterAttrs bool           // Get *all* printer attrs, for logging
+	LogIppDump         bool           // Dump IPP messages into files
 	ColorConsole       bool           // Enable ANSI colors on console
+	LogColors          LogColors      // Console colors, per LogLevel
+	UsbCapture         bool           // Capture USB traffic for replay
+	UsbCapturePcapng   bool           // Capture USB traffic into pcapng
+	UsbMon             bool           // Cross-check USB traffic with usbmon
+	UsbHotplug         UsbHotplug     // USB hotplug detection method
+	UsbSpoolThreshold  int64          // Spool larger bodies, 0 if disabled
+	UsbSpoolDir        string         // Spool directory, "" for system temp
+	UsbQueueMax        uint           // Max requests, waiting for USB, 0 if unlimited
+	UsbQueueWait       time.Duration  // Max wait for USB connection, 0 if unlimited
+	ShutdownTimeout    time.Duration  // Graceful shutdown timeout
+	LogDeterministic   bool           // Deterministic logs, for regression tests
+	LeakCheck          bool           // Goroutine and fd leak self-monitoring
+	MaxMemory          int64          // Soft memory limit, 0 if unlimited
+	GCPercent          uint           // GC target percentage, 0 for default
+	Printers           []*ConfPrinter // Logical printers
 	Quirks             QuirksDb       // Quirks data base
 }
 
@@ -45,43 +88,134 @@ var Conf = Configuration{
 	HTTPMinPort:        60000,
 	HTTPMaxPort:        65535,
 	DNSSdEnable:        true,
+	DNSSdASCII:         false,
 	LoopbackOnly:       true,
 	IPV6Enable:         true,
+	TestDevicePort:     0,
+	HTTPMaxSessions:    0,
+	HTTPMaxQueue:       0,
+	HTTPCacheTTL:       0,
+	HTTPRequestTimeout: 0,
+	HTTPCompress:       false,
+	HTTPSEnable:        false,
+	HTTPSCert:          "",
+	HTTPSKey:           "",
+	ACL:                nil,
+	DeviceACLs:         nil,
+	DeviceShares:       nil,
 	ConfAuthUID:        nil,
-	LogDevice:          LogDebug,
+	ConfAuthHTTP:       nil,
+	AuthPolkit:         AuthOpsNone,
+	LogDevice:          confDefaultLogDevice,
 	LogMain:            LogDebug,
 	LogConsole:         LogDebug,
-	LogMaxFileSize:     256 * 1024,
-	LogMaxBackupFiles:  5,
+	LogMaxFileSize:     confDefaultLogMaxFileSize,
+	LogMaxBackupFiles:  confDefaultLogMaxBackupFiles,
+	LogBackupCompress:  LogCompressGzip,
+	LogFormat:          LogFormatText,
+	LogJournal:         false,
+	LogAsync:           true,
+	LogTraceBuffer:     0,
+	LogRemoteNetwork:   "",
+	LogRemoteAddr:      "",
+	LogRemoteBuffer:    confDefaultLogRemoteBuffer,
+	OtlpEndpoint:       "",
 	LogAllPrinterAttrs: false,
+	LogIppDump:         false,
 	ColorConsole:       true,
+	LogColors:          LogColorsDefault,
+	UsbCapture:         false,
+	UsbCapturePcapng:   false,
+	UsbMon:             false,
+	UsbHotplug:         UsbHotplugAuto,
+	UsbSpoolThreshold:  0,
+	UsbSpoolDir:        "",
+	UsbQueueMax:        0,
+	UsbQueueWait:       0,
+	ShutdownTimeout:    DevShutdownTimeout,
+	LogDeterministic:   false,
+	LeakCheck:          false,
+	MaxMemory:          confDefaultMaxMemory,
+	GCPercent:          confDefaultGCPercent,
 }
 
 // ConfLoad loads the program configuration
 func ConfLoad() error {
-	// Build list of configuration files
-	files := filepath.SplitList(PathConfDirList)
-	for i := range files {
-		files[i] = filepath.Join(files[i], ConfFileName)
-	}
-
 	// Load file by file
-	for _, file := range files {
+	for _, file := range confFiles() {
 		err := confLoadInternal(file)
 		if err != nil {
 			return err
 		}
 	}
 
+	err := confValidatePrinters()
+	if err != nil {
+		return err
+	}
+
 	// Load quirks
 	quirksDirs := filepath.SplitList(PathQuirksDirList)
 
-	var err error
 	Conf.Quirks, err = LoadQuirksSet(quirksDirs...)
 
 	return err
 }
 
+// ConfLoadLogLevels reloads log levels (the device-log and main-log
+// parameters of the [logging] section) from the configuration files,
+// leaving other parameters intact. It allows to change log levels
+// of the running daemon without restart.
+//
+// On error, Conf is not modified
+func ConfLoadLogLevels() error {
+	logDevice, logMain := confDefaultLogDevice, LogDebug
+
+	for _, file := range confFiles() {
+		ini, err := OpenIniFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for err == nil {
+			var rec *IniRecord
+			rec, err = ini.Next()
+			if err != nil || !confMatchName(rec.Section, "logging") {
+				continue
+			}
+
+			switch {
+			case confMatchName(rec.Key, "device-log"):
+				err = rec.LoadLogLevel(&logDevice)
+			case confMatchName(rec.Key, "main-log"):
+				err = rec.LoadLogLevel(&logMain)
+			}
+		}
+
+		ini.Close()
+
+		if err != io.EOF {
+			return err
+		}
+	}
+
+	Conf.LogDevice, Conf.LogMain = logDevice, logMain
+	return nil
+}
+
+// confFiles returns list of configuration files
+func confFiles() []string {
+	files := filepath.SplitList(PathConfDirList)
+	for i := range files {
+		files[i] = filepath.Join(files[i], ConfFileName)
+	}
+
+	return files
+}
+
 // Load the program configuration -- internal version
 func confLoadInternal(path string) error {
 	// Open configuration file
@@ -112,15 +246,55 @@ func confLoadInternal(path string) error {
 				err = rec.LoadIPPort(&Conf.HTTPMaxPort)
 			case confMatchName(rec.Key, "dns-sd"):
 				err = rec.LoadNamedBool(&Conf.DNSSdEnable, "disable", "enable")
+			case confMatchName(rec.Key, "dns-sd-names"):
+				err = rec.LoadNamedBool(&Conf.DNSSdASCII, "unicode", "ascii")
 			case confMatchName(rec.Key, "interface"):
-				err = rec.LoadNamedBool(&Conf.LoopbackOnly, "all", "loopback")
+				err = rec.LoadInterface(&Conf.LoopbackOnly, &Conf.Interface)
 			case confMatchName(rec.Key, "ipv6"):
 				err = rec.LoadNamedBool(&Conf.IPV6Enable, "disable", "enable")
+			case confMatchName(rec.Key, "http-max-sessions"):
+				err = rec.LoadUint(&Conf.HTTPMaxSessions)
+			case confMatchName(rec.Key, "http-max-queue"):
+				err = rec.LoadUint(&Conf.HTTPMaxQueue)
+			case confMatchName(rec.Key, "http-cache-ttl"):
+				err = rec.LoadDuration(&Conf.HTTPCacheTTL)
+			case confMatchName(rec.Key, "http-request-timeout"):
+				err = rec.LoadDuration(&Conf.HTTPRequestTimeout)
+			case confMatchName(rec.Key, "http-compress"):
+				err = rec.LoadNamedBool(&Conf.HTTPCompress, "disable", "enable")
+			case confMatchName(rec.Key, "https"):
+				err = rec.LoadNamedBool(&Conf.HTTPSEnable, "disable", "enable")
+			case confMatchName(rec.Key, "https-cert"):
+				err = rec.LoadFile(&Conf.HTTPSCert)
+			case confMatchName(rec.Key, "https-key"):
+				err = rec.LoadFile(&Conf.HTTPSKey)
+			case confMatchName(rec.Key, "allow"):
+				err = rec.LoadACL(&Conf.ACL)
+			case confMatchName(rec.Key, "test-device"):
+				if rec.Value == "disable" {
+					Conf.TestDevicePort = 0
+				} else {
+					err = rec.LoadIPPort(&Conf.TestDevicePort)
+				}
 			}
 
+		case confMatchName(rec.Section, "allow"):
+			err = confLoadACL(rec)
+
+		case confMatchName(rec.Section, "share"):
+			err = confLoadShare(rec)
+
 		case confMatchName(rec.Section, "auth uid"):
 			err = rec.LoadAuthUIDRules(&Conf.ConfAuthUID)
 
+		case confMatchName(rec.Section, "auth http"):
+			err = rec.LoadAuthHTTPRules(&Conf.ConfAuthHTTP)
+
+		case confMatchName(rec.Section, "auth polkit"):
+			if confMatchName(rec.Key, "operations") {
+				err = rec.LoadAuthOps(&Conf.AuthPolkit)
+			}
+
 		case confMatchName(rec.Section, "logging"):
 			switch {
 			case confMatchName(rec.Key, "device-log"):
@@ -131,12 +305,72 @@ func confLoadInternal(path string) error {
 				err = rec.LoadLogLevel(&Conf.LogConsole)
 			case confMatchName(rec.Key, "console-color"):
 				err = rec.LoadNamedBool(&Conf.ColorConsole, "disable", "enable")
+			case confMatchName(rec.Key, "colors"):
+				err = rec.LoadLogColors(&Conf.LogColors)
 			case confMatchName(rec.Key, "max-file-size"):
 				err = rec.LoadSize(&Conf.LogMaxFileSize)
 			case confMatchName(rec.Key, "max-backup-files"):
 				err = rec.LoadUint(&Conf.LogMaxBackupFiles)
+			case confMatchName(rec.Key, "log-max-disk-usage"):
+				err = rec.LoadSize(&Conf.LogMaxDiskUsage)
+			case confMatchName(rec.Key, "backup-compress"):
+				err = rec.LoadLogCompress(&Conf.LogBackupCompress)
+			case confMatchName(rec.Key, "log-format"):
+				err = rec.LoadLogFormat(&Conf.LogFormat)
+			case confMatchName(rec.Key, "trace-buffer"):
+				err = rec.LoadSize(&Conf.LogTraceBuffer)
+			case confMatchName(rec.Key, "remote"):
+				err = rec.LoadLogRemote(&Conf.LogRemoteNetwork,
+					&Conf.LogRemoteAddr)
+			case confMatchName(rec.Key, "remote-buffer"):
+				err = rec.LoadSize(&Conf.LogRemoteBuffer)
+			case confMatchName(rec.Key, "otlp-endpoint"):
+				err = rec.LoadOtlpEndpoint(&Conf.OtlpEndpoint)
+			case confMatchName(rec.Key, "journal"):
+				err = rec.LoadNamedBool(&Conf.LogJournal, "disable", "enable")
+			case confMatchName(rec.Key, "async"):
+				err = rec.LoadNamedBool(&Conf.LogAsync, "disable", "enable")
 			case confMatchName(rec.Key, "get-all-printer-attrs"):
 				err = rec.LoadBool(&Conf.LogAllPrinterAttrs)
+			case confMatchName(rec.Key, "ipp-dump"):
+				err = rec.LoadBool(&Conf.LogIppDump)
+			case confMatchName(rec.Key, "usb-capture"):
+				err = rec.LoadBool(&Conf.UsbCapture)
+			case confMatchName(rec.Key, "usb-capture-pcapng"):
+				err = rec.LoadBool(&Conf.UsbCapturePcapng)
+			case confMatchName(rec.Key, "usbmon"):
+				err = rec.LoadBool(&Conf.UsbMon)
+			case confMatchName(rec.Key, "deterministic"):
+				err = rec.LoadBool(&Conf.LogDeterministic)
+			case confMatchName(rec.Key, "leak-check"):
+				err = rec.LoadBool(&Conf.LeakCheck)
+			}
+
+		case confMatchName(rec.Section, "usb"):
+			switch {
+			case confMatchName(rec.Key, "hotplug"):
+				err = rec.LoadUsbHotplug(&Conf.UsbHotplug)
+			case confMatchName(rec.Key, "spool-threshold"):
+				err = rec.LoadSize(&Conf.UsbSpoolThreshold)
+			case confMatchName(rec.Key, "spool-dir"):
+				err = rec.LoadDir(&Conf.UsbSpoolDir)
+			case confMatchName(rec.Key, "queue-max"):
+				err = rec.LoadUint(&Conf.UsbQueueMax)
+			case confMatchName(rec.Key, "queue-wait"):
+				err = rec.LoadDuration(&Conf.UsbQueueWait)
+			case confMatchName(rec.Key, "shutdown-timeout"):
+				err = rec.LoadDuration(&Conf.ShutdownTimeout)
+			}
+
+		case confIsPrinterSection(rec.Section):
+			err = confLoadPrinter(rec)
+
+		case confMatchName(rec.Section, "limits"):
+			switch {
+			case confMatchName(rec.Key, "max-memory"):
+				err = rec.LoadSize(&Conf.MaxMemory)
+			case confMatchName(rec.Key, "gc-percent"):
+				err = rec.LoadUintRange(&Conf.GCPercent, 0, 1000)
 			}
 		}
 	}
@@ -150,6 +384,17 @@ func confLoadInternal(path string) error {
 		return errors.New("http-min-port must be less that http-max-port")
 	}
 
+	if Conf.TestDevicePort != 0 && (Conf.TestDevicePort < Conf.HTTPMinPort ||
+		Conf.TestDevicePort > Conf.HTTPMaxPort) {
+		return errors.New("test-device port must be in range " +
+			"http-min-port...http-max-port")
+	}
+
+	if (Conf.HTTPSCert == "") != (Conf.HTTPSKey == "") {
+		return errors.New("https-cert and https-key must be " +
+			"both set or both auto")
+	}
+
 	return nil
 }
 
@@ -184,5 +429,7 @@ func confMatchName(name, pattern string) bool {
 		}
 	}
 
-	return true
+	// Name must not be a prefix of pattern or vice versa,
+	// otherwise dns-sd would match dns-sd-names
+	return name == "" && pattern == ""
 }
@@ -0,0 +1,22 @@
+//go:build !embedded
+// +build !embedded
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Configuration defaults -- regular build
+ */
+
+package main
+
+// Configuration defaults, that depend on a build profile
+const (
+	confDefaultLogDevice         = LogDebug
+	confDefaultLogMaxFileSize    = 256 * 1024
+	confDefaultLogMaxBackupFiles = 5
+	confDefaultMaxMemory         = 0
+	confDefaultGCPercent         = 0
+	confDefaultLogRemoteBuffer   = 1024 * 1024
+)
@@ -0,0 +1,26 @@
+//go:build embedded
+// +build embedded
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Configuration defaults -- embedded (OpenWrt and similar) build
+ *
+ * Embedded systems have little RAM and the flash storage that
+ * wears out, so logging is reduced and memory usage is limited
+ * by default
+ */
+
+package main
+
+// Configuration defaults, that depend on a build profile
+const (
+	confDefaultLogDevice         = LogInfo | LogError
+	confDefaultLogMaxFileSize    = 64 * 1024
+	confDefaultLogMaxBackupFiles = 1
+	confDefaultMaxMemory         = 16 * 1024 * 1024
+	confDefaultGCPercent         = 50
+	confDefaultLogRemoteBuffer   = 64 * 1024
+)
@@ -0,0 +1,76 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Configuration loading tests
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestConfLoadShipped tests that the shipped ipp-usb.conf loads
+func TestConfLoadShipped(t *testing.T) {
+	testConf(t)
+
+	err := confLoadInternal("ipp-usb.conf")
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+// TestConfLoadPrefixKeys tests loading of keys, which names
+// start with the name of another key (i.e., dns-sd-names vs dns-sd)
+func TestConfLoadPrefixKeys(t *testing.T) {
+	testConf(t)
+
+	err := testConfLoad(t, `
+[network]
+  dns-sd = enable
+  dns-sd-names = ascii
+
+[logging]
+  usb-capture = false
+  usb-capture-pcapng = true
+  remote = none
+  remote-buffer = 4K
+`)
+
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !Conf.DNSSdEnable || !Conf.DNSSdASCII ||
+		!Conf.UsbCapturePcapng || Conf.LogRemoteBuffer != 4096 {
+		t.Errorf("values not loaded: dns-sd=%v dns-sd-names=%v "+
+			"usb-capture-pcapng=%v remote-buffer=%d",
+			Conf.DNSSdEnable, Conf.DNSSdASCII,
+			Conf.UsbCapturePcapng, Conf.LogRemoteBuffer)
+	}
+}
+
+// TestConfLoadUsbHotplug tests loading of the [usb] hotplug parameter
+func TestConfLoadUsbHotplug(t *testing.T) {
+	testConf(t)
+
+	load := func(value string) error {
+		return testConfLoad(t, "[usb]\n  hotplug = "+value+"\n")
+	}
+
+	for _, hotplug := range []UsbHotplug{UsbHotplugLibusb,
+		UsbHotplugPoll, UsbHotplugAuto} {
+		err := load(hotplug.String())
+		if err != nil {
+			t.Errorf("%s: %s", hotplug, err)
+		} else if Conf.UsbHotplug != hotplug {
+			t.Errorf("%s: loaded as %s", hotplug, Conf.UsbHotplug)
+		}
+	}
+
+	if load("udev") == nil {
+		t.Errorf("udev: error expected")
+	}
+}
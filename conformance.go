@@ -0,0 +1,677 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Device conformance test runner
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// conformanceTimeout is the per-request timeout, used by
+// conformance tests. If device doesn't respond within this
+// time, it is considered hung
+var conformanceTimeout = 10 * time.Second
+
+// conformanceAlign is the alignment of requests, used to check
+// device behavior with requests, that end at the USB packet
+// boundary. 1024 is a multiple of both USB 2.0 and USB 3.0
+// bulk packet sizes
+const conformanceAlign = 1024
+
+// conformanceAttrsRequired lists printer attributes, without
+// which ipp-usb cannot advertise the device properly
+var conformanceAttrsRequired = []string{
+	"document-format-supported",
+	"printer-make-and-model",
+	"printer-uuid",
+}
+
+// conformanceAttrsRecommended lists printer attributes, that
+// are used to build DNS-SD TXT records and should be present
+var conformanceAttrsRecommended = []string{
+	"color-supported",
+	"media-size-supported",
+	"printer-device-id",
+	"printer-dns-sd-name",
+	"printer-icons",
+	"printer-info",
+	"printer-kind",
+	"printer-location",
+	"printer-more-info",
+	"sides-supported",
+	"urf-supported",
+}
+
+// ConformanceStatus represents status of the conformance check
+type ConformanceStatus int
+
+// ConformanceStatus values
+const (
+	ConformancePass ConformanceStatus = iota // Check passed
+	ConformanceWarn                          // Passed with remarks
+	ConformanceFail                          // Check failed
+	ConformanceSkip                          // Check not performed
+)
+
+// String returns ConformanceStatus name
+func (status ConformanceStatus) String() string {
+	switch status {
+	case ConformancePass:
+		return "PASS"
+	case ConformanceWarn:
+		return "WARN"
+	case ConformanceFail:
+		return "FAIL"
+	case ConformanceSkip:
+		return "SKIP"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(status))
+}
+
+// ConformanceResult represents result of a single conformance check
+type ConformanceResult struct {
+	Name   string            // Check name
+	Status ConformanceStatus // Check status
+	Notes  []string          // Details
+}
+
+// ConformanceReport represents the conformance test report
+type ConformanceReport struct {
+	Desc     UsbDeviceDesc       // Device descriptor
+	Info     UsbDeviceInfo       // Device information
+	Firmware string              // Firmware version, "" if unknown
+	Results  []ConformanceResult // Results of checks
+	Applied  []*Quirk            // Quirks, applied to the device
+	Quirks   []*Quirk            // Suggested quirks
+	LogFile  string              // Path to the detailed device log
+}
+
+// Failed reports if some checks were failed
+func (report *ConformanceReport) Failed() bool {
+	for _, res := range report.Results {
+		if res.Status == ConformanceFail {
+			return true
+		}
+	}
+	return false
+}
+
+// suggest adds suggested quirk to the report
+func (report *ConformanceReport) suggest(name, value string) {
+	for _, q := range report.Quirks {
+		if q.Name == name {
+			q.RawValue = value
+			return
+		}
+	}
+
+	report.Quirks = append(report.Quirks, &Quirk{
+		Origin:   "conformance",
+		Match:    report.Info.MakeAndModel(),
+		Name:     name,
+		RawValue: value,
+	})
+}
+
+// WriteTo writes the report in the human-readable form. The
+// suggested quirks are written in the quirks file syntax, so they
+// can be directly used to create a new quirks file entry.
+//
+// It implements io.WriterTo interface
+func (report *ConformanceReport) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "ipp-usb conformance report\n")
+	fmt.Fprintf(buf, "==========================\n")
+	fmt.Fprintf(buf, "\n")
+	fmt.Fprintf(buf, "Device:       %s\n", report.Info.MakeAndModel())
+	fmt.Fprintf(buf, "USB ID:       %4.4x:%4.4x\n",
+		report.Info.Vendor, report.Info.Product)
+	fmt.Fprintf(buf, "Serial:       %s\n", report.Info.SerialNumber)
+	if report.Firmware != "" {
+		fmt.Fprintf(buf, "Firmware:     %s\n", report.Firmware)
+	}
+	fmt.Fprintf(buf, "Address:      %s\n", report.Desc.UsbAddr)
+	fmt.Fprintf(buf, "Interfaces:   %d\n", len(report.Desc.IfAddrs))
+	fmt.Fprintf(buf, "Capabilities: %s\n", report.Info.BasicCaps)
+	fmt.Fprintf(buf, "\n")
+
+	for _, res := range report.Results {
+		fmt.Fprintf(buf, "[%s] %s\n", res.Status, res.Name)
+		for _, note := range res.Notes {
+			fmt.Fprintf(buf, "       %s\n", note)
+		}
+	}
+
+	if len(report.Applied) != 0 {
+		fmt.Fprintf(buf, "\n")
+		fmt.Fprintf(buf, "Applied quirks:\n")
+		for _, q := range report.Applied {
+			fmt.Fprintf(buf, "  %s = %s (%s)\n",
+				q.Name, q.RawValue, q.Origin)
+		}
+	}
+
+	fmt.Fprintf(buf, "\n")
+	if len(report.Quirks) == 0 {
+		fmt.Fprintf(buf, "No quirks suggested\n")
+	} else {
+		fmt.Fprintf(buf, "Suggested quirks:\n")
+		fmt.Fprintf(buf, "\n")
+		fmt.Fprintf(buf, "[%s]\n", report.Info.MakeAndModel())
+		for _, q := range report.Quirks {
+			value := q.RawValue
+			if value == "" {
+				value = `""`
+			}
+			fmt.Fprintf(buf, "  %s = %s\n", q.Name, value)
+		}
+	}
+
+	if report.LogFile != "" {
+		fmt.Fprintf(buf, "\n")
+		fmt.Fprintf(buf, "Detailed log: %s\n", report.LogFile)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ConformanceRun runs conformance tests against the connected
+// device and writes report to the output.
+//
+// If devices list is empty, and there is only one IPP-over-USB
+// device connected, this device is tested.
+//
+// If compat is not "", the compatibility report is saved into
+// this file (see CompatReport)
+func ConformanceRun(out io.Writer, devices UsbAddrList, compat string) error {
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		return err
+	}
+
+	var list []UsbDeviceDesc
+	for _, desc := range descs {
+		if len(devices) == 0 || devices.Find(desc.UsbAddr) >= 0 {
+			list = append(list, desc)
+		}
+	}
+
+	switch {
+	case len(list) == 0:
+		return errors.New("No IPP over USB devices found")
+	case len(list) > 1:
+		return errors.New("Multiple IPP over USB devices found, " +
+			"please specify the device to test")
+	}
+
+	desc := list[0]
+	dev, err := UsbOpenDevice(desc)
+	if err != nil {
+		return err
+	}
+
+	report, err := Conformance(desc, dev)
+	if err != nil {
+		return err
+	}
+
+	_, err = report.WriteTo(out)
+	if err == nil && compat != "" {
+		err = NewCompatReport(report).Save(compat)
+		if err == nil {
+			fmt.Fprintf(out, "\n")
+			fmt.Fprintf(out, "Compatibility report: %s\n", compat)
+			fmt.Fprintf(out, "Please consider sharing it at %s\n",
+				CompatReportURL)
+		}
+	}
+
+	if err == nil && report.Failed() {
+		err = errors.New("Some conformance checks failed")
+	}
+
+	return err
+}
+
+// Conformance runs conformance tests on a top of opened UsbDevice.
+// It takes ownership of the device and closes it on return
+func Conformance(desc UsbDeviceDesc, dev UsbDevice) (
+	*ConformanceReport, error) {
+
+	probe := &conformanceProbe{UsbDevice: dev}
+	transport, err := NewUsbTransportDev(desc, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	transport.SetTimeout(conformanceTimeout)
+
+	info := transport.UsbDeviceInfo()
+	runner := &conformanceRunner{
+		transport: transport,
+		probe:     probe,
+		client:    &http.Client{Transport: transport},
+		report: &ConformanceReport{
+			Desc:    desc,
+			Info:    info,
+			Applied: transport.Quirks().All(),
+			LogFile: filepath.Join(PathLogDir, info.Ident()+".log"),
+		},
+	}
+
+	runner.run("IPP attributes completeness", runner.checkAttrs)
+	runner.run("HTTP keep-alive behavior", runner.checkKeepAlive)
+	runner.run("Chunked request handling", runner.checkChunked)
+	runner.run("Concurrent interfaces behavior", runner.checkConcurrent)
+	runner.run("Zero-length packets behavior", runner.checkZlp)
+
+	// Device that has sent zero-length packet, and then hung,
+	// most likely expects ZLP to be treated as the end of
+	// response body
+	if probe.zlpTimeouts > 0 {
+		runner.report.suggest(QuirkNmZlpRecvHack, "true")
+	}
+
+	transport.Close(transport.TimeoutExpired())
+
+	return runner.report, nil
+}
+
+// conformanceRunner runs conformance checks
+type conformanceRunner struct {
+	transport *UsbTransport      // Transport to the device
+	probe     *conformanceProbe  // USB traffic probe
+	client    *http.Client       // HTTP client on a top of transport
+	report    *ConformanceReport // Report being created
+	hung      bool               // Device hung, further checks skipped
+}
+
+// run runs the single check and adds its result to the report
+func (runner *conformanceRunner) run(name string,
+	check func(res *ConformanceResult)) {
+
+	res := ConformanceResult{Name: name}
+
+	if runner.hung {
+		res.Status = ConformanceSkip
+		res.Notes = append(res.Notes, "skipped, device not responding")
+	} else {
+		runner.transport.Log().Info(' ', "conformance: %s", name)
+		check(&res)
+		if runner.transport.TimeoutExpired() {
+			runner.hung = true
+		}
+	}
+
+	runner.report.Results = append(runner.report.Results, res)
+}
+
+// note adds the note to the check result and sets its status,
+// if new status is worse that the current one
+func (res *ConformanceResult) note(status ConformanceStatus,
+	format string, args ...interface{}) {
+
+	if status > res.Status {
+		res.Status = status
+	}
+
+	res.Notes = append(res.Notes, fmt.Sprintf(format, args...))
+}
+
+// ippRequest sends Get-Printer-Attributes request to the device
+// and returns raw IPP response.
+//
+// If chunked is true, request is sent with chunked encoding.
+// Extra headers, if not nil, are added to the request
+func (runner *conformanceRunner) ippRequest(chunked bool, hdr http.Header) (
+	*http.Response, []byte, error) {
+
+	const uri = "http://localhost/ipp/print"
+
+	msg := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+	msg.Operation.Add(goipp.MakeAttribute("requested-attributes",
+		goipp.TagKeyword, goipp.String("all")))
+
+	data, _ := msg.EncodeBytes()
+
+	var body io.Reader = bytes.NewReader(data)
+	if chunked {
+		// Hide the length from the net/http
+		body = struct{ io.Reader }{body}
+	}
+
+	rq, _ := http.NewRequest("POST", uri, body)
+	rq.Header.Set("Content-Type", goipp.ContentType)
+	if chunked {
+		rq.ContentLength = -1
+	}
+
+	for name, values := range hdr {
+		rq.Header[name] = values
+	}
+
+	resp, err := runner.client.Do(rq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	return resp, data, err
+}
+
+// checkAttrs checks IPP attributes completeness
+func (runner *conformanceRunner) checkAttrs(res *ConformanceResult) {
+	_, data, err := runner.ippRequest(false, nil)
+	if err != nil {
+		res.note(ConformanceFail, "Get-Printer-Attributes: %s", err)
+		return
+	}
+
+	msg := &goipp.Message{}
+	err = msg.DecodeBytes(data)
+	if err != nil {
+		opts := goipp.DecoderOptions{EnableWorkarounds: true}
+		if msg.DecodeBytesEx(data, opts) != nil {
+			res.note(ConformanceFail, "IPP decode: %s", err)
+			return
+		}
+
+		res.note(ConformanceWarn, "IPP response is malformed: %s", err)
+		runner.report.suggest(QuirkNmBuggyIppResponses, "allow")
+	}
+
+	if msg.Code >= 0x100 {
+		status := goipp.Status(msg.Code)
+		if len(msg.Printer) == 0 {
+			res.note(ConformanceFail, "IPP: %s", status)
+			return
+		}
+
+		res.note(ConformanceWarn,
+			"IPP: %s, but printer attributes returned", status)
+		runner.report.suggest(QuirkNmIgnoreIppStatus, "true")
+	}
+
+	attrs := newIppAttrs(msg.Printer)
+	res.note(ConformancePass, "%d printer attributes returned", len(attrs))
+
+	runner.report.Firmware = attrs.strJoined(
+		"printer-firmware-string-version")
+
+	missed := func(names []string) []string {
+		list := []string{}
+		for _, name := range names {
+			if _, found := attrs[name]; !found {
+				list = append(list, name)
+			}
+		}
+		return list
+	}
+
+	if list := missed(conformanceAttrsRequired); len(list) != 0 {
+		res.note(ConformanceFail, "missed required: %s",
+			strings.Join(list, ", "))
+	}
+
+	if list := missed(conformanceAttrsRecommended); len(list) != 0 {
+		res.note(ConformanceWarn, "missed recommended: %s",
+			strings.Join(list, ", "))
+	}
+}
+
+// checkKeepAlive checks that device serves subsequent
+// requests on the same connection
+func (runner *conformanceRunner) checkKeepAlive(res *ConformanceResult) {
+	const count = 3
+
+	closed := 0
+	for i := 0; i < count; i++ {
+		resp, _, err := runner.ippRequest(false, nil)
+		if err != nil {
+			res.note(ConformanceFail, "request %d of %d: %s",
+				i+1, count, err)
+			runner.report.suggest("http-connection", "keep-alive")
+			return
+		}
+
+		if resp.Close {
+			closed++
+		}
+	}
+
+	res.note(ConformancePass, "%d subsequent requests served", count)
+
+	if closed != 0 {
+		res.note(ConformanceWarn,
+			"device asks to close connection after response")
+	}
+}
+
+// checkChunked checks chunked requests and responses handling
+func (runner *conformanceRunner) checkChunked(res *ConformanceResult) {
+	resp, _, err := runner.ippRequest(true, nil)
+	if err != nil {
+		res.note(ConformanceFail, "chunked request: %s", err)
+		return
+	}
+
+	res.note(ConformancePass, "chunked request accepted")
+
+	if len(resp.TransferEncoding) != 0 {
+		res.note(ConformancePass, "response uses %s encoding",
+			strings.Join(resp.TransferEncoding, ","))
+	} else {
+		res.note(ConformancePass, "response uses Content-Length")
+	}
+}
+
+// checkConcurrent checks that device serves requests on all its
+// interfaces in parallel
+func (runner *conformanceRunner) checkConcurrent(res *ConformanceResult) {
+	count := len(runner.transport.connList)
+	if count < 2 {
+		res.note(ConformanceSkip, "only %d interface is in use", count)
+		return
+	}
+
+	var wait sync.WaitGroup
+	errs := make([]error, count)
+
+	for i := 0; i < count; i++ {
+		wait.Add(1)
+		go func(i int) {
+			_, _, errs[i] = runner.ippRequest(false, nil)
+			wait.Done()
+		}(i)
+	}
+
+	wait.Wait()
+
+	ok := 0
+	for i, err := range errs {
+		if err != nil {
+			res.note(ConformanceFail, "request %d of %d: %s",
+				i+1, count, err)
+		} else {
+			ok++
+		}
+	}
+
+	if ok == count {
+		res.note(ConformancePass, "%d requests served in parallel",
+			count)
+		return
+	}
+
+	if ok == 0 {
+		ok = 1
+	}
+
+	runner.report.suggest(QuirkNmUsbMaxInterfaces, fmt.Sprintf("%d", ok))
+}
+
+// checkZlp checks zero-length packets behavior
+func (runner *conformanceRunner) checkZlp(res *ConformanceResult) {
+	if n := runner.probe.zlps; n != 0 {
+		res.note(ConformancePass,
+			"device sends zero-length packets (%d seen)", n)
+	}
+
+	// Measure size of the request
+	runner.probe.reset()
+	_, _, err := runner.ippRequest(false, nil)
+	if err != nil {
+		res.note(ConformanceFail, "request: %s", err)
+		return
+	}
+
+	size, _ := runner.probe.sent()
+
+	// Send the request, that ends at the packet boundary, padding
+	// it with extra header. Some devices require such a request
+	// to be terminated with zero-length packet
+	const padName = "X-Ipp-Usb-Pad"
+	pad := conformanceAlign -
+		(size+len(padName+": \r\n"))%conformanceAlign
+	hdr := http.Header{padName: {strings.Repeat("x", pad)}}
+
+	runner.probe.reset()
+	_, _, err = runner.ippRequest(false, hdr)
+	size, last := runner.probe.sent()
+
+	switch {
+	case size%conformanceAlign != 0 || last%conformanceAlign != 0:
+		res.note(ConformanceSkip,
+			"can't align request to the packet boundary (%d bytes)",
+			size)
+
+	case err != nil:
+		res.note(ConformanceFail,
+			"request ending at the packet boundary: %s", err)
+		if !runner.transport.quirks.GetZlpSend() {
+			runner.report.suggest(QuirkNmZlpSend, "true")
+		}
+
+	default:
+		res.note(ConformancePass,
+			"request ending at the packet boundary served")
+	}
+}
+
+// conformanceProbe wraps UsbDevice and collects USB-level
+// statistics, needed for conformance checks
+type conformanceProbe struct {
+	UsbDevice              // Underlying device
+	lock        sync.Mutex // Access lock
+	sentTotal   int        // Bytes sent since reset
+	sentLast    int        // Size of the last bulk transfer
+	zlps        int        // Count of received zero-length packets
+	zlpTimeouts int        // Count of timeouts after ZLP
+}
+
+// reset resets counters of sent data
+func (probe *conformanceProbe) reset() {
+	probe.lock.Lock()
+	probe.sentTotal = 0
+	probe.sentLast = 0
+	probe.lock.Unlock()
+}
+
+// sent returns count of bytes sent since reset and size
+// of the last bulk transfer
+func (probe *conformanceProbe) sent() (total, last int) {
+	probe.lock.Lock()
+	defer probe.lock.Unlock()
+	return probe.sentTotal, probe.sentLast
+}
+
+// OpenUsbInterface opens an interface
+func (probe *conformanceProbe) OpenUsbInterface(addr UsbIfAddr,
+	quirks *Quirks) (UsbInterfaceIO, error) {
+
+	iface, err := probe.UsbDevice.OpenUsbInterface(addr, quirks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conformanceProbeInterface{UsbInterfaceIO: iface,
+		probe: probe}, nil
+}
+
+// conformanceProbeInterface wraps UsbInterfaceIO and collects
+// USB-level statistics
+type conformanceProbeInterface struct {
+	UsbInterfaceIO                   // Underlying interface
+	probe          *conformanceProbe // Probe that owns the interface
+	zlp            bool              // Last received packet was ZLP
+}
+
+// Send data to interface
+func (iface *conformanceProbeInterface) Send(ctx context.Context,
+	data []byte) (int, error) {
+
+	n, err := iface.UsbInterfaceIO.Send(ctx, data)
+
+	iface.probe.lock.Lock()
+	iface.probe.sentTotal += n
+	iface.probe.sentLast = len(data)
+	iface.probe.lock.Unlock()
+
+	return n, err
+}
+
+// Recv data from interface
+func (iface *conformanceProbeInterface) Recv(ctx context.Context,
+	data []byte) (int, error) {
+
+	n, err := iface.UsbInterfaceIO.Recv(ctx, data)
+
+	iface.probe.lock.Lock()
+	switch {
+	case err == context.DeadlineExceeded && iface.zlp:
+		iface.probe.zlpTimeouts++
+	case err == nil && n == 0:
+		iface.probe.zlps++
+	}
+	iface.probe.lock.Unlock()
+
+	iface.zlp = err == nil && n == 0
+
+	return n, err
+}
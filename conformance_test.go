@@ -0,0 +1,126 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Conformance test runner tests
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// conformanceTest runs conformance tests against emulated device
+func conformanceTest(t *testing.T, emu *UsbEmulator) *ConformanceReport {
+	testConf(t)
+
+	report, err := Conformance(emu.Desc(), emu)
+	if err != nil {
+		t.Fatalf("Conformance: %s", err)
+	}
+
+	return report
+}
+
+// TestConformance tests conformance tests with well-behaving device
+func TestConformance(t *testing.T) {
+	report := conformanceTest(t, NewUsbEmulator(UsbEmuConfig{}))
+
+	buf := &bytes.Buffer{}
+	report.WriteTo(buf)
+
+	if report.Failed() || len(report.Quirks) != 0 {
+		t.Fatalf("unexpected failure:\n%s", buf)
+	}
+
+	for _, res := range report.Results {
+		if res.Status == ConformanceSkip {
+			t.Errorf("%s: unexpectedly skipped", res.Name)
+		}
+	}
+
+	if !strings.Contains(buf.String(), "[PASS] Concurrent interfaces") {
+		t.Errorf("concurrent check not passed:\n%s", buf)
+	}
+}
+
+// TestConformanceZlpSend tests detection of device, that hangs
+// on requests that end at the packet boundary
+func TestConformanceZlpSend(t *testing.T) {
+	saveTimeout := conformanceTimeout
+	conformanceTimeout = 100 * time.Millisecond
+	defer func() { conformanceTimeout = saveTimeout }()
+
+	emu := NewUsbEmulator(UsbEmuConfig{})
+	emu.Hook(func(rq *http.Request) error {
+		if rq.Header.Get("X-Ipp-Usb-Pad") != "" {
+			return errors.New("hang up")
+		}
+		return nil
+	})
+
+	report := conformanceTest(t, emu)
+
+	if !report.Failed() {
+		t.Errorf("failure not detected")
+	}
+
+	if len(report.Quirks) != 1 || report.Quirks[0].Name != QuirkNmZlpSend {
+		t.Errorf("%s quirk not suggested", QuirkNmZlpSend)
+	}
+
+	if emu.Resets() == 0 {
+		t.Errorf("hung device not reset")
+	}
+}
+
+// TestConformanceCompatReport tests compatibility report generation
+func TestConformanceCompatReport(t *testing.T) {
+	saveTimeout := conformanceTimeout
+	conformanceTimeout = 100 * time.Millisecond
+	defer func() { conformanceTimeout = saveTimeout }()
+
+	emu := NewUsbEmulator(UsbEmuConfig{})
+	emu.Hook(func(rq *http.Request) error {
+		if len(rq.TransferEncoding) != 0 {
+			return errors.New("chunked not supported")
+		}
+		return nil
+	})
+
+	report := conformanceTest(t, emu)
+	data := NewCompatReport(report).Encode()
+
+	var compat CompatReport
+	err := json.Unmarshal(data, &compat)
+	if err != nil {
+		t.Fatalf("%s:\n%s", err, data)
+	}
+
+	switch {
+	case compat.Format != CompatReportFormat:
+		t.Errorf("format: %d", compat.Format)
+	case compat.Model != report.Info.MakeAndModel():
+		t.Errorf("model: %q", compat.Model)
+	case compat.UsbID != "0000:0000":
+		t.Errorf("usb-id: %q", compat.UsbID)
+	case compat.Firmware != "1.0":
+		t.Errorf("firmware: %q", compat.Firmware)
+	case compat.Result != "FAIL":
+		t.Errorf("result: %q", compat.Result)
+	case len(compat.Checks) != len(report.Results):
+		t.Errorf("%d checks exported", len(compat.Checks))
+	}
+
+	if bytes.Contains(data, []byte(report.Info.SerialNumber)) {
+		t.Errorf("serial number is exported:\n%s", data)
+	}
+}
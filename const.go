@@ -17,8 +17,18 @@ const (
 	// device initialization
 	DevInitTimeout = 5 * time.Second
 
+	// DevReadyTimeout specifies how long to wait until device
+	// answers the readiness probe, before it is announced. It
+	// may be overridden by the "init-ready-timeout" quirk
+	DevReadyTimeout = 30 * time.Second
+
+	// DevReadyProbeInterval specifies the retry interval of the
+	// device readiness probe
+	DevReadyProbeInterval = time.Second
+
 	// DevShutdownTimeout specifies how much time to wait for
-	// device graceful shutdown
+	// device graceful shutdown. It may be overridden by the
+	// "shutdown-timeout" configuration parameter
 	DevShutdownTimeout = 5 * time.Second
 
 	// DevInitRetryInterval specifies the retry interval for
@@ -28,4 +38,138 @@ const (
 	// DNSSdRetryInterval specifies the retry interval in a case
 	// of failed DNS-SD operation
 	DNSSdRetryInterval = 2 * time.Second
+
+	// DNSSdRetryMaxInterval specifies the maximum retry interval,
+	// when DNS-SD operation fails repeatedly (i.e., DNS-SD daemon
+	// is not running)
+	DNSSdRetryMaxInterval = time.Minute
+
+	// PolkitCheckTimeout specifies how long to wait for the polkit
+	// decision. It includes time the user spends in the polkit
+	// authentication dialog
+	PolkitCheckTimeout = time.Minute
+
+	// LogFileRetryInterval specifies how often log file is retried,
+	// when it cannot be written (i.e., disk is full or read-only)
+	LogFileRetryInterval = time.Minute
+
+	// LogAsyncQueueSize specifies maximum size of data, queued
+	// for asynchronous writing to the log file. If queue is
+	// full, logging blocks until there is a room
+	LogAsyncQueueSize = 256 * 1024
+
+	// LogRemoteRetryInterval specifies how often connection to
+	// the remote log collector is retried, if it is not reachable.
+	// It is also the timeout of connect and send operations
+	LogRemoteRetryInterval = 5 * time.Second
+
+	// OtlpExportInterval specifies how often OTLP spans are
+	// sent to the collector. It is also the send timeout
+	OtlpExportInterval = 2 * time.Second
+
+	// UsbReadTimeout specifies how long to wait for data from
+	// device before the HTTP transaction is failed. It may be
+	// overridden by the "usb-read-timeout" quirk. Default is no
+	// timeout, as device legitimately may take minutes to respond
+	// (i.e., while warming up or scanning), and timeout causes
+	// device reset
+	UsbReadTimeout time.Duration = 0
+
+	// UsbWriteTimeout specifies how long to wait until device
+	// accepts data. It may be overridden by the "usb-write-timeout"
+	// quirk. Default is no timeout, as printer legitimately stops
+	// accepting print data, when out of paper
+	UsbWriteTimeout time.Duration = 0
+
+	// UsbStallResetTimeout specifies how long device may
+	// continuously respond with zero-size reads, before it is
+	// considered stalled and reset. It may be overridden by
+	// the "usb-stall-reset" quirk
+	UsbStallResetTimeout = time.Minute
+
+	// UsbSoftResetTimeout specifies how long to wait, after
+	// SOFT_RESET on close, until connections are released,
+	// before falling back to the device hard reset
+	UsbSoftResetTimeout = 5 * time.Second
+
+	// UsbClearHaltZlpCount specifies, after how many subsequent
+	// zero-size reads ClearHalt is attempted, if enabled by the
+	// "usb-clear-halt" quirk. With the zero-size reads backoff,
+	// the first attempt happens after about 0.2 seconds
+	UsbClearHaltZlpCount = 8
+
+	// UsbCloseTimeout specifies how long to wait on close until
+	// connections are released, before falling back to the device
+	// hard reset
+	UsbCloseTimeout = 5 * time.Second
+
+	// UsbForceCloseTimeout specifies how long to wait, after
+	// the device hard reset on forced or timed out close, until
+	// connections are released, before they are abandoned
+	UsbForceCloseTimeout = 2 * time.Second
+
+	// UsbKeepaliveTimeout specifies timeout for the keep-alive
+	// probe of the idle connection, enabled by the "usb-keepalive"
+	// quirk. If keep-alive interval is shorter, it is used instead
+	UsbKeepaliveTimeout = 5 * time.Second
+
+	// UsbConnReopenErrors specifies, after how many subsequent
+	// transactions, failed due to USB I/O errors, the interface
+	// is closed and reopened
+	UsbConnReopenErrors = 3
+
+	// QuirkSuggestMinFailures specifies, how many times the
+	// characteristic failure must be observed, before the quirk,
+	// that may help, is suggested
+	QuirkSuggestMinFailures = 2
+
+	// HTTPCacheMaxBody specifies the maximum size of request and
+	// response bodies, cached by the capabilities cache
+	HTTPCacheMaxBody = 256 * 1024
+
+	// HTTPRewriteMaxBody specifies the maximum size of HTML page,
+	// processed by the URL rewriter. Larger pages pass unchanged
+	HTTPRewriteMaxBody = 1024 * 1024
+
+	// HTTPCompressMinSize specifies the minimum size of response,
+	// compressed toward client, if size is known in advance
+	HTTPCompressMinSize = 1024
+
+	// HTTPRetryAfter specifies the Retry-After value of HTTP 503
+	// responses, sent when device is too busy to serve the request
+	HTTPRetryAfter = 5 * time.Second
+
+	// HTTPSCertLifetime specifies validity period of the
+	// automatically generated self-signed TLS certificates
+	HTTPSCertLifetime = 10 * 365 * 24 * time.Hour
+
+	// HTTPSCertRenewTime specifies how long before expiration the
+	// automatically generated TLS certificate is regenerated
+	HTTPSCertRenewTime = 30 * 24 * time.Hour
+
+	// UsbSuperSpeedReadBuffer specifies size of the per-connection
+	// USB read buffer and max size of the single bulk read for
+	// SuperSpeed devices. It is a multiple of the max SuperSpeed
+	// burst (16 packets of 1024 bytes). The buffer size may be
+	// overridden by the "usb-read-buffer" quirk
+	UsbSuperSpeedReadBuffer = 64 * 1024
+
+	// ResumeCheckInterval specifies how often system resume
+	// from suspend is checked
+	ResumeCheckInterval = 5 * time.Second
+
+	// ResumeSleepThreshold specifies the minimal detected suspend
+	// duration, that causes devices to be reopened
+	ResumeSleepThreshold = 5 * time.Second
+
+	// UsbPipelineBuffers and UsbPipelineBufferSize specify count
+	// and size of buffers, used for pipelined reading of large
+	// request bodies
+	UsbPipelineBuffers    = 2
+	UsbPipelineBufferSize = 32 * 1024
+
+	// UsbHotPlugPollInterval specifies how often USB devices are
+	// rescanned on platforms where libusb doesn't support hotplug
+	// notifications (i.e., OpenBSD and NetBSD)
+	UsbHotPlugPollInterval = 2 * time.Second
 )
@@ -8,19 +8,22 @@
  * ipp-usb runs a HTTP server on a top of the unix domain control
  * socket.
  *
- * Currently it is only used to obtain a per-device status from the
- * running daemon. Using HTTP here sounds as overkill, but taking
- * in account that it costs us virtually nothing and this mechanism
- * is well-extendable, this is a good choice
+ * It is used to obtain a per-device status from the running daemon
+ * and to hold and release print jobs of the device. Using HTTP here
+ * sounds as overkill, but taking in account that it costs us virtually
+ * nothing and this mechanism is well-extendable, this is a good choice
  */
 
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -50,24 +53,123 @@ func ctrlsockHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Check request method
-	if r.Method != "GET" {
-		http.Error(w, r.Method+": method not supported",
-			http.StatusMethodNotAllowed)
+	// Check request path and method
+	method := "GET"
+	switch r.URL.Path {
+	case "/status":
+	case "/hold", "/release":
+		method = "POST"
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
-	// Check request path
-	if r.URL.Path != "/status" {
-		http.Error(w, "Not found", http.StatusNotFound)
+	if r.Method != method {
+		http.Error(w, r.Method+": method not supported",
+			http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Handle the request
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	httpNoCache(w)
+
+	if r.URL.Path == "/status" {
+		w.WriteHeader(http.StatusOK)
+		w.Write(StatusFormat())
+		return
+	}
+
+	// Hold and release change the daemon state, so they are
+	// allowed only to the privileged clients
+	uid := -1
+	if s := strings.TrimPrefix(r.RemoteAddr, "uid="); s != r.RemoteAddr {
+		uid, _ = strconv.Atoi(s)
+	}
+
+	if !ctrlsockAllowed(uid) {
+		Log.Error('!', "ctrlsock: %s: uid=%d: access denied",
+			r.URL.Path, uid)
+		http.Error(w, ErrAccess.Error(), http.StatusForbidden)
+		return
+	}
+
+	err := StatusHoldDevice(r.URL.Query().Get("device"),
+		r.URL.Path == "/hold")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	w.Write(StatusFormat())
+}
+
+// ctrlsockAllowed tells if client with the given UID is allowed to
+// change the daemon state. uid == -1 indicates that UID is not
+// available.
+//
+// root and the user ipp-usb runs as are always allowed. Others are
+// allowed, if [auth uid] is configured and allows them "config"
+// operations: as control socket is accessible to everybody, the
+// [auth uid] defaults, that allow everything, don't apply here
+func ctrlsockAllowed(uid int) bool {
+	switch {
+	case uid == -1:
+		return false
+	case uid == 0 || uid == os.Getuid():
+		return true
+	case Conf.ConfAuthUID == nil:
+		return false
+	}
+
+	info, err := AuthUIDinfoLookup(uid)
+	if err != nil {
+		Log.Error('!', "ctrlsock: uid=%d: %s", uid, err)
+		return false
+	}
+
+	return AuthUID(info)&AuthOpsConfig != 0
+}
+
+// ctrlsockListener wraps the control socket listener, so accepted
+// connections report UID of the peer process as their RemoteAddr
+type ctrlsockListener struct {
+	*net.UnixListener
+}
+
+// ctrlsockConn is the accepted control socket connection
+type ctrlsockConn struct {
+	*net.UnixConn
+	peer ctrlsockPeer
+}
+
+// ctrlsockPeer is the net.Addr of the control socket peer. Its
+// String() is passed to the handler as http.Request.RemoteAddr
+type ctrlsockPeer int
+
+// Accept accepts the next connection
+func (l ctrlsockListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctrlsockConn{conn, ctrlsockPeer(ctrlsockPeerUID(conn))}, nil
+}
+
+// RemoteAddr returns the peer address
+func (c *ctrlsockConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// Network returns the peer address network name
+func (peer ctrlsockPeer) Network() string {
+	return "unix"
+}
+
+// String returns the peer address as "uid=N"
+func (peer ctrlsockPeer) String() string {
+	return fmt.Sprintf("uid=%d", int(peer))
 }
 
 // CtrlsockStart starts control socket server
@@ -88,7 +190,7 @@ func CtrlsockStart() error {
 
 	// Start HTTP server on a top of the listening socket
 	go func() {
-		ctrlsockServer.Serve(listener)
+		ctrlsockServer.Serve(ctrlsockListener{listener})
 	}()
 
 	return nil
@@ -0,0 +1,34 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket peer credentials -- Linux version
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// ctrlsockPeerUID returns UID of the control socket peer process,
+// or -1, if UID cannot be obtained
+func ctrlsockPeerUID(conn *net.UnixConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1
+	}
+
+	uid := -1
+	raw.Control(func(fd uintptr) {
+		cred, err := syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if err == nil {
+			uid = int(cred.Uid)
+		}
+	})
+
+	return uid
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket peer credentials -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+import (
+	"net"
+)
+
+// ctrlsockPeerUID returns UID of the control socket peer process,
+// or -1, if UID cannot be obtained
+func ctrlsockPeerUID(conn *net.UnixConn) int {
+	return -1
+}
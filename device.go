@@ -10,6 +10,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -19,27 +20,38 @@ import (
 //   - HTTP proxy server
 //   - USB-backed http.Transport
 //   - DNS-SD advertiser
+//   - Logical printers, if configured
 //
 // There is one instance of Device object per USB device
 type Device struct {
-	UsbAddr        UsbAddr         // Device's USB address
-	State          *DevState       // Persistent state
-	HTTPClient     *http.Client    // HTTP client for internal queries
-	HTTPProxy      *HTTPProxy      // HTTP proxy
-	UsbTransport   *UsbTransport   // Backing USB transport
-	DNSSdPublisher *DNSSdPublisher // DNS-SD publisher
-	Log            *Logger         // Device's logger
+	UsbAddr        UsbAddr           // Device's USB address
+	State          *DevState         // Persistent state
+	HTTPClient     *http.Client      // HTTP client for internal queries
+	HTTPProxy      *HTTPProxy        // HTTP proxy
+	HTTPSProxy     *HTTPProxy        // HTTPS proxy, if enabled
+	UsbTransport   *UsbTransport     // Backing USB transport
+	DNSSdPublisher *DNSSdPublisher   // DNS-SD publisher
+	Printers       []*LogicalPrinter // Logical printers
+	Log            *Logger           // Device's logger
 }
 
 // NewDevice creates new Device object
 func NewDevice(desc UsbDeviceDesc) (*Device, error) {
+	return NewDeviceDev(desc, nil)
+}
+
+// NewDeviceDev creates new Device object on a top of already
+// opened UsbDevice (i.e., emulated or replayed). If usbdev is
+// nil, the real USB device is opened by desc
+func NewDeviceDev(desc UsbDeviceDesc, usbdev UsbDevice) (*Device, error) {
 	dev := &Device{
 		UsbAddr: desc.UsbAddr,
 	}
 
 	var err error
 	var info UsbDeviceInfo
-	var listener net.Listener
+	var listener, tlsListener net.Listener
+	var tlsConfig *tls.Config
 	var ippinfo *IppPrinterInfo
 	var dnssdName string
 	var dnssdServices DNSSdServices
@@ -49,9 +61,14 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	var httpstatus int
 	var canPrint bool
 	var canScan bool
+	var share bool
 
 	// Create USB transport
-	dev.UsbTransport, err = NewUsbTransport(desc)
+	if usbdev != nil {
+		dev.UsbTransport, err = NewUsbTransportDev(desc, usbdev)
+	} else {
+		dev.UsbTransport, err = NewUsbTransport(desc)
+	}
 	if err != nil {
 		goto ERROR
 	}
@@ -86,13 +103,62 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	// Configure transport for init
 	dev.UsbTransport.SetTimeout(quirks.GetInitTimeout())
 
+	// Create HTTPS net.Listener, if enabled. Shared device is
+	// accessible from the network only via HTTPS
+	share = dev.UsbTransport.Shared()
+	if Conf.HTTPSEnable || share {
+		tlsListener, err = dev.State.HTTPSListen(share)
+		if err == nil {
+			tlsConfig, err = TLSConfig(info.Ident(), info.MakeAndModel())
+		}
+		if err != nil {
+			goto ERROR
+		}
+	}
+
 	// Create HTTP server
 	dev.HTTPProxy = NewHTTPProxy(dev.Log, listener, dev.UsbTransport)
+	if tlsListener != nil {
+		dev.HTTPSProxy = NewHTTPProxy(dev.Log,
+			tls.NewListener(tlsListener, tlsConfig), dev.UsbTransport)
+		if share {
+			dev.HTTPSProxy.Share()
+		}
+	}
 
-	// Obtain DNS-SD info for IPP
 	log = dev.Log.Begin()
 	defer log.Commit()
 
+	// Wait until device is ready
+	if timeout := quirks.GetInitReadyTimeout(); timeout > 0 {
+		httpstatus, err = DevReadyProbe(log, dev.State.HTTPPort,
+			info.BasicCaps, dev.UsbTransport, dev.HTTPClient, timeout)
+
+		log.Flush()
+
+		switch {
+		case dev.UsbTransport.TimeoutExpired():
+			err = ErrInitTimedOut
+			goto ERROR
+
+		case err != nil && quirks.GetInitRetryPartial():
+			dev.Log.Begin().
+				Info(' ', "Device not ready (HTTP status %d)",
+					httpstatus).
+				Info(' ', "Retrying due to the %q quirk",
+					QuirkNmInitRetryPartial).
+				Commit()
+
+			err = ErrPartialInit
+			goto ERROR
+
+		case err != nil:
+			dev.Log.Error('!', "Device not ready: %s", err)
+			dev.Log.Error('!', "Continuing anyway")
+		}
+	}
+
+	// Obtain DNS-SD info for IPP
 	ippinfo, httpstatus, err = IppService(log, &dnssdServices,
 		dev.State.HTTPPort, info, dev.UsbTransport.Quirks(),
 		dev.HTTPClient)
@@ -128,6 +194,14 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		dnssdName = info.MakeAndModel()
 	}
 
+	// Duplicate devices share the same name, so append USB
+	// port path to tell them apart
+	if info.Duplicate {
+		dnssdName += " (USB " + info.PortPath + ")"
+	}
+
+	dnssdName = nameSanitize(dnssdName, Conf.DNSSdASCII)
+
 	// Update device state, if name changed
 	if dnssdName != dev.State.DNSSdName {
 		dev.State.DNSSdName = dnssdName
@@ -196,6 +270,13 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		svc.Txt.Add("usb_HWID", hwid)
 	}
 
+	// Advertise secure variants of IPP and eSCL services, if
+	// HTTPS is enabled. Shared device advertises them on the
+	// network
+	if dev.HTTPSProxy != nil {
+		dnssdServices.AddSecure(dev.State.HTTPSPort, share)
+	}
+
 	// Advertise Web service. Assume it always exists
 	dnssdServices.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: dev.State.HTTPPort})
 
@@ -218,6 +299,9 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	// Enable handling incoming requests
 	dev.UsbTransport.SetTimeout(0)
 	dev.HTTPProxy.Enable()
+	if dev.HTTPSProxy != nil {
+		dev.HTTPSProxy.Enable()
+	}
 
 	// Start DNS-SD publisher
 	for _, svc := range dnssdServices {
@@ -227,13 +311,49 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		}
 	}
 
+	// DNS-SD requires loopback interface, at least for the
+	// _ipp-usb._tcp service. If it is not available, don't fail
+	// the entire device, but run with DNS-SD disabled
 	if Conf.DNSSdEnable {
-		dev.DNSSdPublisher = NewDNSSdPublisher(dev.Log, dev.State,
+		if _, err = Loopback(); err != nil {
+			dev.Log.Begin().
+				Error('!', "DNS-SD: %s", err).
+				Error('!', "DNS-SD: disabled, device still available at port %d",
+					dev.State.HTTPPort).
+				Commit()
+			err = nil
+		} else {
+			dev.DNSSdPublisher = NewDNSSdPublisher(dev.Log, dev.State,
+				dnssdServices)
+			err = dev.DNSSdPublisher.Publish()
+			if err != nil {
+				goto ERROR
+			}
+		}
+	}
+
+	// Start logical printers. Failure of logical printer
+	// doesn't affect the device itself
+	for _, conf := range Conf.Printers {
+		getinfo := func() (UsbDeviceInfo, error) { return info, nil }
+		if !conf.Match.Match(desc, getinfo) {
+			continue
+		}
+
+		if ippinfo == nil {
+			dev.Log.Error('!', "printer %q: device has no IPP printer",
+				conf.Name)
+			continue
+		}
+
+		prn, err2 := NewLogicalPrinter(dev, conf, info, ippinfo,
 			dnssdServices)
-		err = dev.DNSSdPublisher.Publish()
-		if err != nil {
-			goto ERROR
+		if err2 != nil {
+			dev.Log.Error('!', "printer %q: %s", conf.Name, err2)
+			continue
 		}
+
+		dev.Printers = append(dev.Printers, prn)
 	}
 
 	return dev, nil
@@ -243,6 +363,10 @@ ERROR:
 		dev.HTTPProxy.Close()
 	}
 
+	if dev.HTTPSProxy != nil {
+		dev.HTTPSProxy.Close()
+	}
+
 	if dev.UsbTransport != nil {
 		reset := true
 		switch err {
@@ -256,6 +380,10 @@ ERROR:
 		listener.Close()
 	}
 
+	if tlsListener != nil {
+		tlsListener.Close()
+	}
+
 	return nil, err
 }
 
@@ -263,6 +391,8 @@ ERROR:
 // expires before the shutdown is complete, Shutdown returns the
 // context's error
 func (dev *Device) Shutdown(ctx context.Context) error {
+	dev.closePrinters()
+
 	if dev.DNSSdPublisher != nil {
 		dev.DNSSdPublisher.Unpublish()
 		dev.DNSSdPublisher = nil
@@ -273,6 +403,11 @@ func (dev *Device) Shutdown(ctx context.Context) error {
 		dev.HTTPProxy = nil
 	}
 
+	if dev.HTTPSProxy != nil {
+		dev.HTTPSProxy.Close()
+		dev.HTTPSProxy = nil
+	}
+
 	if dev.UsbTransport != nil {
 		return dev.UsbTransport.Shutdown(ctx)
 	}
@@ -282,6 +417,27 @@ func (dev *Device) Shutdown(ctx context.Context) error {
 
 // Close the Device
 func (dev *Device) Close() {
+	dev.close(false, false)
+}
+
+// CloseReset closes the Device and resets the USB device.
+// It is used to recover the stalled device
+func (dev *Device) CloseReset() {
+	dev.close(true, false)
+}
+
+// CloseForce closes the Device after failed graceful shutdown,
+// without waiting forever for connections that are still in use.
+// It is only used when ipp-usb is about to exit
+func (dev *Device) CloseForce() {
+	dev.close(true, true)
+}
+
+// close closes the Device, optionally resetting the USB device.
+// If force is true, UsbTransport.CloseForce is used
+func (dev *Device) close(reset, force bool) {
+	dev.closePrinters()
+
 	if dev.DNSSdPublisher != nil {
 		dev.DNSSdPublisher.Unpublish()
 		dev.DNSSdPublisher = nil
@@ -292,8 +448,26 @@ func (dev *Device) Close() {
 		dev.HTTPProxy = nil
 	}
 
-	if dev.UsbTransport != nil {
-		dev.UsbTransport.Close(false)
-		dev.UsbTransport = nil
+	if dev.HTTPSProxy != nil {
+		dev.HTTPSProxy.Close()
+		dev.HTTPSProxy = nil
+	}
+
+	switch {
+	case dev.UsbTransport == nil:
+	case force:
+		dev.UsbTransport.CloseForce()
+	default:
+		dev.UsbTransport.Close(reset)
+	}
+
+	dev.UsbTransport = nil
+}
+
+// closePrinters closes all logical printers of the Device
+func (dev *Device) closePrinters() {
+	for _, prn := range dev.Printers {
+		prn.Close()
 	}
+	dev.Printers = nil
 }
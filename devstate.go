@@ -23,6 +23,7 @@ import (
 type DevState struct {
 	Ident         string // Device identification
 	HTTPPort      int    // Allocated HTTP port
+	HTTPSPort     int    // Allocated HTTPS port, 0 if none
 	DNSSdName     string // DNS-SD name, as reported by device
 	DNSSdOverride string // DNS-SD name after collision resolution
 
@@ -113,6 +114,10 @@ func LoadUsedPorts() (ports map[int]string) {
 		if state.HTTPPort != 0 {
 			ports[state.HTTPPort] = file.Name()
 		}
+
+		if state.HTTPSPort != 0 {
+			ports[state.HTTPSPort] = file.Name()
+		}
 	}
 
 	return
@@ -137,6 +142,8 @@ func (state *DevState) load(ini *IniFile) error {
 			switch rec.Key {
 			case "http-port":
 				err = state.loadTCPPort(&state.HTTPPort, rec)
+			case "https-port":
+				err = state.loadTCPPort(&state.HTTPSPort, rec)
 			case "dns-sd-name":
 				state.DNSSdName = rec.Value
 			case "dns-sd-override":
@@ -184,6 +191,9 @@ func (state *DevState) Save() {
 
 	fmt.Fprintf(&buf, "[device]\n")
 	fmt.Fprintf(&buf, "http-port       = %d\n", state.HTTPPort)
+	if state.HTTPSPort != 0 {
+		fmt.Fprintf(&buf, "https-port      = %d\n", state.HTTPSPort)
+	}
 	fmt.Fprintf(&buf, "dns-sd-name     = %q\n", state.DNSSdName)
 	fmt.Fprintf(&buf, "dns-sd-override = %q\n", state.DNSSdOverride)
 
@@ -222,7 +232,23 @@ func (state *DevState) save(data []byte) error {
 
 // HTTPListen allocates HTTP port and updates persistent configuration
 func (state *DevState) HTTPListen() (net.Listener, error) {
-	port := state.HTTPPort
+	return state.listen(&state.HTTPPort, "HTTP", false)
+}
+
+// HTTPSListen allocates HTTPS port and updates persistent configuration.
+// The returned listener is not wrapped into TLS yet. If share is true,
+// it accepts network connections even in loopback-only mode
+func (state *DevState) HTTPSListen(share bool) (net.Listener, error) {
+	return state.listen(&state.HTTPSPort, "HTTPS", share)
+}
+
+// listen allocates TCP port, stored in the *statePort, and updates
+// persistent configuration. proto is used for logging. share is
+// passed to NewShareListener
+func (state *DevState) listen(statePort *int, proto string, share bool) (
+	net.Listener, error) {
+
+	port := *statePort
 
 	// Check that preallocated port is within the configured range
 	if !(Conf.HTTPMinPort <= port && port <= Conf.HTTPMaxPort) {
@@ -231,7 +257,7 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 
 	// Try to allocate port used before
 	if port != 0 {
-		listener, err := NewListener(port)
+		listener, err := NewShareListener(port, share)
 		if err == nil {
 			return listener, nil
 		}
@@ -244,13 +270,13 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 	for port = Conf.HTTPMinPort; port <= Conf.HTTPMaxPort; port++ {
 		used := ports[port]
 		if used != "" {
-			Log.Info(' ', "HTTP port %d used by %s", port, used)
+			Log.Info(' ', "%s port %d used by %s", proto, port, used)
 			continue
 		}
 
-		listener, err := NewListener(port)
+		listener, err := NewShareListener(port, share)
 		if err == nil {
-			state.HTTPPort = port
+			*statePort = port
 			state.Save()
 			return listener, nil
 		}
@@ -259,16 +285,16 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 	// No success so far. Repeat allocation attempt, ignoring
 	// existent allocations
 	for port = Conf.HTTPMinPort; port <= Conf.HTTPMaxPort; port++ {
-		listener, err := NewListener(port)
+		listener, err := NewShareListener(port, share)
 		if err == nil {
-			state.HTTPPort = port
+			*statePort = port
 			state.Save()
 			return listener, nil
 		}
 	}
 
 	// Give up and return an error
-	err := state.error("failed to allocate HTTP port")
+	err := state.error("failed to allocate %s port", proto)
 	Log.Error('!', "STATE PORT: %s", err)
 
 	return nil, err
@@ -108,6 +108,7 @@ type DNSSdSvcInfo struct {
 	Port     int            // TCP port
 	Txt      DNSSdTxtRecord // TXT record
 	Loopback bool           // Advertise only on loopback interface
+	Network  bool           // Advertise on network, even if loopback-only
 }
 
 // DNSSdServices represents a collection of DNS-SD services
@@ -118,16 +119,79 @@ func (services *DNSSdServices) Add(srv DNSSdSvcInfo) {
 	*services = append(*services, srv)
 }
 
+// AddSecure adds secure counterparts of the IPP and eSCL services
+// (_ipps._tcp and _uscans._tcp), served at the HTTPS port. If
+// network is true, they are advertised on the network, even if
+// ipp-usb runs in loopback-only mode (device is shared)
+func (services *DNSSdServices) AddSecure(port int, network bool) {
+	for _, svc := range *services {
+		var secure string
+		switch svc.Type {
+		case "_ipp._tcp":
+			secure = "_ipps._tcp"
+		case "_uscan._tcp":
+			secure = "_uscans._tcp"
+		default:
+			continue
+		}
+
+		// Subtypes look like "_universal._sub._ipp._tcp"
+		var subtypes []string
+		for _, st := range svc.SubTypes {
+			st = strings.TrimSuffix(st, svc.Type) + secure
+			subtypes = append(subtypes, st)
+		}
+
+		svc.Type = secure
+		svc.SubTypes = subtypes
+		svc.Port = port
+		svc.Txt = append(DNSSdTxtRecord(nil), svc.Txt...)
+		svc.Network = network
+
+		services.Add(svc)
+	}
+}
+
+// DNSSdBackend represents the part of DNS-SD publisher, that actually
+// advertises services, either via system DNS-SD daemon (Avahi or
+// Bonjour) or by itself.
+//
+// Backend starts publishing when created, reports publishing status
+// via channel, returned by Chan(), and stops publishing when Halt()
+// is called
+type DNSSdBackend interface {
+	Chan() <-chan DNSSdStatus // Status notifications channel
+	Halt()                    // Stop publishing
+}
+
+// DNSSdBackendFactory creates a new DNSSdBackend, that publishes
+// services under the specified Service Instance Name
+type DNSSdBackendFactory func(log *Logger, instance string,
+	services DNSSdServices) DNSSdBackend
+
+// DNSSdSysdepBackend is the DNSSdBackendFactory for the system
+// DNS-SD daemon (Avahi or Bonjour, depending on platform)
+func DNSSdSysdepBackend(log *Logger, instance string,
+	services DNSSdServices) DNSSdBackend {
+	return newDnssdSysdep(log, instance, services)
+}
+
 // DNSSdPublisher represents a DNS-SD service publisher
 // One publisher may publish multiple services unser the
 // same Service Instance Name
 type DNSSdPublisher struct {
-	Log      *Logger        // Device's logger
-	DevState *DevState      // Device persistent state
-	Services DNSSdServices  // Registered services
-	fin      chan struct{}  // Closed to terminate publisher goroutine
-	finDone  sync.WaitGroup // To wait for goroutine termination
-	sysdep   *dnssdSysdep   // System-dependent stuff
+	Log      *Logger             // Device's logger
+	DevState *DevState           // Device persistent state
+	Services DNSSdServices       // Registered services
+	Backend  DNSSdBackendFactory // Creates DNSSdBackend
+	fin      chan struct{}       // Closed to terminate publisher goroutine
+	finDone  sync.WaitGroup      // To wait for goroutine termination
+	sysdep   DNSSdBackend        // Current backend instance
+	retry    time.Duration       // Initial retry interval
+	retryMax time.Duration       // Maximum retry interval, for backoff
+	lock     sync.Mutex          // Protects the following fields
+	success  bool                // Services are published
+	failures int                 // Failed attempts since last success
 }
 
 // DNSSdStatus represents DNS-SD publisher status
@@ -170,6 +234,10 @@ func (status DNSSdStatus) String() string {
 // Service instance name comes from the DevState, and if
 // name changes as result of name collision resolution,
 // DevState will be updated
+//
+// Services are published via system DNS-SD daemon. Use of
+// the different DNSSdBackend can be requested by setting
+// publisher's Backend before calling Publish()
 func NewDNSSdPublisher(log *Logger,
 	devstate *DevState, services DNSSdServices) *DNSSdPublisher {
 
@@ -177,14 +245,17 @@ func NewDNSSdPublisher(log *Logger,
 		Log:      log,
 		DevState: devstate,
 		Services: services,
+		Backend:  DNSSdSysdepBackend,
 		fin:      make(chan struct{}),
+		retry:    DNSSdRetryInterval,
+		retryMax: DNSSdRetryMaxInterval,
 	}
 }
 
 // Publish all services
 func (publisher *DNSSdPublisher) Publish() error {
 	instance := publisher.instance(0)
-	publisher.sysdep = newDnssdSysdep(publisher.Log, instance,
+	publisher.sysdep = publisher.Backend(publisher.Log, instance,
 		publisher.Services)
 
 	publisher.Log.Info('+', "DNS-SD: %s: publishing requested", instance)
@@ -205,6 +276,55 @@ func (publisher *DNSSdPublisher) Unpublish() {
 	publisher.Log.Info('-', "DNS-SD: %s: removed", publisher.instance(0))
 }
 
+// Status returns human-readable publishing status, for the
+// status output
+func (publisher *DNSSdPublisher) Status() string {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	switch {
+	case publisher.success:
+		return "published"
+	case publisher.failures > 0:
+		return fmt.Sprintf("pending, %d attempts failed",
+			publisher.failures)
+	}
+
+	return "publishing"
+}
+
+// setStatus updates publishing status. On failure, it returns
+// the retry interval: the initial retry interval, doubled for
+// each subsequent failure, up to retryMax
+//
+// The typical reason of repeated failures is the DNS-SD daemon,
+// not started yet (i.e., ipp-usb started before avahi-daemon
+// at boot) or restarted, so device remains operational, and
+// registration is retried with backoff, until it succeeds
+func (publisher *DNSSdPublisher) setStatus(success bool) time.Duration {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	publisher.success = success
+	if success {
+		publisher.failures = 0
+		return 0
+	}
+
+	retry := publisher.retry
+	for i := 0; i < publisher.failures && retry < publisher.retryMax; i++ {
+		retry *= 2
+	}
+
+	if retry > publisher.retryMax {
+		retry = publisher.retryMax
+	}
+
+	publisher.failures++
+
+	return retry
+}
+
 // Build service instance name with optional collision-resolution suffix
 func (publisher *DNSSdPublisher) instance(suffix int) string {
 	name := publisher.DevState.DNSSdName
@@ -226,9 +346,7 @@ func (publisher *DNSSdPublisher) instance(suffix int) string {
 	}
 
 	const MaxDNSSDName = 63
-	if len(name)+len(strSuffix) > MaxDNSSDName {
-		name = name[:MaxDNSSDName-len(strSuffix)]
-	}
+	name = nameTruncate(name, MaxDNSSDName-len(strSuffix))
 
 	return name + strSuffix
 }
@@ -254,7 +372,7 @@ func (publisher *DNSSdPublisher) goroutine() {
 
 	instance := publisher.instance(0)
 	for {
-		fail := false
+		var retry time.Duration
 
 		select {
 		case <-publisher.fin:
@@ -264,6 +382,7 @@ func (publisher *DNSSdPublisher) goroutine() {
 			switch status {
 			case DNSSdSuccess:
 				publisher.Log.Info(' ', "DNS-SD: %s: published", instance)
+				publisher.setStatus(true)
 				if instance != publisher.DevState.DNSSdOverride {
 					publisher.DevState.DNSSdOverride = instance
 					publisher.DevState.Save()
@@ -273,13 +392,19 @@ func (publisher *DNSSdPublisher) goroutine() {
 				publisher.Log.Error(' ', "DNS-SD: %s: name collision",
 					instance)
 				suffix++
-				fallthrough
+
+				// Name collision is not a failure of DNS-SD
+				// as such, so retry without backoff
+				retry = publisher.retry
+				publisher.sysdep.Halt()
 
 			case DNSSdFailure:
+				retry = publisher.setStatus(false)
 				publisher.Log.Error(' ', "DNS-SD: %s: publishing failed",
 					instance)
+				publisher.Log.Info(' ', "DNS-SD: %s: pending, retry in %s",
+					instance, retry)
 
-				fail = true
 				publisher.sysdep.Halt()
 
 			default:
@@ -289,17 +414,17 @@ func (publisher *DNSSdPublisher) goroutine() {
 
 		case <-timer.C:
 			instance = publisher.instance(suffix)
-			publisher.sysdep = newDnssdSysdep(publisher.Log,
+			publisher.sysdep = publisher.Backend(publisher.Log,
 				instance, publisher.Services)
 
 			if err != nil {
 				publisher.Log.Error('!', "DNS-SD: %s: %s", instance, err)
-				fail = true
+				retry = publisher.setStatus(false)
 			}
 		}
 
-		if fail {
-			timer.Reset(DNSSdRetryInterval)
+		if retry != 0 {
+			timer.Reset(retry)
 		}
 	}
 }
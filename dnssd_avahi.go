@@ -1,5 +1,5 @@
-//go:build linux || freebsd
-// +build linux freebsd
+//go:build linux || freebsd || netbsd || openbsd
+// +build linux freebsd netbsd openbsd
 
 /* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
  *
@@ -27,6 +27,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"sync"
 	"unsafe"
@@ -44,6 +45,7 @@ type dnssdSysdep struct {
 	log        *Logger            // Device's logger
 	instance   string             // Service Instance Name
 	fqdn       string             // Host's fully-qualified domain name
+	netFqdn    string             // The same, for services on network
 	client     *C.AvahiClient     // Avahi client
 	egroup     *C.AvahiEntryGroup // Avahi entry group
 	statusChan chan DNSSdStatus   // Status notifications channel
@@ -68,6 +70,7 @@ func newDnssdSysdep(log *Logger, instance string,
 	var poll *C.AvahiPoll
 	var rc C.int
 	var proto, iface int
+	var netif *net.Interface
 
 	sysdep := &dnssdSysdep{
 		log:        log,
@@ -81,6 +84,12 @@ func newDnssdSysdep(log *Logger, instance string,
 		goto ERROR // Very unlikely to happen
 	}
 
+	// Obtain explicitly configured interface, if any
+	netif, err = NetIf()
+	if err != nil {
+		goto ERROR
+	}
+
 	// Obtain AvahiPoll
 	poll, err = avahiGetPoll()
 	if err != nil {
@@ -107,6 +116,7 @@ func newDnssdSysdep(log *Logger, instance string,
 	avahiClientMap[sysdep.client] = sysdep
 
 	sysdep.fqdn = C.GoString(C.avahi_client_get_host_name_fqdn(sysdep.client))
+	sysdep.netFqdn = sysdep.fqdn
 	sysdep.log.Debug(' ', "DNS-SD: FQDN: %q", sysdep.fqdn)
 
 	// Create entry group
@@ -132,6 +142,16 @@ func newDnssdSysdep(log *Logger, instance string,
 		sysdep.log.Debug(' ', "DNS-SD: FQDN: %q->%q", old, sysdep.fqdn)
 	}
 
+	if netif != nil {
+		iface = netif.Index
+		if netif.Flags&net.FlagLoopback != 0 {
+			old := sysdep.fqdn
+			sysdep.fqdn = "localhost"
+			sysdep.log.Debug(' ', "DNS-SD: FQDN: %q->%q",
+				old, sysdep.fqdn)
+		}
+	}
+
 	proto = C.AVAHI_PROTO_UNSPEC
 	if !Conf.IPV6Enable {
 		proto = C.AVAHI_PROTO_INET
@@ -139,9 +159,19 @@ func newDnssdSysdep(log *Logger, instance string,
 
 	// Populate entry group
 	for _, svc := range services {
+		// Handle loopback-only mode. Services of shared device
+		// are advertised on network even in this mode
+		ifaceInUse, fqdn := iface, sysdep.fqdn
+		switch {
+		case svc.Loopback:
+			ifaceInUse = loopback
+		case svc.Network && Conf.LoopbackOnly:
+			ifaceInUse, fqdn = C.AVAHI_IF_UNSPEC, sysdep.netFqdn
+		}
+
 		// Prepare TXT record
 		var cTxt *C.AvahiStringList
-		cTxt, err = sysdep.avahiTxtRecord(svc.Port, svc.Txt)
+		cTxt, err = sysdep.avahiTxtRecord(fqdn, svc.Port, svc.Txt)
 		if err != nil {
 			goto ERROR
 		}
@@ -156,12 +186,6 @@ func newDnssdSysdep(log *Logger, instance string,
 			cInstance = C.CString(instance)
 		}
 
-		// Handle loopback-only mode
-		ifaceInUse := iface
-		if svc.Loopback {
-			ifaceInUse = loopback
-		}
-
 		// Register service type
 		rc = C.avahi_entry_group_add_service_strlst(
 			sysdep.egroup,
@@ -282,9 +306,10 @@ func (sysdep *dnssdSysdep) notify(status DNSSdStatus) {
 	sysdep.statusChan <- status
 }
 
-// avahiTxtRecord converts DNSSdTxtRecord to AvahiStringList
-func (sysdep *dnssdSysdep) avahiTxtRecord(port int, txt DNSSdTxtRecord) (
-	*C.AvahiStringList, error) {
+// avahiTxtRecord converts DNSSdTxtRecord to AvahiStringList.
+// Host in URLs is replaced with fqdn
+func (sysdep *dnssdSysdep) avahiTxtRecord(fqdn string, port int,
+	txt DNSSdTxtRecord) (*C.AvahiStringList, error) {
 	var buf bytes.Buffer
 	var list, prev *C.AvahiStringList
 
@@ -293,12 +318,12 @@ func (sysdep *dnssdSysdep) avahiTxtRecord(port int, txt DNSSdTxtRecord) (
 		buf.WriteString(t.Key)
 		buf.WriteByte('=')
 
-		if !t.URL || sysdep.fqdn == "" {
+		if !t.URL || fqdn == "" {
 			buf.WriteString(t.Value)
 		} else {
 			value := t.Value
 			if parsed, err := url.Parse(value); err == nil && parsed.IsAbs() {
-				parsed.Host = sysdep.fqdn
+				parsed.Host = fqdn
 				if port != 0 {
 					parsed.Host += fmt.Sprintf(":%d", port)
 				}
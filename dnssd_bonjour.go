@@ -0,0 +1,359 @@
+//go:build darwin
+// +build darwin
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * DNS-SD publisher: mDNSResponder (Bonjour) backend, used on macOS
+ */
+
+package main
+
+// #include <stdlib.h>
+// #include <poll.h>
+// #include <arpa/inet.h>
+// #include <dns_sd.h>
+//
+// void bonjourRegisterCallback(DNSServiceRef, DNSServiceErrorType);
+//
+// // DNSServiceRegisterReply has const char* parameters, which cannot
+// // be expressed by the exported Go function. So wrap it here.
+// static void DNSSD_API
+// bonjourRegisterReply (DNSServiceRef sdRef, DNSServiceFlags flags,
+//         DNSServiceErrorType err, const char *name, const char *regtype,
+//         const char *domain, void *context) {
+//     bonjourRegisterCallback(sdRef, err);
+// }
+//
+// static inline DNSServiceErrorType
+// bonjourRegister (DNSServiceRef conn, DNSServiceRef *sdRef,
+//         uint32_t iface, const char *name, const char *regtype,
+//         uint16_t port, uint16_t txtLen, const void *txt) {
+//     *sdRef = conn;
+//     return DNSServiceRegister(sdRef,
+//         kDNSServiceFlagsShareConnection | kDNSServiceFlagsNoAutoRename,
+//         iface, name, regtype, NULL, NULL, htons(port),
+//         txtLen, txt, bonjourRegisterReply, NULL);
+// }
+//
+// // Wait until connection becomes readable. Returns positive
+// // value if data is available, 0 on timeout and negative on error
+// static inline int
+// bonjourWait (DNSServiceRef conn, int timeout) {
+//     struct pollfd pfd = {DNSServiceRefSockFD(conn), POLLIN, 0};
+//     return poll(&pfd, 1, timeout);
+// }
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+var (
+	bonjourInitLock sync.Mutex
+	bonjourLock     sync.Mutex
+	bonjourConn     C.DNSServiceRef
+	bonjourRefMap   = make(map[C.DNSServiceRef]*dnssdSysdep)
+)
+
+// dnssdSysdep represents a system-dependent DNS-SD advertiser
+type dnssdSysdep struct {
+	log        *Logger           // Device's logger
+	instance   string            // Service Instance Name
+	fqdn       string            // Host's fully-qualified domain name
+	netFqdn    string            // The same, for services on network
+	refs       []C.DNSServiceRef // Registered services
+	pending    int               // Count of not yet confirmed services
+	statusChan chan DNSSdStatus  // Status notifications channel
+}
+
+// dnssdSysdepErr implements error interface on a top of
+// mDNSResponder error codes
+type dnssdSysdepErr C.DNSServiceErrorType
+
+// Error returns error string for the dnssdSysdepErr
+func (err dnssdSysdepErr) Error() string {
+	return fmt.Sprintf("mDNSResponder error: %d", int(err))
+}
+
+// newDnssdSysdep creates new dnssdSysdep instance
+func newDnssdSysdep(log *Logger, instance string,
+	services DNSSdServices) *dnssdSysdep {
+
+	log.Debug(' ', "DNS-SD: %s: trying", instance)
+
+	var err error
+	var rc C.DNSServiceErrorType
+	var conn C.DNSServiceRef
+	var netif *net.Interface
+
+	sysdep := &dnssdSysdep{
+		log:        log,
+		instance:   instance,
+		statusChan: make(chan DNSSdStatus, 10),
+	}
+
+	// Obtain explicitly configured interface, if any
+	netif, err = NetIf()
+	if err != nil {
+		goto ERROR
+	}
+
+	// Obtain shared connection to mDNSResponder
+	conn, err = bonjourConnection()
+	if err != nil {
+		goto ERROR
+	}
+
+	// Synchronize with Bonjour thread
+	bonjourLock.Lock()
+	defer bonjourLock.Unlock()
+
+	// Compute fqdn
+	if host, err := os.Hostname(); err == nil {
+		host = strings.TrimSuffix(host, ".")
+		if !strings.HasSuffix(host, ".local") {
+			host = strings.SplitN(host, ".", 2)[0] + ".local"
+		}
+		sysdep.netFqdn = host
+	}
+
+	sysdep.fqdn = sysdep.netFqdn
+	if Conf.LoopbackOnly ||
+		(netif != nil && netif.Flags&net.FlagLoopback != 0) {
+		sysdep.fqdn = "localhost"
+	}
+	sysdep.log.Debug(' ', "DNS-SD: FQDN: %q", sysdep.fqdn)
+
+	// Register services. Note, mDNSResponder doesn't allow to choose
+	// protocol for registration, so Conf.IPV6Enable is not honored here
+	for _, svc := range services {
+		var ref C.DNSServiceRef
+
+		// Services of shared device are advertised on network
+		// even in loopback-only mode
+		iface := C.uint32_t(C.kDNSServiceInterfaceIndexAny)
+		fqdn := sysdep.fqdn
+		switch {
+		case svc.Network && Conf.LoopbackOnly && !svc.Loopback:
+			fqdn = sysdep.netFqdn
+		case Conf.LoopbackOnly || svc.Loopback ||
+			(netif != nil && netif.Flags&net.FlagLoopback != 0):
+			iface = C.uint32_t(C.kDNSServiceInterfaceIndexLocalOnly)
+		case netif != nil:
+			iface = C.uint32_t(netif.Index)
+		}
+
+		name := instance
+		if svc.Instance != "" {
+			name = svc.Instance
+		}
+
+		// Subtypes are passed as comma-separated list,
+		// appended to the service type
+		regtype := svc.Type
+		for _, subtype := range svc.SubTypes {
+			sysdep.log.Debug(' ', "DNS-SD: +subtype: %q", subtype)
+			regtype += "," + strings.SplitN(subtype, ".", 2)[0]
+		}
+
+		txt := sysdep.bonjourTxtRecord(fqdn, svc.Port, svc.Txt)
+		var txtPtr unsafe.Pointer
+		if len(txt) != 0 {
+			txtPtr = C.CBytes(txt)
+		}
+
+		cName := C.CString(name)
+		cRegtype := C.CString(regtype)
+
+		rc = C.bonjourRegister(conn, &ref, iface, cName, cRegtype,
+			C.uint16_t(svc.Port), C.uint16_t(len(txt)), txtPtr)
+
+		C.free(unsafe.Pointer(cName))
+		C.free(unsafe.Pointer(cRegtype))
+		if txtPtr != nil {
+			C.free(txtPtr)
+		}
+
+		if rc != C.kDNSServiceErr_NoError {
+			err = dnssdSysdepErr(rc)
+			goto ERROR
+		}
+
+		sysdep.refs = append(sysdep.refs, ref)
+		sysdep.pending++
+		bonjourRefMap[ref] = sysdep
+	}
+
+	return sysdep
+
+	// Error: cleanup and exit
+ERROR:
+	// Raise an error event
+	sysdep.log.Error(' ', "DNS-SD: %s: %s", sysdep.instance, err)
+	sysdep.haltLocked()
+
+	if err == dnssdSysdepErr(C.kDNSServiceErr_NameConflict) {
+		sysdep.notify(DNSSdCollision)
+	} else {
+		sysdep.notify(DNSSdFailure)
+	}
+
+	return sysdep
+}
+
+// Halt dnssdSysdep
+//
+// It cancel all activity related to the dnssdSysdep instance,
+// but sysdep.Chan() remains valid, though no notifications
+// will be pushed there anymore
+func (sysdep *dnssdSysdep) Halt() {
+	bonjourLock.Lock()
+	sysdep.haltLocked()
+	bonjourLock.Unlock()
+}
+
+// Get status change notification channel
+func (sysdep *dnssdSysdep) Chan() <-chan DNSSdStatus {
+	return sysdep.statusChan
+}
+
+// Halt dnssdSysdep -- internal version
+//
+// Must be called under bonjourLock
+// Can be used with semi-constructed dnssdSysdep
+func (sysdep *dnssdSysdep) haltLocked() {
+	// Deallocate all registrations
+	for _, ref := range sysdep.refs {
+		C.DNSServiceRefDeallocate(ref)
+		delete(bonjourRefMap, ref)
+	}
+
+	sysdep.refs = nil
+	sysdep.pending = 0
+
+	// Drain status channel
+	for len(sysdep.statusChan) > 0 {
+		<-sysdep.statusChan
+	}
+}
+
+// Push status change notification
+func (sysdep *dnssdSysdep) notify(status DNSSdStatus) {
+	sysdep.statusChan <- status
+}
+
+// bonjourTxtRecord converts DNSSdTxtRecord into the wire format,
+// expected by DNSServiceRegister: sequence of length-prefixed strings.
+// Host in URLs is replaced with fqdn
+func (sysdep *dnssdSysdep) bonjourTxtRecord(fqdn string, port int,
+	txt DNSSdTxtRecord) []byte {
+
+	var out, buf bytes.Buffer
+
+	for _, t := range txt {
+		buf.Reset()
+		buf.WriteString(t.Key)
+		buf.WriteByte('=')
+
+		if !t.URL || fqdn == "" {
+			buf.WriteString(t.Value)
+		} else {
+			value := t.Value
+			if parsed, err := url.Parse(value); err == nil && parsed.IsAbs() {
+				parsed.Host = fqdn
+				if port != 0 {
+					parsed.Host += fmt.Sprintf(":%d", port)
+				}
+
+				value = parsed.String()
+			}
+			buf.WriteString(value)
+		}
+
+		b := buf.Bytes()
+		if len(b) > 255 {
+			b = b[:255]
+		}
+
+		out.WriteByte(byte(len(b)))
+		out.Write(b)
+	}
+
+	return out.Bytes()
+}
+
+// bonjourRegisterCallback called by mDNSResponder client library
+// to report service registration result
+//
+//export bonjourRegisterCallback
+func bonjourRegisterCallback(ref C.DNSServiceRef, rc C.DNSServiceErrorType) {
+	sysdep := bonjourRefMap[ref]
+	if sysdep == nil {
+		return
+	}
+
+	switch rc {
+	case C.kDNSServiceErr_NoError:
+		sysdep.log.Debug(' ', "DNS-SD: %s: service registered",
+			sysdep.instance)
+		sysdep.pending--
+		if sysdep.pending == 0 {
+			sysdep.notify(DNSSdSuccess)
+		}
+
+	case C.kDNSServiceErr_NameConflict:
+		sysdep.log.Debug(' ', "DNS-SD: %s: name conflict",
+			sysdep.instance)
+		sysdep.notify(DNSSdCollision)
+
+	default:
+		sysdep.log.Debug(' ', "DNS-SD: %s: %s",
+			sysdep.instance, dnssdSysdepErr(rc))
+		sysdep.notify(DNSSdFailure)
+	}
+}
+
+// bonjourConnection returns shared connection to mDNSResponder.
+// Connection and its processing goroutine are created on demand
+func bonjourConnection() (C.DNSServiceRef, error) {
+	bonjourInitLock.Lock()
+	defer bonjourInitLock.Unlock()
+
+	if bonjourConn == nil {
+		rc := C.DNSServiceCreateConnection(&bonjourConn)
+		if rc != C.kDNSServiceErr_NoError {
+			bonjourConn = nil
+			return nil, dnssdSysdepErr(rc)
+		}
+
+		go bonjourThread(bonjourConn)
+	}
+
+	return bonjourConn, nil
+}
+
+// bonjourThread processes replies from mDNSResponder
+func bonjourThread(conn C.DNSServiceRef) {
+	for {
+		// Wait without holding the lock, so registrations
+		// may proceed in meantime
+		rc := C.bonjourWait(conn, 250)
+		if rc <= 0 {
+			continue
+		}
+
+		bonjourLock.Lock()
+		C.DNSServiceProcessResult(conn)
+		bonjourLock.Unlock()
+	}
+}
@@ -0,0 +1,331 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * DNS-SD publisher tests
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnssdFakeNet is the in-memory fake of the DNS-SD network. It
+// creates dnssdFakeBackend instances and detects name collisions
+// between them
+type dnssdFakeNet struct {
+	lock      sync.Mutex                   // Access lock
+	names     map[string]*dnssdFakeBackend // Published instances
+	failures  int                          // Count of publishing to fail
+	published chan string                  // Receives published instances
+}
+
+// dnssdFakeBackend implements DNSSdBackend on a top of dnssdFakeNet
+type dnssdFakeBackend struct {
+	fnet     *dnssdFakeNet    // Network that owns the backend
+	instance string           // Service Instance Name
+	services DNSSdServices    // Published services
+	status   chan DNSSdStatus // Status notifications channel
+	halt     chan struct{}    // Closed by Halt
+	once     sync.Once        // For Halt
+}
+
+// newDnssdFakeNet creates a new dnssdFakeNet
+func newDnssdFakeNet() *dnssdFakeNet {
+	return &dnssdFakeNet{
+		names:     make(map[string]*dnssdFakeBackend),
+		published: make(chan string, 16),
+	}
+}
+
+// backend creates a new dnssdFakeBackend. It implements
+// DNSSdBackendFactory
+func (fnet *dnssdFakeNet) backend(log *Logger, instance string,
+	services DNSSdServices) DNSSdBackend {
+
+	b := &dnssdFakeBackend{
+		fnet:     fnet,
+		instance: instance,
+		services: services,
+		status:   make(chan DNSSdStatus),
+		halt:     make(chan struct{}),
+	}
+
+	fnet.lock.Lock()
+	status := DNSSdSuccess
+	switch {
+	case fnet.failures > 0:
+		fnet.failures--
+		status = DNSSdFailure
+	case fnet.names[instance] != nil:
+		status = DNSSdCollision
+	default:
+		fnet.names[instance] = b
+	}
+	fnet.lock.Unlock()
+
+	// Status is reported synchronously, so when instance name
+	// is sent to the published channel, publisher has already
+	// received the status
+	go func() {
+		select {
+		case b.status <- status:
+			if status == DNSSdSuccess {
+				fnet.published <- instance
+			}
+		case <-b.halt:
+		}
+	}()
+
+	return b
+}
+
+// lookup returns published services by instance name
+func (fnet *dnssdFakeNet) lookup(instance string) DNSSdServices {
+	fnet.lock.Lock()
+	defer fnet.lock.Unlock()
+
+	if b := fnet.names[instance]; b != nil {
+		return b.services
+	}
+
+	return nil
+}
+
+// wait waits until some instance is published
+func (fnet *dnssdFakeNet) wait(t *testing.T) string {
+	select {
+	case instance := <-fnet.published:
+		return instance
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DNS-SD: publishing timeout")
+	}
+	return ""
+}
+
+// Chan returns status notifications channel. It implements
+// DNSSdBackend interface
+func (b *dnssdFakeBackend) Chan() <-chan DNSSdStatus {
+	return b.status
+}
+
+// Halt stops publishing. It implements DNSSdBackend interface
+func (b *dnssdFakeBackend) Halt() {
+	b.once.Do(func() {
+		close(b.halt)
+
+		b.fnet.lock.Lock()
+		if b.fnet.names[b.instance] == b {
+			delete(b.fnet.names, b.instance)
+		}
+		b.fnet.lock.Unlock()
+	})
+}
+
+// dnssdTestPublisher creates DNSSdPublisher on a top of
+// dnssdFakeNet. Device state goes to the test's temporary directory
+func dnssdTestPublisher(t *testing.T, fnet *dnssdFakeNet,
+	name string) *DNSSdPublisher {
+
+	dir := testConf(t)
+
+	state := &DevState{
+		Ident:         "test",
+		DNSSdName:     name,
+		DNSSdOverride: name,
+		path:          filepath.Join(dir, "test.state"),
+	}
+
+	var txt DNSSdTxtRecord
+	txt.Add("txtvers", "1")
+	txt.Add("ty", name)
+
+	services := DNSSdServices{
+		{Type: "_ipp._tcp", Port: 60000, Txt: txt},
+		{Type: "_uscan._tcp", Port: 60000},
+	}
+
+	publisher := NewDNSSdPublisher(NewLogger(), state, services)
+	publisher.Backend = fnet.backend
+	publisher.retry = 10 * time.Millisecond
+
+	return publisher
+}
+
+// TestDNSSdPublisher tests DNS-SD publishing and unpublishing
+func TestDNSSdPublisher(t *testing.T) {
+	fnet := newDnssdFakeNet()
+	publisher := dnssdTestPublisher(t, fnet, "Printer")
+
+	publisher.Publish()
+	instance := fnet.wait(t)
+
+	if instance != "Printer (USB)" {
+		t.Errorf("instance name: %q", instance)
+	}
+
+	services := fnet.lookup(instance)
+	if len(services) != 2 || services[0].Txt[1].Value != "Printer" {
+		t.Errorf("services not published properly: %v", services)
+	}
+
+	publisher.Unpublish()
+
+	if publisher.DevState.DNSSdOverride != instance {
+		t.Errorf("DevState not updated: %q",
+			publisher.DevState.DNSSdOverride)
+	}
+
+	if fnet.lookup(instance) != nil {
+		t.Errorf("services not removed")
+	}
+}
+
+// TestDNSSdCollision tests name collision resolution
+func TestDNSSdCollision(t *testing.T) {
+	fnet := newDnssdFakeNet()
+	fnet.names["Printer (USB)"] = &dnssdFakeBackend{}
+	fnet.names["Printer (USB 1)"] = &dnssdFakeBackend{}
+
+	publisher := dnssdTestPublisher(t, fnet, "Printer")
+
+	publisher.Publish()
+	instance := fnet.wait(t)
+	publisher.Unpublish()
+
+	if instance != "Printer (USB 2)" {
+		t.Errorf("instance name: %q", instance)
+	}
+
+	// Resolved name must persist across re-publishing
+	fnet.names = map[string]*dnssdFakeBackend{}
+	publisher = dnssdTestPublisher(t, fnet, "Printer")
+
+	publisher.DevState.DNSSdOverride = instance
+
+	publisher.Publish()
+	instance = fnet.wait(t)
+	publisher.Unpublish()
+
+	if instance != "Printer (USB 2)" {
+		t.Errorf("instance name after re-publishing: %q", instance)
+	}
+}
+
+// TestDNSSdFailure tests re-registration after failure
+func TestDNSSdFailure(t *testing.T) {
+	fnet := newDnssdFakeNet()
+	fnet.failures = 2
+
+	publisher := dnssdTestPublisher(t, fnet, "Printer")
+
+	publisher.Publish()
+	instance := fnet.wait(t)
+	publisher.Unpublish()
+
+	if instance != "Printer (USB)" {
+		t.Errorf("instance name: %q", instance)
+	}
+}
+
+// TestDNSSdLongName tests truncation of long instance names
+func TestDNSSdLongName(t *testing.T) {
+	fnet := newDnssdFakeNet()
+	name := strings.Repeat("x", 70)
+
+	publisher := dnssdTestPublisher(t, fnet, name)
+
+	fnet.names[publisher.instance(0)] = &dnssdFakeBackend{}
+
+	publisher.Publish()
+	instance := fnet.wait(t)
+	publisher.Unpublish()
+
+	if len(instance) != 63 || !strings.HasSuffix(instance, " (USB 1)") {
+		t.Errorf("instance name: %q", instance)
+	}
+}
+
+// TestDNSSdBackoff tests retry backoff and status of the publisher
+func TestDNSSdBackoff(t *testing.T) {
+	publisher := NewDNSSdPublisher(NewLogger(), &DevState{}, nil)
+	publisher.retry = 10 * time.Millisecond
+	publisher.retryMax = 40 * time.Millisecond
+
+	if s := publisher.Status(); s != "publishing" {
+		t.Errorf("initial status: %q", s)
+	}
+
+	expected := []time.Duration{10, 20, 40, 40}
+	for i, exp := range expected {
+		exp *= time.Millisecond
+		if retry := publisher.setStatus(false); retry != exp {
+			t.Errorf("failure %d: retry in %s, expected %s",
+				i+1, retry, exp)
+		}
+	}
+
+	if s := publisher.Status(); s != "pending, 4 attempts failed" {
+		t.Errorf("status after failures: %q", s)
+	}
+
+	publisher.setStatus(true)
+	if s := publisher.Status(); s != "published" {
+		t.Errorf("status after success: %q", s)
+	}
+
+	// Backoff restarts after success
+	if retry := publisher.setStatus(false); retry != publisher.retry {
+		t.Errorf("failure after success: retry in %s, expected %s",
+			retry, publisher.retry)
+	}
+}
+
+// TestDNSSdServicesAddSecure tests DNSSdServices.AddSecure
+func TestDNSSdServicesAddSecure(t *testing.T) {
+	var txt DNSSdTxtRecord
+	txt.Add("txtvers", "1")
+
+	services := DNSSdServices{
+		{Type: "_ipp._tcp", Port: 60000, Txt: txt,
+			SubTypes: []string{"_universal._sub._ipp._tcp"}},
+		{Type: "_uscan._tcp", Port: 60000},
+		{Type: "_printer._tcp"},
+	}
+
+	services.AddSecure(60001, true)
+
+	if len(services) != 5 {
+		t.Fatalf("%d services, expected 5", len(services))
+	}
+
+	ipps, uscans := services[3], services[4]
+
+	switch {
+	case ipps.Type != "_ipps._tcp" || ipps.Port != 60001:
+		t.Errorf("ipps: %s at %d", ipps.Type, ipps.Port)
+	case len(ipps.SubTypes) != 1 ||
+		ipps.SubTypes[0] != "_universal._sub._ipps._tcp":
+		t.Errorf("ipps subtypes: %v", ipps.SubTypes)
+	case uscans.Type != "_uscans._tcp" || uscans.Port != 60001:
+		t.Errorf("uscans: %s at %d", uscans.Type, uscans.Port)
+	}
+
+	// Only secure services of the shared device go to the network
+	if !ipps.Network || !uscans.Network || services[0].Network {
+		t.Errorf("network: ipp=%v ipps=%v uscans=%v",
+			services[0].Network, ipps.Network, uscans.Network)
+	}
+
+	// TXT records must not be shared
+	ipps.Txt.Add("TLS", "1.2")
+	if len(services[0].Txt) != 1 {
+		t.Errorf("ipp TXT modified via ipps: %v", services[0].Txt)
+	}
+}
@@ -25,6 +25,14 @@ var (
 	ErrNoIppUsb     = errors.New("ipp-usb daemon not running")
 	ErrAccess       = errors.New("Access denied")
 	ErrPartialInit  = errors.New("Some parts of device not ready yet")
+	ErrUsbTimeout   = errors.New("Device doesn't respond (USB I/O timeout)")
+	ErrUsbStalled   = errors.New("Device stalled, reset requested")
+	ErrUsbWatchdog  = errors.New("USB transaction stuck, aborted by watchdog")
+	ErrUsbNoDevice  = errors.New("Device disconnected")
+	ErrHTTPLimit    = errors.New("Too many concurrent requests to device")
+	ErrUsbBusy      = errors.New("All USB connections are busy, retry later")
+	ErrUpgradeBusy  = errors.New("No USB connection available for protocol upgrade")
+	ErrHTTPDeadline = errors.New("Device hasn't completed the response in time")
 )
 
 // ErrIsEOF tells if error is io.EOF, possibly wrapped by
@@ -10,6 +10,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -40,8 +41,17 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	var xmlData []byte
 	var list []string
 
+	// Allocate HTTP session in advance, so ScannerCapabilities
+	// are tagged with it in the log
+	session := HTTPClientNewSession(c)
+	log.Session(session)
+	defer log.Session(-1)
+
+	rq, _ := http.NewRequest("GET", uri, nil)
+	rq = rq.WithContext(WithHTTPSession(context.Background(), session))
+
 	// Query ScannerCapabilities
-	resp, err := c.Get(uri)
+	resp, err := c.Do(rq)
 	if err != nil {
 		goto ERROR
 	}
@@ -180,10 +190,14 @@ func (decoder *esclCapsDecoder) decode(in io.Reader) error {
 
 	for {
 		token, err := xmlDecoder.RawToken()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
 
+		if err != nil {
+			return err
+		}
+
 		switch t := token.(type) {
 		case xml.StartElement:
 			lenStack = append(lenStack, path.Len())
@@ -194,7 +208,14 @@ func (decoder *esclCapsDecoder) decode(in io.Reader) error {
 			decoder.element(path.String())
 
 		case xml.EndElement:
+			// RawToken doesn't check that elements are
+			// properly nested, so it's up to us
 			last := len(lenStack) - 1
+			if last < 0 {
+				return fmt.Errorf("XML: unexpected </%s>",
+					t.Name.Local)
+			}
+
 			path.Truncate(lenStack[last])
 			lenStack = lenStack[:last]
 
@@ -206,6 +227,11 @@ func (decoder *esclCapsDecoder) decode(in io.Reader) error {
 		}
 	}
 
+	// Truncated input ends with elements still open
+	if len(lenStack) != 0 {
+		return errors.New("XML: unexpected EOF")
+	}
+
 	return nil
 }
 
@@ -0,0 +1,41 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * eSCL ScannerCapabilities decoder tests
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEsclCapsDecode tests that malformed ScannerCapabilities
+// are rejected
+func TestEsclCapsDecode(t *testing.T) {
+	tests := []struct {
+		data string
+		err  bool
+	}{
+		{string(UsbEmuEsclCaps), false},
+		{string(UsbEmuEsclCaps[:len(UsbEmuEsclCaps)/2]), true},
+		{`<scan:ScannerCapabilities></scan:ScannerCapabilities>`, false},
+		{`<scan:ScannerCapabilities>`, true},
+		{`</scan:ScannerCapabilities>`, true},
+		{`<scan:ScannerCapabilities><`, true},
+	}
+
+	for _, test := range tests {
+		decoder := newEsclCapsDecoder(&IppPrinterInfo{})
+		err := decoder.decode(bytes.NewReader([]byte(test.data)))
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%.40q...: error expected", test.data)
+		case !test.err && err != nil:
+			t.Errorf("%.40q...: %s", test.data, err)
+		}
+	}
+}
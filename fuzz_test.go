@@ -0,0 +1,208 @@
+//go:build go1.18
+// +build go1.18
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Fuzzing targets for parsing of data, received from device
+ *
+ * Run them as:
+ *   go test -run XXX -fuzz FuzzUsbHTTPResponse -fuzztime 1m
+ *
+ * or use "make fuzz" to run all of them
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// fuzzInit prepares environment for fuzz tests: logs are
+// redirected to the temporary directory, which is returned,
+// and console is muted
+func fuzzInit(f *testing.F) string {
+	dir := testConf(f)
+
+	saveLevels := Console.levels
+	Console.SetLevels(0)
+	f.Cleanup(func() { Console.SetLevels(saveLevels) })
+
+	return dir
+}
+
+// fuzzCaptureResponses returns device responses from USB
+// captures in testdata/captures, for use as corpus seeds
+func fuzzCaptureResponses(f *testing.F) [][]byte {
+	files, _ := filepath.Glob("testdata/captures/*.usbcap")
+	responses := [][]byte{}
+
+	for _, file := range files {
+		capture, err := UsbCaptureLoad(file)
+		if err != nil {
+			f.Fatalf("%s", err)
+		}
+
+		for _, exchange := range NewUsbReplay(capture).exchanges {
+			rsp := []byte{}
+			for _, evnt := range exchange.evnts {
+				rsp = append(rsp, evnt.Data...)
+			}
+			responses = append(responses, rsp)
+		}
+	}
+
+	return responses
+}
+
+// fuzzHTTPBody returns body of the HTTP response, or nil
+func fuzzHTTPBody(rsp []byte) []byte {
+	if i := bytes.Index(rsp, []byte("\r\n\r\n")); i >= 0 {
+		return rsp[i+4:]
+	}
+	return nil
+}
+
+// FuzzUsbHTTPResponse feeds arbitrary data as device's response
+// to the UsbTransport
+func FuzzUsbHTTPResponse(f *testing.F) {
+	fuzzInit(f)
+
+	for _, rsp := range fuzzCaptureResponses(f) {
+		f.Add(rsp, false)
+		f.Add(rsp, true)
+	}
+
+	f.Add([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n0\r\n\r\n"), false)
+	f.Add([]byte("HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n"), false)
+	f.Add([]byte("HTTP/1.0 404 Not found\r\n\r\n"), false)
+
+	f.Fuzz(func(t *testing.T, rsp []byte, sanitize bool) {
+		capture := &UsbCapture{
+			Info: UsbDeviceInfo{
+				Manufacturer: "Fuzz",
+				ProductName:  "Fuzz",
+				SerialNumber: "FUZZ",
+			},
+			Interfaces: 1,
+			Events: []UsbCaptureEvent{
+				{IfNum: 0, Dir: '>'},
+				{IfNum: 0, Dir: '<', Data: rsp},
+			},
+		}
+
+		replay := NewUsbReplay(capture)
+		replay.Hangup = true
+		transport, err := NewUsbTransportDev(replay.Desc(), replay)
+		if err != nil {
+			t.Fatalf("NewUsbTransportDev: %s", err)
+		}
+
+		defer transport.Close(false)
+
+		if sanitize {
+			transport.quirks.put(&Quirk{
+				Name:   QuirkNmBuggyIppResponses,
+				Parsed: QuirkBuggyIppRspSanitize,
+			})
+		}
+
+		transport.SetTimeout(10 * time.Millisecond)
+
+		client := &http.Client{Transport: transport}
+		resp, err := client.Post("http://localhost/ipp/print",
+			goipp.ContentType, bytes.NewReader(nil))
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
+
+// FuzzIppAttrs feeds arbitrary data as IPP Get-Printer-Attributes
+// response to the IPP attributes decoder, used for DNS-SD
+func FuzzIppAttrs(f *testing.F) {
+	for _, rsp := range fuzzCaptureResponses(f) {
+		if body := fuzzHTTPBody(rsp); len(body) > 0 && body[0] == 2 {
+			f.Add(body)
+		}
+	}
+
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	msg.Printer = usbEmuPrinterAttrs()
+	data, _ := msg.EncodeBytes()
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg goipp.Message
+		opts := goipp.DecoderOptions{EnableWorkarounds: true}
+		if msg.DecodeBytesEx(data, opts) != nil {
+			return
+		}
+
+		attrs := newIppAttrs(msg.Printer)
+		attrs.decode(UsbDeviceInfo{})
+	})
+}
+
+// FuzzEsclCaps feeds arbitrary data as eSCL ScannerCapabilities
+// to the eSCL capabilities decoder
+func FuzzEsclCaps(f *testing.F) {
+	for _, rsp := range fuzzCaptureResponses(f) {
+		if body := fuzzHTTPBody(rsp); bytes.HasPrefix(body, []byte("<?xml")) {
+			f.Add(body)
+		}
+	}
+
+	f.Add(UsbEmuEsclCaps)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := newEsclCapsDecoder(&IppPrinterInfo{})
+		decoder.decode(bytes.NewReader(data))
+	})
+}
+
+// FuzzQuirksFile feeds arbitrary data as quirks file
+func FuzzQuirksFile(f *testing.F) {
+	dir := fuzzInit(f)
+
+	files, _ := filepath.Glob("testdata/quirks/*.conf")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatalf("%s", err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file := filepath.Join(dir, "quirks.conf")
+		err := ioutil.WriteFile(file, data, 0600)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		defer os.Remove(file)
+
+		var qdb QuirksDb
+		if qdb.readFile(file) != nil {
+			return
+		}
+
+		quirks := NewQuirks()
+		quirks.PullByHWID(qdb, 0x03f0, 0x0001, 0x0100)
+		quirks.PullByModelName(qdb, "HP LaserJet")
+		quirks.WriteLog("fuzz", NewLogger())
+	})
+}
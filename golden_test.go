@@ -0,0 +1,117 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Golden-log regression tests
+ *
+ * Each USB capture in testdata/captures is replayed with deterministic
+ * logging and the resulting device log is compared against the golden
+ * file in testdata/golden. When proxy behavior is changed intentionally,
+ * regenerate golden files with:
+ *
+ *   go test -run TestGoldenLogs -update-golden
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// goldenUpdate requests to regenerate golden files
+var goldenUpdate = flag.Bool("update-golden", false,
+	"update golden logs in testdata/golden")
+
+// goldenReplayLog replays USB capture and returns the resulting
+// device log
+func goldenReplayLog(t *testing.T, path string) []byte {
+	dir := testConf(t)
+
+	capture, err := UsbCaptureLoad(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	replay := NewUsbReplay(capture)
+	transport, err := NewUsbTransportDev(replay.Desc(), replay)
+	if err != nil {
+		t.Fatalf("NewUsbTransportDev: %s", err)
+	}
+
+	usbCaptureTestServices(t, transport)
+	transport.Close(false)
+
+	ident := transport.UsbDeviceInfo().Ident()
+	data, err := ioutil.ReadFile(filepath.Join(dir, ident+".log"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return data
+}
+
+// TestGoldenLogs compares logs of replayed captures against
+// the golden files
+func TestGoldenLogs(t *testing.T) {
+	testConf(t)
+	Conf.LogDeterministic = true
+	Conf.LogDevice = LogAll
+	Conf.UsbCapture = false
+
+	files, _ := filepath.Glob("testdata/captures/*.usbcap")
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".usbcap")
+		golden := filepath.Join("testdata", "golden", name+".log")
+
+		data := goldenReplayLog(t, file)
+
+		if *goldenUpdate {
+			MakeParentDirectory(golden)
+			err := ioutil.WriteFile(golden, data, 0644)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			continue
+		}
+
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s (use -update-golden to create)", err)
+			continue
+		}
+
+		if !bytes.Equal(data, expected) {
+			goldenDiff(t, golden, expected, data)
+		}
+	}
+}
+
+// goldenDiff reports the first difference between golden and
+// actual logs
+func goldenDiff(t *testing.T, golden string, expected, present []byte) {
+	lines1 := strings.Split(string(expected), "\n")
+	lines2 := strings.Split(string(present), "\n")
+
+	for i := 0; i < len(lines1) || i < len(lines2); i++ {
+		var l1, l2 string
+		if i < len(lines1) {
+			l1 = lines1[i]
+		}
+		if i < len(lines2) {
+			l2 = lines2[i]
+		}
+
+		if l1 != l2 {
+			t.Errorf("%s:%d: log mismatch:\n"+
+				"expected: %q\n"+
+				"present:  %q", golden, i+1, l1, l2)
+			return
+		}
+	}
+}
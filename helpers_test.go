@@ -0,0 +1,55 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Common test helpers
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testConf saves the global configuration (Conf and paths) and
+// restores it when test completes, so test may freely modify it.
+//
+// Logs, device state and certificates are redirected into the
+// test's temporary directory, which is returned, so test never
+// writes into the system directories
+func testConf(t testing.TB) string {
+	saveConf := Conf
+	saveLogDir, saveDevStateDir, saveCertDir :=
+		PathLogDir, PathDevStateDir, PathCertDir
+	saveConfDirList := PathConfDirList
+
+	t.Cleanup(func() {
+		Conf = saveConf
+		PathLogDir, PathDevStateDir, PathCertDir =
+			saveLogDir, saveDevStateDir, saveCertDir
+		PathConfDirList = saveConfDirList
+	})
+
+	dir := t.TempDir()
+	PathLogDir = dir
+	PathDevStateDir = dir
+	PathCertDir = filepath.Join(dir, "cert")
+
+	return dir
+}
+
+// testConfLoad writes text into the configuration file in the
+// test's temporary directory and loads it. Use testConf first,
+// so loaded configuration doesn't leak into other tests
+func testConfLoad(t *testing.T, text string) error {
+	path := filepath.Join(t.TempDir(), "ipp-usb.conf")
+	err := ioutil.WriteFile(path, []byte(text), 0644)
+	if err == nil {
+		err = confLoadInternal(path)
+	}
+
+	return err
+}
@@ -9,16 +9,23 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
-	"sync/atomic"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 var (
@@ -29,11 +36,13 @@ var (
 // specified http.RoundTripper. It implements http.Handler
 // interface
 type HTTPProxy struct {
-	log       *Logger       // Logger instance
-	server    *http.Server  // HTTP server
-	enable    bool          // Proxy can handle incoming requests
-	transport *UsbTransport // Transport for outgoing requests
-	closeWait chan struct{} // Closed at server close
+	log       *Logger         // Logger instance
+	server    *http.Server    // HTTP server
+	enable    bool            // Proxy can handle incoming requests
+	share     bool            // Serves network clients of shared device
+	transport *UsbTransport   // Transport for outgoing requests
+	printer   *LogicalPrinter // Logical printer, nil for device
+	closeWait chan struct{}   // Closed at server close
 }
 
 // NewHTTPProxy creates new HTTP proxy
@@ -51,8 +60,13 @@ func NewHTTPProxy(logger *Logger,
 		ErrorLog: log.New(logger.LineWriter(LogError, '!'), "", 0),
 	}
 
+	leakGoroutine := transport.leaks.Track(LeakGoroutine, "HTTP server")
+	leakListener := transport.leaks.Track(LeakFd, "HTTP listener")
+
 	go func() {
 		proxy.server.Serve(listener)
+		leakListener.Release()
+		leakGoroutine.Release()
 		close(proxy.closeWait)
 	}()
 
@@ -71,17 +85,26 @@ func (proxy *HTTPProxy) Enable() {
 	proxy.enable = true
 }
 
+// Share indicates that proxy serves network clients of the shared
+// device, so they must authenticate with password
+func (proxy *HTTPProxy) Share() {
+	proxy.share = true
+}
+
 // Handle HTTP request
 func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Catch panics to log
 	defer func() {
 		v := recover()
-		if v != nil {
+		if v == http.ErrAbortHandler {
+			panic(v)
+		} else if v != nil {
 			Log.Panic(v)
 		}
 	}()
 
-	session := int(atomic.AddInt32(&httpSessionID, 1)-1) % 1000
+	session := proxy.transport.NewSession()
+	start := time.Now()
 
 	// Perform sanity checking
 	if !proxy.enable {
@@ -90,13 +113,48 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Obtain request's client address and check it against ACL.
+	// It is done before the concurrent requests limit is applied,
+	// so rejected clients don't occupy the limit
+	clientAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		proxy.httpError(session, w, r, http.StatusInternalServerError,
+			errors.New("Unable to get client address for request"))
+		return
+	}
+
+	if !proxy.transport.acl.Allow(clientAddr.IP) {
+		proxy.httpError(session, w, r, http.StatusForbidden,
+			fmt.Errorf("Access denied for %s", clientAddr.IP))
+		return
+	}
+
+	// Apply per-request deadline, if configured
+	ctx := r.Context()
+	if Conf.HTTPRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, Conf.HTTPRequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Limit concurrent requests
+	err = proxy.transport.httpLimit.acquire(ctx)
+	if err != nil {
+		proxy.httpError(session, w, r, httpErrorStatus(err), err)
+		return
+	}
+
+	defer proxy.transport.httpLimit.release()
+
 	if r.Method == "CONNECT" {
 		proxy.httpError(session, w, r, http.StatusMethodNotAllowed,
 			errors.New("CONNECT not allowed"))
 		return
 	}
 
-	if r.Header.Get("Upgrade") != "" {
+	upgrade := httpIsWebSocket(r)
+	if !upgrade && r.Header.Get("Upgrade") != "" {
 		proxy.httpError(session, w, r, http.StatusServiceUnavailable,
 			errors.New("Protocol upgrade is not implemented"))
 		return
@@ -108,15 +166,8 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Obtain request's client and server addresses
-	var clientAddr, serverAddr *net.TCPAddr
-
-	clientAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
-	if err != nil {
-		proxy.httpError(session, w, r, http.StatusInternalServerError,
-			errors.New("Unable to get client address for request"))
-		return
-	}
+	// Obtain request's server address
+	var serverAddr *net.TCPAddr
 
 	if v := r.Context().Value(http.LocalAddrContextKey); v != nil {
 		if v != nil {
@@ -132,7 +183,11 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Authenticate
 	if status, err := AuthHTTPRequest(proxy.log,
-		clientAddr, serverAddr, r); err != nil {
+		clientAddr, serverAddr, r, proxy.share); err != nil {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate",
+				`Basic realm="ipp-usb", charset="UTF-8"`)
+		}
 		proxy.httpError(session, w, r, status, err)
 		return
 	}
@@ -144,13 +199,19 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if serverAddr.IP.IsLoopback() {
 			r.Host = fmt.Sprintf("localhost:%d", serverAddr.Port)
 		} else {
-			r.Host = serverAddr.String()
+			r.Host = httpHost(serverAddr)
 		}
 	}
 
 	r.URL.Scheme = "http"
 	r.URL.Host = r.Host
 
+	// WebSocket is relayed over the dedicated USB connection
+	if upgrade {
+		proxy.serveUpgrade(session, w, r)
+		return
+	}
+
 	// If request is ordered to the loopback address, and r.Host is not
 	// "localhost" or "localhost:port", redirect request to the localhost
 	//
@@ -177,25 +238,85 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Logical printer needs to know IPP operation, to rewrite
+	// Get-Printer-Attributes responses
+	var op goipp.Op
+	if proxy.printer != nil {
+		op = httpPeekIppOp(r)
+	}
+
 	// Send request and obtain response status and header
-	resp, err := proxy.transport.RoundTripWithSession(session, r)
+	resp, err := httpDeadlineRoundTrip(ctx, func() (*http.Response, error) {
+		return proxy.transport.httpCache.roundTrip(session, r,
+			proxy.transport)
+	})
+
 	if err != nil {
-		proxy.httpError(session, w, r, http.StatusServiceUnavailable, err)
+		proxy.deadlineExpired(session, err, start, "response header")
+		proxy.httpError(session, w, r, httpErrorStatus(err), err)
+		return
+	}
+
+	if op == goipp.OpGetPrinterAttributes &&
+		resp.StatusCode == http.StatusOK {
+		proxy.printer.rewriteResponse(proxy.log, session, resp)
+	}
+
+	// Point device's absolute URLs to the proxy
+	if proxy.transport.Quirks().GetURLRewrite() {
+		rw := httpURLRewriter{scheme: "http", host: r.Host}
+		if r.TLS != nil {
+			rw.scheme = "https"
+		}
+		rw.rewriteResponse(resp)
+	}
+
+	// Deadline may expire while response is being rewritten
+	if ctx.Err() == context.DeadlineExceeded {
+		resp.Body.Close()
+		proxy.deadlineExpired(session, ErrHTTPDeadline, start,
+			"response rewriting")
+		proxy.httpError(session, w, r, http.StatusGatewayTimeout,
+			ErrHTTPDeadline)
 		return
 	}
 
 	httpRemoveHopByHopHeaders(resp.Header)
 	httpCopyHeaders(w.Header(), resp.Header)
+
+	// Compress textual responses, if enabled
+	var out io.Writer = w
+	var gz *gzip.Writer
+
+	if Conf.HTTPCompress && httpCompressible(r, resp) {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+
 	w.WriteHeader(resp.StatusCode)
 
 	// Obtain response body, if any
-	_, err = io.Copy(w, resp.Body)
+	_, err = io.Copy(out, resp.Body)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
 
 	if err != nil {
 		proxy.log.HTTPError('!', session, "%s", err)
 	}
 
 	resp.Body.Close()
+
+	// Headers are already sent, so the only way to tell client
+	// that response is incomplete is to drop the connection
+	if err == ErrHTTPDeadline {
+		proxy.deadlineExpired(session, err, start, "response body")
+		panic(http.ErrAbortHandler)
+	}
 }
 
 // Reject request with a error
@@ -209,6 +330,12 @@ func (proxy *HTTPProxy) httpError(session int, w http.ResponseWriter, r *http.Re
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	httpNoCache(w)
+
+	// Ask client to back off, if device is busy
+	if err == ErrUsbBusy || err == ErrHTTPLimit {
+		w.Header().Set("Retry-After",
+			strconv.Itoa(int(HTTPRetryAfter/time.Second)))
+	}
 	w.WriteHeader(status)
 
 	w.Write([]byte(err.Error()))
@@ -236,6 +363,59 @@ func (proxy *HTTPProxy) httpRedirect(session int, w http.ResponseWriter, r *http
 	proxy.log.HTTPDebug(' ', session, "redirected to %s", location)
 }
 
+// httpErrorStatus returns HTTP status for the failed request
+func httpErrorStatus(err error) int {
+	switch err {
+	case ErrUsbTimeout, ErrUsbWatchdog, ErrHTTPDeadline,
+		context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case ErrUsbNoDevice:
+		return http.StatusBadGateway
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+// httpHost formats TCP address for use in the HTTP Host header
+// and URLs. IPv6 literals are enclosed in brackets and zone, if
+// any, is percent-encoded, as required by RFC 6874
+func httpHost(addr *net.TCPAddr) string {
+	host := addr.IP.String()
+	if addr.IP.To4() == nil {
+		if addr.Zone != "" {
+			host += "%25" + addr.Zone
+		}
+		host = "[" + host + "]"
+	}
+
+	return host + ":" + strconv.Itoa(addr.Port)
+}
+
+// httpPeekIppOp returns IPP operation code of the request, or 0,
+// if request is not IPP. Request body remains unchanged
+func httpPeekIppOp(r *http.Request) goipp.Op {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != "POST" || ct != goipp.ContentType {
+		return 0
+	}
+
+	// IPP message starts with version-number (2 bytes),
+	// operation-id (2 bytes) and request-id (4 bytes)
+	var hdr [8]byte
+	n, err := io.ReadFull(r.Body, hdr[:])
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(hdr[:n]), r.Body), r.Body}
+
+	if err != nil {
+		return 0
+	}
+
+	return goipp.Op(binary.BigEndian.Uint16(hdr[2:4]))
+}
+
 // Set response headers to disable cacheing
 func httpNoCache(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
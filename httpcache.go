@@ -0,0 +1,217 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-device cache of printer and scanner capabilities
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// httpCache caches responses to the Get-Printer-Attributes
+// requests and eSCL ScannerCapabilities for a short time.
+//
+// CUPS and scanning tools poll them constantly, and on devices
+// with a single IPP-over-USB interface each poll occupies the
+// only USB connection. Any request that may change device state
+// (i.e., print or scan job submission) invalidates the cache.
+//
+// nil *httpCache means no caching
+type httpCache struct {
+	ttl     time.Duration              // Time to live of entries
+	lock    sync.Mutex                 // Access lock
+	entries map[string]*httpCacheEntry // Entries, by key
+}
+
+// httpCacheEntry represents a cached response
+type httpCacheEntry struct {
+	status  string      // Response status
+	code    int         // Response status code
+	header  http.Header // Response header
+	body    []byte      // Response body
+	expires time.Time   // Expiration time
+}
+
+// newHTTPCache creates a new httpCache. If ttl is 0, there is
+// no caching and nil is returned
+func newHTTPCache(ttl time.Duration) *httpCache {
+	if ttl == 0 {
+		return nil
+	}
+
+	return &httpCache{
+		ttl:     ttl,
+		entries: make(map[string]*httpCacheEntry),
+	}
+}
+
+// roundTrip executes HTTP request via transport, serving it from
+// the cache, if possible
+func (c *httpCache) roundTrip(session int, rq *http.Request,
+	transport *UsbTransport) (*http.Response, error) {
+
+	if c == nil {
+		return transport.RoundTripWithSession(session, rq)
+	}
+
+	key, reqid := httpCacheKey(rq)
+
+	switch {
+	case key != "":
+		if rsp := c.get(key, rq, reqid); rsp != nil {
+			transport.log.Begin().
+				HTTPRqParams(LogDebug, '>', session, rq).
+				HTTPRspStatus(LogDebug, '<', session, rq, rsp).
+				HTTPDebug(' ', session, "served from cache").
+				Commit()
+			return rsp, nil
+		}
+
+	case rq.Method != "GET" && rq.Method != "HEAD":
+		c.invalidate()
+	}
+
+	rsp, err := transport.RoundTripWithSession(session, rq)
+	if key == "" || err != nil || rsp.StatusCode != http.StatusOK {
+		return rsp, err
+	}
+
+	// Read and save response body
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body,
+		HTTPCacheMaxBody+1))
+
+	rsp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rsp.Body), rsp.Body}
+
+	if err == nil && len(body) <= HTTPCacheMaxBody {
+		c.put(key, rsp, body)
+	}
+
+	return rsp, nil
+}
+
+// get returns the cached response to the request, or nil.
+// IPP response gets request-id of the request, if reqid is not nil
+func (c *httpCache) get(key string, rq *http.Request,
+	reqid []byte) *http.Response {
+
+	c.lock.Lock()
+	entry := c.entries[key]
+	c.lock.Unlock()
+
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil
+	}
+
+	body := append([]byte(nil), entry.body...)
+
+	// IPP response must have the same request-id, as request
+	if reqid != nil && len(body) >= 8 {
+		copy(body[4:8], reqid)
+	}
+
+	header := make(http.Header, len(entry.header))
+	for name, values := range entry.header {
+		header[name] = append([]string(nil), values...)
+	}
+
+	return &http.Response{
+		Status:        entry.status,
+		StatusCode:    entry.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       rq,
+	}
+}
+
+// put saves response into the cache
+func (c *httpCache) put(key string, rsp *http.Response, body []byte) {
+	entry := &httpCacheEntry{
+		status:  rsp.Status,
+		code:    rsp.StatusCode,
+		header:  make(http.Header, len(rsp.Header)),
+		body:    body,
+		expires: time.Now().Add(c.ttl),
+	}
+
+	for name, values := range rsp.Header {
+		entry.header[name] = append([]string(nil), values...)
+	}
+
+	c.lock.Lock()
+	c.entries[key] = entry
+	c.lock.Unlock()
+}
+
+// invalidate drops all cached entries. It is called, when
+// device state may change (i.e., on non-GET/HEAD request or
+// device reset)
+func (c *httpCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	c.entries = make(map[string]*httpCacheEntry)
+	c.lock.Unlock()
+}
+
+// httpCacheKey returns cache key for the request, or "", if
+// request is not cacheable. For IPP requests, request-id is
+// returned as well.
+//
+// Request body of cacheable IPP request is read and replaced
+// with its in-memory copy
+func httpCacheKey(rq *http.Request) (key string, reqid []byte) {
+	switch rq.Method {
+	case "GET":
+		if strings.HasSuffix(rq.URL.Path, "/ScannerCapabilities") {
+			return "GET " + rq.URL.RequestURI(), nil
+		}
+
+	case "POST":
+		if httpPeekIppOp(rq) != goipp.OpGetPrinterAttributes {
+			return "", nil
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(rq.Body,
+			HTTPCacheMaxBody+1))
+
+		rq.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rq.Body), rq.Body}
+
+		if err != nil || len(body) > HTTPCacheMaxBody {
+			return "", nil
+		}
+
+		// Requests, that differ only by request-id, are the same
+		reqid = append([]byte(nil), body[4:8]...)
+		data := append([]byte(nil), body...)
+		binary.BigEndian.PutUint32(data[4:8], 0)
+
+		return "POST " + rq.URL.RequestURI() + " " + string(data), reqid
+	}
+
+	return "", nil
+}
@@ -0,0 +1,129 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for the capabilities cache
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestHTTPCache tests httpCache
+func TestHTTPCache(t *testing.T) {
+	// Device answers all IPP requests with successful-ok
+	var hits int32
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+
+			atomic.AddInt32(&hits, 1)
+
+			if rq.Method == "GET" {
+				w.Header().Set("Content-Type", "text/xml")
+				w.Write([]byte("<caps/>"))
+				return
+			}
+
+			msg := goipp.Message{}
+			if err := msg.Decode(rq.Body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			rsp := goipp.NewResponse(msg.Version,
+				goipp.StatusOk, msg.RequestID)
+			data, _ := rsp.EncodeBytes()
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			w.Write(data)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	cache := newHTTPCache(time.Hour)
+
+	// ipp sends IPP request and returns request-id of response
+	ipp := func(op goipp.Op, id uint32) uint32 {
+		data, _ := goipp.NewRequest(goipp.DefaultVersion,
+			op, id).EncodeBytes()
+		rq, _ := http.NewRequest("POST", "http://localhost/ipp/print",
+			bytes.NewReader(data))
+		rq.Header.Set("Content-Type", goipp.ContentType)
+
+		rsp, err := cache.roundTrip(0, rq, transport)
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+
+		msg := goipp.Message{}
+		err = msg.Decode(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+
+		return msg.RequestID
+	}
+
+	// Get-Printer-Attributes served from cache, with proper request-id
+	for id := uint32(1); id <= 3; id++ {
+		if rid := ipp(goipp.OpGetPrinterAttributes, id); rid != id {
+			t.Errorf("request-id: expected %d, present %d", id, rid)
+		}
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("Get-Printer-Attributes: %d device requests", n)
+	}
+
+	// ScannerCapabilities served from cache
+	for i := 0; i < 3; i++ {
+		rq, _ := http.NewRequest("GET",
+			"http://localhost/eSCL/ScannerCapabilities", nil)
+		rsp, err := cache.roundTrip(0, rq, transport)
+		if err != nil {
+			t.Fatalf("ScannerCapabilities: %s", err)
+		}
+
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != "<caps/>" {
+			t.Errorf("ScannerCapabilities: %q", body)
+		}
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("ScannerCapabilities: %d device requests", n-1)
+	}
+
+	// Job submission invalidates the cache
+	ipp(goipp.OpPrintJob, 10)
+	ipp(goipp.OpGetPrinterAttributes, 11)
+
+	if n := atomic.LoadInt32(&hits); n != 4 {
+		t.Errorf("after Print-Job: %d device requests, expected 4", n)
+	}
+
+	// Device reset invalidates the cache
+	transport.httpCache = cache
+	ipp(goipp.OpGetPrinterAttributes, 12)
+	transport.softReset()
+	ipp(goipp.OpGetPrinterAttributes, 13)
+
+	if n := atomic.LoadInt32(&hits); n != 5 {
+		t.Errorf("after reset: %d device requests, expected 5", n)
+	}
+}
@@ -0,0 +1,166 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-request deadline
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// httpDeadlineRoundTrip executes HTTP transaction by calling
+// roundTrip, but gives up, if ctx deadline expires before
+// response header is received, returning ErrHTTPDeadline.
+//
+// USB transaction cannot be simply canceled: device doesn't know
+// about it and still will send the response. So it continues in
+// background, and its response, if any, is drained, so the USB
+// connection is recovered.
+//
+// Body of the returned response is limited by the same deadline.
+//
+// If ctx has no deadline, roundTrip is simply called
+func httpDeadlineRoundTrip(ctx context.Context,
+	roundTrip func() (*http.Response, error)) (*http.Response, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		return roundTrip()
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		resp, err := roundTrip()
+		done <- result{resp, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err == context.DeadlineExceeded {
+			res.err = ErrHTTPDeadline
+		}
+
+		if res.resp != nil {
+			res.resp.Body = &httpDeadlineBody{
+				ctx:  ctx,
+				body: res.resp.Body,
+			}
+		}
+
+		return res.resp, res.err
+
+	case <-ctx.Done():
+		go func() {
+			res := <-done
+			if res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrHTTPDeadline
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// httpDeadlineBody wraps http.Response.Body and limits reading
+// by the request deadline.
+//
+// When deadline expires, Read returns ErrHTTPDeadline, and
+// pending Read of the underlying body, if any, is completed in
+// background, before the body is closed
+type httpDeadlineBody struct {
+	ctx     context.Context       // Request context with deadline
+	body    io.ReadCloser         // Underlying body
+	buf     []byte                // Buffer for the underlying Read
+	pending chan httpDeadlineRead // Pending Read, nil if none
+}
+
+// httpDeadlineRead is the result of the underlying body Read
+type httpDeadlineRead struct {
+	n   int   // Count of bytes read
+	err error // Read error, if any
+}
+
+// Read from httpDeadlineBody
+func (body *httpDeadlineBody) Read(buf []byte) (int, error) {
+	// Underlying Read writes into the own buffer, because
+	// it may outlive this call
+	if body.pending == nil {
+		if len(body.buf) < len(buf) {
+			body.buf = make([]byte, len(buf))
+		}
+
+		pending := make(chan httpDeadlineRead, 1)
+		b := body.buf[:len(buf)]
+
+		go func() {
+			n, err := body.body.Read(b)
+			pending <- httpDeadlineRead{n, err}
+		}()
+
+		body.pending = pending
+	}
+
+	select {
+	case res := <-body.pending:
+		body.pending = nil
+		n := copy(buf, body.buf[:res.n])
+		return n, res.err
+
+	case <-body.ctx.Done():
+		if body.ctx.Err() == context.DeadlineExceeded {
+			return 0, ErrHTTPDeadline
+		}
+		return 0, body.ctx.Err()
+	}
+}
+
+// Close httpDeadlineBody
+func (body *httpDeadlineBody) Close() error {
+	if body.pending == nil {
+		return body.body.Close()
+	}
+
+	pending := body.pending
+	body.pending = nil
+
+	go func() {
+		<-pending
+		body.body.Close()
+	}()
+
+	return nil
+}
+
+// deadlineExpired logs expiration of the per-request deadline,
+// if err reports it. stage is what the request was waiting for
+func (proxy *HTTPProxy) deadlineExpired(session int, err error,
+	start time.Time, stage string) {
+
+	if err != ErrHTTPDeadline {
+		return
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if Conf.LogDeterministic {
+		elapsed = 0
+	}
+
+	proxy.log.HTTPError('!', session,
+		"deadline %s expired after %s, waiting for %s; "+
+			"USB connection is recovered in background",
+		Conf.HTTPRequestTimeout, elapsed, stage)
+}
@@ -0,0 +1,123 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for per-request deadline
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// httpDeadlineTestBody is the response body for httpDeadline tests.
+// Read blocks until data is sent to the channel
+type httpDeadlineTestBody struct {
+	data   chan []byte   // Data to be read
+	closed chan struct{} // Closed by Close
+}
+
+// Read from httpDeadlineTestBody
+func (body *httpDeadlineTestBody) Read(buf []byte) (int, error) {
+	data, ok := <-body.data
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(buf, data), nil
+}
+
+// Close httpDeadlineTestBody
+func (body *httpDeadlineTestBody) Close() error {
+	close(body.closed)
+	return nil
+}
+
+// TestHTTPDeadline tests httpDeadlineRoundTrip and httpDeadlineBody
+func TestHTTPDeadline(t *testing.T) {
+	newBody := func() *httpDeadlineTestBody {
+		return &httpDeadlineTestBody{
+			data:   make(chan []byte),
+			closed: make(chan struct{}),
+		}
+	}
+
+	// Without deadline, response is returned as is
+	body := newBody()
+	resp, err := httpDeadlineRoundTrip(context.Background(),
+		func() (*http.Response, error) {
+			return &http.Response{Body: body}, nil
+		})
+
+	if err != nil || resp.Body != body {
+		t.Errorf("no deadline: response body is wrapped, err %v", err)
+	}
+
+	// Deadline expires before response is received. Late
+	// response is closed in background
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+
+	body = newBody()
+	ready := make(chan struct{})
+
+	_, err = httpDeadlineRoundTrip(ctx, func() (*http.Response, error) {
+		<-ready
+		return &http.Response{Body: body}, nil
+	})
+
+	if err != ErrHTTPDeadline {
+		t.Errorf("header: expected %q, present %v", ErrHTTPDeadline, err)
+	}
+
+	close(ready)
+	<-body.closed
+
+	// Deadline expires while reading the body. Underlying
+	// body is closed, when pending Read is done
+	ctx, cancel = context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+
+	body = newBody()
+	resp, err = httpDeadlineRoundTrip(ctx, func() (*http.Response, error) {
+		return &http.Response{Body: body}, nil
+	})
+
+	if err != nil {
+		t.Fatalf("body: %s", err)
+	}
+
+	go func() {
+		body.data <- []byte("hello")
+	}()
+
+	data := make([]byte, 16)
+	n, err := resp.Body.Read(data)
+	if err != nil || string(data[:n]) != "hello" {
+		t.Errorf("body: %q %v", data[:n], err)
+	}
+
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != ErrHTTPDeadline {
+		t.Errorf("body: expected %q, present %v", ErrHTTPDeadline, err)
+	}
+
+	resp.Body.Close()
+
+	select {
+	case <-body.closed:
+		t.Errorf("body: closed while Read is pending")
+	default:
+	}
+
+	close(body.data)
+	<-body.closed
+}
@@ -0,0 +1,77 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * gzip compression of responses
+ */
+
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpCompressible tells if response may be gzip-compressed
+// toward the client.
+//
+// Only textual responses (web console pages, eSCL XML and so on)
+// are worth compression. IPP and document formats are binary and
+// mostly compressed already. Client must accept gzip encoding
+func httpCompressible(rq *http.Request, rsp *http.Response) bool {
+	switch {
+	case rq.Method == "HEAD":
+		return false
+	case rsp.StatusCode == http.StatusNoContent,
+		rsp.StatusCode == http.StatusNotModified:
+		return false
+	case rsp.Header.Get("Content-Encoding") != "":
+		return false
+	case rsp.ContentLength >= 0 && rsp.ContentLength < HTTPCompressMinSize:
+		return false
+	case !httpAcceptsGzip(rq.Header.Get("Accept-Encoding")):
+		return false
+	}
+
+	ct, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(ct, "text/"),
+		strings.HasSuffix(ct, "+xml"),
+		ct == "application/xml",
+		ct == "application/json",
+		ct == "application/javascript":
+		return true
+	}
+
+	return false
+}
+
+// httpAcceptsGzip tells if Accept-Encoding header allows gzip
+func httpAcceptsGzip(accept string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		// Coding may be explicitly rejected with q=0
+		rejected := false
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				rejected = err == nil && q == 0
+			}
+		}
+
+		if !rejected {
+			return true
+		}
+	}
+
+	return false
+}
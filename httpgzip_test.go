@@ -0,0 +1,61 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for gzip compression of responses
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestHTTPCompressible tests httpCompressible
+func TestHTTPCompressible(t *testing.T) {
+	tests := []struct {
+		method string
+		accept string
+		ct     string
+		enc    string
+		length int64
+		status int
+		result bool
+	}{
+		{"GET", "gzip, deflate", "text/html", "", -1, 200, true},
+		{"GET", "gzip;q=0.5", "text/xml", "", 4096, 200, true},
+		{"GET", "*", "application/json", "", -1, 200, true},
+		{"GET", "", "text/html", "", -1, 200, false},
+		{"GET", "deflate", "text/html", "", -1, 200, false},
+		{"GET", "gzip;q=0", "text/html", "", -1, 200, false},
+		{"GET", "gzip", "text/html", "", 100, 200, false},
+		{"GET", "gzip", "text/html", "br", -1, 200, false},
+		{"GET", "gzip", "image/png", "", -1, 200, false},
+		{"POST", "gzip", "application/ipp", "", -1, 200, false},
+		{"HEAD", "gzip", "text/html", "", -1, 200, false},
+		{"GET", "gzip", "text/html", "", -1, 304, false},
+	}
+
+	for _, test := range tests {
+		rq, _ := http.NewRequest(test.method, "http://localhost/", nil)
+		rq.Header.Set("Accept-Encoding", test.accept)
+
+		rsp := &http.Response{
+			StatusCode:    test.status,
+			Header:        http.Header{"Content-Type": {test.ct}},
+			ContentLength: test.length,
+		}
+
+		if test.enc != "" {
+			rsp.Header.Set("Content-Encoding", test.enc)
+		}
+
+		if r := httpCompressible(rq, rsp); r != test.result {
+			t.Errorf("%s %q %s %q %d %d: expected %v",
+				test.method, test.accept, test.ct, test.enc,
+				test.length, test.status, test.result)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP header rewrite rules
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// httpHeaderRewrite represents the parsed s/REGEX/REPLACEMENT/
+// header rewrite rule
+type httpHeaderRewrite struct {
+	re   *regexp.Regexp // Regular expression
+	repl string         // Replacement
+}
+
+// httpHeaderRewriteCache caches parsed rewrite rules, by value
+var httpHeaderRewriteCache sync.Map
+
+// httpParseHeaderRewrite parses the header rewrite rule, which
+// looks like s/REGEX/REPLACEMENT/, like in sed. Any punctuation
+// character may be used as delimiter instead of '/' (i.e.,
+// s|text/plain|text/html|).
+//
+// It returns nil rule without error, if value is not the rewrite
+// rule, so value must be used as is
+func httpParseHeaderRewrite(value string) (*httpHeaderRewrite, error) {
+	if len(value) < 2 || value[0] != 's' ||
+		!strings.ContainsRune("/|#!,:;@", rune(value[1])) {
+		return nil, nil
+	}
+
+	if rule, ok := httpHeaderRewriteCache.Load(value); ok {
+		return rule.(*httpHeaderRewrite), nil
+	}
+
+	parts := strings.Split(value[2:], value[1:2])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("%q: must be s/REGEX/REPLACEMENT/",
+			value)
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", value, err)
+	}
+
+	rule := &httpHeaderRewrite{re: re, repl: parts[1]}
+	httpHeaderRewriteCache.Store(value, rule)
+
+	return rule, nil
+}
+
+// httpApplyHeaderRules applies header rules, defined by the
+// http-XXX and http-response-XXX quirks, to the HTTP header:
+//   - empty value removes the header
+//   - s/REGEX/REPLACEMENT/ rewrites existing header, if any
+//   - other values replace the header
+func httpApplyHeaderRules(hdr http.Header, rules map[string]string) {
+	for name, value := range rules {
+		rule, err := httpParseHeaderRewrite(value)
+		switch {
+		case err != nil:
+			// Rules are validated on load, so it is unlikely
+		case rule != nil:
+			for i, v := range hdr[name] {
+				hdr[name][i] = rule.re.ReplaceAllString(v, rule.repl)
+			}
+		case value != "":
+			hdr.Set(name, value)
+		default:
+			hdr.Del(name)
+		}
+	}
+}
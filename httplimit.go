@@ -0,0 +1,81 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-device limit of concurrent HTTP requests
+ */
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// httpLimiter limits count of concurrently served HTTP requests
+// per device.
+//
+// Requests, waiting for USB connection, don't consume much, but
+// a misbehaving client, opening hundreds of sockets, still can
+// exhaust memory and file descriptors. So requests above the
+// limit wait in the bounded queue, and requests above the queue
+// bound are rejected.
+//
+// nil *httpLimiter means no limit
+type httpLimiter struct {
+	slots   chan struct{} // Semaphore of active requests
+	queue   int32         // Max count of waiting requests
+	waiting int32         // Atomic count of waiting requests
+}
+
+// newHTTPLimiter creates a new httpLimiter. If max is 0, there is
+// no limit and nil is returned
+func newHTTPLimiter(max, queue uint) *httpLimiter {
+	if max == 0 {
+		return nil
+	}
+
+	return &httpLimiter{
+		slots: make(chan struct{}, max),
+		queue: int32(queue),
+	}
+}
+
+// acquire acquires the request slot, waiting in queue, if needed.
+// It returns ErrHTTPLimit if queue is full, or ctx.Err(), if
+// context is canceled while waiting
+func (l *httpLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	// Fast path: slot is available
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	// Slow path: wait in queue
+	if atomic.AddInt32(&l.waiting, 1) > l.queue {
+		atomic.AddInt32(&l.waiting, -1)
+		return ErrHTTPLimit
+	}
+
+	defer atomic.AddInt32(&l.waiting, -1)
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release releases the request slot, acquired by acquire
+func (l *httpLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,73 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for per-device limit of concurrent HTTP requests
+ */
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHTTPLimiter tests httpLimiter
+func TestHTTPLimiter(t *testing.T) {
+	// nil limiter doesn't limit anything
+	var unlimited *httpLimiter
+	for i := 0; i < 100; i++ {
+		if err := unlimited.acquire(context.Background()); err != nil {
+			t.Fatalf("unlimited: %s", err)
+		}
+	}
+	unlimited.release()
+
+	if newHTTPLimiter(0, 10) != nil {
+		t.Errorf("newHTTPLimiter(0, 10): limiter created")
+	}
+
+	// 2 active, 1 waiting, others rejected
+	l := newHTTPLimiter(2, 1)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatalf("acquire %d: %s", i, err)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- l.acquire(ctx)
+	}()
+
+	for atomic.LoadInt32(&l.waiting) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := l.acquire(ctx); err != ErrHTTPLimit {
+		t.Errorf("queue full: expected %q, present %v", ErrHTTPLimit, err)
+	}
+
+	l.release()
+	if err := <-done; err != nil {
+		t.Errorf("queued: %s", err)
+	}
+
+	// Waiting is aborted by context
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("canceled: expected %q, present %v",
+			context.DeadlineExceeded, err)
+	}
+
+	if n := atomic.LoadInt32(&l.waiting); n != 0 {
+		t.Errorf("waiting counter leaked: %d", n)
+	}
+}
@@ -0,0 +1,128 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * WebSocket passthrough
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// serveUpgrade handles the WebSocket opening handshake. If device
+// accepts it, client connection is hijacked and relayed to the
+// dedicated USB connection in both directions, until either side
+// closes it
+func (proxy *HTTPProxy) serveUpgrade(session int,
+	w http.ResponseWriter, r *http.Request) {
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		proxy.httpError(session, w, r, http.StatusInternalServerError,
+			errors.New("Connection cannot be upgraded"))
+		return
+	}
+
+	if !proxy.transport.UpgradeAcquire() {
+		proxy.httpError(session, w, r, http.StatusServiceUnavailable,
+			ErrUpgradeBusy)
+		return
+	}
+
+	defer proxy.transport.UpgradeRelease()
+
+	// Restore hop-by-hop headers, needed for upgrade
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+
+	resp, err := proxy.transport.RoundTripWithSession(session, r)
+	if err != nil {
+		proxy.httpError(session, w, r, httpErrorStatus(err), err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	// Device has refused upgrade. Forward its response as is
+	stream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		httpRemoveHopByHopHeaders(resp.Header)
+		httpCopyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	// Take over client connection and forward 101 response
+	client, brw, err := hijacker.Hijack()
+	if err != nil {
+		proxy.log.HTTPError('!', session, "hijack: %s", err)
+		return
+	}
+
+	defer client.Close()
+
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	err = brw.Flush()
+	if err != nil {
+		proxy.log.HTTPError('!', session, "%s", err)
+		return
+	}
+
+	// Relay data in both directions. When either direction
+	// is done, both connections are closed, which terminates
+	// the opposite direction as well
+	var sent, recv int64
+	done := make(chan struct{}, 2)
+
+	leak := proxy.transport.leaks.Track(LeakGoroutine,
+		fmt.Sprintf("HTTP[%3.3d] upgrade relay", session))
+
+	go func() {
+		defer leak.Release()
+		sent, _ = io.Copy(stream, brw.Reader)
+		stream.Close()
+		done <- struct{}{}
+	}()
+
+	recv, _ = io.Copy(client, stream)
+
+	client.Close()
+	stream.Close()
+	<-done
+
+	proxy.log.HTTPDebug(' ', session,
+		"upgraded connection closed: sent %d, received %d bytes",
+		sent, recv)
+}
+
+// httpIsWebSocket reports if request is the WebSocket opening
+// handshake, RFC 6455, 4.1
+func httpIsWebSocket(r *http.Request) bool {
+	return r.Method == "GET" &&
+		httpHasToken(r.Header, "Connection", "upgrade") &&
+		httpHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// httpHasToken reports if comma-separated list of tokens in
+// the HTTP header contains the specified token, case-insensitively
+func httpHasToken(hdr http.Header, name, token string) bool {
+	for _, v := range hdr[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
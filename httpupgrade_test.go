@@ -0,0 +1,119 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for WebSocket passthrough
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestHTTPUpgrade tests WebSocket passthrough
+func TestHTTPUpgrade(t *testing.T) {
+	// Device accepts WebSocket and echoes all received data
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Interfaces: 3,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			if !httpIsWebSocket(rq) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "websocket")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	listener, err := NewListener(0)
+	if err != nil {
+		t.Fatalf("NewListener: %s", err)
+	}
+
+	proxy := NewHTTPProxy(transport.Log(), listener, transport)
+	defer proxy.Close()
+	proxy.Enable()
+
+	addr := fmt.Sprintf("localhost:%d", listener.Addr().(*net.TCPAddr).Port)
+
+	// Perform the opening handshake
+	handshake := func() (net.Conn, *bufio.Reader, *http.Response) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		fmt.Fprintf(c, "GET /ws HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"\r\n", addr)
+
+		reader := bufio.NewReader(c)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("handshake: %s", err)
+		}
+
+		return c, reader, resp
+	}
+
+	c, reader, resp := handshake()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %s", resp.Status)
+	}
+
+	// Data is relayed in both directions
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("echo: %q, %v", buf, err)
+	}
+
+	// 2 regular connections, one of them is upgraded, so the
+	// second upgrade is rejected
+	c2, _, resp := handshake()
+	c2.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second upgrade: %s", resp.Status)
+	}
+
+	// Connection is released and soft-reset, when client is gone
+	soft := emu.SoftResets()
+	c.Close()
+	for transport.connInUse() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := emu.SoftResets() - soft; n != 1 {
+		t.Errorf("%d soft resets, expected 1", n)
+	}
+
+	// Regular requests still work
+	rsp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET: %s", rsp.Status)
+	}
+}
@@ -0,0 +1,135 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Rewriting of device's absolute URLs
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// httpURLAttrRegexp matches absolute URLs in the HTML attributes,
+// that may contain links. Submatch 1 is the URL itself
+var httpURLAttrRegexp = regexp.MustCompile(
+	`(?i)\b(?:href|src|action)\s*=\s*["']?(https?://[^"'\s>]+)`)
+
+// httpURLRewriter rewrites absolute URLs, generated by the device's
+// embedded web server, so they point to the proxy.
+//
+// Device doesn't know its proxy address, so its redirects and
+// links often point to its internal hostname, localhost or :80,
+// which are not reachable by client
+type httpURLRewriter struct {
+	scheme string // Proxy scheme, "http" or "https"
+	host   string // Proxy host, with port
+}
+
+// rewriteResponse rewrites Location header and HTML body of the
+// response
+func (rw httpURLRewriter) rewriteResponse(rsp *http.Response) {
+	if loc := rsp.Header.Get("Location"); loc != "" {
+		rsp.Header.Set("Location", rw.rewriteURL(loc))
+	}
+
+	ct, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	enc := rsp.Header.Get("Content-Encoding")
+	if ct != "text/html" || (enc != "" && enc != "identity") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body,
+		HTTPRewriteMaxBody+1))
+
+	if err != nil || len(body) > HTTPRewriteMaxBody {
+		rsp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rsp.Body), rsp.Body}
+		return
+	}
+
+	body = rw.rewriteHTML(body)
+
+	rsp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), rsp.Body}
+
+	rsp.ContentLength = int64(len(body))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// rewriteHTML rewrites absolute URLs in the HTML attributes
+func (rw httpURLRewriter) rewriteHTML(html []byte) []byte {
+	matches := httpURLAttrRegexp.FindAllSubmatchIndex(html, -1)
+	if matches == nil {
+		return html
+	}
+
+	out := make([]byte, 0, len(html))
+	prev := 0
+
+	for _, m := range matches {
+		beg, end := m[2], m[3]
+		out = append(out, html[prev:beg]...)
+		out = append(out, rw.rewriteURL(string(html[beg:end]))...)
+		prev = end
+	}
+
+	return append(out, html[prev:]...)
+}
+
+// rewriteURL rewrites URL, if it points to the device's
+// internal address. Other URLs are returned unchanged
+func (rw httpURLRewriter) rewriteURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || !rw.isInternal(u) {
+		return s
+	}
+
+	u.Scheme = rw.scheme
+	u.Host = rw.host
+
+	return u.String()
+}
+
+// isInternal tells if URL points to the device's internal address:
+//   - localhost or loopback address
+//   - single-label host name (i.e., NPI1A2B3C)
+//   - proxy host with different port (i.e., :80)
+func (rw httpURLRewriter) isInternal(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	host := u.Hostname()
+	proxyHost := rw.host
+	if h, _, err := net.SplitHostPort(rw.host); err == nil {
+		proxyHost = h
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case strings.EqualFold(host, "localhost"):
+		return true
+	case ip != nil:
+		return ip.IsLoopback() || ip.Equal(net.ParseIP(proxyHost))
+	case !strings.Contains(host, "."):
+		return true
+	}
+
+	return strings.EqualFold(host, proxyHost)
+}
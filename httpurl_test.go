@@ -0,0 +1,82 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for rewriting of device's absolute URLs
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestHTTPURLRewriter tests httpURLRewriter
+func TestHTTPURLRewriter(t *testing.T) {
+	rw := httpURLRewriter{scheme: "http", host: "localhost:60000"}
+
+	tests := []struct{ in, out string }{
+		{"http://localhost/hp/device", "http://localhost:60000/hp/device"},
+		{"http://127.0.0.1:80/", "http://localhost:60000/"},
+		{"https://[::1]/x?y=1", "http://localhost:60000/x?y=1"},
+		{"http://NPI1A2B3C/info", "http://localhost:60000/info"},
+		{"http://www.example.com/", "http://www.example.com/"},
+		{"http://192.168.1.5/", "http://192.168.1.5/"},
+		{"/relative/path", "/relative/path"},
+		{"mailto:root", "mailto:root"},
+	}
+
+	for _, test := range tests {
+		if out := rw.rewriteURL(test.in); out != test.out {
+			t.Errorf("%q: expected %q, present %q",
+				test.in, test.out, out)
+		}
+	}
+
+	// Proxy, accessed by LAN address: device's :80 is rewritten
+	rw = httpURLRewriter{scheme: "https", host: "192.168.1.5:60001"}
+	if out := rw.rewriteURL("http://192.168.1.5/"); out !=
+		"https://192.168.1.5:60001/" {
+		t.Errorf("LAN address: %q", out)
+	}
+
+	// Response with Location and HTML body
+	html := `<html><head><base href="http://localhost/"></head>` +
+		`<a href='http://printer/setup'>Setup</a>` +
+		`<img src=http://www.example.com/logo.png>` +
+		`<form action="http://127.0.0.1:80/post"></form></html>`
+
+	rsp := &http.Response{
+		Header: http.Header{
+			"Location":     {"http://localhost:80/index.html"},
+			"Content-Type": {"text/html; charset=utf-8"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader(html)),
+	}
+
+	rw = httpURLRewriter{scheme: "http", host: "localhost:60000"}
+	rw.rewriteResponse(rsp)
+
+	if loc := rsp.Header.Get("Location"); loc !=
+		"http://localhost:60000/index.html" {
+		t.Errorf("Location: %q", loc)
+	}
+
+	body, _ := ioutil.ReadAll(rsp.Body)
+	expected := `<html><head><base href="http://localhost:60000/"></head>` +
+		`<a href='http://localhost:60000/setup'>Setup</a>` +
+		`<img src=http://www.example.com/logo.png>` +
+		`<form action="http://localhost:60000/post"></form></html>`
+
+	if string(body) != expected {
+		t.Errorf("HTML:\nexpected: %s\npresent:  %s", expected, body)
+	}
+
+	if rsp.ContentLength != int64(len(expected)) {
+		t.Errorf("Content-Length: %d", rsp.ContentLength)
+	}
+}
@@ -8,13 +8,19 @@
 
 package main
 
-import "strconv"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // HWIDPattern defines matching rule for matching USB devices by
 // the hardware ID
 type HWIDPattern struct {
-	vid, pid uint16 // Vendor/Product IDs
-	anypid   bool   // Pattern matches any PID
+	vid, pid       uint16 // Vendor/Product IDs
+	anypid         bool   // Pattern matches any PID
+	relMin, relMax uint16 // Range of device releases (bcdDevice)
+	anyrel         bool   // Pattern matches any device release
 }
 
 // ParseHWIDPattern parses supplied string as the HWID-style
@@ -28,9 +34,31 @@ type HWIDPattern struct {
 // VVVV and DDDD are device/vendor IDs, represented as sequence of
 // the four hexadecimal digits.
 //
+// Optionally, pattern may be restricted to the range of device
+// releases (bcdDevice, which usually reflects the firmware version):
+//
+//	VVVV:DDDD@1.10      - matches only release 1.10
+//	VVVV:DDDD@1.10-2.00 - matches releases from 1.10 to 2.00, inclusive
+//	VVVV:DDDD@1.10-     - matches release 1.10 and above
+//	VVVV:DDDD@-2.00     - matches release 2.00 and below
+//
+// Releases are written the same way as lsusb writes them.
+//
 // It returns *HWIDPattern or nil, if string doesn't match HWIDPattern
 // syntax.
 func ParseHWIDPattern(pattern string) *HWIDPattern {
+	// Split off release range
+	relMin, relMax, anyrel := uint16(0), uint16(0xffff), true
+	if i := strings.IndexByte(pattern, '@'); i >= 0 {
+		var ok bool
+		relMin, relMax, ok = parseHWIDReleaseRange(pattern[i+1:])
+		if !ok {
+			return nil
+		}
+		pattern = pattern[:i]
+		anyrel = false
+	}
+
 	// Split pattern into VID and PID
 	if len(pattern) != 6 && len(pattern) != 9 {
 		return nil
@@ -62,10 +90,74 @@ func ParseHWIDPattern(pattern string) *HWIDPattern {
 		}
 	}
 
-	return &HWIDPattern{vid: uint16(vid), pid: uint16(pid), anypid: anypid}
+	return &HWIDPattern{
+		vid:    uint16(vid),
+		pid:    uint16(pid),
+		anypid: anypid,
+		relMin: relMin,
+		relMax: relMax,
+		anyrel: anyrel,
+	}
 }
 
-// Match reports if the USB device VID/PID matches the pattern.
+// parseHWIDReleaseRange parses range of device releases
+// (MIN-MAX, MIN-, -MAX or just REL)
+func parseHWIDReleaseRange(s string) (relMin, relMax uint16, ok bool) {
+	relMin, relMax = 0, 0xffff
+
+	strMin, strMax := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		strMin, strMax = s[:i], s[i+1:]
+	}
+
+	if strMin == "" && strMax == "" {
+		return 0, 0, false
+	}
+
+	if strMin != "" {
+		if relMin, ok = ParseUsbRelease(strMin); !ok {
+			return 0, 0, false
+		}
+	}
+
+	if strMax != "" {
+		if relMax, ok = ParseUsbRelease(strMax); !ok {
+			return 0, 0, false
+		}
+	}
+
+	return relMin, relMax, relMin <= relMax
+}
+
+// ParseUsbRelease parses the USB device release number (bcdDevice),
+// written as lsusb does it (i.e., 1.10)
+func ParseUsbRelease(s string) (uint16, bool) {
+	i := strings.IndexByte(s, '.')
+	if i < 1 || i > 2 || len(s)-i != 3 {
+		return 0, false
+	}
+
+	major, err := strconv.ParseUint(s[:i], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+
+	minor, err := strconv.ParseUint(s[i+1:], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint16(major<<8 | minor), true
+}
+
+// UsbReleaseString formats the USB device release number (bcdDevice)
+// as lsusb does it (i.e., 1.10)
+func UsbReleaseString(rel uint16) string {
+	return fmt.Sprintf("%x.%2.2x", rel>>8, rel&0xff)
+}
+
+// Match reports if the USB device VID/PID and release number
+// (bcdDevice) matches the pattern.
 //
 // It returns the "matching weight" which allows to prioritize
 // quirks, if there are multiple matches, as more or less specific
@@ -77,19 +169,31 @@ func ParseHWIDPattern(pattern string) *HWIDPattern {
 // only slightly more specific, that the all-wildcard (i.e., the default)
 // match by the model name.
 //
+// If pattern is restricted to the range of device releases, its
+// weight is incremented by 1, so it wins over the same pattern
+// without the release range.
+//
 // If there is no match, it returns -1.
 //
 // See also [GlobMatch] documentation for comparison with the
 // similar function, used for match-by-model-name purpose.
-func (p *HWIDPattern) Match(vid, pid uint16) int {
-	ok := vid == p.vid && (p.anypid || pid == p.pid)
+func (p *HWIDPattern) Match(vid, pid, rel uint16) int {
+	ok := vid == p.vid && (p.anypid || pid == p.pid) &&
+		(p.anyrel || (rel >= p.relMin && rel <= p.relMax))
 
+	weight := 0
 	switch {
 	case !ok:
 		return -1 // No match
 	case p.anypid:
-		return 1 // Match by VID only
+		weight = 1 // Match by VID only
 	default:
-		return 1000 // Match by VID+PID
+		weight = 1000 // Match by VID+PID
+	}
+
+	if !p.anyrel {
+		weight++ // Match by release
 	}
+
+	return weight
 }
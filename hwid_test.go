@@ -0,0 +1,80 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB devices matching by HWID
+ */
+
+package main
+
+import "testing"
+
+// TestHWIDPattern tests ParseHWIDPattern and HWIDPattern.Match
+func TestHWIDPattern(t *testing.T) {
+	type match struct {
+		vid, pid, rel uint16
+		weight        int
+	}
+
+	tests := []struct {
+		pattern string
+		matches []match
+	}{
+		{"1234:5678", []match{
+			{0x1234, 0x5678, 0x0100, 1000},
+			{0x1234, 0x5679, 0x0100, -1},
+		}},
+		{"1234:*", []match{
+			{0x1234, 0x5678, 0x0100, 1},
+			{0x1235, 0x5678, 0x0100, -1},
+		}},
+		{"1234:5678@1.10", []match{
+			{0x1234, 0x5678, 0x0110, 1001},
+			{0x1234, 0x5678, 0x0111, -1},
+		}},
+		{"1234:*@1.10-2.0a", []match{
+			{0x1234, 0x5678, 0x0109, -1},
+			{0x1234, 0x5678, 0x0110, 2},
+			{0x1234, 0x5678, 0x020a, 2},
+			{0x1234, 0x5678, 0x020b, -1},
+		}},
+		{"1234:5678@1.10-", []match{
+			{0x1234, 0x5678, 0x0109, -1},
+			{0x1234, 0x5678, 0xffff, 1001},
+		}},
+		{"1234:5678@-1.10", []match{
+			{0x1234, 0x5678, 0x0000, 1001},
+			{0x1234, 0x5678, 0x0111, -1},
+		}},
+		{"1234:5678@", nil},
+		{"1234:5678@-", nil},
+		{"1234:5678@1.1", nil},
+		{"1234:5678@100.00", nil},
+		{"1234:5678@2.00-1.00", nil},
+		{"1234:567", nil},
+	}
+
+	for _, test := range tests {
+		p := ParseHWIDPattern(test.pattern)
+		switch {
+		case p == nil && test.matches != nil:
+			t.Errorf("%q: parse error", test.pattern)
+		case p != nil && test.matches == nil:
+			t.Errorf("%q: parse error expected", test.pattern)
+		}
+
+		for _, m := range test.matches {
+			if p == nil {
+				break
+			}
+
+			weight := p.Match(m.vid, m.pid, m.rel)
+			if weight != m.weight {
+				t.Errorf("%q: %4.4x:%4.4x@%s: weight %d, expected %d",
+					test.pattern, m.vid, m.pid,
+					UsbReleaseString(m.rel), weight, m.weight)
+			}
+		}
+	}
+}
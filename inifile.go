@@ -13,7 +13,10 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -440,6 +443,123 @@ func (rec *IniRecord) LoadNamedBool(out *bool, vFalse, vTrue string) error {
 	}
 }
 
+// LoadInterface loads network interface selection. The value may be:
+//
+//	all      - all interfaces; loopbackOnly set to false, iface to ""
+//	loopback - loopback only; loopbackOnly set to true, iface to ""
+//	name     - interface name; loopbackOnly set to false, iface to name
+//	address  - IP address; loopbackOnly set to false, iface to address
+//
+// Unspecified address (0.0.0.0 or ::) is the same as all.
+//
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadInterface(loopbackOnly *bool, iface *string) error {
+	ip := net.ParseIP(rec.Value)
+
+	switch {
+	case rec.Value == "":
+		return rec.errBadValue("must be all, loopback, name or address")
+	case rec.Value == "all", ip != nil && ip.IsUnspecified():
+		*loopbackOnly, *iface = false, ""
+	case rec.Value == "loopback":
+		*loopbackOnly, *iface = true, ""
+	default:
+		*loopbackOnly, *iface = false, rec.Value
+	}
+
+	return nil
+}
+
+// LoadACL loads ACL (see ParseACL for syntax)
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadACL(out *ACL) error {
+	acl, err := ParseACL(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	*out = acl
+	return nil
+}
+
+// LoadDir loads directory path: system - the system default
+// (out set to ""), or an absolute path
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadDir(out *string) error {
+	switch {
+	case rec.Value == "system":
+		*out = ""
+	case filepath.IsAbs(rec.Value):
+		*out = filepath.Clean(rec.Value)
+	default:
+		return rec.errBadValue("must be system or absolute path")
+	}
+
+	return nil
+}
+
+// LoadFile loads file path: auto - the automatic default
+// (out set to ""), or an absolute path
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadFile(out *string) error {
+	switch {
+	case rec.Value == "auto":
+		*out = ""
+	case filepath.IsAbs(rec.Value):
+		*out = filepath.Clean(rec.Value)
+	default:
+		return rec.errBadValue("must be auto or absolute path")
+	}
+
+	return nil
+}
+
+// LoadLogRemote loads address of the remote log collector. The
+// value may be:
+//
+//	none            - forwarding disabled; network and addr set to ""
+//	tcp://host:port - TCP collector
+//	udp://host:port - UDP collector
+//
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadLogRemote(network, addr *string) error {
+	if rec.Value == "none" {
+		*network, *addr = "", ""
+		return nil
+	}
+
+	i := strings.Index(rec.Value, "://")
+	if i >= 0 {
+		n, a := rec.Value[:i], rec.Value[i+3:]
+		_, port, err := net.SplitHostPort(a)
+		if (n == "tcp" || n == "udp") && err == nil && port != "" {
+			*network, *addr = n, a
+			return nil
+		}
+	}
+
+	return rec.errBadValue("must be none, tcp://host:port or udp://host:port")
+}
+
+// LoadOtlpEndpoint loads OTLP/HTTP collector URL: none,
+// http://host:port/path or https://host:port/path
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadOtlpEndpoint(out *string) error {
+	if rec.Value == "none" {
+		*out = ""
+		return nil
+	}
+
+	u, err := url.Parse(rec.Value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return rec.errBadValue("must be none or http(s)://host:port/path")
+	}
+
+	*out = rec.Value
+	return nil
+}
+
 // LoadLogLevel loads LogLevel value
 // The destination remains untouched in a case of an error
 func (rec *IniRecord) LoadLogLevel(out *LogLevel) error {
@@ -474,15 +594,143 @@ func (rec *IniRecord) LoadLogLevel(out *LogLevel) error {
 	return nil
 }
 
+// LoadLogColors loads console colors. The value is the comma-separated
+// list of level:color pairs, where level is error, info, debug, trace
+// (all trace levels) or trace-ipp, trace-escl, trace-http, trace-usb,
+// and color is the color name with the optional "bold-" prefix or none
+// (i.e., "debug:default, trace:gray"). Levels, not mentioned in the
+// list, retain their colors
+//
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadLogColors(out *LogColors) error {
+	colors := make(LogColors)
+	for level, sgr := range *out {
+		colors[level] = sgr
+	}
+
+	for _, pair := range strings.Split(rec.Value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.IndexByte(pair, ':')
+		if i < 0 {
+			return rec.errBadValue("%q: must be level:color", pair)
+		}
+
+		name, color := strings.TrimSpace(pair[:i]),
+			strings.TrimSpace(pair[i+1:])
+
+		var levels LogLevel
+		switch name {
+		case "error":
+			levels = LogError
+		case "info":
+			levels = LogInfo
+		case "debug":
+			levels = LogDebug
+		case "trace":
+			levels = LogTraceAll
+		case "trace-ipp":
+			levels = LogTraceIPP
+		case "trace-escl":
+			levels = LogTraceESCL
+		case "trace-http":
+			levels = LogTraceHTTP
+		case "trace-usb":
+			levels = LogTraceUSB
+		default:
+			return rec.errBadValue("invalid log level %q", name)
+		}
+
+		sgr, ok := logColorSGR(color)
+		if !ok {
+			return rec.errBadValue("invalid color %q", color)
+		}
+
+		for level := LogError; level <= LogTraceUSB; level <<= 1 {
+			if levels&level != 0 {
+				colors[level] = sgr
+			}
+		}
+	}
+
+	*out = colors
+	return nil
+}
+
+// LoadLogFormat loads LogFormat value
+func (rec *IniRecord) LoadLogFormat(out *LogFormat) error {
+	switch rec.Value {
+	case "text":
+		*out = LogFormatText
+	case "json":
+		*out = LogFormatJSON
+	case "logfmt":
+		*out = LogFormatLogfmt
+	default:
+		return rec.errBadValue("must be text, json or logfmt")
+	}
+
+	return nil
+}
+
+// LoadLogCompress loads LogCompress value
+func (rec *IniRecord) LoadLogCompress(out *LogCompress) error {
+	switch rec.Value {
+	case "gzip":
+		*out = LogCompressGzip
+	case "zstd":
+		*out = LogCompressZstd
+	case "none":
+		*out = LogCompressNone
+	default:
+		return rec.errBadValue("must be gzip, zstd or none")
+	}
+
+	return nil
+}
+
+// LoadUsbHotplug loads UsbHotplug value
+func (rec *IniRecord) LoadUsbHotplug(out *UsbHotplug) error {
+	for _, hotplug := range []UsbHotplug{UsbHotplugAuto,
+		UsbHotplugLibusb, UsbHotplugPoll} {
+		if rec.Value == hotplug.String() {
+			*out = hotplug
+			return nil
+		}
+	}
+
+	return rec.errBadValue("must be auto, libusb or poll")
+}
+
 // LoadDuration loads time.Duration value
+// The syntax is following:
+//
+//	1500 - duration in milliseconds
+//	5s   - duration in time.ParseDuration syntax (i.e, 1m30s)
+//
 // The destination remains untouched in a case of an error
 func (rec *IniRecord) LoadDuration(out *time.Duration) error {
-	var ms uint
-	err := rec.LoadUint(&ms)
+	ms, err := strconv.ParseUint(rec.Value, 10, 32)
 	if err == nil {
 		*out = time.Millisecond * time.Duration(ms)
+		return nil
 	}
-	return err
+
+	// Note, time.ParseDuration allows signed duration,
+	// but we don't
+	if !strings.HasPrefix(rec.Value, "+") &&
+		!strings.HasPrefix(rec.Value, "-") {
+		v, err := time.ParseDuration(rec.Value)
+		if err == nil {
+			*out = v
+			return nil
+		}
+	}
+
+	return rec.errBadValue("%q: invalid duration", rec.Value)
 }
 
 // LoadSize loads size value (returned as int64)
@@ -558,23 +806,9 @@ func (rec *IniRecord) LoadUintRange(out *uint, min, max uint) error {
 // The destination remains untouched in a case of an error
 func (rec *IniRecord) LoadAuthUIDRules(out *[]*AuthUIDRule) error {
 	// Parse rec.Key -- it contains list of operations
-	allowed := AuthOpsNone
-	for _, s := range strings.Split(rec.Key, ",") {
-		s = strings.TrimSpace(s)
-		switch s {
-		case "all":
-			allowed |= AuthOpsAll
-		case "config":
-			allowed |= AuthOpsConfig
-		case "fax":
-			allowed |= AuthOpsFax
-		case "print":
-			allowed |= AuthOpsPrint
-		case "scan":
-			allowed |= AuthOpsScan
-		default:
-			return rec.errBadValue("invalid operation: %q", s)
-		}
+	allowed, err := ParseAuthOps(rec.Key)
+	if err != nil {
+		return rec.errBadValue("%s", err)
 	}
 
 	// Parse rec.Value -- it contains list of users
@@ -609,6 +843,67 @@ func (rec *IniRecord) LoadAuthUIDRules(out *[]*AuthUIDRule) error {
 		rules = append(rules, rule)
 	}
 
+	// Save results. Once the section has a record, authentication
+	// is configured, even if that record allows nothing
+	if *out == nil {
+		*out = []*AuthUIDRule{}
+	}
+
+	*out = append(*out, rules...)
+	return nil
+}
+
+// LoadAuthOps loads comma-separated list of operations
+// (see ParseAuthOps)
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadAuthOps(out *AuthOps) error {
+	ops, err := ParseAuthOps(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	*out = ops
+	return nil
+}
+
+// LoadAuthHTTPRules loads [auth http] section record, which
+// looks like operations = user:password, ...
+//
+// Password may be given either in plain text or as
+// sha256:HEX-ENCODED-HASH
+func (rec *IniRecord) LoadAuthHTTPRules(out *AuthHTTPRules) error {
+	// Parse rec.Key -- it contains list of operations
+	allowed, err := ParseAuthOps(rec.Key)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	// Parse rec.Value -- it contains list of credentials
+	rules := AuthHTTPRules{}
+	for _, s := range strings.Split(rec.Value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		i := strings.IndexByte(s, ':')
+		if i <= 0 {
+			return rec.errBadValue("%q: must be user:password", s)
+		}
+
+		rule := &AuthHTTPRule{
+			User:     s[:i],
+			Password: s[i+1:],
+			Allowed:  allowed,
+		}
+
+		if err = rule.validate(); err != nil {
+			return rec.errBadValue("%s", err)
+		}
+
+		rules = append(rules, rule)
+	}
+
 	// Save results
 	*out = append(*out, rules...)
 	return nil
@@ -10,7 +10,9 @@ package main
 
 import (
 	"io"
+	"reflect"
 	"testing"
+	"time"
 )
 
 // Don't forget to update testData when ipp-ini.conf changes
@@ -64,3 +66,126 @@ func TestIniReader(t *testing.T) {
 		t.Fatalf("%s", err)
 	}
 }
+
+// TestIniLoadLogColors tests IniRecord.LoadLogColors
+func TestIniLoadLogColors(t *testing.T) {
+	tests := []struct {
+		value string
+		out   LogColors
+		err   bool
+	}{
+		{
+			value: "debug:default, trace:gray",
+			out: LogColors{
+				LogError:     "31;1",
+				LogInfo:      "32;1",
+				LogDebug:     "39",
+				LogTraceIPP:  "90",
+				LogTraceESCL: "90",
+				LogTraceHTTP: "90",
+				LogTraceUSB:  "90",
+			},
+		},
+		{
+			value: "error:bold-yellow,trace-usb:none",
+			out: LogColors{
+				LogError:     "33;1",
+				LogInfo:      "32;1",
+				LogDebug:     "37;1",
+				LogTraceIPP:  "37",
+				LogTraceESCL: "37",
+				LogTraceHTTP: "37",
+				LogTraceUSB:  "",
+			},
+		},
+		{value: "debug", err: true},
+		{value: "debug:pink", err: true},
+		{value: "warning:red", err: true},
+	}
+
+	for _, test := range tests {
+		rec := &IniRecord{Key: "colors", Value: test.value}
+		out := LogColorsDefault
+		err := rec.LoadLogColors(&out)
+
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: error expected", test.value)
+		case !test.err && err != nil:
+			t.Errorf("%q: %s", test.value, err)
+		case !test.err && !reflect.DeepEqual(out, test.out):
+			t.Errorf("%q: expected %v, present %v",
+				test.value, test.out, out)
+		}
+	}
+
+	if LogColorsDefault[LogDebug] != "37;1" {
+		t.Errorf("LogColorsDefault modified")
+	}
+}
+
+// TestIniLoadDuration tests IniRecord.LoadDuration
+func TestIniLoadDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		out   time.Duration
+		err   bool
+	}{
+		{value: "1500", out: 1500 * time.Millisecond},
+		{value: "5s", out: 5 * time.Second},
+		{value: "1m30s", out: 90 * time.Second},
+		{value: "0", out: 0},
+		{value: "-5s", err: true},
+		{value: "five", err: true},
+	}
+
+	for _, test := range tests {
+		rec := &IniRecord{Key: "shutdown-timeout", Value: test.value}
+		var out time.Duration
+		err := rec.LoadDuration(&out)
+
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: error expected", test.value)
+		case !test.err && err != nil:
+			t.Errorf("%q: %s", test.value, err)
+		case !test.err && out != test.out:
+			t.Errorf("%q: expected %s, present %s",
+				test.value, test.out, out)
+		}
+	}
+}
+
+// TestIniLoadInterface tests IniRecord.LoadInterface
+func TestIniLoadInterface(t *testing.T) {
+	tests := []struct {
+		value    string
+		loopback bool
+		iface    string
+		err      bool
+	}{
+		{value: "all"},
+		{value: "0.0.0.0"},
+		{value: "::"},
+		{value: "loopback", loopback: true},
+		{value: "eth0", iface: "eth0"},
+		{value: "192.168.1.10", iface: "192.168.1.10"},
+		{value: "", err: true},
+	}
+
+	for _, test := range tests {
+		rec := &IniRecord{Key: "interface", Value: test.value}
+		loopback, iface := true, "unchanged"
+		err := rec.LoadInterface(&loopback, &iface)
+
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: error expected", test.value)
+		case !test.err && err != nil:
+			t.Errorf("%q: %s", test.value, err)
+		case !test.err && (loopback != test.loopback || iface != test.iface):
+			t.Errorf("%q: expected %v %q, present %v %q", test.value,
+				test.loopback, test.iface, loopback, iface)
+		}
+	}
+}
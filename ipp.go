@@ -10,6 +10,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -77,6 +78,8 @@ func IppService(log *LogMessage, services *DNSSdServices,
 	if canFax {
 		ippSvc.Txt.Add("Fax", "T")
 		ippSvc.Txt.Add("rfo", "ipp/faxout")
+		ippSvc.SubTypes = append(ippSvc.SubTypes,
+			"_fax._sub._ipp._tcp")
 	} else {
 		ippSvc.Txt.Add("Fax", "F")
 	}
@@ -102,6 +105,9 @@ func IppService(log *LogMessage, services *DNSSdServices,
 // ippGetPrinterAttributes performs GetPrinterAttributes query,
 // using the specified http.Client and uri
 //
+// If requested attributes are not specified, attributes needed
+// for DNS-SD registration are requested.
+//
 // If this function returns nil error, it means that:
 //  1. HTTP transaction performed successfully
 //  2. Received reply successfully decoded
@@ -109,7 +115,8 @@ func IppService(log *LogMessage, services *DNSSdServices,
 //
 // Otherwise, the appropriate error is generated and returned
 func ippGetPrinterAttributes(log *LogMessage, c *http.Client, quirks *Quirks,
-	uri string) (msg *goipp.Message, httpstatus int, err error) {
+	uri string, requested ...string) (msg *goipp.Message,
+	httpstatus int, err error) {
 
 	// Query printer attributes
 	msg = goipp.NewRequest(goipp.DefaultVersion, goipp.OpGetPrinterAttributes, 1)
@@ -122,9 +129,14 @@ func ippGetPrinterAttributes(log *LogMessage, c *http.Client, quirks *Quirks,
 
 	rq := goipp.Attribute{Name: "requested-attributes"}
 
-	if Conf.LogAllPrinterAttrs {
+	switch {
+	case len(requested) != 0:
+		for _, name := range requested {
+			rq.Values.Add(goipp.TagKeyword, goipp.String(name))
+		}
+	case Conf.LogAllPrinterAttrs:
 		rq.Values.Add(goipp.TagKeyword, goipp.String("all"))
-	} else {
+	default:
 		rq.Values.Add(goipp.TagKeyword, goipp.String("color-supported"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("document-format-supported"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("media-size-supported"))
@@ -144,13 +156,26 @@ func ippGetPrinterAttributes(log *LogMessage, c *http.Client, quirks *Quirks,
 
 	msg.Operation.Add(rq)
 
+	// Allocate HTTP session in advance, so IPP request
+	// and response are tagged with it in the log
+	session := HTTPClientNewSession(c)
+	log.Session(session)
+	defer log.Session(-1)
+
+	req, _ := msg.EncodeBytes()
+	seq := ippDump(log, 0, "request", req)
+
 	log.Add(LogTraceIPP, '>', "IPP request:").
 		IppRequest(LogTraceIPP, '>', msg).
 		Nl(LogTraceIPP).
 		Flush()
 
-	req, _ := msg.EncodeBytes()
-	resp, err := c.Post(uri, goipp.ContentType, bytes.NewBuffer(req))
+	httprq, _ := http.NewRequest("POST", uri, bytes.NewBuffer(req))
+	httprq = httprq.WithContext(WithHTTPSession(context.Background(),
+		session))
+	httprq.Header.Set("Content-Type", goipp.ContentType)
+
+	resp, err := c.Do(httprq)
 	if err != nil {
 		if !ErrIsEOF(err) {
 			err = fmt.Errorf("HTTP: %s", err)
@@ -174,6 +199,8 @@ func ippGetPrinterAttributes(log *LogMessage, c *http.Client, quirks *Quirks,
 		return
 	}
 
+	ippDump(log, seq, "response", respData)
+
 	opts := goipp.DecoderOptions{}
 	if quirks.GetBuggyIppRsp() == QuirkBuggyIppRspAllow {
 		opts.EnableWorkarounds = true
@@ -546,6 +573,16 @@ func (attrs ippAttrs) getBool(name string) string {
 	return "F"
 }
 
+// Get integer (or enum) attribute. Returns -1, if attribute
+// is not found.
+func (attrs ippAttrs) getInt(name string) int {
+	vals := attrs.getAttr(goipp.TypeInteger, name)
+	if vals == nil {
+		return -1
+	}
+	return int(vals[0].(goipp.Integer))
+}
+
 // Get attribute's value by attribute name
 // Value type is checked and enforced
 func (attrs ippAttrs) getAttr(t goipp.Type, name string) []goipp.Value {
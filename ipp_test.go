@@ -9,6 +9,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -391,3 +394,50 @@ func TestIppAttrsGetStrings(t *testing.T) {
 		}
 	}
 }
+
+// TestIppDump tests dumping of IPP messages into files
+func TestIppDump(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: &UsbEmuPrinter{},
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	saveLogIppDump := Conf.LogIppDump
+	Conf.LogIppDump = true
+	defer func() { Conf.LogIppDump = saveLogIppDump }()
+
+	client := &http.Client{Transport: transport}
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	var services DNSSdServices
+	_, _, err := IppService(log, &services, 60000,
+		transport.UsbDeviceInfo(), transport.Quirks(), client)
+	if err != nil {
+		t.Fatalf("IppService: %s", err)
+	}
+
+	// Dumped files must be decodable IPP messages
+	files, _ := filepath.Glob(filepath.Join(IppDumpDir(""), "*.ipp"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, present %q", files)
+	}
+
+	for i, op := range []goipp.Code{
+		goipp.Code(goipp.OpGetPrinterAttributes),
+		goipp.Code(goipp.StatusOk),
+	} {
+		data, _ := ioutil.ReadFile(files[i])
+
+		var msg goipp.Message
+		err = msg.DecodeBytes(data)
+		if err != nil {
+			t.Errorf("%s: %s", files[i], err)
+		} else if msg.Code != op {
+			t.Errorf("%s: expected 0x%4.4x, present 0x%4.4x",
+				files[i], op, msg.Code)
+		}
+	}
+}
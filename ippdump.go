@@ -0,0 +1,62 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Dumping of IPP messages into binary files
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// ippDumpSeq is the sequence number of dumped IPP messages
+var ippDumpSeq uint32
+
+// IppDumpDir returns path to the directory, where IPP messages
+// of the device are dumped. ident is the device ident, "" for
+// the main log
+func IppDumpDir(ident string) string {
+	if ident == "" {
+		ident = "main"
+	}
+	return filepath.Join(PathLogDir, "ipp", ident)
+}
+
+// ippDump saves raw IPP message into the NNNNNN-kind.ipp file in
+// the IppDumpDir directory, if Conf.LogIppDump is set and LogTraceIPP
+// is enabled for the log. kind is "request" or "response"
+//
+// These files use the IPP wire encoding and can be decoded by
+// CUPS tools, like testipp, or fed to the device with ipptool
+// to reproduce the problem
+//
+// It returns sequence number of the dump, to pair request and
+// response, or 0 if nothing was dumped
+func ippDump(log *LogMessage, seq uint32, kind string, data []byte) uint32 {
+	if !Conf.LogIppDump || log.logger.levels&LogTraceIPP == 0 {
+		return 0
+	}
+
+	if seq == 0 {
+		seq = atomic.AddUint32(&ippDumpSeq, 1)
+	}
+
+	path := filepath.Join(IppDumpDir(log.logger.ident),
+		fmt.Sprintf("%6.6d-%s.ipp", seq, kind))
+
+	MakeParentDirectory(path)
+	err := ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		log.Error('!', "IPP dump: %s", err)
+	} else {
+		log.Add(LogTraceIPP, ' ', "IPP dump: %s", path)
+	}
+
+	return seq
+}
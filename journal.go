@@ -0,0 +1,131 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Logging to systemd journal, using the native journal protocol
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// logJournalSocket is the path to the journald socket
+var logJournalSocket = "/run/systemd/journal/socket"
+
+// logJournal is the connection to journald, shared between
+// all loggers
+var logJournal struct {
+	lock sync.Mutex // Access lock
+	conn net.Conn   // Connection to journald, nil if not opened
+}
+
+// LogJournalOpen opens connection to journald. It must succeed
+// before Logger.ToJournal can be used. Connection remains open
+// until program exit
+func LogJournalOpen() error {
+	logJournal.lock.Lock()
+	defer logJournal.lock.Unlock()
+
+	if logJournal.conn != nil {
+		return nil
+	}
+
+	conn, err := net.Dial("unixgram", logJournalSocket)
+	if err != nil {
+		return err
+	}
+
+	logJournal.conn = conn
+	return nil
+}
+
+// ToJournal redirects log to systemd journal. ident is the
+// device ident, "" for the main log
+//
+// Every line of log is sent as a separate journal entry, with
+// the following fields:
+//
+//	MESSAGE           - line of log, without prefix character
+//	PRIORITY          - 3 (error), 6 (info) or 7 (debug and traces)
+//	SYSLOG_IDENTIFIER - ipp-usb
+//	DEVICE_IDENT      - device ident, for per-device logs
+//	HTTP_SESSION      - HTTP session number, if line belongs to session
+//
+// If LogJournalOpen was not called or failed, Logger is left as is
+func (l *Logger) ToJournal(ident string) *Logger {
+	logJournal.lock.Lock()
+	conn := logJournal.conn
+	logJournal.lock.Unlock()
+
+	if conn == nil {
+		return l
+	}
+
+	l.Close()
+
+	l.ident = ident
+	l.mode = loggerJournal
+	l.out = conn
+	l.outhook = l.journalWrite
+
+	return l
+}
+
+// journalWrite writes a line of log to journal
+func (l *Logger) journalWrite(out io.Writer, level LogLevel, line []byte) {
+	priority := "7"
+	switch level {
+	case LogError:
+		priority = "3"
+	case LogInfo:
+		priority = "6"
+	}
+
+	buf := &bytes.Buffer{}
+	logJournalField(buf, "PRIORITY", []byte(priority))
+	logJournalField(buf, "SYSLOG_IDENTIFIER", []byte("ipp-usb"))
+
+	if l.ident != "" {
+		logJournalField(buf, "DEVICE_IDENT", []byte(l.ident))
+	}
+
+	if session, rest, ok := logParseSession(line); ok {
+		logJournalField(buf, "HTTP_SESSION",
+			[]byte(strconv.Itoa(session)))
+		line = rest
+	}
+
+	logJournalField(buf, "MESSAGE", line)
+
+	out.Write(buf.Bytes())
+}
+
+// logJournalField encodes field of the journal entry
+//
+// Values that contain newline characters are encoded in
+// the binary form: name, newline, 64-bit little-endian
+// length, value, newline
+func logJournalField(buf *bytes.Buffer, name string, value []byte) {
+	buf.WriteString(name)
+
+	if bytes.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.Write(value)
+	} else {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		buf.WriteByte('\n')
+		buf.Write(size[:])
+		buf.Write(value)
+	}
+
+	buf.WriteByte('\n')
+}
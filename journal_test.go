@@ -0,0 +1,83 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for logging to systemd journal
+ */
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLogJournal tests logging to systemd journal
+func TestLogJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	// Create fake journald socket
+	path := filepath.Join(dir, "socket")
+	server, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("%s", err)
+	}
+	defer server.Close()
+
+	saveLogJournalSocket := logJournalSocket
+	logJournalSocket = path
+	defer func() {
+		logJournalSocket = saveLogJournalSocket
+		if logJournal.conn != nil {
+			logJournal.conn.Close()
+			logJournal.conn = nil
+		}
+	}()
+
+	// ToJournal does nothing, until connection is opened
+	log := NewLogger().ToJournal("")
+	if log.HasDestination() {
+		t.Errorf("ToJournal succeeded without LogJournalOpen")
+	}
+
+	err = LogJournalOpen()
+	if err != nil {
+		t.Fatalf("LogJournalOpen: %s", err)
+	}
+
+	log.ToJournal("04f9-2d48-E74512K5N-Brother")
+	log.Begin().
+		Error('!', "HTTP[%3.3d]: %s", 5, "broken pipe").
+		Nl(LogError).
+		Debug(' ', "multi\nline").
+		Commit()
+
+	expected := []string{
+		"PRIORITY=3\n" +
+			"SYSLOG_IDENTIFIER=ipp-usb\n" +
+			"DEVICE_IDENT=04f9-2d48-E74512K5N-Brother\n" +
+			"HTTP_SESSION=5\n" +
+			"MESSAGE=broken pipe\n",
+		"PRIORITY=7\n" +
+			"SYSLOG_IDENTIFIER=ipp-usb\n" +
+			"DEVICE_IDENT=04f9-2d48-E74512K5N-Brother\n" +
+			"MESSAGE\n\x0a\x00\x00\x00\x00\x00\x00\x00multi\nline\n",
+	}
+
+	buf := make([]byte, 4096)
+	for _, exp := range expected {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if string(buf[:n]) != exp {
+			t.Errorf("expected %q, present %q", exp, buf[:n])
+		}
+	}
+}
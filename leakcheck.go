@@ -0,0 +1,314 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Goroutine and file descriptor leak self-monitoring
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// LeakCheckInterval is the interval between periodic leak checks
+	LeakCheckInterval = time.Minute
+
+	// LeakCheckGrace is how long tracked resource may survive
+	// its owner before considered leaked
+	LeakCheckGrace = 10 * time.Second
+)
+
+const (
+	// leakCheckSlack is how many untracked goroutines and file
+	// descriptors, per owner, considered normal. HTTP client
+	// connections are not tracked individually and fall here
+	leakCheckSlack = 32
+)
+
+// LeakKind is the kind of tracked resource
+type LeakKind int
+
+// LeakKind values
+const (
+	LeakGoroutine LeakKind = iota // Goroutine
+	LeakFd                        // File descriptor
+)
+
+// String returns name of LeakKind
+func (kind LeakKind) String() string {
+	switch kind {
+	case LeakGoroutine:
+		return "goroutine"
+	case LeakFd:
+		return "fd"
+	}
+
+	return fmt.Sprintf("LeakKind(%d)", int(kind))
+}
+
+// LeakOwner tracks resources, owned by a single device.
+//
+// When leak checking is disabled, owner is nil, and all
+// tracking operations are no-op
+type LeakOwner struct {
+	name   string                // Owner name, for logging
+	closed time.Time             // When closed, zero if not yet
+	res    map[*LeakRes]struct{} // Tracked resources
+}
+
+// LeakRes represents a single tracked resource
+type LeakRes struct {
+	owner    *LeakOwner // Owner of the resource
+	kind     LeakKind   // Resource kind
+	what     string     // What it is, for logging
+	created  time.Time  // Creation time
+	stack    []byte     // Creation stack, if debug enabled
+	reported bool       // Already reported as leaked
+}
+
+// leakCheck contains the global state of leak checker
+var leakCheck struct {
+	lock           sync.Mutex              // Access lock
+	enabled        bool                    // Leak checking enabled
+	owners         map[*LeakOwner]struct{} // All live owners
+	baseGoroutines int                     // Baseline count of goroutines
+	baseFds        int                     // Baseline count of fds
+	leaks          int                     // Total leaks found so far
+}
+
+// LeakCheckStart starts periodic leak checking, if enabled
+// by configuration. Baseline counts of goroutines and file
+// descriptors are taken at this point, so it should be called
+// before any device is opened
+func LeakCheckStart() {
+	if !Conf.LeakCheck {
+		return
+	}
+
+	leakCheckInit()
+
+	go func() {
+		for {
+			time.Sleep(LeakCheckInterval)
+			LeakCheck(Log)
+		}
+	}()
+
+	Log.Debug(' ', "Leak check: started, %d goroutines, %d fds",
+		leakCheck.baseGoroutines, leakCheck.baseFds)
+}
+
+// leakCheckInit enables leak checking and takes baseline counts
+func leakCheckInit() {
+	leakCheck.lock.Lock()
+	leakCheck.enabled = true
+	leakCheck.owners = make(map[*LeakOwner]struct{})
+	leakCheck.baseGoroutines = runtime.NumGoroutine()
+	leakCheck.baseFds = leakCountFds()
+	leakCheck.leaks = 0
+	leakCheck.lock.Unlock()
+}
+
+// NewLeakOwner creates a new LeakOwner. It returns nil,
+// if leak checking is not enabled
+func NewLeakOwner(name string) *LeakOwner {
+	leakCheck.lock.Lock()
+	defer leakCheck.lock.Unlock()
+
+	if !leakCheck.enabled {
+		return nil
+	}
+
+	owner := &LeakOwner{
+		name: name,
+		res:  make(map[*LeakRes]struct{}),
+	}
+	leakCheck.owners[owner] = struct{}{}
+
+	return owner
+}
+
+// Track starts tracking of the new resource. Returned LeakRes
+// must be released, when resource is gone
+func (owner *LeakOwner) Track(kind LeakKind, what string) *LeakRes {
+	if owner == nil {
+		return nil
+	}
+
+	res := &LeakRes{
+		owner:   owner,
+		kind:    kind,
+		what:    what,
+		created: time.Now(),
+	}
+
+	if Conf.LogMain&LogDebug != 0 {
+		res.stack = debug.Stack()
+	}
+
+	leakCheck.lock.Lock()
+	owner.res[res] = struct{}{}
+	leakCheck.lock.Unlock()
+
+	return res
+}
+
+// Close marks the owner as closed. All its resources expected
+// to be released within the LeakCheckGrace interval
+func (owner *LeakOwner) Close() {
+	if owner == nil {
+		return
+	}
+
+	leakCheck.lock.Lock()
+	owner.closed = time.Now()
+	if len(owner.res) == 0 {
+		delete(leakCheck.owners, owner)
+	}
+	leakCheck.lock.Unlock()
+}
+
+// Release releases the tracked resource
+func (res *LeakRes) Release() {
+	if res == nil {
+		return
+	}
+
+	leakCheck.lock.Lock()
+	owner := res.owner
+	delete(owner.res, res)
+	if len(owner.res) == 0 && !owner.closed.IsZero() {
+		delete(leakCheck.owners, owner)
+	}
+	leakCheck.lock.Unlock()
+}
+
+// LeakCheck compares actual count of goroutines and file
+// descriptors against the expected values and reports
+// resources, survived their owners. It returns count of
+// newly found leaks
+func LeakCheck(log *Logger) int {
+	leakCheck.lock.Lock()
+	defer leakCheck.lock.Unlock()
+
+	if !leakCheck.enabled {
+		return 0
+	}
+
+	now := time.Now()
+	msg := log.Begin()
+	defer msg.Commit()
+
+	// Collect leaked resources, in creation order
+	tracked := make(map[LeakKind]int)
+	leaked := []*LeakRes{}
+
+	for owner := range leakCheck.owners {
+		for res := range owner.res {
+			tracked[res.kind]++
+
+			if !owner.closed.IsZero() && !res.reported &&
+				now.Sub(owner.closed) >= LeakCheckGrace {
+				leaked = append(leaked, res)
+			}
+		}
+	}
+
+	sort.Slice(leaked, func(i, j int) bool {
+		return leaked[i].created.Before(leaked[j].created)
+	})
+
+	for _, res := range leaked {
+		res.reported = true
+		msg.Error('!', "LEAK: %s: %s %q, created %s ago, owner closed %s ago",
+			res.owner.name, res.kind, res.what,
+			now.Sub(res.created).Round(time.Second),
+			now.Sub(res.owner.closed).Round(time.Second))
+
+		if res.stack != nil {
+			lines := strings.Split(strings.TrimSpace(string(res.stack)), "\n")
+			for _, line := range lines {
+				msg.Debug(' ', "  %s", line)
+			}
+		}
+	}
+
+	leakCheck.leaks += len(leaked)
+
+	// Compare actual counts against expected
+	slack := leakCheckSlack * (len(leakCheck.owners) + 1)
+
+	goroutines := runtime.NumGoroutine()
+	expGoroutines := leakCheck.baseGoroutines + tracked[LeakGoroutine]
+	msg.Debug(' ', "Leak check: goroutines: %d actual, %d expected",
+		goroutines, expGoroutines)
+	if goroutines > expGoroutines+slack {
+		msg.Error('!', "LEAK: %d goroutines running, %d expected",
+			goroutines, expGoroutines)
+	}
+
+	fds := leakCountFds()
+	if fds >= 0 && leakCheck.baseFds >= 0 {
+		expFds := leakCheck.baseFds + tracked[LeakFd]
+		msg.Debug(' ', "Leak check: fds: %d actual, %d expected",
+			fds, expFds)
+		if fds > expFds+slack {
+			msg.Error('!', "LEAK: %d file descriptors open, %d expected",
+				fds, expFds)
+		}
+	}
+
+	return len(leaked)
+}
+
+// LeakCheckStatus returns leak checker status, for ipp-usb status,
+// or nil, if leak checking is disabled
+func LeakCheckStatus() []byte {
+	leakCheck.lock.Lock()
+	defer leakCheck.lock.Unlock()
+
+	if !leakCheck.enabled {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "ipp-usb resources: %d goroutines", runtime.NumGoroutine())
+	if fds := leakCountFds(); fds >= 0 {
+		fmt.Fprintf(buf, ", %d fds", fds)
+	}
+	fmt.Fprintf(buf, ", %d leaks found\n", leakCheck.leaks)
+
+	return buf.Bytes()
+}
+
+// leakCountFds returns count of open file descriptors,
+// or -1, if not supported by the OS
+func leakCountFds() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		file, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+
+		names, err := file.Readdirnames(-1)
+		file.Close()
+
+		if err == nil {
+			// Don't count the directory fd itself
+			return len(names) - 1
+		}
+	}
+
+	return -1
+}
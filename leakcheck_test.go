@@ -0,0 +1,149 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for leak self-monitoring
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// leakCheckTestStart enables leak checking for the test.
+// Returned function must be called to disable it
+func leakCheckTestStart() func() {
+	saveGrace := LeakCheckGrace
+	LeakCheckGrace = 0
+	leakCheckInit()
+
+	return func() {
+		LeakCheckGrace = saveGrace
+		leakCheck.lock.Lock()
+		leakCheck.enabled = false
+		leakCheck.owners = nil
+		leakCheck.lock.Unlock()
+	}
+}
+
+// leakCheckTestTracked returns count of tracked resources
+func leakCheckTestTracked() int {
+	leakCheck.lock.Lock()
+	defer leakCheck.lock.Unlock()
+
+	n := 0
+	for owner := range leakCheck.owners {
+		n += len(owner.res)
+	}
+
+	return n
+}
+
+// TestLeakCheck tests leak detection
+func TestLeakCheck(t *testing.T) {
+	if NewLeakOwner("test") != nil {
+		t.Fatalf("NewLeakOwner: must return nil when disabled")
+	}
+
+	stop := leakCheckTestStart()
+	defer stop()
+
+	log := NewLogger()
+
+	owner := NewLeakOwner("test")
+	released := owner.Track(LeakGoroutine, "released")
+	leaked := owner.Track(LeakFd, "leaked")
+	released.Release()
+
+	if n := LeakCheck(log); n != 0 {
+		t.Errorf("%d leaks found while owner is open", n)
+	}
+
+	owner.Close()
+
+	if n := LeakCheck(log); n != 1 {
+		t.Errorf("%d leaks found, expected 1", n)
+	}
+
+	if n := LeakCheck(log); n != 0 {
+		t.Errorf("leak reported twice")
+	}
+
+	leaked.Release()
+
+	leakCheck.lock.Lock()
+	owners := len(leakCheck.owners)
+	leakCheck.lock.Unlock()
+
+	if owners != 0 {
+		t.Errorf("owner not forgotten after all resources released")
+	}
+}
+
+// TestLeakCheckResponseDrain tests that background drain of
+// abandoned response body doesn't leak
+func TestLeakCheckResponseDrain(t *testing.T) {
+	stop := leakCheckTestStart()
+	defer stop()
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			w.Write(body)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+
+	resp.Body.Read(make([]byte, 1))
+	resp.Body.Close()
+
+	// Other requests still work, while response is drained
+	resp, err = client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if len(data) != len(body) {
+		t.Errorf("%d bytes received, expected %d", len(data), len(body))
+	}
+
+	// Close must not wait forever for the draining connection
+	closed := make(chan struct{})
+	go func() {
+		transport.Close(false)
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(30 * time.Second):
+		t.Fatal("transport.Close() hangs")
+	}
+
+	// Drain goroutine releases connection just before it exits
+	deadline := time.Now().Add(5 * time.Second)
+	for leakCheckTestTracked() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := LeakCheck(transport.Log()); n != 0 {
+		t.Errorf("%d leaks found", n)
+	}
+}
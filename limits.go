@@ -0,0 +1,32 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Resource limits
+ */
+
+package main
+
+import (
+	"runtime/debug"
+)
+
+// LimitsApply applies resource limits, configured in the
+// [limits] section of the configuration file, to the
+// Go runtime
+func LimitsApply() {
+	if Conf.GCPercent != 0 {
+		debug.SetGCPercent(int(Conf.GCPercent))
+		Log.Debug(' ', "GC percent set to %d", Conf.GCPercent)
+	}
+
+	if Conf.MaxMemory != 0 {
+		if limitsSetMemory(Conf.MaxMemory) {
+			Log.Debug(' ', "Memory limit set to %d bytes",
+				Conf.MaxMemory)
+		} else {
+			Log.Info(' ', "Memory limit not supported by this build")
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build go1.19
+// +build go1.19
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Resource limits -- Go 1.19 and newer
+ */
+
+package main
+
+import (
+	"runtime/debug"
+)
+
+// limitsSetMemory sets the soft memory limit.
+// It returns false, if not supported.
+func limitsSetMemory(limit int64) bool {
+	debug.SetMemoryLimit(limit)
+	return true
+}
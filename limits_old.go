@@ -0,0 +1,20 @@
+//go:build !go1.19
+// +build !go1.19
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Resource limits -- Go older that 1.19
+ */
+
+package main
+
+// limitsSetMemory sets the soft memory limit.
+// It returns false, if not supported.
+//
+// Soft memory limit appeared in Go 1.19, so not supported here.
+func limitsSetMemory(limit int64) bool {
+	return false
+}
@@ -26,11 +26,20 @@ import (
 // that create separate IPv4 and IPv6 listeners and dial with
 // them both
 type Listener struct {
-	net.Listener // Underlying net.Listener
+	net.Listener      // Underlying net.Listener
+	share        bool // Accept local networks clients of shared device
 }
 
 // NewListener creates new listener
 func NewListener(port int) (net.Listener, error) {
+	return NewShareListener(port, false)
+}
+
+// NewShareListener creates new listener. If share is true, it
+// accepts connections from the local networks even if ipp-usb
+// is restricted to the loopback or particular interface, so the
+// shared device is accessible from the network
+func NewShareListener(port int, share bool) (net.Listener, error) {
 	// Setup network and address
 	network := "tcp4"
 	if Conf.IPV6Enable {
@@ -39,14 +48,50 @@ func NewListener(port int) (net.Listener, error) {
 
 	addr := ":" + strconv.Itoa(port)
 
+	// If loopback interface cannot be discovered (i.e., in minimal
+	// containers or broken network namespaces), bind to the loopback
+	// address directly, as the catch-all listener may not work at
+	// this case
+	var nl net.Listener
+	var err error
+
+	if Conf.LoopbackOnly && !share {
+		if _, err = Loopback(); err != nil {
+			nl, err = listenLoopback(port)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Create net.Listener
-	nl, err := net.Listen(network, addr)
-	if err != nil {
-		return nil, err
+	if nl == nil {
+		nl, err = net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Wrap into Listener
-	return Listener{nl}, nil
+	return Listener{nl, share}, nil
+}
+
+// listenLoopback creates listener, bound directly to the
+// loopback address. IPv4 loopback is preferred, IPv6 loopback
+// is used on IPv6-only hosts, where IPv4 is not available
+func listenLoopback(port int) (net.Listener, error) {
+	nl, err := net.Listen("tcp4",
+		net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+
+	if err != nil && Conf.IPV6Enable {
+		nl6, err6 := net.Listen("tcp6",
+			net.JoinHostPort("::1", strconv.Itoa(port)))
+		if err6 == nil {
+			return nl6, nil
+		}
+	}
+
+	return nl, err
 }
 
 // Accept new connection
@@ -66,9 +111,25 @@ func (l Listener) Accept() (net.Conn, error) {
 			continue
 		}
 
-		// Reject non-loopback connections, if required
-		if Conf.LoopbackOnly &&
-			!tcpconn.LocalAddr().(*net.TCPAddr).IP.IsLoopback() {
+		// Reject non-loopback connections, or connections
+		// to the not configured interface, if required
+		local := tcpconn.LocalAddr().(*net.TCPAddr).IP
+		reject := false
+
+		switch {
+		case Conf.LoopbackOnly:
+			reject = !local.IsLoopback()
+		case Conf.Interface != "":
+			reject = !NetIfMatch(local)
+		}
+
+		// Shared device is accessible from the local networks
+		if reject && l.share {
+			remote := tcpconn.RemoteAddr().(*net.TCPAddr).IP
+			reject = !ShareAllowed(remote)
+		}
+
+		if reject {
 			tcpconn.SetLinger(0)
 			tcpconn.Close()
 			continue
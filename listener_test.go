@@ -0,0 +1,149 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP listener and proxy tests on IPv6 loopback
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// TestHTTPHost tests httpHost
+func TestHTTPHost(t *testing.T) {
+	tests := []struct {
+		addr net.TCPAddr
+		host string
+	}{
+		{net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 60000},
+			"127.0.0.1:60000"},
+		{net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 631},
+			"10.0.0.1:631"},
+		{net.TCPAddr{IP: net.ParseIP("::1"), Port: 60000},
+			"[::1]:60000"},
+		{net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 60001},
+			"[2001:db8::1]:60001"},
+		{net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 60002, Zone: "eth0"},
+			"[fe80::1%25eth0]:60002"},
+	}
+
+	for _, test := range tests {
+		host := httpHost(&test.addr)
+		if host != test.host {
+			t.Errorf("%s: expected %q, present %q",
+				test.addr.String(), test.host, host)
+		}
+	}
+}
+
+// TestNetIfParseAddr tests netIfParseAddr
+func TestNetIfParseAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		ip   string
+		zone string
+	}{
+		{"192.168.1.1", "192.168.1.1", ""},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+		{"192.168.1.1%eth0", "", ""},
+		{"eth0", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		ip, zone := netIfParseAddr(test.in)
+
+		s := ""
+		if ip != nil {
+			s = ip.String()
+		}
+
+		if s != test.ip || zone != test.zone {
+			t.Errorf("%q: expected %q %q, present %q %q",
+				test.in, test.ip, test.zone, s, zone)
+		}
+	}
+}
+
+// TestIPv6Loopback tests HTTP proxy, accessed via IPv6 loopback
+func TestIPv6Loopback(t *testing.T) {
+	// Skip the test, if IPv6 loopback is not available
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+	} else {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+
+	saveLoopbackOnly, saveIPV6Enable := Conf.LoopbackOnly, Conf.IPV6Enable
+	Conf.LoopbackOnly, Conf.IPV6Enable = true, true
+	defer func() {
+		Conf.LoopbackOnly, Conf.IPV6Enable =
+			saveLoopbackOnly, saveIPV6Enable
+	}()
+
+	// Create device, serving echo of Host header
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			w.Write([]byte(rq.Host))
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	listener, err := NewListener(0)
+	if err != nil {
+		t.Fatalf("NewListener: %s", err)
+	}
+
+	proxy := NewHTTPProxy(transport.Log(), listener, transport)
+	defer proxy.Close()
+	proxy.Enable()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	host := fmt.Sprintf("[::1]:%d", port)
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// POST is forwarded to device as is
+	resp, err := client.Post("http://"+host+"/ipp/print",
+		"application/ipp", bytes.NewReader([]byte("x")))
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(data) != host {
+		t.Errorf("POST: %s, Host %q; expected Host %q",
+			resp.Status, data, host)
+	}
+
+	// GET is redirected to localhost
+	resp, err = client.Get("http://" + host + "/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Close()
+
+	location := fmt.Sprintf("http://localhost:%d/", port)
+	if resp.StatusCode != http.StatusFound ||
+		resp.Header.Get("Location") != location {
+		t.Errorf("GET: %s, Location %q; expected %q",
+			resp.Status, resp.Header.Get("Location"), location)
+	}
+}
@@ -0,0 +1,125 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Asynchronous writing of log files
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// logAsync writes to the underlying io.Writer from the background
+// goroutine, so slow disk doesn't stall the logging goroutine
+//
+// Written data is queued. If queue size exceeds its limit, Write
+// blocks until queue is drained, so memory usage remains bounded.
+// Background goroutine runs only while there is queued data.
+//
+// Write errors are sticky: once underlying writer has failed,
+// all subsequent Write and Sync calls return the error, and the
+// unwritten data can be taken back with the take method
+type logAsync struct {
+	lock     sync.Mutex // Access lock
+	cond     *sync.Cond // Signaled when queue is drained
+	out      io.Writer  // Underlying writer
+	queue    []byte     // Queued data
+	inflight int        // Size of data being written
+	max      int        // Max size of queued data
+	running  bool       // Background goroutine is running
+	err      error      // Write error, if any
+	failed   []byte     // Data not written because of error
+}
+
+// newLogAsync creates a new logAsync
+func newLogAsync(out io.Writer, max int) *logAsync {
+	async := &logAsync{out: out, max: max}
+	async.cond = sync.NewCond(&async.lock)
+	return async
+}
+
+// Write queues data for writing
+func (async *logAsync) Write(data []byte) (int, error) {
+	async.lock.Lock()
+	defer async.lock.Unlock()
+
+	for async.err == nil && len(async.queue) != 0 &&
+		len(async.queue)+len(data) > async.max {
+		async.cond.Wait()
+	}
+
+	if async.err != nil {
+		return 0, async.err
+	}
+
+	async.queue = append(async.queue, data...)
+	if !async.running {
+		async.running = true
+		go async.writer()
+	}
+
+	return len(data), nil
+}
+
+// Sync waits until all queued data is written and returns
+// write error, if any
+func (async *logAsync) Sync() error {
+	async.lock.Lock()
+	defer async.lock.Unlock()
+
+	for async.running {
+		async.cond.Wait()
+	}
+
+	return async.err
+}
+
+// pending returns size of data, queued or being written
+func (async *logAsync) pending() int {
+	async.lock.Lock()
+	defer async.lock.Unlock()
+
+	return len(async.queue) + async.inflight
+}
+
+// take returns data, not written because of error
+func (async *logAsync) take() []byte {
+	async.lock.Lock()
+	defer async.lock.Unlock()
+
+	failed := async.failed
+	async.failed = nil
+	return failed
+}
+
+// writer is the background goroutine that writes queued data
+func (async *logAsync) writer() {
+	async.lock.Lock()
+	defer async.lock.Unlock()
+
+	for async.err == nil && len(async.queue) != 0 {
+		data := async.queue
+		async.queue = nil
+		async.inflight = len(data)
+
+		async.lock.Unlock()
+		n, err := async.out.Write(data)
+		async.lock.Lock()
+
+		async.inflight = 0
+		if err != nil {
+			async.err = err
+			async.failed = append(data[n:], async.queue...)
+			async.queue = nil
+		}
+
+		async.cond.Broadcast()
+	}
+
+	async.running = false
+	async.cond.Broadcast()
+}
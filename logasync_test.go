@@ -0,0 +1,71 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for asynchronous writing of log files
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// logAsyncTestWriter is the io.Writer for logAsync tests. It
+// waits for the gate before each write and writes at most
+// limit bytes, then fails
+type logAsyncTestWriter struct {
+	gate  chan struct{} // Write waits for it
+	buf   bytes.Buffer  // Written data
+	limit int           // Bytes to write before failure
+}
+
+// Write writes to logAsyncTestWriter
+func (w *logAsyncTestWriter) Write(data []byte) (int, error) {
+	<-w.gate
+
+	if w.buf.Len()+len(data) <= w.limit {
+		return w.buf.Write(data)
+	}
+
+	n := w.limit - w.buf.Len()
+	w.buf.Write(data[:n])
+	return n, errors.New("write error")
+}
+
+// TestLogAsync tests logAsync
+func TestLogAsync(t *testing.T) {
+	w := &logAsyncTestWriter{gate: make(chan struct{}), limit: 8}
+	async := newLogAsync(w, 16)
+
+	// Write doesn't wait for the underlying writer
+	async.Write([]byte("12345"))
+	async.Write([]byte("678"))
+	if n := async.pending(); n != 8 {
+		t.Errorf("pending: expected 8, present %d", n)
+	}
+
+	close(w.gate)
+	err := async.Sync()
+	if err != nil || w.buf.String() != "12345678" {
+		t.Errorf("Sync: %v, written %q", err, w.buf.String())
+	}
+
+	// Write error is sticky, unwritten data is returned
+	async.Write([]byte("abc"))
+	err = async.Sync()
+	if err == nil {
+		t.Errorf("Sync: error expected")
+	}
+
+	if failed := async.take(); string(failed) != "abc" {
+		t.Errorf("take: expected %q, present %q", "abc", failed)
+	}
+
+	if _, err := async.Write([]byte("def")); err == nil {
+		t.Errorf("Write: error expected")
+	}
+}
@@ -0,0 +1,107 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Total log disk usage enforcement
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// logDiskBackupRe matches names of rotated backup files,
+// i.e., main.log.0, main.log.1.gz and so on
+var logDiskBackupRe = regexp.MustCompile(`\.log\.[0-9]+(\.[a-z]+)?$`)
+
+// logDiskLock serializes LogDiskPrune calls, as log
+// files of many devices may be rotated simultaneously
+var logDiskLock sync.Mutex
+
+// LogDiskPrune enforces the total log disk budget (the
+// log-max-disk-usage parameter).
+//
+// The budget includes all log files in the PathLogDir, of all
+// devices, including devices that are not connected anymore.
+// If budget is exceeded, the oldest rotated backups are removed,
+// until total size fits the budget. Current log files are never
+// removed.
+//
+// It returns names of removed files
+func LogDiskPrune() []string {
+	if Conf.LogMaxDiskUsage <= 0 {
+		return nil
+	}
+
+	return logDiskPrune(PathLogDir, Conf.LogMaxDiskUsage)
+}
+
+// logDiskPrune removes the oldest rotated backups in the
+// directory, until total size of log files fits the budget
+func logDiskPrune(dir string, max int64) []string {
+	logDiskLock.Lock()
+	defer logDiskLock.Unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	// Count total size and collect backups
+	var total int64
+	var backups []os.FileInfo
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, ".log"):
+			total += file.Size()
+		case logDiskBackupRe.MatchString(name):
+			total += file.Size()
+			backups = append(backups, file)
+		}
+	}
+
+	if total <= max {
+		return nil
+	}
+
+	// Remove the oldest backups first
+	sort.Slice(backups, func(i, j int) bool {
+		ti, tj := backups[i].ModTime(), backups[j].ModTime()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+
+		// Within the same log, backup with the bigger
+		// number is older
+		return backups[i].Name() > backups[j].Name()
+	})
+
+	var removed []string
+	for _, file := range backups {
+		if total <= max {
+			break
+		}
+
+		err := os.Remove(filepath.Join(dir, file.Name()))
+		if err == nil {
+			total -= file.Size()
+			removed = append(removed, file.Name())
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,77 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Total log disk usage enforcement tests
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogDiskPrune tests enforcement of the total log disk budget
+func TestLogDiskPrune(t *testing.T) {
+	dir := t.TempDir()
+
+	// Files, oldest first, 100 bytes each. Unrelated
+	// files are not counted and never removed
+	files := []string{
+		"gone.log.1.gz",
+		"gone.log.0.gz",
+		"gone.log",
+		"main.log.1",
+		"main.log.0",
+		"main.log",
+		"dev.pcapng",
+		"dev.log",
+	}
+
+	data := make([]byte, 100)
+	tm := time.Now().Add(-time.Hour)
+
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		os.Chtimes(path, tm, tm)
+		tm = tm.Add(time.Minute)
+	}
+
+	// Within budget: nothing removed
+	removed := logDiskPrune(dir, 700)
+	if len(removed) != 0 {
+		t.Errorf("unexpected removal: %q", removed)
+	}
+
+	// Budget exceeded: the oldest backups removed
+	removed = logDiskPrune(dir, 500)
+	expected := "gone.log.1.gz gone.log.0.gz"
+	if strings.Join(removed, " ") != expected {
+		t.Errorf("removed: expected %q, present %q", expected, removed)
+	}
+
+	// Current logs are never removed
+	removed = logDiskPrune(dir, 0)
+	expected = "main.log.1 main.log.0"
+	if strings.Join(removed, " ") != expected {
+		t.Errorf("removed: expected %q, present %q", expected, removed)
+	}
+
+	for _, name := range []string{"gone.log", "main.log",
+		"dev.pcapng", "dev.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+}
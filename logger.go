@@ -12,14 +12,17 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -48,6 +51,11 @@ var (
 	InitLog = NewLogger().ToStdOutErr()
 )
 
+// logFallback is where file loggers write to, when log file
+// cannot be opened or written. Under systemd it goes to journal,
+// and in background mode it is redirected to /dev/null
+var logFallback io.Writer = os.Stderr
+
 // LogLevel enumerates possible log levels
 type LogLevel int
 
@@ -78,6 +86,133 @@ func (levels *LogLevel) Adjust() {
 	}
 }
 
+// String returns name of the single LogLevel, as used in
+// configuration file
+func (level LogLevel) String() string {
+	switch level {
+	case LogError:
+		return "error"
+	case LogInfo:
+		return "info"
+	case LogDebug:
+		return "debug"
+	case LogTraceIPP:
+		return "trace-ipp"
+	case LogTraceESCL:
+		return "trace-escl"
+	case LogTraceHTTP:
+		return "trace-http"
+	case LogTraceUSB:
+		return "trace-usb"
+	case logTraceDump:
+		return "trace"
+	}
+
+	return fmt.Sprintf("0x%x", int(level))
+}
+
+// LogColors defines ANSI colors of console output, per LogLevel.
+// Colors are SGR parameters (i.e., "31;1" for bold red), missed
+// LogLevel means no color
+type LogColors map[LogLevel]string
+
+// LogColorsDefault is the default color theme
+var LogColorsDefault = LogColors{
+	LogError:     "31;1", // Bold red
+	LogInfo:      "32;1", // Bold green
+	LogDebug:     "37;1", // Bold white
+	LogTraceIPP:  "37",   // Gray
+	LogTraceESCL: "37",   // Gray
+	LogTraceHTTP: "37",   // Gray
+	LogTraceUSB:  "37",   // Gray
+}
+
+// logColorNames maps color names to SGR parameters
+var logColorNames = map[string]string{
+	"black":   "30",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+	"gray":    "90",
+	"default": "39",
+}
+
+// logColorSGR returns SGR parameters for the color name. Name may
+// have the "bold-" prefix (i.e., "bold-red"). "none" means no color,
+// and "" is returned for it
+func logColorSGR(name string) (sgr string, ok bool) {
+	if name == "none" {
+		return "", true
+	}
+
+	bold := strings.HasPrefix(name, "bold-")
+	if bold {
+		name = name[5:]
+	}
+
+	sgr, ok = logColorNames[name]
+	if ok && bold {
+		sgr += ";1"
+	}
+
+	return
+}
+
+// LogFormat enumerates possible formats of log files
+type LogFormat int
+
+// LogFormat constants
+const (
+	LogFormatText   LogFormat = iota // Human-readable text
+	LogFormatJSON                    // JSON object per line
+	LogFormatLogfmt                  // key=value pairs per line
+)
+
+// LogCompress enumerates possible compressors of rotated
+// log files
+type LogCompress int
+
+// LogCompress constants
+const (
+	LogCompressGzip LogCompress = iota // Compress with gzip
+	LogCompressZstd                    // Compress with zstd program
+	LogCompressNone                    // Don't compress
+)
+
+// logCompressAll lists all LogCompress values
+var logCompressAll = []LogCompress{
+	LogCompressGzip, LogCompressZstd, LogCompressNone,
+}
+
+// Suffix returns file name suffix of compressed file
+func (compress LogCompress) Suffix() string {
+	switch compress {
+	case LogCompressGzip:
+		return ".gz"
+	case LogCompressZstd:
+		return ".zst"
+	}
+
+	return ""
+}
+
+// LogSink is the function that receives lines of log, written by
+// the Logger, in addition to the Logger's own output. It allows to
+// forward log events into the external telemetry systems.
+//
+// level is the line's LogLevel, device is the device ident ("" for
+// the main log) and line is the line text without time stamp and
+// prefix character. line is only valid during the call, so sink
+// must copy it if it needs to keep it.
+//
+// Sinks are called with the Logger's lock held, so they must not
+// write to the same Logger
+type LogSink func(level LogLevel, device string, line []byte)
+
 // loggerMode enumerates possible Logger modes
 type loggerMode int
 
@@ -87,6 +222,7 @@ const (
 	loggerConsole                        // Log goes to console
 	loggerColorConsole                   // Log goes to console and uses ANSI colors
 	loggerFile                           // Log goes to disk file
+	loggerJournal                        // Log goes to systemd journal
 )
 
 // Logger implements logging facilities
@@ -98,8 +234,14 @@ type Logger struct {
 	mode       loggerMode      // Logger mode
 	lock       sync.Mutex      // Write lock
 	path       string          // Path to log file
+	ident      string          // Device ident, "" for main log
 	cc         []*Logger       // Loggers to send carbon copy to
 	out        io.Writer       // Output stream, may be *os.File
+	async      *logAsync       // Asynchronous file writer, nil if none
+	fileErr    error           // Log file error, nil if file is OK
+	fileRetry  time.Time       // When to retry log file after error
+	ring       *logRing        // Trace ring buffer, nil if disabled
+	sinks      []LogSink       // Additional sinks
 	outhook    func(io.Writer, // Output hook
 		LogLevel, []byte)
 
@@ -163,9 +305,16 @@ func (l *Logger) ToStdOutErr() *Logger {
 
 // ToFile redirects log to arbitrary log file
 func (l *Logger) ToFile(path string) *Logger {
+	if l.async != nil {
+		l.async.Sync()
+		l.async = nil
+	}
+
 	l.path = path
 	l.mode = loggerFile
 	l.out = nil // Will be opened on demand
+	l.fileErr = nil
+	l.fileRetry = time.Time{}
 	return l
 }
 
@@ -176,7 +325,8 @@ func (l *Logger) ToMainFile() *Logger {
 
 // ToDevFile redirects log to per-device log file
 func (l *Logger) ToDevFile(info UsbDeviceInfo) *Logger {
-	return l.ToFile(filepath.Join(PathLogDir, info.Ident()+".log"))
+	l.ident = info.Ident()
+	return l.ToFile(filepath.Join(PathLogDir, l.ident+".log"))
 }
 
 // HasDestination reports if Logger destination is already
@@ -193,8 +343,20 @@ func (l *Logger) Cc(to *Logger) *Logger {
 	return l
 }
 
+// AddSink adds LogSink to the Logger. Sink receives all non-empty
+// lines, enabled by the Logger's log levels
+func (l *Logger) AddSink(sink LogSink) *Logger {
+	l.lock.Lock()
+	l.sinks = append(l.sinks, sink)
+	l.lock.Unlock()
+
+	return l
+}
+
 // Close the logger
 func (l *Logger) Close() {
+	l.Sync()
+
 	if l.mode == loggerFile && l.out != nil {
 		if file, ok := l.out.(*os.File); ok {
 			file.Close()
@@ -202,6 +364,34 @@ func (l *Logger) Close() {
 	}
 }
 
+// Sync waits until all lines, written to the log file, are
+// actually written. It only makes sense, if log file is
+// written asynchronously (see Conf.LogAsync)
+func (l *Logger) Sync() {
+	l.lock.Lock()
+	l.sync()
+	l.lock.Unlock()
+}
+
+// sync waits for the asynchronous file writer to finish.
+// Must be called under the lock
+func (l *Logger) sync() {
+	if l.async != nil {
+		err := l.async.Sync()
+		if err != nil {
+			l.fileFailed(err)
+		}
+	}
+}
+
+// wants reports if logger wants lines of the specified level,
+// either for own output, for carbon copies or for the trace
+// ring buffer
+func (l *Logger) wants(level LogLevel) bool {
+	return (l.levels|l.ccLevels)&level != 0 ||
+		level == logTraceDump || l.ring != nil
+}
+
 // SetLevels set logger's log levels
 func (l *Logger) SetLevels(levels LogLevel) *Logger {
 	levels.Adjust()
@@ -235,6 +425,8 @@ func (l *Logger) Panic(v interface{}) {
 	w.Write(debug.Stack())
 	w.Close()
 
+	logTraceDumpAll("panic")
+
 	os.Exit(1)
 }
 
@@ -242,7 +434,16 @@ func (l *Logger) Panic(v interface{}) {
 func (l *Logger) fmtTime() *logLineBuf {
 	buf := logLineBufAlloc(0, 0)
 
-	if l.mode == loggerFile {
+	switch {
+	case l.mode != loggerFile || Conf.LogFormat != LogFormatText:
+		// No time prefix
+
+	case Conf.LogDeterministic:
+		// Fixed time prefix of the same width, so logs
+		// of different runs can be compared
+		buf.WriteString("00-00-0000 00:00:00:")
+
+	default:
 		now := time.Now()
 
 		year, month, day := now.Date()
@@ -256,6 +457,209 @@ func (l *Logger) fmtTime() *logLineBuf {
 	return buf
 }
 
+// fileOpen opens log file on demand
+//
+// After failure, file is not retried until l.fileRetry
+func (l *Logger) fileOpen() {
+	if l.out != nil || time.Now().Before(l.fileRetry) {
+		return
+	}
+
+	MakeParentDirectory(l.path)
+	file, err := os.OpenFile(l.path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		l.fileFailed(err)
+		return
+	}
+
+	l.out = file
+	if Conf.LogAsync {
+		l.async = newLogAsync(file, LogAsyncQueueSize)
+	}
+}
+
+// fileFailed handles log file error (i.e., disk is full or
+// read-only). Log file is closed and logger falls back to
+// logFallback until next retry. Warning is written only once,
+// when file stops working
+func (l *Logger) fileFailed(err error) {
+	// Take data, not written by the asynchronous writer,
+	// so it will go to logFallback
+	var failed []byte
+	if l.async != nil {
+		l.async.Sync()
+		failed = l.async.take()
+		l.async = nil
+	}
+
+	if file, ok := l.out.(*os.File); ok {
+		file.Close()
+	}
+
+	l.out = nil
+	l.fileRetry = time.Now().Add(LogFileRetryInterval)
+
+	if l.fileErr == nil {
+		fmt.Fprintf(logFallback,
+			"ipp-usb: log %s: %s; logging to stderr, retry every %s\n",
+			l.path, err, LogFileRetryInterval)
+	}
+
+	logFallback.Write(failed)
+	l.fileErr = err
+}
+
+// logJSONRecord represents a line of log in the JSON format
+type logJSONRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Device  string `json:"device,omitempty"`
+	Session *int   `json:"session,omitempty"`
+	Msg     string `json:"msg"`
+}
+
+// fmtJSON formats a line of log as JSON object
+//
+// HTTP session number, if line starts with the "HTTP[NNN]: "
+// prefix, goes to the separate field
+func (l *Logger) fmtJSON(buf *logLineBuf, line *logLineBuf) {
+	rec := logJSONRecord{
+		Time:   "0000-00-00T00:00:00.000Z",
+		Level:  line.level.String(),
+		Device: l.ident,
+	}
+
+	if !Conf.LogDeterministic {
+		rec.Time = time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	}
+
+	text := line.text()
+	if session, rest, ok := logParseSession(text); ok {
+		rec.Session = &session
+		text = rest
+	}
+
+	rec.Msg = string(text)
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(rec)
+}
+
+// fmtLogfmt formats a line of log in the logfmt format: the
+// space-separated key=value pairs, with the following keys:
+//
+//	time      - time stamp, RFC 3339 with milliseconds
+//	level     - log level
+//	device    - device ident, for per-device logs
+//	session   - HTTP session number, if line belongs to session
+//	subsystem - subsystem name, taken from the "NAME: " or
+//	            "NAME[N]: " line prefix
+//	msg       - the message
+func (l *Logger) fmtLogfmt(buf *logLineBuf, line *logLineBuf) {
+	tm := "0000-00-00T00:00:00.000Z"
+	if !Conf.LogDeterministic {
+		tm = time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	}
+
+	logfmtPair(buf, "time", tm)
+	logfmtPair(buf, "level", line.level.String())
+	if l.ident != "" {
+		logfmtPair(buf, "device", l.ident)
+	}
+
+	text := line.text()
+	if session, rest, ok := logParseSession(text); ok {
+		logfmtPair(buf, "session", strconv.Itoa(session))
+		logfmtPair(buf, "subsystem", "http")
+		text = rest
+	} else if subsys, rest := logParseSubsystem(text); subsys != "" {
+		logfmtPair(buf, "subsystem", subsys)
+		text = rest
+	}
+
+	logfmtPair(buf, "msg", string(text))
+	buf.WriteByte('\n')
+}
+
+// logfmtPair writes key=value pair in the logfmt format. Values
+// with spaces, quotes, '=' or control characters are quoted
+func logfmtPair(buf *logLineBuf, key, value string) {
+	if buf.Len() != 0 {
+		buf.WriteByte(' ')
+	}
+
+	buf.WriteString(key)
+	buf.WriteByte('=')
+
+	quote := value == ""
+	for _, c := range value {
+		if c <= ' ' || c == '=' || c == '"' || c == '\\' ||
+			c == 0x7f {
+			quote = true
+			break
+		}
+	}
+
+	if quote {
+		buf.WriteString(strconv.Quote(value))
+	} else {
+		buf.WriteString(value)
+	}
+}
+
+// logParseSubsystem parses subsystem name from the log line
+// prefix. The following prefixes are recognized:
+//
+//	"NAME: "     - subsystem is name, rest is text after the prefix
+//	"NAME[N]..." - subsystem is name, rest is the entire text
+//
+// Subsystem name is returned in lower case. If there is no
+// such prefix, subsystem is ""
+func logParseSubsystem(text []byte) (subsys string, rest []byte) {
+	i := 0
+	for i < len(text) && i < 32 {
+		c := text[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			i > 0 && ('0' <= c && c <= '9' || c == '-')) {
+			break
+		}
+		i++
+	}
+
+	switch {
+	case i == 0:
+	case bytes.HasPrefix(text[i:], []byte(": ")):
+		return strings.ToLower(string(text[:i])), text[i+2:]
+	case bytes.HasPrefix(text[i:], []byte("[")):
+		return strings.ToLower(string(text[:i])), text
+	}
+
+	return "", text
+}
+
+// logParseSession parses the "HTTP[NNN]: " prefix of the log line
+func logParseSession(text []byte) (session int, rest []byte, ok bool) {
+	const prefix = "HTTP["
+	if !bytes.HasPrefix(text, []byte(prefix)) {
+		return
+	}
+
+	i := bytes.Index(text, []byte("]: "))
+	if i < 0 {
+		return
+	}
+
+	session, err := strconv.Atoi(string(text[len(prefix):i]))
+	if err != nil {
+		return
+	}
+
+	return session, text[i+3:], true
+}
+
 // Handle log rotation
 func (l *Logger) rotate() {
 	// Do we need to rotate?
@@ -265,36 +669,68 @@ func (l *Logger) rotate() {
 	}
 
 	stat, err := file.Stat()
-	if err != nil || stat.Size() <= Conf.LogMaxFileSize {
+	if err != nil {
 		return
 	}
 
-	// Perform rotation
+	// Data, queued by the asynchronous writer, counts too,
+	// and must be written before rotation
+	size := stat.Size()
+	if l.async != nil {
+		size += int64(l.async.pending())
+	}
+
+	if size <= Conf.LogMaxFileSize {
+		return
+	}
+
+	if l.async != nil && l.async.Sync() != nil {
+		// Write error will be handled by the caller
+		return
+	}
+
+	// Perform rotation. Backups, compressed by other
+	// compressors (i.e., before configuration change)
+	// are rotated as well
 	if Conf.LogMaxBackupFiles > 0 {
-		prevpath := ""
 		for i := Conf.LogMaxBackupFiles; i > 0; i-- {
-			nextpath := fmt.Sprintf("%s.%d.gz", l.path, i-1)
-
-			if i == Conf.LogMaxBackupFiles {
-				os.Remove(nextpath)
-			} else {
-				os.Rename(nextpath, prevpath)
+			for _, compress := range logCompressAll {
+				nextpath := fmt.Sprintf("%s.%d%s", l.path, i-1,
+					compress.Suffix())
+
+				if i == Conf.LogMaxBackupFiles {
+					os.Remove(nextpath)
+				} else {
+					os.Rename(nextpath, fmt.Sprintf("%s.%d%s",
+						l.path, i, compress.Suffix()))
+				}
 			}
+		}
 
-			prevpath = nextpath
+		compress := Conf.LogBackupCompress
+		err := l.backup(l.path, compress)
+		if err != nil && compress == LogCompressZstd {
+			// zstd program may be missed or fail; save
+			// backup uncompressed rather than lose it
+			err = l.backup(l.path, LogCompressNone)
 		}
 
-		err := l.gzip(l.path, prevpath)
 		if err != nil {
 			return
 		}
 	}
 
 	file.Truncate(0)
+
+	// Enforce the total log disk budget
+	LogDiskPrune()
 }
 
-// gzip the log file
-func (l *Logger) gzip(ipath, opath string) error {
+// backup copies the log file into the first backup file
+// (path.0 + suffix), using specified compressor
+func (l *Logger) backup(ipath string, compress LogCompress) error {
+	opath := ipath + ".0" + compress.Suffix()
+
 	// Open input file
 	ifile, err := os.Open(ipath)
 	if err != nil {
@@ -309,10 +745,24 @@ func (l *Logger) gzip(ipath, opath string) error {
 		return err
 	}
 
-	// gzip ifile->ofile
-	w := gzip.NewWriter(ofile)
-	_, err = io.Copy(w, ifile)
-	err2 := w.Close()
+	// Copy ifile->ofile
+	var err2 error
+	switch compress {
+	case LogCompressGzip:
+		w := gzip.NewWriter(ofile)
+		_, err = io.Copy(w, ifile)
+		err2 = w.Close()
+
+	case LogCompressZstd:
+		cmd := exec.Command(PathZstd, "-q", "-c")
+		cmd.Stdin = ifile
+		cmd.Stdout = ofile
+		err = cmd.Run()
+
+	default:
+		_, err = io.Copy(ofile, ifile)
+	}
+
 	err3 := ofile.Close()
 
 	switch {
@@ -334,9 +784,11 @@ func (l *Logger) gzip(ipath, opath string) error {
 // message, which will appear in the output log atomically,
 // and will be not interrupted in the middle by other log activity
 type LogMessage struct {
-	logger *Logger       // Underlying logger
-	parent *LogMessage   // Parent message
-	lines  []*logLineBuf // One buffer per line
+	logger  *Logger       // Underlying logger
+	parent  *LogMessage   // Parent message
+	lines   []*logLineBuf // One buffer per line
+	session int           // HTTP session, if tagged
+	tagged  bool          // Lines are tagged with HTTP session
 }
 
 // logMessagePool manages a pool of reusable LogMessages
@@ -348,16 +800,50 @@ func (msg *LogMessage) Begin() *LogMessage {
 	msg2 := logMessagePool.Get().(*LogMessage)
 	msg2.logger = msg.logger
 	msg2.parent = msg
+	msg2.session = msg.session
+	msg2.tagged = msg.tagged
 	return msg2
 }
 
+// Session makes all lines of the message, and of its child
+// messages, tagged with the "HTTP[NNN]: " prefix of the HTTP
+// session, so all lines, related to the particular session,
+// can be easily found in the log. Negative session removes
+// the tag
+func (msg *LogMessage) Session(session int) *LogMessage {
+	msg.session = session
+	msg.tagged = session >= 0
+	return msg
+}
+
+// tagSession prepends the line with the HTTP session tag, if
+// message is tagged. Empty and already tagged lines are left
+// as is
+func (msg *LogMessage) tagSession(buf *logLineBuf) {
+	if !msg.tagged {
+		return
+	}
+
+	text := buf.text()
+	if len(bytes.TrimSpace(text)) == 0 ||
+		bytes.HasPrefix(text, []byte("HTTP[")) {
+		return
+	}
+
+	saved := append([]byte(nil), text...)
+	buf.Truncate(buf.Len() - len(text))
+	fmt.Fprintf(buf, "HTTP[%3.3d]: ", msg.session)
+	buf.Write(saved)
+}
+
 // Add formats a next line of log message, with level and prefix char
 func (msg *LogMessage) Add(level LogLevel, prefix byte,
 	format string, args ...interface{}) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.wants(level) {
 		buf := logLineBufAlloc(level, prefix)
 		fmt.Fprintf(buf, format, args...)
+		msg.tagSession(buf)
 
 		msg.appendLineBuf(buf)
 	}
@@ -372,9 +858,10 @@ func (msg *LogMessage) Nl(level LogLevel) *LogMessage {
 
 // addBytes adds a next line of log message, taking slice of bytes as input
 func (msg *LogMessage) addBytes(level LogLevel, prefix byte, line []byte) *LogMessage {
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.wants(level) {
 		buf := logLineBufAlloc(level, prefix)
 		buf.Write(line)
+		msg.tagSession(buf)
 
 		msg.appendLineBuf(buf)
 	}
@@ -438,7 +925,7 @@ func (msg *LogMessage) Check(err error) {
 func (msg *LogMessage) HexDump(level LogLevel, prefix byte,
 	data []byte) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if !msg.logger.wants(level) {
 		return msg
 	}
 
@@ -493,7 +980,7 @@ func (msg *LogMessage) HexDump(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 	session int, rq *http.Request) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if !msg.logger.wants(level) {
 		return msg
 	}
 
@@ -501,8 +988,11 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 	rq = rq.WithContext(context.Background())
 	rq.Body = struct{ io.ReadCloser }{http.NoBody}
 
-	// Write it to the log
-	msg.Add(level, prefix, "HTTP[%3.3d]: HTTP request header:", session)
+	// Write it to the log, tagged with session
+	log := msg.Begin().Session(session)
+	defer log.Commit()
+
+	log.Add(level, prefix, "HTTP request header:")
 
 	buf := &bytes.Buffer{}
 	rq.Write(buf)
@@ -512,7 +1002,7 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 			l = l[:sz-1]
 		}
 
-		msg.Add(level, prefix, "  %s", l)
+		log.Add(level, prefix, "  %s", l)
 
 		if len(l) == 0 {
 			break
@@ -526,7 +1016,7 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 	session int, rsp *http.Response) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if !msg.logger.wants(level) {
 		return msg
 	}
 
@@ -543,9 +1033,12 @@ func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 			strings.Join(rsp.TransferEncoding, ", "))
 	}
 
-	// Write it to the log
-	msg.Add(level, prefix, "HTTP[%3.3d]: HTTP response header:", session)
-	msg.Add(level, prefix, "  %s %s", rsp.Proto, rsp.Status)
+	// Write it to the log, tagged with session
+	log := msg.Begin().Session(session)
+	defer log.Commit()
+
+	log.Add(level, prefix, "HTTP response header:")
+	log.Add(level, prefix, "  %s %s", rsp.Proto, rsp.Status)
 
 	keys := make([]string, 0, len(hdr))
 
@@ -555,10 +1048,10 @@ func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 
 	sort.Strings(keys)
 	for _, k := range keys {
-		msg.Add(level, prefix, "  %s: %s", k, hdr.Get(k))
+		log.Add(level, prefix, "  %s: %s", k, hdr.Get(k))
 	}
 
-	msg.Add(level, prefix, "  ")
+	log.Add(level, prefix, "  ")
 
 	return msg
 }
@@ -604,7 +1097,7 @@ func (msg *LogMessage) HTTPDebug(prefix byte,
 func (msg *LogMessage) IppRequest(level LogLevel, prefix byte,
 	m *goipp.Message) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.wants(level) {
 		m.Print(msg.LineWriter(level, prefix), true)
 	}
 	return msg
@@ -614,7 +1107,7 @@ func (msg *LogMessage) IppRequest(level LogLevel, prefix byte,
 func (msg *LogMessage) IppResponse(level LogLevel, prefix byte,
 	m *goipp.Message) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.wants(level) {
 		m.Print(msg.LineWriter(level, prefix), false)
 	}
 	return msg
@@ -669,26 +1162,32 @@ func (msg *LogMessage) Flush() {
 	}
 
 	// Open log file on demand
-	if msg.logger.out == nil && msg.logger.mode == loggerFile {
-		MakeParentDirectory(msg.logger.path)
-		msg.logger.out, _ = os.OpenFile(msg.logger.path,
-			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if msg.logger.mode == loggerFile {
+		msg.logger.fileOpen()
 	}
 
 	// If there are still no destination, return for now.
 	//
-	// It may happen either because destination is not yet
-	// set (log.ToXXX not called) or because we've failed
-	// to open destination file.
+	// It may happen because destination is not yet set
+	// (log.ToXXX not called). If we return now, the logger
+	// will continue to work in the buffering mode, which
+	// is desired behavior.
 	//
-	// In both cases if we return now, the logger will continue
-	// to work in the buffering mode, which is desired behavior.
-	if msg.logger.out == nil {
+	// If log file cannot be opened, we write to logFallback
+	// instead, so log is not buffered forever
+	out := &logErrWriter{Writer: msg.logger.out}
+	switch {
+	case msg.logger.async != nil:
+		out.Writer = msg.logger.async
+	case msg.logger.out != nil:
+	case msg.logger.fileErr != nil:
+		out.Writer = logFallback
+	default:
 		return
 	}
 
 	// Rotate now
-	if msg.logger.mode == loggerFile {
+	if msg.logger.mode == loggerFile && msg.logger.out != nil {
 		msg.logger.rotate()
 	}
 
@@ -710,34 +1209,90 @@ func (msg *LogMessage) Flush() {
 	defer buf.free()
 
 	timeLen := buf.Len()
+	jsonFmt, logfmtFmt := false, false
+	if msg.logger.mode == loggerFile {
+		jsonFmt = Conf.LogFormat == LogFormatJSON
+		logfmtFmt = Conf.LogFormat == LogFormatLogfmt
+	}
+	journal := msg.logger.mode == loggerJournal
+	sync := false
+
 	for _, l := range msg.lines {
 		l.trim()
 
-		// Generate own output
+		// Generate own output. Empty lines are only used
+		// as separators, so omitted in JSON, logfmt and journal
 		buf.Truncate(timeLen)
-		if l.level&msg.logger.levels != 0 {
-			if !l.empty() {
-				if timeLen != 0 {
-					buf.WriteByte(' ')
+		own := l.level&msg.logger.levels != 0 || l.level == logTraceDump
+		if own && !((jsonFmt || logfmtFmt || journal) && l.empty()) {
+			switch {
+			case jsonFmt:
+				msg.logger.fmtJSON(buf, l)
+
+			case logfmtFmt:
+				msg.logger.fmtLogfmt(buf, l)
+
+			case journal:
+				// One entry per line, prefix omitted
+				buf.Write(l.text())
+
+			default:
+				if !l.empty() {
+					if timeLen != 0 {
+						buf.WriteByte(' ')
+					}
+
+					buf.Write(l.Bytes())
 				}
 
-				buf.Write(l.Bytes())
+				buf.WriteByte('\n')
+			}
+
+			msg.logger.outhook(out, l.level, buf.Bytes())
+			sync = sync || l.level == LogError
+
+			// On log file error, switch to logFallback
+			// and repeat the line there
+			if out.err != nil && msg.logger.mode == loggerFile {
+				msg.logger.fileFailed(out.err)
+				out.Writer, out.err = logFallback, nil
+				msg.logger.outhook(out, l.level, buf.Bytes())
+				out.err = nil
 			}
+		} else if !own && msg.logger.ring != nil {
+			msg.logger.ring.add(l.Bytes())
+		}
 
-			buf.WriteByte('\n')
-			msg.logger.outhook(msg.logger.out, l.level, buf.Bytes())
+		// Send to sinks
+		if own && !l.empty() {
+			for _, sink := range msg.logger.sinks {
+				sink(l.level, msg.logger.ident, l.text())
+			}
 		}
 
 		// Send carbon copies
 		for _, cc := range cclist {
 			if (cc.levels & l.level) != 0 {
-				cc.msg.addBytes(l.level, 0, l.Bytes())
+				cc.msg.addBytes(l.level, l.prefix, l.text())
 			}
 		}
 
 		l.free()
 	}
 
+	// Errors are written synchronously, so they are not
+	// lost, if program crashes
+	if sync {
+		msg.logger.sync()
+	}
+
+	// Log file works again?
+	if msg.logger.out != nil && msg.logger.fileErr != nil {
+		msg.logger.fileErr = nil
+		fmt.Fprintf(logFallback, "ipp-usb: log %s: resumed\n",
+			msg.logger.path)
+	}
+
 	// Commit carbon copies
 	for _, cc := range cclist {
 		cc.msg.Commit()
@@ -767,14 +1322,31 @@ func (msg *LogMessage) free() {
 	}
 
 	msg.logger = nil
+	msg.tagged = false
 
 	logMessagePool.Put(msg)
 }
 
+// logErrWriter wraps io.Writer and remembers write error
+type logErrWriter struct {
+	io.Writer       // Underlying writer
+	err       error // Write error, if any
+}
+
+// Write writes to the underlying writer and remembers error
+func (w *logErrWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
 // logLineBuf represents a single log line buffer
 type logLineBuf struct {
 	bytes.Buffer          // Underlying buffer
 	level        LogLevel // Log level the line was written on
+	prefix       byte     // Prefix char, 0 if none
 }
 
 // logLinePool manages a pool of reusable logLines
@@ -788,6 +1360,7 @@ var logLineBufPool = sync.Pool{New: func() interface{} {
 func logLineBufAlloc(level LogLevel, prefix byte) *logLineBuf {
 	buf := logLineBufPool.Get().(*logLineBuf)
 	buf.level = level
+	buf.prefix = prefix
 	if prefix != 0 {
 		buf.Write([]byte{prefix, ' '})
 	}
@@ -819,6 +1392,20 @@ loop:
 	buf.Truncate(i)
 }
 
+// text returns text of the line without prefix
+func (buf *logLineBuf) text() []byte {
+	bytes := buf.Bytes()
+	switch {
+	case buf.prefix == 0:
+	case len(bytes) >= 2:
+		bytes = bytes[2:]
+	default:
+		bytes = nil
+	}
+
+	return bytes
+}
+
 // empty returns true if logLineBuf is empty (no text, no prefix)
 func (buf *logLineBuf) empty() bool {
 	return buf.Len() == 0
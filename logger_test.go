@@ -0,0 +1,323 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Logging tests
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogFileFallback tests logging, when log file cannot be
+// opened, and its recovery
+func TestLogFileFallback(t *testing.T) {
+	dir := t.TempDir()
+
+	fallback := &bytes.Buffer{}
+	saveLogFallback := logFallback
+	logFallback = fallback
+	defer func() { logFallback = saveLogFallback }()
+
+	// Make log directory unusable: it is a regular file
+	logdir := filepath.Join(dir, "log")
+	err := ioutil.WriteFile(logdir, nil, 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	path := filepath.Join(logdir, "main.log")
+	log := NewLogger().ToFile(path)
+	defer log.Close()
+
+	log.Info(' ', "line 1")
+	log.Info(' ', "line 2")
+
+	// Lines must go to fallback with the single warning
+	s := fallback.String()
+	switch {
+	case !strings.Contains(s, "line 1") || !strings.Contains(s, "line 2"):
+		t.Errorf("lines missed in fallback:\n%s", s)
+	case strings.Count(s, "retry every") != 1:
+		t.Errorf("warning expected once:\n%s", s)
+	}
+
+	// Make log directory usable. Before retry time, file
+	// is not retried
+	os.Remove(logdir)
+	os.Mkdir(logdir, 0755)
+
+	log.Info(' ', "line 3")
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("log file retried too early")
+	}
+
+	// After retry time, log file must resume
+	log.fileRetry = time.Time{}
+	fallback.Reset()
+	log.Info(' ', "line 4")
+	log.Sync()
+
+	data, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(data), "line 4") {
+		t.Errorf("log file not resumed:\n%s", data)
+	}
+
+	if s := fallback.String(); !strings.Contains(s, "resumed") ||
+		strings.Contains(s, "line 4") {
+		t.Errorf("unexpected fallback output:\n%s", s)
+	}
+}
+
+// TestLogFileFull tests logging to the full disk
+func TestLogFileFull(t *testing.T) {
+	const path = "/dev/full"
+	if _, err := os.Stat(path); err != nil {
+		t.Skipf("%s", err)
+	}
+
+	fallback := &bytes.Buffer{}
+	saveLogFallback := logFallback
+	logFallback = fallback
+	defer func() { logFallback = saveLogFallback }()
+
+	log := NewLogger().ToFile(path)
+	defer log.Close()
+
+	log.Info(' ', "line 1")
+	log.Sync()
+
+	s := fallback.String()
+	if !strings.Contains(s, "no space left on device") ||
+		!strings.Contains(s, "line 1") {
+		t.Errorf("unexpected fallback output:\n%s", s)
+	}
+}
+
+// TestLogJSON tests logging in the JSON format
+func TestLogJSON(t *testing.T) {
+	dir := testConf(t)
+	Conf.LogFormat, Conf.LogDeterministic = LogFormatJSON, true
+
+	path := filepath.Join(dir, "dev.log")
+	log := NewLogger().ToFile(path)
+	log.ident = "04f9-2d48-E74512K5N-Brother"
+
+	log.Begin().
+		Info('+', "opened <printer>").
+		Nl(LogInfo).
+		HTTPError('!', 7, "%s", "broken pipe").
+		Commit()
+	log.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	expected := `` +
+		`{"time":"0000-00-00T00:00:00.000Z","level":"info",` +
+		`"device":"04f9-2d48-E74512K5N-Brother",` +
+		`"msg":"opened <printer>"}` + "\n" +
+		`{"time":"0000-00-00T00:00:00.000Z","level":"error",` +
+		`"device":"04f9-2d48-E74512K5N-Brother",` +
+		`"session":7,"msg":"broken pipe"}` + "\n"
+
+	if string(data) != expected {
+		t.Errorf("expected:\n%s\npresent:\n%s", expected, data)
+	}
+}
+
+// TestLogLogfmt tests logging in the logfmt format
+func TestLogLogfmt(t *testing.T) {
+	dir := testConf(t)
+	Conf.LogFormat, Conf.LogDeterministic = LogFormatLogfmt, true
+
+	path := filepath.Join(dir, "dev.log")
+	log := NewLogger().ToFile(path)
+	log.ident = "04f9-2d48-E74512K5N-Brother"
+
+	log.Begin().
+		Info('+', "opened").
+		Nl(LogInfo).
+		HTTPError('!', 7, "%s", "broken \"pipe\"").
+		Debug(' ', "USB[1]: closed").
+		Debug(' ', "DNS-SD: x=1").
+		Commit()
+	log.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	expected := "" +
+		"time=0000-00-00T00:00:00.000Z level=info " +
+		"device=04f9-2d48-E74512K5N-Brother msg=opened\n" +
+		"time=0000-00-00T00:00:00.000Z level=error " +
+		"device=04f9-2d48-E74512K5N-Brother session=7 " +
+		"subsystem=http msg=\"broken \\\"pipe\\\"\"\n" +
+		"time=0000-00-00T00:00:00.000Z level=debug " +
+		"device=04f9-2d48-E74512K5N-Brother subsystem=usb " +
+		"msg=\"USB[1]: closed\"\n" +
+		"time=0000-00-00T00:00:00.000Z level=debug " +
+		"device=04f9-2d48-E74512K5N-Brother subsystem=dns-sd " +
+		"msg=\"x=1\"\n"
+
+	if string(data) != expected {
+		t.Errorf("expected:\n%s\npresent:\n%s", expected, data)
+	}
+}
+
+// TestLogSink tests Logger.AddSink
+func TestLogSink(t *testing.T) {
+	var lines []string
+	sink := func(level LogLevel, device string, line []byte) {
+		lines = append(lines, level.String()+" "+device+" "+
+			string(line))
+	}
+
+	log := NewLogger().ToNowhere().SetLevels(LogInfo | LogError)
+	log.ident = "04f9-2d48-E74512K5N-Brother"
+	log.AddSink(sink)
+
+	log.Begin().
+		Info('+', "opened").
+		Nl(LogInfo).
+		Debug(' ', "not enabled").
+		HTTPError('!', 7, "%s", "broken pipe").
+		Commit()
+
+	expected := []string{
+		"info 04f9-2d48-E74512K5N-Brother opened",
+		"error 04f9-2d48-E74512K5N-Brother HTTP[007]: broken pipe",
+	}
+
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\npresent:\n%s",
+			strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+// TestLogSession tests tagging of log lines with HTTP session
+func TestLogSession(t *testing.T) {
+	var lines []string
+	sink := func(level LogLevel, device string, line []byte) {
+		lines = append(lines, string(line))
+	}
+
+	log := NewLogger().ToNowhere().SetLevels(LogAll)
+	log.AddSink(sink)
+
+	msg := log.Begin().Session(7)
+	msg.Debug(' ', "USB[1]: read")
+	msg.HexDump(LogTraceUSB, '<', []byte("data"))
+	msg.Nl(LogDebug)
+	msg.HTTPDebug(' ', 7, "already tagged")
+	msg.Begin().Debug(' ', "child").Commit()
+	msg.Session(-1).Debug(' ', "untagged")
+	msg.Commit()
+
+	expected := []string{
+		"HTTP[007]: USB[1]: read",
+		"HTTP[007]: 0000: 64 61 74 61:" + strings.Repeat(" ", 37) +
+			"data",
+		"HTTP[007]: already tagged",
+		"HTTP[007]: child",
+		"untagged",
+	}
+
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\npresent:\n%s",
+			strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+// TestLogRotate tests log rotation with different compressors
+func TestLogRotate(t *testing.T) {
+	dir := testConf(t)
+
+	Conf.LogMaxFileSize = 100
+	Conf.LogMaxBackupFiles = 2
+
+	path := filepath.Join(dir, "main.log")
+	log := NewLogger().ToFile(path)
+	defer log.Close()
+
+	// Each line exceeds the maximum file size, so each
+	// next line causes rotation
+	line := strings.Repeat("x", 100)
+	rotate := func(compress LogCompress) {
+		Conf.LogBackupCompress = compress
+		log.Info(' ', "%s", line)
+	}
+
+	log.Info(' ', "%s", line)
+	rotate(LogCompressNone)
+	rotate(LogCompressGzip)
+
+	// Now we have main.log.0.gz and main.log.1, previous
+	// main.log.0 is rotated
+	for _, name := range []string{"main.log.0.gz", "main.log.1"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+
+	// Next rotation removes main.log.1
+	rotate(LogCompressZstd)
+
+	suffix := ".zst"
+	if _, err := os.Stat(PathZstd); err != nil {
+		suffix = ""
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "main.log.*"))
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+
+	expected := "main.log.0" + suffix + " main.log.1.gz"
+	if strings.Join(files, " ") != expected {
+		t.Errorf("expected %q, present %q", expected, files)
+	}
+}
+
+// TestLogTraceRing tests the trace ring buffer
+func TestLogTraceRing(t *testing.T) {
+	dir := testConf(t)
+	Conf.LogDeterministic = true
+
+	path := filepath.Join(dir, "dev.log")
+	log := NewLogger().ToFile(path).SetLevels(LogInfo)
+	log.TraceRing(120)
+	defer log.TraceRing(0)
+
+	// Each saved line takes 22-23 bytes, so only 5 last
+	// lines remain in the buffer
+	for i := 0; i < 10; i++ {
+		log.Debug(' ', "debug %d", i)
+	}
+	log.Info(' ', "info")
+	log.TraceDump("test")
+
+	// Buffer is emptied by dump
+	log.TraceDump("test")
+	log.Sync()
+
+	data, _ := ioutil.ReadFile(path)
+	expected := "" +
+		"00-00-0000 00:00:00:   info\n" +
+		"00-00-0000 00:00:00: * trace buffer (test): 5 lines\n" +
+		"00-00-0000 00:00:00: * 00:00:00.000   debug 5\n" +
+		"00-00-0000 00:00:00: * 00:00:00.000   debug 6\n" +
+		"00-00-0000 00:00:00: * 00:00:00.000   debug 7\n" +
+		"00-00-0000 00:00:00: * 00:00:00.000   debug 8\n" +
+		"00-00-0000 00:00:00: * 00:00:00.000   debug 9\n" +
+		"00-00-0000 00:00:00: * end of trace buffer\n"
+
+	if string(data) != expected {
+		t.Errorf("expected:\n%s\npresent:\n%s", expected, data)
+	}
+}
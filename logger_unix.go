@@ -25,22 +25,16 @@ func logIsAtty(file *os.File) bool {
 	return C.isatty(C.int(fd)) == 1
 }
 
-// logColorConsoleWrite writes a colorized line to console
+// logColorConsoleWrite writes a colorized line to console,
+// using colors from Conf.LogColors
 func logColorConsoleWrite(out io.Writer, level LogLevel, line []byte) {
-	var beg, end string
-
-	switch {
-	case (level & LogError) != 0:
-		beg, end = "\033[31;1m", "\033[0m" // Red
-	case (level & LogInfo) != 0:
-		beg, end = "\033[32;1m", "\033[0m" // Green
-	case (level & LogDebug) != 0:
-		beg, end = "\033[37;1m", "\033[0m" // White
-	case (level & LogTraceAll) != 0:
-		beg, end = "\033[37m", "\033[0m" // Gray
+	sgr := Conf.LogColors[level]
+	if sgr == "" {
+		out.Write(line)
+		return
 	}
 
-	out.Write([]byte(beg))
+	out.Write([]byte("\033[" + sgr + "m"))
 	out.Write(line)
-	out.Write([]byte(end))
+	out.Write([]byte("\033[0m"))
 }
@@ -0,0 +1,331 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Search in the log files ("ipp-usb logs" command)
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogQuery represents the log search parameters
+type LogQuery struct {
+	Since, Until time.Time // Time range; zero means unlimited
+	Levels       LogLevel  // Levels to show, 0 for any
+	Session      int       // HTTP session to show, -1 for any
+}
+
+// logQueryLine represents the parsed log line
+type logQueryLine struct {
+	time    time.Time // Line time, zero if unknown
+	level   LogLevel  // Line level, 0 if unknown
+	session int       // HTTP session, -1 if none
+}
+
+// LogQueryFiles returns list of files of the log, including the
+// rotated backups, oldest first. Log is specified by name: "main"
+// for the main log or device ident, as used in the log file name.
+// Unique part of the ident is enough
+func LogQueryFiles(name string) ([]string, error) {
+	// Find the log
+	logs, _ := filepath.Glob(filepath.Join(PathLogDir, "*.log"))
+	var found []string
+
+	for _, log := range logs {
+		base := strings.TrimSuffix(filepath.Base(log), ".log")
+		if base == name {
+			found = []string{log}
+			break
+		}
+
+		if strings.Contains(base, name) {
+			found = append(found, log)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%s: log not found in %s", name, PathLogDir)
+	case 1:
+	default:
+		for i := range found {
+			found[i] = strings.TrimSuffix(filepath.Base(found[i]),
+				".log")
+		}
+		return nil, fmt.Errorf("%s: ambiguous log name, matches %s",
+			name, strings.Join(found, ", "))
+	}
+
+	// Collect backups: path.N + compressor suffix
+	path := found[0]
+	backups, _ := filepath.Glob(path + ".*")
+	numbers := make(map[string]int)
+
+	for _, backup := range backups {
+		s := strings.TrimPrefix(backup, path+".")
+		for _, compress := range logCompressAll {
+			if suffix := compress.Suffix(); suffix != "" &&
+				strings.HasSuffix(s, suffix) {
+				s = strings.TrimSuffix(s, suffix)
+				break
+			}
+		}
+
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			numbers[backup] = n
+		}
+	}
+
+	files := make([]string, 0, len(numbers)+1)
+	for backup := range numbers {
+		files = append(files, backup)
+	}
+
+	// Backup with the bigger number is older
+	sort.Slice(files, func(i, j int) bool {
+		return numbers[files[i]] > numbers[files[j]]
+	})
+
+	return append(files, path), nil
+}
+
+// Run searches in the log files and writes matching lines to out
+func (q *LogQuery) Run(out io.Writer, files []string) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	for _, file := range files {
+		err := q.runFile(w, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runFile searches in the single log file, decompressing it
+// on the fly, if needed
+func (q *LogQuery) runFile(out io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var in io.Reader = f
+	var cmd *exec.Cmd
+
+	switch {
+	case strings.HasSuffix(file, LogCompressGzip.Suffix()):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		in = gz
+
+	case strings.HasSuffix(file, LogCompressZstd.Suffix()):
+		cmd = exec.Command(PathZstd, "-q", "-d", "-c")
+		cmd.Stdin = f
+		pipe, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: zstd: %s", file, err)
+		}
+		in = pipe
+	}
+
+	err = q.search(out, in)
+
+	if cmd != nil {
+		err2 := cmd.Wait()
+		if err == nil && err2 != nil {
+			err = fmt.Errorf("zstd: %s", err2)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	return nil
+}
+
+// search writes matching lines from in to out
+func (q *LogQuery) search(out io.Writer, in io.Reader) error {
+	reader := bufio.NewReader(in)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 && q.match(logQueryParse(line)) {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+
+			_, err2 := out.Write(line)
+			if err2 != nil {
+				return err2
+			}
+		}
+
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// match checks if parsed line matches the query
+//
+// Lines without time stamp or level (i.e., the text format
+// doesn't write levels) don't match the time range or level
+// filters
+func (q *LogQuery) match(line logQueryLine) bool {
+	switch {
+	case !q.Since.IsZero() && (line.time.IsZero() ||
+		line.time.Before(q.Since)):
+		return false
+
+	case !q.Until.IsZero() && (line.time.IsZero() ||
+		line.time.After(q.Until)):
+		return false
+
+	case q.Levels != 0 && line.level&q.Levels == 0:
+		return false
+
+	case q.Session >= 0 && line.session != q.Session:
+		return false
+	}
+
+	return true
+}
+
+// logQueryParse parses the log line in any of supported
+// formats (text, json or logfmt)
+func logQueryParse(line []byte) logQueryLine {
+	line = bytes.TrimRight(line, "\r\n")
+	parsed := logQueryLine{session: -1}
+
+	switch {
+	case bytes.HasPrefix(line, []byte("{")):
+		// JSON
+		var rec logJSONRecord
+		if json.Unmarshal(line, &rec) != nil {
+			return parsed
+		}
+
+		parsed.time = logQueryParseTime(rec.Time)
+		parsed.level = logQueryParseLevel(rec.Level)
+		if rec.Session != nil {
+			parsed.session = *rec.Session
+		}
+
+	case bytes.HasPrefix(line, []byte("time=")):
+		// logfmt. msg is always the last field
+		for _, field := range strings.Split(string(line), " ") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "msg" {
+				break
+			}
+
+			switch kv[0] {
+			case "time":
+				parsed.time = logQueryParseTime(kv[1])
+			case "level":
+				parsed.level = logQueryParseLevel(kv[1])
+			case "session":
+				if n, err := strconv.Atoi(kv[1]); err == nil {
+					parsed.session = n
+				}
+			}
+		}
+
+	default:
+		// Text: "DD-MM-YYYY HH:MM:SS: P text"
+		const layout = "02-01-2006 15:04:05:"
+		if len(line) >= len(layout) {
+			tm, err := time.ParseInLocation(layout,
+				string(line[:len(layout)]), time.Local)
+			if err == nil {
+				parsed.time = tm
+			}
+			line = line[len(layout):]
+		}
+
+		if len(line) >= 3 {
+			line = line[3:] // Skip " P "
+		}
+
+		if session, _, ok := logParseSession(line); ok {
+			parsed.session = session
+		}
+	}
+
+	return parsed
+}
+
+// logQueryParseTime parses time of JSON and logfmt log lines
+func logQueryParseTime(s string) time.Time {
+	tm, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", s)
+	return tm
+}
+
+// logQueryParseLevel parses level of JSON and logfmt log lines
+func logQueryParseLevel(s string) LogLevel {
+	for level := LogError; level <= LogTraceUSB; level <<= 1 {
+		if level.String() == s {
+			return level
+		}
+	}
+
+	if s == logTraceDump.String() {
+		return logTraceDump
+	}
+
+	return 0
+}
+
+// ParseLogQueryTime parses time, specified in the command line:
+// absolute (2006-01-02, 2006-01-02 15:04 or 2006-01-02 15:04:05,
+// in local time) or relative to now (i.e., 2h for "2 hours ago")
+func ParseLogQueryTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+
+	s = strings.Replace(s, "T", " ", 1)
+	for _, layout := range []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	} {
+		tm, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return tm, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q: invalid time", s)
+}
@@ -0,0 +1,111 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for search in the log files
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogQuery tests search in the log files
+func TestLogQuery(t *testing.T) {
+	dir := testConf(t)
+
+	const ident = "04f9-2d48-E74512K5N-Brother"
+	path := filepath.Join(dir, ident+".log")
+
+	// Text, gzipped backup
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("" +
+		"01-02-2024 10:00:00: > HTTP[001]: GET /\n" +
+		"01-02-2024 10:00:01:   HTTP[002]: USB[0]: read\n"))
+	gz.Close()
+	ioutil.WriteFile(path+".1.gz", buf.Bytes(), 0644)
+
+	// JSON backup
+	ioutil.WriteFile(path+".0", []byte(""+
+		`{"time":"2024-02-01T11:00:00.000Z","level":"debug",`+
+		`"session":1,"msg":"done"}`+"\n"+
+		`{"time":"2024-02-01T11:00:01.000Z","level":"error",`+
+		`"msg":"failed"}`+"\n"), 0644)
+
+	// logfmt current log
+	ioutil.WriteFile(path, []byte(""+
+		"time=2024-02-01T12:00:00.000Z level=info msg=opened\n"+
+		"time=2024-02-01T12:00:01.000Z level=debug session=1 "+
+		"subsystem=http msg=again\n"), 0644)
+
+	ioutil.WriteFile(filepath.Join(dir, "main.log"), nil, 0644)
+
+	// Check files lookup
+	files, err := LogQueryFiles("E74512K5N")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+
+	expected := ident + ".log.1.gz " + ident + ".log.0 " + ident + ".log"
+	if strings.Join(files, " ") != expected {
+		t.Errorf("files: expected %q, present %q", expected, files)
+	}
+
+	if _, err := LogQueryFiles("missed"); err == nil {
+		t.Errorf("missed log: error expected")
+	}
+
+	// Run queries
+	files, _ = LogQueryFiles(ident)
+	query := func(q LogQuery) []string {
+		buf := &bytes.Buffer{}
+		err := q.Run(buf, files)
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+
+		var lines []string
+		for _, l := range strings.Split(buf.String(), "\n") {
+			if l != "" {
+				lines = append(lines, l)
+			}
+		}
+		return lines
+	}
+
+	lines := query(LogQuery{Session: -1})
+	if len(lines) != 6 {
+		t.Errorf("all lines: %d, expected 6", len(lines))
+	}
+
+	lines = query(LogQuery{Session: 1})
+	if len(lines) != 3 || !strings.Contains(lines[0], "GET /") ||
+		!strings.Contains(lines[2], "msg=again") {
+		t.Errorf("session 1:\n%s", strings.Join(lines, "\n"))
+	}
+
+	lines = query(LogQuery{Session: -1, Levels: LogInfo | LogError})
+	if len(lines) != 2 || !strings.Contains(lines[0], "failed") ||
+		!strings.Contains(lines[1], "opened") {
+		t.Errorf("info:\n%s", strings.Join(lines, "\n"))
+	}
+
+	since := time.Date(2024, 2, 1, 11, 30, 0, 0, time.UTC)
+	lines = query(LogQuery{Session: -1, Since: since})
+	if len(lines) != 2 {
+		t.Errorf("since:\n%s", strings.Join(lines, "\n"))
+	}
+}
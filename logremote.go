@@ -0,0 +1,232 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Forwarding of logs to the remote syslog collector
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// logRemoteFacility is the syslog facility of forwarded lines
+// (LOG_DAEMON)
+const logRemoteFacility = 3
+
+// logRemote forwards log lines to the remote syslog collector
+//
+// Lines are queued in memory and sent by the background goroutine.
+// If collector is not reachable, lines are kept in the queue up
+// to its maximum size (the oldest lines are dropped, if queue
+// overflows), and connection is retried every LogRemoteRetryInterval
+type logRemote struct {
+	network  string        // "tcp" or "udp"
+	addr     string        // Collector address, host:port
+	hostname string        // Our host name, for syslog header
+	lock     sync.Mutex    // Access lock
+	queue    [][]byte      // Queued lines, oldest first
+	size     int           // Total size of queued lines
+	max      int           // Max size of queued lines
+	dropped  int           // Count of lines dropped on overflow
+	wake     chan struct{} // Wakes up sender goroutine
+}
+
+// logRemoteActive is the active logRemote, nil if not opened
+var logRemoteActive struct {
+	lock   sync.Mutex // Access lock
+	remote *logRemote // Active logRemote
+}
+
+// LogRemoteOpen starts forwarding of logs to the remote collector.
+// network is "tcp" or "udp", addr is the collector address and
+// bufsize is the maximum size of lines, queued in memory while
+// collector is not reachable
+//
+// Once opened, forwarding remains active until program exit.
+// Use Logger.ToRemote to forward particular Logger's lines
+func LogRemoteOpen(network, addr string, bufsize int) {
+	logRemoteActive.lock.Lock()
+	defer logRemoteActive.lock.Unlock()
+
+	if logRemoteActive.remote != nil {
+		return
+	}
+
+	remote := newLogRemote(network, addr, bufsize)
+	go remote.sender()
+
+	logRemoteActive.remote = remote
+}
+
+// newLogRemote creates a new logRemote. Sender goroutine
+// is not started
+func newLogRemote(network, addr string, bufsize int) *logRemote {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return &logRemote{
+		network:  network,
+		addr:     addr,
+		hostname: hostname,
+		max:      bufsize,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// ToRemote forwards Logger's lines to the remote collector, in
+// addition to the Logger's own output. If LogRemoteOpen was not
+// called, Logger is left as is
+func (l *Logger) ToRemote() *Logger {
+	logRemoteActive.lock.Lock()
+	remote := logRemoteActive.remote
+	logRemoteActive.lock.Unlock()
+
+	if remote != nil {
+		l.AddSink(remote.sink)
+	}
+
+	return l
+}
+
+// sink is the LogSink that formats line as RFC 5424 syslog
+// message and queues it for sending
+func (remote *logRemote) sink(level LogLevel, device string, line []byte) {
+	severity := 7
+	switch level {
+	case LogError:
+		severity = 3
+	case LogInfo:
+		severity = 6
+	}
+
+	tm := "-"
+	if !Conf.LogDeterministic {
+		tm = time.Now().Format("2006-01-02T15:04:05.000000Z07:00")
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s ipp-usb %d - - ",
+		logRemoteFacility*8+severity, tm, remote.hostname, os.Getpid())
+
+	if device != "" {
+		msg += device + ": "
+	}
+
+	remote.add([]byte(msg + string(line)))
+}
+
+// add queues message for sending
+func (remote *logRemote) add(msg []byte) {
+	remote.lock.Lock()
+
+	remote.queue = append(remote.queue, msg)
+	remote.size += len(msg)
+
+	for remote.size > remote.max && len(remote.queue) > 0 {
+		remote.size -= len(remote.queue[0])
+		remote.queue[0] = nil
+		remote.queue = remote.queue[1:]
+		remote.dropped++
+	}
+
+	remote.lock.Unlock()
+
+	select {
+	case remote.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sender sends queued messages, (re)connecting when needed
+func (remote *logRemote) sender() {
+	var conn net.Conn
+	var err error
+
+	for range remote.wake {
+		if conn == nil {
+			conn, err = net.DialTimeout(remote.network,
+				remote.addr, LogRemoteRetryInterval)
+			if err != nil {
+				conn = nil
+			}
+		}
+
+		if conn != nil && !remote.send(conn) {
+			conn.Close()
+			conn = nil
+		}
+
+		// Connection failed: retry later. Meanwhile,
+		// new lines are queued
+		if conn == nil {
+			time.Sleep(LogRemoteRetryInterval)
+			select {
+			case remote.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// send sends queued messages via connection, until queue is empty.
+// Messages are removed from the queue only after being successfully
+// sent. It returns false, if connection has failed
+func (remote *logRemote) send(conn net.Conn) bool {
+	for {
+		// Fetch next message. If some lines were dropped,
+		// report it first
+		remote.lock.Lock()
+		dropped := remote.dropped
+		var msg []byte
+
+		switch {
+		case dropped != 0:
+			msg = []byte(fmt.Sprintf("<%d>1 - %s ipp-usb %d - - "+
+				"%d lines dropped: collector not reachable",
+				logRemoteFacility*8+4, remote.hostname,
+				os.Getpid(), dropped))
+		case len(remote.queue) != 0:
+			msg = remote.queue[0]
+		}
+		remote.lock.Unlock()
+
+		if msg == nil {
+			return true
+		}
+
+		// Send the message. TCP uses newline as message
+		// delimiter (non-transparent framing), UDP sends
+		// one message per datagram
+		data := msg
+		if remote.network == "tcp" {
+			data = append(msg[:len(msg):len(msg)], '\n')
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(LogRemoteRetryInterval))
+		_, err := conn.Write(data)
+		if err != nil {
+			return false
+		}
+
+		// Remove sent message from the queue. Note, while we
+		// were sending, queue might overflow and be shifted
+		remote.lock.Lock()
+		switch {
+		case dropped != 0:
+			remote.dropped -= dropped
+		case len(remote.queue) != 0 && &remote.queue[0][0] == &msg[0]:
+			remote.size -= len(msg)
+			remote.queue[0] = nil
+			remote.queue = remote.queue[1:]
+		}
+		remote.lock.Unlock()
+	}
+}
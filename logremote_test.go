@@ -0,0 +1,84 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for forwarding of logs to the remote collector
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestLogRemote tests forwarding of logs to the TCP collector
+func TestLogRemote(t *testing.T) {
+	testConf(t)
+	Conf.LogDeterministic = true
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("%s", err)
+	}
+	defer server.Close()
+
+	// Queue lines before collector is connected. Queue
+	// is then shrunk, so the oldest lines are dropped, to
+	// make room for the last (longer) line
+	remote := newLogRemote("tcp", server.Addr().String(), 65536)
+	log := NewLogger().ToNowhere().SetLevels(LogInfo | LogError)
+	log.ident = "04f9-2d48-E74512K5N-Brother"
+	log.AddSink(remote.sink)
+
+	for i := 0; i < 4; i++ {
+		log.Info(' ', "line %d", i)
+	}
+
+	remote.lock.Lock()
+	remote.max = remote.size
+	remote.lock.Unlock()
+
+	log.Error('!', "HTTP[%3.3d]: %s", 5, "broken pipe")
+
+	go remote.sender()
+
+	conn, err := server.Accept()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	hdr := func(severity int) string {
+		hostname, _ := os.Hostname()
+		return fmt.Sprintf("<%d>1 - %s ipp-usb %d - - ",
+			24+severity, hostname, os.Getpid())
+	}
+
+	expected := []string{
+		hdr(4) + "2 lines dropped: collector not reachable",
+		hdr(6) + "04f9-2d48-E74512K5N-Brother: line 2",
+		hdr(6) + "04f9-2d48-E74512K5N-Brother: line 3",
+		hdr(3) + "04f9-2d48-E74512K5N-Brother: HTTP[005]: broken pipe",
+	}
+
+	for _, exp := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		line = line[:len(line)-1]
+		if line != exp {
+			t.Errorf("expected %q, present %q", exp, line)
+		}
+	}
+}
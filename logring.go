@@ -0,0 +1,126 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * In-memory trace ring buffer
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// logTraceDump is the pseudo-level of lines, dumped from the
+// trace ring buffer. These lines are always written to the
+// Logger's own destination and never sent to carbon copies
+const logTraceDump LogLevel = 1 << 30
+
+// logRing is the circular buffer of recent log lines, not
+// written to the log because of log levels
+type logRing struct {
+	lines [][]byte // Saved lines, oldest first
+	size  int      // Total size of saved lines
+	max   int      // Max size of saved lines
+}
+
+// logRings contains all Loggers with trace ring buffers,
+// so they can be dumped on panic
+var logRings struct {
+	lock    sync.Mutex
+	loggers map[*Logger]struct{}
+}
+
+// TraceRing enables trace ring buffer of the specified
+// size, in bytes. Size of 0 disables the buffer.
+//
+// When enabled, all lines, suppressed by log levels, are
+// saved in the buffer. Buffer content is written to the
+// log by TraceDump and on panic, so post-mortem traces
+// are available without permanently enabled trace logging
+func (l *Logger) TraceRing(size int) *Logger {
+	l.lock.Lock()
+	if size > 0 {
+		l.ring = &logRing{max: size}
+	} else {
+		l.ring = nil
+	}
+	l.lock.Unlock()
+
+	logRings.lock.Lock()
+	if logRings.loggers == nil {
+		logRings.loggers = make(map[*Logger]struct{})
+	}
+
+	if size > 0 {
+		logRings.loggers[l] = struct{}{}
+	} else {
+		delete(logRings.loggers, l)
+	}
+	logRings.lock.Unlock()
+
+	return l
+}
+
+// TraceDump writes content of the trace ring buffer to the
+// log and empties the buffer
+func (l *Logger) TraceDump(reason string) {
+	l.lock.Lock()
+	var lines [][]byte
+	if l.ring != nil {
+		lines = l.ring.lines
+		l.ring.lines, l.ring.size = nil, 0
+	}
+	l.lock.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	msg := l.Begin()
+	msg.Add(logTraceDump, '*', "trace buffer (%s): %d lines",
+		reason, len(lines))
+	for _, line := range lines {
+		msg.addBytes(logTraceDump, '*', line)
+	}
+	msg.Add(logTraceDump, '*', "end of trace buffer")
+	msg.Commit()
+}
+
+// logTraceDumpAll dumps trace ring buffers of all loggers
+func logTraceDumpAll(reason string) {
+	logRings.lock.Lock()
+	loggers := make([]*Logger, 0, len(logRings.loggers))
+	for l := range logRings.loggers {
+		loggers = append(loggers, l)
+	}
+	logRings.lock.Unlock()
+
+	for _, l := range loggers {
+		l.TraceDump(reason)
+	}
+}
+
+// add saves line in the ring buffer, prefixed with time
+func (ring *logRing) add(line []byte) {
+	tm := "00:00:00.000"
+	if !Conf.LogDeterministic {
+		tm = time.Now().Format("15:04:05.000")
+	}
+
+	saved := make([]byte, 0, len(tm)+1+len(line))
+	saved = append(saved, tm...)
+	saved = append(saved, ' ')
+	saved = append(saved, line...)
+
+	ring.lines = append(ring.lines, saved)
+	ring.size += len(saved)
+
+	for ring.size > ring.max && len(ring.lines) > 0 {
+		ring.size -= len(ring.lines[0])
+		ring.lines[0] = nil
+		ring.lines = ring.lines[1:]
+	}
+}
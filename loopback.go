@@ -3,7 +3,7 @@
  * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
  * See LICENSE for license terms and conditions
  *
- * Loopback interface index discovery
+ * Loopback and configured network interface discovery
  */
 
 package main
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 )
 
 // Loopback returns index of loopback interface
@@ -31,3 +32,117 @@ func Loopback() (int, error) {
 
 	return 0, fmt.Errorf("Loopback discovery: %s", err)
 }
+
+// NetIf returns network interface, explicitly selected by name
+// or by address with the "interface" parameter of the [network]
+// section of the configuration file.
+//
+// If interface is not selected explicitly (i.e., "all" or "loopback"
+// is used), it returns nil, nil
+func NetIf() (*net.Interface, error) {
+	if Conf.Interface == "" {
+		return nil, nil
+	}
+
+	// Lookup by address
+	if ip, zone := netIfParseAddr(Conf.Interface); ip != nil {
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("Interface discovery: %s", err)
+		}
+
+		for i := range interfaces {
+			iface := &interfaces[i]
+			if (zone == "" || iface.Name == zone) &&
+				netIfHasAddr(iface, ip) {
+				return iface, nil
+			}
+		}
+
+		return nil, fmt.Errorf("Interface discovery: %s: not found",
+			Conf.Interface)
+	}
+
+	// Lookup by name
+	iface, err := net.InterfaceByName(Conf.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("Interface discovery: %s", err)
+	}
+
+	return iface, nil
+}
+
+// NetIfMatch tells if the local address of incoming connection
+// matches the explicitly configured interface.
+//
+// If interface is selected by address, the address must match.
+// If interface is selected by name, the address must belong to
+// that interface.
+func NetIfMatch(addr net.IP) bool {
+	if ip, _ := netIfParseAddr(Conf.Interface); ip != nil {
+		return ip.Equal(addr)
+	}
+
+	iface, err := net.InterfaceByName(Conf.Interface)
+	if err != nil {
+		return false
+	}
+
+	return netIfHasAddr(iface, addr)
+}
+
+// netIfParseAddr parses interface address, as specified in the
+// configuration file. IPv6 address may include zone, which names
+// the interface (i.e., "fe80::1%eth0"). It returns nil IP, if s
+// is not an address
+func netIfParseAddr(s string) (ip net.IP, zone string) {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+	}
+
+	ip = net.ParseIP(s)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+
+	return ip, zone
+}
+
+// NetIPv6Only tells if host is IPv6-only, i.e., has IPv6 but
+// no IPv4 addresses, except the loopback
+func NetIPv6Only() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	have6 := false
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		switch {
+		case !ok || ipnet.IP.IsLoopback():
+		case ipnet.IP.To4() != nil:
+			return false
+		default:
+			have6 = true
+		}
+	}
+
+	return have6
+}
+
+// netIfHasAddr tells if address belongs to the interface
+func netIfHasAddr(iface *net.Interface, addr net.IP) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
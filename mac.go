@@ -0,0 +1,170 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Mandatory Access Control (SELinux/AppArmor) diagnostics
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MACKind represents a kind of Mandatory Access Control system
+type MACKind int
+
+// MACKind values:
+const (
+	MACNone     MACKind = iota // No MAC or not confined
+	MACSELinux                 // SELinux in enforcing mode
+	MACAppArmor                // AppArmor, confined by profile
+)
+
+// String returns name of MACKind
+func (kind MACKind) String() string {
+	switch kind {
+	case MACNone:
+		return "none"
+	case MACSELinux:
+		return "SELinux"
+	case MACAppArmor:
+		return "AppArmor"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(kind))
+}
+
+// MACDetect detects Mandatory Access Control system, that
+// may restrict our process. It returns the MAC kind and
+// the security context or profile name, if known
+func MACDetect() (MACKind, string) {
+	// SELinux: check for enforcing mode
+	enforce, err := ioutil.ReadFile("/sys/fs/selinux/enforce")
+	if err == nil && string(bytes.TrimSpace(enforce)) == "1" {
+		ctx, _ := ioutil.ReadFile("/proc/self/attr/current")
+		return MACSELinux, string(bytes.Trim(ctx, "\x00\n "))
+	}
+
+	// AppArmor: check if we are confined
+	//
+	// /proc/self/attr/current is shared between LSMs, so on
+	// other than AppArmor system (i.e., SELinux in permissive
+	// mode), it contains a foreign context. So it is only used,
+	// if AppArmor is known to be active
+	paths := []string{"/proc/self/attr/apparmor/current"}
+	if _, err := os.Stat("/sys/kernel/security/apparmor"); err == nil {
+		paths = append(paths, "/proc/self/attr/current")
+	}
+
+	for _, path := range paths {
+		profile, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		s := string(bytes.Trim(profile, "\x00\n "))
+		if s != "" && s != "unconfined" {
+			return MACAppArmor, s
+		}
+
+		break
+	}
+
+	return MACNone, ""
+}
+
+// MACDiagnose writes to the log targeted diagnostics for
+// the access denial to the specified path, if it looks like
+// the denial is caused by the Mandatory Access Control.
+//
+// It does nothing, if no MAC system is active
+func MACDiagnose(log *Logger, path string) {
+	kind, ctx := MACDetect()
+	hints := macHints(kind, ctx, path)
+	if hints == nil {
+		return
+	}
+
+	msg := log.Begin()
+	for _, hint := range hints {
+		msg.Error('!', "%s", hint)
+	}
+	msg.Commit()
+}
+
+// MACCheckPaths checks that directories, used by the daemon,
+// are writable, and writes diagnostics to the log, if they
+// are not due to the access denial
+func MACCheckPaths(log *Logger) {
+	dirs := []string{
+		PathLogDir,
+		PathDevStateDir,
+		filepath.Dir(PathLockFile),
+		filepath.Dir(PathControlSocket),
+	}
+
+	for _, dir := range dirs {
+		MakeDirectory(dir)
+
+		f, err := ioutil.TempFile(dir, ".ipp-usb-probe")
+		if err == nil {
+			f.Close()
+			os.Remove(f.Name())
+			continue
+		}
+
+		if os.IsPermission(err) {
+			log.Error('!', "%s: access denied", dir)
+			MACDiagnose(log, dir)
+		}
+	}
+}
+
+// macHints returns list of hints for access denial to the path
+func macHints(kind MACKind, ctx, path string) []string {
+	var hints []string
+
+	isDevice := strings.HasPrefix(path, "/dev/")
+
+	switch kind {
+	case MACSELinux:
+		hints = append(hints,
+			fmt.Sprintf("SELinux is enforcing (context: %s)", ctx),
+			fmt.Sprintf("Access to %s may be denied by SELinux policy", path),
+			"  Check for denials: ausearch -m AVC -c ipp-usb -ts recent",
+			fmt.Sprintf("  Fix file labels: restorecon -Rv %s", path),
+			"  Generate local policy module: ausearch -m AVC -c ipp-usb | audit2allow -M ipp-usb-local",
+		)
+
+	case MACAppArmor:
+		rule := path + "/** rwk,"
+		if isDevice {
+			rule = path + " rw,"
+		}
+
+		hints = append(hints,
+			fmt.Sprintf("Running under AppArmor profile %s", ctx),
+			fmt.Sprintf("Access to %s may be denied by AppArmor", path),
+			"  Check for denials: journalctl -k | grep 'apparmor=\"DENIED\"'",
+			fmt.Sprintf("  Allow access by adding \"%s\" to the local profile override", rule),
+		)
+
+	default:
+		return nil
+	}
+
+	if !isDevice {
+		hints = append(hints,
+			"  Or use path, permitted by the policy, with -path-log-dir,",
+			"  -path-dev-state-dir, -path-lock-file or -path-ctrl-sock options")
+	}
+
+	return hints
+}
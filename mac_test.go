@@ -0,0 +1,44 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for mac.go
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test macHints
+func TestMACHints(t *testing.T) {
+	if hints := macHints(MACNone, "", "/var/log/ipp-usb"); hints != nil {
+		t.Errorf("MACNone: expected no hints, got %q", hints)
+	}
+
+	hints := macHints(MACSELinux, "system_u:system_r:ipp_usb_t:s0",
+		"/var/log/ipp-usb")
+	text := strings.Join(hints, "\n")
+	for _, s := range []string{"SELinux", "restorecon -Rv /var/log/ipp-usb",
+		"-path-log-dir"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("SELinux: %q missed in hints:\n%s", s, text)
+		}
+	}
+
+	hints = macHints(MACAppArmor, "/usr/sbin/ipp-usb (enforce)",
+		"/dev/bus/usb/001/005")
+	text = strings.Join(hints, "\n")
+	for _, s := range []string{"AppArmor", "/dev/bus/usb/001/005 rw,"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("AppArmor: %q missed in hints:\n%s", s, text)
+		}
+	}
+
+	if strings.Contains(text, "-path-log-dir") {
+		t.Errorf("AppArmor: unexpected path hint for device:\n%s", text)
+	}
+}
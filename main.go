@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 const usageText = `Usage:
@@ -25,12 +27,83 @@ Modes are:
                   device is disconnected
     debug       - logs duplicated on console, -bg option is
                   ignored
+    container   - like standalone, but logs duplicated on console
+                  and USB hotplug is disabled; devices are rescanned
+                  on SIGUSR2. Intended for use in Docker/Podman
     check       - check configuration and exit
     status      - print ipp-usb status and exit
+    conformance [device]
+                - run conformance tests against the device and
+                  print report, suitable for submitting new quirks.
+                  Device is specified as BUS:DEV or /dev/bus/usb/BUS/DEV
+                  and may be omitted, if only one device is connected
+    hold device - hold print jobs of the device in the running daemon:
+                  jobs are spooled, but not sent to device until
+                  released. Device is specified as BUS:DEV or
+                  VID:PID[/serial][@path]
+    release device
+                - send held print jobs to device and stop holding
+    logs [name] - search in the log, including rotated (compressed)
+                  backups, and print matching lines. Log is "main"
+                  (the default) or device ident, as in the log file
+                  name; unique part of the ident is enough
 
 Options are
     -bg         - run in background (ignored in debug mode)
 
+    -user       - run as unprivileged user, with per-user paths
+                  (see below); root privileges are not required
+
+    -no-color   - don't use ANSI colors on console, regardless of
+                  the console-color option of ipp-usb.conf. Colors
+                  are also disabled, if NO_COLOR environment variable
+                  is set
+
+    -device BUS:DEV or -device /dev/bus/usb/BUS/DEV
+        Serve only the specified device. May be repeated
+        to serve multiple devices
+
+    -device VID:PID[/serial][@path] or -device @path
+        In debug mode, serve only the specified device (i.e.,
+        04f9:2d48/E74512K5N or device at the USB path @1-1.4.2,
+        as shown by "ipp-usb check"), with full trace on console and
+        without DNS-SD advertising. Lock file, control socket,
+        logs and device state are kept in a private temporary
+        directory, so running system instance is not affected
+
+    -dnssd      - with -device VID:PID, advertise the device
+                  with DNS-SD, as usual
+
+    -usb-fd fd
+        Use already opened USB device, passed as file descriptor
+        (i.e., by termux-usb on Android). Devices enumeration and
+        hotplug are disabled, root privileges are not required,
+        -bg option is ignored
+
+    -replay file
+        Don't use real USB devices, but replay the device side of
+        USB capture, recorded with usb-capture = true option
+        of ipp-usb.conf. Root privileges are not required, -bg
+        option is ignored
+
+    -compat-report file
+        In conformance mode, save the compatibility report (model,
+        firmware, results of checks, applied and suggested quirks)
+        into the file in JSON format, for sharing with the community
+
+    -since time, -until time
+        In logs mode, print only lines in the time range. Time is
+        absolute (2006-01-02, 2006-01-02 15:04 or 2006-01-02 15:04:05)
+        or relative to now (i.e., 30m or 2h)
+
+    -level level
+        In logs mode, print only lines of this level and more
+        important (error, info, debug, trace-ipp, ...). Requires
+        log-format = json or logfmt, as text logs have no levels
+
+    -session N
+        In logs mode, print only lines of the HTTP session N
+
     -path-conf-files-srch dir1[:dir2...]
         List of directories where configuration files (ipp-usb.conf)
 	are searched (%s)
@@ -53,6 +126,13 @@ Options are
     -path-quirks-files-srch dir1[:dir2...]
         List of directories where quirks files (*.conf) is searched
 	(%s)
+
+With the -user option, default paths are following:
+    configuration  $XDG_CONFIG_HOME/ipp-usb (~/.config/ipp-usb)
+    quirks         $XDG_CONFIG_HOME/ipp-usb/quirks
+    logs           $XDG_STATE_HOME/ipp-usb/log (~/.local/state/ipp-usb/log)
+    device state   $XDG_STATE_HOME/ipp-usb/dev
+    lock, control  $XDG_RUNTIME_DIR/ipp-usb
 `
 
 // RunMode represents the program run mode
@@ -60,20 +140,31 @@ type RunMode int
 
 // Run modes:
 //
-//	RunStandalone - run forever, automatically discover IPP-over-USB
-//	                devices and serve them all
-//	RunUdev       - like RunStandalone, but exit when last IPP-over-USB
-//	                device is disconnected
-//	RunDebug      - logs duplicated on console, -bg option is ignored
-//	RunCheck      - check configuration and exit
-//	RunStatus     - print ipp-usb status and exit
+//	RunStandalone  - run forever, automatically discover IPP-over-USB
+//	                 devices and serve them all
+//	RunUdev        - like RunStandalone, but exit when last IPP-over-USB
+//	                 device is disconnected
+//	RunDebug       - logs duplicated on console, -bg option is ignored
+//	RunContainer   - like RunStandalone, but logs duplicated on console
+//	                 and USB hotplug is disabled
+//	RunCheck       - check configuration and exit
+//	RunStatus      - print ipp-usb status and exit
+//	RunConformance - run conformance tests against the device
+//	RunLogs        - search in the log files
+//	RunHold        - hold print jobs of the device and exit
+//	RunRelease     - release held print jobs of the device and exit
 const (
 	RunDefault RunMode = iota
 	RunStandalone
 	RunUdev
 	RunDebug
+	RunContainer
 	RunCheck
 	RunStatus
+	RunConformance
+	RunLogs
+	RunHold
+	RunRelease
 )
 
 // String returns RunMode name
@@ -87,10 +178,20 @@ func (m RunMode) String() string {
 		return "udev"
 	case RunDebug:
 		return "debug"
+	case RunContainer:
+		return "container"
 	case RunCheck:
 		return "check"
 	case RunStatus:
 		return "status"
+	case RunConformance:
+		return "conformance"
+	case RunLogs:
+		return "logs"
+	case RunHold:
+		return "hold"
+	case RunRelease:
+		return "release"
 	}
 
 	return fmt.Sprintf("unknown (%d)", int(m))
@@ -98,8 +199,21 @@ func (m RunMode) String() string {
 
 // RunParameters represents the program run parameters
 type RunParameters struct {
-	Mode       RunMode // Run mode
-	Background bool    // Run in background
+	Mode         RunMode      // Run mode
+	Background   bool         // Run in background
+	Devices      UsbAddrList  // If not empty, serve only these devices
+	UsbFd        int          // If not -1, externally opened USB device
+	User         bool         // Run as unprivileged user
+	Replay       string       // If not "", USB capture file to replay
+	CompatReport string       // If not "", compatibility report file
+	Match        *UsbDevMatch // If not nil, debug only this device
+	DebugDir     string       // Private directory for Match mode
+	DNSSd        bool         // Keep DNS-SD in Match mode
+	NoColor      bool         // Disable ANSI colors on console
+	LogName      string       // Log name, for logs mode
+	HoldDevice   string       // Device, for hold and release modes
+	LogQuery     LogQuery     // Log search parameters
+	LogQueryOpts bool         // Log search options are used
 }
 
 // usage prints detailed usage and exits
@@ -139,8 +253,12 @@ func parseArgv() (params RunParameters) {
 
 	// For now, default mode is debug mode. It may change in a future
 	params.Mode = RunDebug
+	params.UsbFd = -1
+	params.LogName = "main"
+	params.LogQuery.Session = -1
 
 	modes := 0
+	paths := make(map[*string]string)
 	for i := 1; i < len(os.Args); i++ {
 		arg := os.Args[i]
 		var optarg *string
@@ -157,15 +275,163 @@ func parseArgv() (params RunParameters) {
 		case "debug":
 			params.Mode = RunDebug
 			modes++
+		case "container":
+			params.Mode = RunContainer
+			modes++
 		case "check":
 			params.Mode = RunCheck
 			modes++
 		case "status":
 			params.Mode = RunStatus
 			modes++
+		case "conformance":
+			params.Mode = RunConformance
+			modes++
+
+			// Device argument is optional
+			if i+1 < len(os.Args) &&
+				!strings.HasPrefix(os.Args[i+1], "-") {
+				i++
+				addr, err := ParseUsbAddr(os.Args[i])
+				if err != nil {
+					usageError("%s", err)
+				}
+				params.Devices.Add(addr)
+			}
+		case "logs":
+			params.Mode = RunLogs
+			modes++
+
+			// Log name is optional
+			if i+1 < len(os.Args) &&
+				!strings.HasPrefix(os.Args[i+1], "-") {
+				i++
+				params.LogName = os.Args[i]
+			}
+		case "hold", "release":
+			params.Mode = RunHold
+			if arg == "release" {
+				params.Mode = RunRelease
+			}
+			modes++
+
+			if i+1 == len(os.Args) ||
+				strings.HasPrefix(os.Args[i+1], "-") {
+				usageError("%s mode requires device", arg)
+			}
+			i++
+			params.HoldDevice = os.Args[i]
+
 		case "-bg":
 			params.Background = true
 
+		case "-user", "--user":
+			params.User = true
+
+		case "-no-color", "--no-color":
+			params.NoColor = true
+
+		case "-device", "--device":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			if match, err := ParseUsbDevMatch(os.Args[i]); err == nil {
+				if params.Match != nil {
+					usageError("Only one VID:PID device may be specified")
+				}
+				params.Match = &match
+			} else {
+				addr, err := ParseUsbAddr(os.Args[i])
+				if err != nil {
+					usageError("%s", err)
+				}
+				params.Devices.Add(addr)
+			}
+
+		case "-dnssd", "--dnssd":
+			params.DNSSd = true
+
+		case "-usb-fd":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			fd, err := strconv.Atoi(os.Args[i])
+			if err != nil || fd < 0 {
+				usageError("%q: invalid file descriptor", os.Args[i])
+			}
+			params.UsbFd = fd
+
+		case "-replay":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			params.Replay = os.Args[i]
+
+		case "-compat-report":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			params.CompatReport = os.Args[i]
+
+		case "-since", "-until":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			tm, err := ParseLogQueryTime(os.Args[i])
+			if err != nil {
+				usageError("%s", err)
+			}
+
+			if arg == "-since" {
+				params.LogQuery.Since = tm
+			} else {
+				params.LogQuery.Until = tm
+			}
+			params.LogQueryOpts = true
+
+		case "-level":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			rec := IniRecord{Key: arg, Value: os.Args[i]}
+			err := rec.LoadLogLevel(&params.LogQuery.Levels)
+			if err != nil {
+				usageError("%q: invalid log level", os.Args[i])
+			}
+			params.LogQueryOpts = true
+
+		case "-session":
+			if i+1 == len(os.Args) {
+				usageError(
+					"Option requires an argument: %s", arg)
+			}
+
+			i++
+			session, err := strconv.Atoi(os.Args[i])
+			if err != nil || session < 0 {
+				usageError("%q: invalid session", os.Args[i])
+			}
+			params.LogQuery.Session = session
+			params.LogQueryOpts = true
+
 		case "-path-log-dir":
 			optarg = &PathLogDir
 
@@ -195,15 +461,53 @@ func parseArgv() (params RunParameters) {
 			}
 
 			i++
-			*optarg = os.Args[i]
+			paths[optarg] = os.Args[i]
 		}
 	}
 
+	// Apply per-user paths layout first, so explicitly
+	// specified paths take precedence
+	if params.User {
+		PathsUserInit()
+	}
+
+	if params.Match != nil {
+		params.DebugDir = PathsDebugInit()
+	}
+
+	for optarg, path := range paths {
+		*optarg = path
+	}
+
 	if modes > 1 {
 		usageError("Conflicting run modes")
 	}
 
-	if params.Mode == RunDebug {
+	if params.CompatReport != "" && params.Mode != RunConformance {
+		usageError("-compat-report requires conformance mode")
+	}
+
+	if params.LogQueryOpts && params.Mode != RunLogs {
+		usageError("-since, -until, -level and -session require logs mode")
+	}
+
+	if params.Match != nil {
+		switch {
+		case params.Mode != RunDebug:
+			usageError("-device VID:PID requires debug mode")
+		case len(params.Devices) != 0:
+			usageError("-device VID:PID and BUS:DEV are mutually exclusive")
+		case params.UsbFd >= 0 || params.Replay != "":
+			usageError("-device VID:PID conflicts with -usb-fd and -replay")
+		}
+	} else if params.DNSSd {
+		usageError("-dnssd requires -device VID:PID")
+	}
+
+	// Note, file descriptor passed by -usb-fd will not
+	// survive the background run
+	if params.Mode == RunDebug || params.Mode == RunConformance ||
+		params.UsbFd >= 0 || params.Replay != "" {
 		params.Background = false
 	}
 
@@ -235,6 +539,19 @@ func printStatus() {
 	}
 }
 
+// holdDevice holds or releases print jobs of the device in the
+// running ipp-usb daemon
+func holdDevice(device string, hold bool) {
+	err := StatusHoldRequest(device, hold)
+	InitLog.Check(err)
+
+	if hold {
+		InitLog.Info(0, "%s: print jobs are held", device)
+	} else {
+		InitLog.Info(0, "%s: print jobs are released", device)
+	}
+}
+
 // The main function
 func main() {
 	var err error
@@ -246,16 +563,40 @@ func main() {
 	// Parse arguments
 	params := parseArgv()
 
+	// In RunLogs mode, search in the logs, and we are done.
+	// Configuration is not needed for that
+	if params.Mode == RunLogs {
+		files, err := LogQueryFiles(params.LogName)
+		if err == nil {
+			err = params.LogQuery.Run(os.Stdout, files)
+		}
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
 	// Load configuration file
 	err = ConfLoad()
 	InitLog.Check(err)
 
+	// In single-device debug mode, trace everything to console,
+	// and don't advertise the device, unless requested. The
+	// built-in test device would conflict with the system instance
+	if params.Match != nil {
+		Conf.LogMain = LogAll
+		Conf.LogDevice = LogAll
+		Conf.LogConsole = LogAll
+		Conf.DNSSdEnable = Conf.DNSSdEnable && params.DNSSd
+		Conf.TestDevicePort = 0
+	}
+
 	// Setup logging
 	if params.Mode != RunDebug &&
+		params.Mode != RunContainer &&
 		params.Mode != RunCheck &&
 		params.Mode != RunStatus {
 		Console.ToNowhere()
-	} else if Conf.ColorConsole {
+	} else if Conf.ColorConsole && !params.NoColor &&
+		os.Getenv("NO_COLOR") == "" {
 		Console.ToColorConsole()
 	}
 
@@ -263,13 +604,41 @@ func main() {
 	Console.SetLevels(Conf.LogConsole)
 	Log.Cc(Console)
 
+	// Switch to systemd journal, if requested. Note, we cannot
+	// write to stderr at this point, as in the background mode
+	// parent process takes it as initialization failure
+	if Conf.LogJournal {
+		err = LogJournalOpen()
+		if err == nil {
+			Log.ToJournal("")
+		} else {
+			Log.Error('!', "journal: %s; logging to files", err)
+		}
+	}
+
+	// Start forwarding to the remote collector, if requested
+	if Conf.LogRemoteNetwork != "" {
+		LogRemoteOpen(Conf.LogRemoteNetwork, Conf.LogRemoteAddr,
+			int(Conf.LogRemoteBuffer))
+		Log.ToRemote()
+	}
+
+	// Start export of OTLP spans, if requested
+	if Conf.OtlpEndpoint != "" {
+		OtlpOpen(Conf.OtlpEndpoint)
+	}
+
 	// In RunCheck mode, list IPP-over-USB devices
 	if params.Mode == RunCheck {
 		// If we are here, configuration is OK
 		InitLog.Info(0, "Configuration files: OK")
 
 		var descs map[UsbAddr]UsbDeviceDesc
-		err = UsbInit(true)
+		if params.UsbFd >= 0 {
+			err = UsbInitFd(params.UsbFd)
+		} else {
+			err = UsbInit(true)
+		}
 		if err == nil {
 			descs, err = UsbGetIppOverUsbDeviceDescs()
 		}
@@ -291,10 +660,15 @@ func main() {
 			})
 
 			InitLog.Info(0, "IPP over USB devices:")
-			InitLog.Info(0, " Num  Device              Vndr:Prod  Model")
+			InitLog.Info(0, " Num  Device              Path       Vndr:Prod  Model")
 			for i, dev := range list {
+				path := dev.Path
+				if path == "" {
+					path = "-"
+				}
+
 				buf.Reset()
-				fmt.Fprintf(&buf, "%3d. %s", i+1, dev.UsbAddr)
+				fmt.Fprintf(&buf, "%3d. %s  %-9s", i+1, dev.UsbAddr, path)
 				if info, err := dev.GetUsbDeviceInfo(); err == nil {
 					fmt.Fprintf(&buf, "  %4.4x:%.4x  %q",
 						info.Vendor, info.Product, info.MakeAndModel())
@@ -311,8 +685,16 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Check user privileges
-	if os.Geteuid() != 0 {
+	// In RunHold and RunRelease modes, ask the daemon, and we are done
+	if params.Mode == RunHold || params.Mode == RunRelease {
+		holdDevice(params.HoldDevice, params.Mode == RunHold)
+		os.Exit(0)
+	}
+
+	// Check user privileges. Externally opened USB
+	// device, replay and per-user instance don't require them
+	if os.Geteuid() != 0 && params.UsbFd < 0 && params.Replay == "" &&
+		!params.User {
 		InitLog.Exit(0, "This program requires root privileges")
 	}
 
@@ -328,6 +710,18 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Create private directory for single-device debug mode.
+	// It must not exist in advance
+	if params.DebugDir != "" {
+		err = os.Mkdir(params.DebugDir, 0700)
+		InitLog.Check(err)
+		defer os.RemoveAll(params.DebugDir)
+	}
+
+	// Check that we can write to our directories. If not, and
+	// it looks like SELinux/AppArmor denial, report it to console
+	MACCheckPaths(InitLog)
+
 	// Prevent multiple copies of ipp-usb from being running
 	// in a same time
 	MakeParentDirectory(PathLockFile)
@@ -352,22 +746,83 @@ func main() {
 		Log.Info(' ', "===============================")
 		Log.Info(' ', "ipp-usb started in %q mode, pid=%d",
 			params.Mode, os.Getpid())
+		defer Log.Sync()
 		defer Log.Info(' ', "ipp-usb finished")
+
+		// Old logs might accumulate while we were not running
+		if removed := LogDiskPrune(); len(removed) != 0 {
+			Log.Info(' ', "Log disk budget exceeded, %d old "+
+				"backups removed", len(removed))
+		}
+	}
+
+	if params.Match != nil {
+		Log.Info(' ', "Serving only %s, private files in %s",
+			params.Match, params.DebugDir)
+	}
+
+	// On IPv6-only host, devices are not reachable over network
+	// and cannot be discovered, if IPv6 is disabled
+	if !Conf.IPV6Enable && !Conf.LoopbackOnly && NetIPv6Only() {
+		Log.Info('!', "Host is IPv6-only, but ipv6 = disable")
+	}
+
+	// Devices, exposed to the network (or shared) without ACL, are
+	// accessible by anybody who can reach the host
+	if (!Conf.LoopbackOnly || Conf.DeviceShares != nil) &&
+		Conf.ACL == nil && Conf.DeviceACLs == nil {
+		Log.Info('!', "Devices are accessible from the network, "+
+			"consider restricting access with allow = ...")
+	}
+
+	// Apply resource limits
+	LimitsApply()
+
+	// In replay mode, real USB devices are not used
+	if params.Replay != "" {
+		err = ReplayRun(params.Replay)
+		InitLog.Check(err)
+		return
 	}
 
-	// Initialize USB
-	err = UsbInit(false)
+	// Initialize USB. In container mode hotplug is disabled,
+	// as there is usually no udev inside the container. Conformance
+	// tests don't need hotplug as well
+	if params.UsbFd >= 0 {
+		err = UsbInitFd(params.UsbFd)
+	} else {
+		err = UsbInit(params.Mode == RunContainer ||
+			params.Mode == RunConformance)
+	}
 	InitLog.Check(err)
 
-	// Close stdin/stdout/stderr, unless running in debug mode
-	if params.Mode != RunDebug {
+	// In conformance mode, test the device, print report and exit
+	if params.Mode == RunConformance {
+		err = ConformanceRun(os.Stdout, params.Devices,
+			params.CompatReport)
+		InitLog.Check(err)
+		return
+	}
+
+	// Close stdin/stdout/stderr, unless running in debug
+	// or container mode
+	if params.Mode != RunDebug && params.Mode != RunContainer {
 		err = CloseStdInOutErr()
 		InitLog.Check(err)
 	}
 
+	// Start leak checking, if enabled
+	LeakCheckStart()
+
+	// Resolve devices, selected by BUS:DEV, into USB paths, so
+	// they remain selected after re-enumeration
+	only, err := PnPResolveDevices(params.Devices)
+	InitLog.Check(err)
+
 	// Run PnP manager
 	for {
-		exitReason := PnPStart(params.Mode == RunUdev)
+		exitReason := PnPStart(params.Mode == RunUdev, only,
+			params.Match)
 
 		// The following race is possible here:
 		// 1) last device disappears, ipp-usb is about to exit
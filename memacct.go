@@ -0,0 +1,126 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-device memory usage accounting
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// MemKind is the kind of accounted memory
+type MemKind int
+
+// MemKind values
+const (
+	MemBuffers MemKind = iota // USB I/O buffers
+	MemBodies                 // Request and response bodies, held in memory
+	memKindMax
+)
+
+// String returns name of MemKind
+func (kind MemKind) String() string {
+	switch kind {
+	case MemBuffers:
+		return "buffers"
+	case MemBodies:
+		return "bodies"
+	}
+
+	return fmt.Sprintf("MemKind(%d)", int(kind))
+}
+
+// MemAcct accounts approximate amount of memory, held by
+// the single device.
+//
+// Only large allocations, whose size depends on device and
+// its workload, are accounted, so numbers are approximate
+// but good enough to spot a device, whose buffering has
+// ballooned
+type MemAcct struct {
+	lock  sync.Mutex        // Access lock
+	used  [memKindMax]int64 // Per-kind usage
+	total int64             // Total usage
+	peak  int64             // Peak of total usage
+}
+
+// Add accounts n bytes of memory of the specified kind
+func (acct *MemAcct) Add(kind MemKind, n int) {
+	acct.lock.Lock()
+	acct.used[kind] += int64(n)
+	acct.total += int64(n)
+	if acct.total > acct.peak {
+		acct.peak = acct.total
+	}
+	acct.lock.Unlock()
+}
+
+// Sub releases n bytes of memory of the specified kind
+func (acct *MemAcct) Sub(kind MemKind, n int) {
+	acct.Add(kind, -n)
+}
+
+// Used returns amount of memory of the specified kind
+func (acct *MemAcct) Used(kind MemKind) int64 {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	return acct.used[kind]
+}
+
+// Total returns total amount of accounted memory
+func (acct *MemAcct) Total() int64 {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	return acct.total
+}
+
+// Peak returns peak of total amount of accounted memory
+func (acct *MemAcct) Peak() int64 {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	return acct.peak
+}
+
+// String formats MemAcct for status, as following:
+//
+//	12K (buffers 8K, bodies 4K), peak 20K
+func (acct *MemAcct) String() string {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(memAcctFormat(acct.total))
+
+	for kind := MemKind(0); kind < memKindMax; kind++ {
+		if kind == 0 {
+			buf.WriteString(" (")
+		} else {
+			buf.WriteString(", ")
+		}
+
+		fmt.Fprintf(buf, "%s %s", kind, memAcctFormat(acct.used[kind]))
+	}
+
+	fmt.Fprintf(buf, "), peak %s", memAcctFormat(acct.peak))
+
+	return buf.String()
+}
+
+// memAcctFormat formats memory size in human-readable form,
+// using the same units, as in the configuration file
+func memAcctFormat(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%dK", (n+1023)/1024)
+	}
+
+	return fmt.Sprintf("%.1fM", float64(n)/(1024*1024))
+}
@@ -0,0 +1,96 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-device memory usage accounting test
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// TestMemAcct tests memory usage accounting
+func TestMemAcct(t *testing.T) {
+	acct := &MemAcct{}
+	acct.Add(MemBuffers, 8192)
+	acct.Add(MemBodies, 3*1024*1024)
+	acct.Sub(MemBodies, 3*1024*1024-100)
+
+	s := acct.String()
+	expected := "9K (buffers 8K, bodies 100), peak 3.0M"
+	if s != expected {
+		t.Errorf("MemAcct.String: expected %q, present %q", expected, s)
+	}
+}
+
+// TestMemAcctTransport tests memory usage accounting by UsbTransport
+func TestMemAcctTransport(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			ioutil.ReadAll(rq.Body)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	mem := transport.Mem()
+	buffers := int64(0)
+	for _, conn := range transport.connList {
+		buffers += int64(conn.reader.Size())
+	}
+
+	if mem.Used(MemBuffers) != buffers {
+		t.Errorf("buffers: expected %d, present %d",
+			buffers, mem.Used(MemBuffers))
+	}
+
+	// Small request body is prefetched and held in memory
+	// until sent
+	client := &http.Client{Transport: transport}
+	body := bytes.Repeat([]byte{'x'}, 1000)
+	resp, err := client.Post("http://localhost/", "text/plain",
+		bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if mem.Used(MemBodies) != 0 {
+		t.Errorf("bodies: %d bytes not released", mem.Used(MemBodies))
+	}
+
+	if mem.Peak() < buffers+int64(len(body)) {
+		t.Errorf("peak: %d, expected at least %d",
+			mem.Peak(), buffers+int64(len(body)))
+	}
+
+	// Large request body is read ahead with the fixed-size
+	// buffers, released after request is sent
+	body = bytes.Repeat([]byte{'x'}, 200000)
+	resp, err = client.Post("http://localhost/", "text/plain",
+		bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if mem.Used(MemBodies) != 0 {
+		t.Errorf("bodies: %d bytes not released", mem.Used(MemBodies))
+	}
+
+	transport.Close(false)
+
+	if mem.Total() != 0 {
+		t.Errorf("total: %d bytes not released after close",
+			mem.Total())
+	}
+}
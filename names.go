@@ -0,0 +1,153 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Sanitization of device-provided names
+ */
+
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// UsbStringMaxLen is the maximum length of USB string descriptor,
+// in characters
+const UsbStringMaxLen = 126
+
+// usbStringSanitize sanitizes string, obtained from the USB
+// string descriptor (manufacturer, product, serial number)
+//
+// libusb returns low bytes of UTF-16 characters, which effectively
+// gives Latin-1 for characters below U+0100. So if string is not
+// valid UTF-8, it is decoded as Latin-1.
+//
+// Control and other non-printable characters are replaced with
+// space and string is truncated to UsbStringMaxLen characters.
+//
+// Note, each character is replaced with exactly one character,
+// so identSanitize of the sanitized string gives the same result,
+// as of the original one, and persistent state of devices with
+// such names is preserved.
+func usbStringSanitize(s string) string {
+	if !utf8.ValidString(s) {
+		runes := make([]rune, len(s))
+		for i := 0; i < len(s); i++ {
+			runes[i] = rune(s[i])
+		}
+		s = string(runes)
+	}
+
+	s = strings.Map(func(c rune) rune {
+		if !unicode.IsPrint(c) {
+			c = ' '
+		}
+		return c
+	}, s)
+
+	if utf8.RuneCountInString(s) > UsbStringMaxLen {
+		s = string([]rune(s)[:UsbStringMaxLen])
+	}
+
+	return s
+}
+
+// nameSanitize sanitizes device name, used as DNS-SD instance name
+//
+// Invalid UTF-8 and non-printable characters are replaced with
+// space, sequences of spaces are replaced with the single space
+// and leading and trailing spaces are removed.
+//
+// If ascii is true, name is transliterated into ASCII
+func nameSanitize(s string, ascii bool) string {
+	s = strings.Map(func(c rune) rune {
+		if c == utf8.RuneError || !unicode.IsPrint(c) {
+			c = ' '
+		}
+		return c
+	}, s)
+
+	if ascii {
+		s = nameTransliterate(s)
+	}
+
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// nameTransliterate transliterates name into ASCII
+//
+// Latin letters with diacritics are replaced with base letters,
+// some other letters and punctuation with their common ASCII
+// equivalents. Other non-ASCII characters are dropped
+func nameTransliterate(s string) string {
+	buf := strings.Builder{}
+	for _, c := range s {
+		switch {
+		case c < utf8.RuneSelf:
+			buf.WriteRune(c)
+		case nameTranslit[c] != "":
+			buf.WriteString(nameTranslit[c])
+		}
+	}
+
+	return buf.String()
+}
+
+// nameTruncate truncates name to at most max bytes, without
+// breaking UTF-8 sequences
+func nameTruncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+
+	return s[:max]
+}
+
+// nameTranslit contains ASCII transliterations of non-ASCII
+// characters, commonly found in device names
+var nameTranslit = map[rune]string{
+	// Latin-1 Supplement
+	'©': "(C)", '®': "(R)", '·': ".",
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A",
+	'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O",
+	'Ô': "O", 'Õ': "O", 'Ö': "O", '×': "x",
+	'Ø': "O", 'Ù': "U", 'Ú': "U", 'Û': "U",
+	'Ü': "U", 'Ý': "Y", 'Þ': "TH", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a",
+	'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o",
+	'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ý': "y", 'þ': "th", 'ÿ': "y",
+
+	// Latin Extended-A, most common letters
+	'Ą': "A", 'ą': "a", 'Ć': "C", 'ć': "c",
+	'Č': "C", 'č': "c", 'Ď': "D", 'ď': "d",
+	'Ę': "E", 'ę': "e", 'Ě': "E", 'ě': "e",
+	'Ğ': "G", 'ğ': "g", 'İ': "I", 'ı': "i",
+	'Ł': "L", 'ł': "l", 'Ń': "N", 'ń': "n",
+	'Ň': "N", 'ň': "n", 'Ő': "O", 'ő': "o",
+	'Œ': "OE", 'œ': "oe", 'Ř': "R", 'ř': "r",
+	'Ś': "S", 'ś': "s", 'Ş': "S", 'ş': "s",
+	'Š': "S", 'š': "s", 'Ť': "T", 'ť': "t",
+	'Ů': "U", 'ů': "u", 'Ű': "U", 'ű': "u",
+	'Ÿ': "Y", 'Ź': "Z", 'ź': "z", 'Ż': "Z",
+	'ż': "z", 'Ž': "Z", 'ž': "z",
+
+	// Punctuation
+	'‐': "-", '‑': "-", '‒': "-", '–': "-",
+	'—': "-", '‘': "'", '’': "'", '“': "\"",
+	'”': "\"", '™': "(TM)",
+}
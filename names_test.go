@@ -0,0 +1,92 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for sanitization of device-provided names
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestUsbStringSanitize tests usbStringSanitize
+func TestUsbStringSanitize(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"HP LaserJet", "HP LaserJet"},
+		{"Imprimante \xe9l\xe9gante", "Imprimante élégante"},
+		{"Café", "Café"},
+		{"A\x01B\tC\x7f", "A B C "},
+		{"\xff\x00", "ÿ "},
+		{strings.Repeat("x", 200), strings.Repeat("x", UsbStringMaxLen)},
+	}
+
+	for _, test := range tests {
+		out := usbStringSanitize(test.in)
+		if out != test.out {
+			t.Errorf("%q: expected %q, present %q", test.in, test.out, out)
+		}
+
+		// Persistent state identifier must not change
+		if identSanitize(out) != identSanitize(test.in) &&
+			len(test.in) <= UsbStringMaxLen {
+			t.Errorf("%q: ident changed: %q -> %q", test.in,
+				identSanitize(test.in), identSanitize(out))
+		}
+	}
+}
+
+// TestNameSanitize tests nameSanitize
+func TestNameSanitize(t *testing.T) {
+	tests := []struct {
+		in    string
+		ascii bool
+		out   string
+	}{
+		{"  Kyocera ECOSYS M2040dn ", false, "Kyocera ECOSYS M2040dn"},
+		{"HP\x00\x00LaserJet\r\n", false, "HP LaserJet"},
+		{"Bad \xff\xfe name", false, "Bad name"},
+		{"Imprimante élégante", false, "Imprimante élégante"},
+		{"Imprimante élégante", true, "Imprimante elegante"},
+		{"Straße Drucker™", true, "Strasse Drucker(TM)"},
+		{"Принтер Canon", true, "Canon"},
+		{"", true, ""},
+	}
+
+	for _, test := range tests {
+		out := nameSanitize(test.in, test.ascii)
+		if out != test.out {
+			t.Errorf("%q (ascii=%v): expected %q, present %q",
+				test.in, test.ascii, test.out, out)
+		}
+	}
+}
+
+// TestNameTruncate tests nameTruncate
+func TestNameTruncate(t *testing.T) {
+	tests := []struct {
+		in  string
+		max int
+		out string
+	}{
+		{"Canon", 63, "Canon"},
+		{"Canon", 3, "Can"},
+		{"ééé", 4, "éé"},
+		{"ééé", 3, "é"},
+		{"é", 1, ""},
+	}
+
+	for _, test := range tests {
+		out := nameTruncate(test.in, test.max)
+		if out != test.out || !utf8.ValidString(out) {
+			t.Errorf("%q, %d: expected %q, present %q",
+				test.in, test.max, test.out, out)
+		}
+	}
+}
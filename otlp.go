@@ -0,0 +1,356 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Export of HTTP transactions timing as OpenTelemetry (OTLP) spans
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+)
+
+// OTLP status codes
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+// otlpMaxQueuedSpans limits count of spans, queued for export.
+// If collector is slow or not reachable, the oldest spans are
+// dropped
+const otlpMaxQueuedSpans = 4096
+
+// otlpSpan is the single span, in the OTLP/JSON encoding
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+// otlpAttr is the span or resource attribute
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is the attribute value. OTLP/JSON encodes
+// 64-bit integers as strings
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+// otlpStatus is the span status
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpExporter sends spans to the OTLP/HTTP collector
+//
+// Spans are queued in memory and sent in batches by the
+// background goroutine. Export is best-effort: spans that
+// cannot be sent are dropped
+type otlpExporter struct {
+	url      string        // Collector URL
+	interval time.Duration // Batching interval
+	client   *http.Client  // HTTP client
+	lock     sync.Mutex    // Access lock
+	spans    []otlpSpan    // Queued spans
+	failed   bool          // Last export has failed
+	wake     chan struct{} // Wakes up sender goroutine
+}
+
+// otlpActive is the active otlpExporter, nil if not opened
+var otlpActive struct {
+	lock     sync.Mutex    // Access lock
+	exporter *otlpExporter // Active exporter
+}
+
+// OtlpOpen starts export of spans to the OTLP/HTTP collector
+// at the specified URL (i.e., http://localhost:4318/v1/traces)
+//
+// Once opened, export remains active until program exit
+func OtlpOpen(url string) {
+	otlpActive.lock.Lock()
+	defer otlpActive.lock.Unlock()
+
+	if otlpActive.exporter != nil {
+		return
+	}
+
+	exporter := newOtlpExporter(url)
+	go exporter.sender()
+
+	otlpActive.exporter = exporter
+}
+
+// newOtlpExporter creates a new otlpExporter. Sender goroutine
+// is not started
+func newOtlpExporter(url string) *otlpExporter {
+	return &otlpExporter{
+		url:      url,
+		interval: OtlpExportInterval,
+		client:   &http.Client{Timeout: OtlpExportInterval},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// OtlpExportTiming exports timing of the HTTP transaction as
+// a span, covering the whole transaction, with a child span for
+// each of its stages. If OtlpOpen was not called, it does nothing
+func OtlpExportTiming(timing *usbTiming, device string,
+	session int, status string) {
+
+	otlpActive.lock.Lock()
+	exporter := otlpActive.exporter
+	otlpActive.lock.Unlock()
+
+	if exporter != nil {
+		exporter.add(otlpTimingSpans(timing, device, session,
+			status, time.Now()))
+	}
+}
+
+// otlpTimingSpans converts usbTiming into spans
+//
+// If request has the W3C traceparent header, spans become part
+// of the client's trace
+func otlpTimingSpans(timing *usbTiming, device string,
+	session int, status string, end time.Time) []otlpSpan {
+
+	traceID, parentID := otlpParseTraceparent(timing.traceparent)
+	if traceID == "" {
+		traceID = otlpNewID(16)
+	}
+
+	// Transaction span
+	root := otlpSpan{
+		TraceID:      traceID,
+		SpanID:       otlpNewID(8),
+		ParentSpanID: parentID,
+		Name:         strings.TrimSpace(timing.method + " " + timing.target),
+		Kind:         otlpSpanKindServer,
+		Start:        otlpTime(timing.start),
+		End:          otlpTime(end),
+		Status:       otlpStatus{Code: otlpStatusOk},
+	}
+
+	root.Attributes = []otlpAttr{
+		otlpString("http.method", timing.method),
+		otlpString("http.target", timing.target),
+		otlpInt("ipp_usb.session", int64(session)),
+	}
+
+	if device != "" {
+		root.Attributes = append(root.Attributes,
+			otlpString("ipp_usb.device", device))
+	}
+
+	if timing.code != 0 {
+		root.Attributes = append(root.Attributes,
+			otlpInt("http.status_code", int64(timing.code)))
+	}
+
+	if timing.code == 0 || timing.code >= 500 {
+		root.Status = otlpStatus{Code: otlpStatusError, Message: status}
+	}
+
+	spans := []otlpSpan{root}
+
+	// Stages spans. Unreached stages are omitted
+	stages := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"usb-connection-wait", timing.start, timing.queued},
+		{"request-write", timing.queued, timing.sent},
+		{"device-response", timing.sent, timing.firstByte},
+		{"response-body", timing.firstByte, timing.received},
+		{"response-drain", timing.firstByte, timing.drained},
+	}
+
+	for _, stage := range stages {
+		if stage.start.IsZero() || stage.end.IsZero() {
+			continue
+		}
+
+		spans = append(spans, otlpSpan{
+			TraceID:      traceID,
+			SpanID:       otlpNewID(8),
+			ParentSpanID: root.SpanID,
+			Name:         stage.name,
+			Kind:         otlpSpanKindInternal,
+			Start:        otlpTime(stage.start),
+			End:          otlpTime(stage.end),
+		})
+	}
+
+	return spans
+}
+
+// add queues spans for export
+func (exporter *otlpExporter) add(spans []otlpSpan) {
+	exporter.lock.Lock()
+
+	exporter.spans = append(exporter.spans, spans...)
+	if drop := len(exporter.spans) - otlpMaxQueuedSpans; drop > 0 {
+		exporter.spans = append(exporter.spans[:0],
+			exporter.spans[drop:]...)
+	}
+
+	exporter.lock.Unlock()
+
+	select {
+	case exporter.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sender sends queued spans in batches. The sender waits for the
+// first span, then collects spans for the batching interval
+func (exporter *otlpExporter) sender() {
+	for range exporter.wake {
+		time.Sleep(exporter.interval)
+
+		exporter.lock.Lock()
+		spans := exporter.spans
+		exporter.spans = nil
+		exporter.lock.Unlock()
+
+		err := exporter.send(spans)
+
+		// Report export failures and recovery only once,
+		// so unreachable collector doesn't flood the log
+		switch {
+		case err != nil && !exporter.failed:
+			Log.Error('!', "OTLP: %s: %s", exporter.url, err)
+		case err == nil && exporter.failed:
+			Log.Info(' ', "OTLP: %s: resumed", exporter.url)
+		}
+
+		exporter.failed = err != nil
+	}
+}
+
+// send sends spans to the collector
+func (exporter *otlpExporter) send(spans []otlpSpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	// Build the ExportTraceServiceRequest
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	var rs resourceSpans
+	rs.Resource.Attributes = []otlpAttr{
+		otlpString("service.name", "ipp-usb"),
+	}
+
+	ss := scopeSpans{Spans: spans}
+	ss.Scope.Name = "ipp-usb"
+	rs.ScopeSpans = []scopeSpans{ss}
+
+	data, err := json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{rs}})
+
+	if err != nil {
+		return err
+	}
+
+	// Send it
+	resp, err := exporter.client.Post(exporter.url, "application/json",
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	return nil
+}
+
+// otlpParseTraceparent parses the W3C traceparent header
+// (version-traceid-parentid-flags) and returns trace and
+// parent span IDs. On error, empty strings are returned
+func otlpParseTraceparent(traceparent string) (traceID, parentID string) {
+	fields := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" ||
+		len(fields[1]) != 32 || len(fields[2]) != 16 {
+		return "", ""
+	}
+
+	for _, id := range fields[1:3] {
+		b, err := hex.DecodeString(id)
+		if err != nil || strings.ToLower(id) != id ||
+			bytes.Count(b, []byte{0}) == len(b) {
+			return "", ""
+		}
+	}
+
+	return fields[1], fields[2]
+}
+
+// otlpNewID generates random trace or span ID of the
+// specified size, in bytes, hex-encoded
+func otlpNewID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// otlpTime formats time as OTLP timestamp
+func otlpTime(tm time.Time) string {
+	return strconv.FormatInt(tm.UnixNano(), 10)
+}
+
+// otlpString makes string attribute
+func otlpString(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// otlpInt makes integer attribute
+func otlpInt(key string, value int64) otlpAttr {
+	return otlpAttr{Key: key,
+		Value: otlpValue{IntValue: strconv.FormatInt(value, 10)}}
+}
@@ -0,0 +1,138 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for export of OTLP spans
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOtlpTimingSpans tests conversion of usbTiming into spans
+func TestOtlpTimingSpans(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+
+	start := time.Unix(1000, 0)
+	timing := &usbTiming{
+		start:       start,
+		queued:      start.Add(1 * time.Millisecond),
+		sent:        start.Add(2 * time.Millisecond),
+		firstByte:   start.Add(3 * time.Millisecond),
+		received:    start.Add(4 * time.Millisecond),
+		method:      "POST",
+		target:      "/ipp/print",
+		traceparent: "00-" + traceID + "-" + parentID + "-01",
+		code:        200,
+	}
+
+	spans := otlpTimingSpans(timing, "dev", 5, "200 OK",
+		start.Add(5*time.Millisecond))
+
+	// Check names and hierarchy
+	names := []string{}
+	for _, span := range spans {
+		names = append(names, span.Name)
+		if span.TraceID != traceID {
+			t.Errorf("%s: traceId %q", span.Name, span.TraceID)
+		}
+	}
+
+	expected := "POST /ipp/print usb-connection-wait request-write " +
+		"device-response response-body"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("expected %q, present %q", expected, names)
+	}
+
+	root := spans[0]
+	switch {
+	case root.ParentSpanID != parentID:
+		t.Errorf("root parent: %q", root.ParentSpanID)
+	case root.Start != "1000000000000" || root.End != "1000005000000":
+		t.Errorf("root time: %s-%s", root.Start, root.End)
+	case root.Status.Code != otlpStatusOk:
+		t.Errorf("root status: %+v", root.Status)
+	}
+
+	for _, span := range spans[1:] {
+		if span.ParentSpanID != root.SpanID {
+			t.Errorf("%s: parent %q", span.Name, span.ParentSpanID)
+		}
+	}
+
+	// Failed transaction without traceparent
+	timing = &usbTiming{start: start, method: "GET", target: "/"}
+	spans = otlpTimingSpans(timing, "", 5, "broken pipe", start)
+
+	switch {
+	case len(spans) != 1:
+		t.Errorf("%d spans, expected 1", len(spans))
+	case spans[0].ParentSpanID != "" || len(spans[0].TraceID) != 32:
+		t.Errorf("bad IDs: %q %q", spans[0].TraceID,
+			spans[0].ParentSpanID)
+	case spans[0].Status.Code != otlpStatusError ||
+		spans[0].Status.Message != "broken pipe":
+		t.Errorf("status: %+v", spans[0].Status)
+	}
+}
+
+// TestOtlpExport tests sending of spans to the collector
+func TestOtlpExport(t *testing.T) {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, rq *http.Request) {
+			data, _ := ioutil.ReadAll(rq.Body)
+			received <- data
+		}))
+	defer server.Close()
+
+	exporter := newOtlpExporter(server.URL + "/v1/traces")
+	exporter.interval = 0
+	go exporter.sender()
+	defer close(exporter.wake)
+
+	start := time.Now()
+	exporter.add(otlpTimingSpans(&usbTiming{start: start,
+		method: "GET", target: "/eSCL/ScannerStatus", code: 200},
+		"dev", 1, "200 OK", start))
+
+	var data []byte
+	select {
+	case data = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	var rq struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+
+	err := json.Unmarshal(data, &rq)
+	switch {
+	case err != nil:
+		t.Fatalf("%s", err)
+	case len(rq.ResourceSpans) != 1 ||
+		len(rq.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(rq.ResourceSpans[0].ScopeSpans[0].Spans) != 1:
+		t.Fatalf("unexpected request:\n%s", data)
+	}
+
+	span := rq.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.Name != "GET /eSCL/ScannerStatus" {
+		t.Errorf("unexpected span name %q", span.Name)
+	}
+}
@@ -29,6 +29,13 @@ var (
 	// Directory that contains per-device state files
 	PathDevStateDir = DefaultPathDevStateDir
 
+	// Directory that contains per-device TLS certificates
+	PathCertDir = DefaultPathCertDir
+
+	// The zstd program. It is run by absolute path, so
+	// the daemon doesn't depend on PATH
+	PathZstd = DefaultPathZstd
+
 	// Path to the program's executable file.
 	// Initialized by PathInit()
 	PathExecutableFile string
@@ -50,22 +57,11 @@ var (
 	PathQuirksDirList string
 )
 
-// Default paths:
+// Default paths, common for all platforms. The platform-specific
+// defaults (DefaultPathConfDir, DefaultPathLocalQuirksDir,
+// DefaultPathGlobalQuirksDir, DefaultPathProgState, DefaultPathLogDir
+// and DefaultPathZstd) are defined in the paths_<os>.go files.
 const (
-	// DefaultPathConfDir defines path to configuration directory
-	DefaultPathConfDir = "/etc/ipp-usb"
-
-	// DefaultPathLocalQuirksDir defines path to locally administered
-	// quirks files
-	DefaultPathLocalQuirksDir = "/etc/ipp-usb/quirks"
-
-	// DefaultPathGlobalQuirksDir defines path to the "global"
-	// quirks files, i.e., files that comes with the ipp-usb package
-	DefaultPathGlobalQuirksDir = "/usr/share/ipp-usb/quirks"
-
-	// DefaultPathProgState defines path to program state directory
-	DefaultPathProgState = "/var/ipp-usb"
-
 	// DefaultPathLockDir defines path to directory that contains
 	// lock files
 	DefaultPathLockDir = DefaultPathProgState + "/lock"
@@ -80,8 +76,9 @@ const (
 	// per-device state files are saved to
 	DefaultPathDevStateDir = DefaultPathProgState + "/dev"
 
-	// DefaultPathLogDir defines path to log directory
-	DefaultPathLogDir = "/var/log/ipp-usb"
+	// DefaultPathCertDir defines path to directory where
+	// per-device self-signed TLS certificates are saved to
+	DefaultPathCertDir = DefaultPathProgState + "/cert"
 )
 
 // PathsInit initializes paths handling.
@@ -121,6 +118,78 @@ func PathsInit() error {
 	return nil
 }
 
+// PathsUserInit switches paths to the per-user layout, suitable
+// for running unprivileged per-user session instance, following
+// the XDG Base Directory Specification:
+//
+//	configuration - $XDG_CONFIG_HOME/ipp-usb, then system-wide
+//	logs          - $XDG_STATE_HOME/ipp-usb/log
+//	device state  - $XDG_STATE_HOME/ipp-usb/dev
+//	certificates  - $XDG_STATE_HOME/ipp-usb/cert
+//	lock, control - $XDG_RUNTIME_DIR/ipp-usb, or state directory,
+//	                if XDG_RUNTIME_DIR is not set
+//
+// Must be called after PathsInit()
+func PathsUserInit() {
+	home := os.Getenv("HOME")
+
+	confHome := pathsXdgDir("XDG_CONFIG_HOME", home, ".config")
+	stateHome := pathsXdgDir("XDG_STATE_HOME", home, ".local/state")
+
+	confDir := filepath.Join(confHome, "ipp-usb")
+	stateDir := filepath.Join(stateHome, "ipp-usb")
+
+	runtimeDir := stateDir
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+		runtimeDir = filepath.Join(dir, "ipp-usb")
+	}
+
+	PathLogDir = filepath.Join(stateDir, "log")
+	PathDevStateDir = filepath.Join(stateDir, "dev")
+	PathCertDir = filepath.Join(stateDir, "cert")
+	PathLockFile = filepath.Join(runtimeDir, "ipp-usb.lock")
+	PathControlSocket = filepath.Join(runtimeDir, "ctrl")
+
+	sep := string(filepath.ListSeparator)
+	PathConfDirList = confDir + sep + PathConfDirList
+	PathQuirksDirList = filepath.Join(confDir, "quirks") + sep +
+		PathQuirksDirList
+}
+
+// PathsDebugInit switches lock file, control socket, logs and
+// device state into the private temporary directory, so the
+// single-device debug instance doesn't interfere with the
+// running system instance. It returns the directory path.
+//
+// The directory is not created here. Caller must create it
+// exclusively before use and remove it at exit (it may remain,
+// if program terminates on fatal error).
+func PathsDebugInit() string {
+	dir := filepath.Join(os.TempDir(),
+		fmt.Sprintf("ipp-usb-debug-%d", os.Getpid()))
+
+	PathLogDir = filepath.Join(dir, "log")
+	PathDevStateDir = filepath.Join(dir, "dev")
+	PathCertDir = filepath.Join(dir, "cert")
+	PathLockFile = filepath.Join(dir, "ipp-usb.lock")
+	PathControlSocket = filepath.Join(dir, "ctrl")
+
+	return dir
+}
+
+// pathsXdgDir returns XDG base directory, specified by the
+// environment variable, or default, relative to the home directory
+//
+// Note, the XDG specification requires relative paths in
+// these variables to be ignored
+func pathsXdgDir(env, home, def string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+
+	return filepath.Join(home, def)
+}
+
 // MakeDirectory creates a directory, specified by the path,
 // along with any necessary parents.
 //
@@ -0,0 +1,36 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Default paths -- FreeBSD version
+ *
+ * FreeBSD keeps third-party software under /usr/local and
+ * persistent program state under /var/db (see hier(7))
+ */
+
+package main
+
+// Default paths:
+const (
+	// DefaultPathConfDir defines path to configuration directory
+	DefaultPathConfDir = "/usr/local/etc/ipp-usb"
+
+	// DefaultPathLocalQuirksDir defines path to locally administered
+	// quirks files
+	DefaultPathLocalQuirksDir = "/usr/local/etc/ipp-usb/quirks"
+
+	// DefaultPathGlobalQuirksDir defines path to the "global"
+	// quirks files, i.e., files that comes with the ipp-usb package
+	DefaultPathGlobalQuirksDir = "/usr/local/share/ipp-usb/quirks"
+
+	// DefaultPathProgState defines path to program state directory
+	DefaultPathProgState = "/var/db/ipp-usb"
+
+	// DefaultPathLogDir defines path to log directory
+	DefaultPathLogDir = "/var/log/ipp-usb"
+
+	// DefaultPathZstd defines path to the zstd program, used for
+	// compression of rotated log files
+	DefaultPathZstd = "/usr/bin/zstd"
+)
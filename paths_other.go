@@ -0,0 +1,40 @@
+//go:build !darwin && !freebsd && !netbsd && !openbsd
+// +build !darwin,!freebsd,!netbsd,!openbsd
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Default paths -- default (Linux) version
+ *
+ * If you've have added platform-specific paths for yet another platform,
+ * please don't forget to update build tag at the top of this file to
+ * exclude your platform
+ */
+
+package main
+
+// Default paths:
+const (
+	// DefaultPathConfDir defines path to configuration directory
+	DefaultPathConfDir = "/etc/ipp-usb"
+
+	// DefaultPathLocalQuirksDir defines path to locally administered
+	// quirks files
+	DefaultPathLocalQuirksDir = "/etc/ipp-usb/quirks"
+
+	// DefaultPathGlobalQuirksDir defines path to the "global"
+	// quirks files, i.e., files that comes with the ipp-usb package
+	DefaultPathGlobalQuirksDir = "/usr/share/ipp-usb/quirks"
+
+	// DefaultPathProgState defines path to program state directory
+	DefaultPathProgState = "/var/ipp-usb"
+
+	// DefaultPathLogDir defines path to log directory
+	DefaultPathLogDir = "/var/log/ipp-usb"
+
+	// DefaultPathZstd defines path to the zstd program, used for
+	// compression of rotated log files
+	DefaultPathZstd = "/usr/bin/zstd"
+)
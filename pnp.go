@@ -42,110 +42,348 @@ func pnpRetryExpired(tm time.Time) bool {
 	return !time.Now().Before(tm)
 }
 
+// pnpState represents the PnP manager state machine: the set
+// of connected devices, devices being served and devices waiting
+// for initialization retry.
+//
+// It is driven by PnPStart with the actual list of USB devices,
+// and may be driven by tests with simulated devices as well
+type pnpState struct {
+	devices     UsbAddrList                          // Connected devices
+	devByAddr   map[UsbAddr]*Device                  // Served devices
+	retryByAddr map[UsbAddr]time.Time                // Waiting for retry
+	newDevice   func(UsbDeviceDesc) (*Device, error) // Device constructor
+}
+
+// newPnpState creates a new pnpState
+func newPnpState() *pnpState {
+	return &pnpState{
+		devices:     UsbAddrList{},
+		devByAddr:   make(map[UsbAddr]*Device),
+		retryByAddr: make(map[UsbAddr]time.Time),
+		newDevice:   NewDevice,
+	}
+}
+
+// update handles changes in the set of connected devices and
+// retries initialization of failed devices, if retry time expired
+func (state *pnpState) update(devDescs map[UsbAddr]UsbDeviceDesc) {
+	newdevices := UsbAddrList{}
+	for _, desc := range devDescs {
+		newdevices.Add(desc.UsbAddr)
+	}
+
+	added, removed := state.devices.Diff(newdevices)
+	state.devices = newdevices
+
+	// Handle added devices
+	for _, addr := range added {
+		Log.Debug('+', "PNP %s: added", addr)
+		state.open(devDescs[addr])
+	}
+
+	// Handle removed devices
+	for _, addr := range removed {
+		Log.Debug('-', "PNP %s: removed", addr)
+		delete(state.retryByAddr, addr)
+		StatusDel(addr)
+
+		dev, ok := state.devByAddr[addr]
+		if ok {
+			dev.Close()
+			delete(state.devByAddr, addr)
+		}
+	}
+
+	// Handle stalled devices: reset and reopen them
+	for addr, dev := range state.devByAddr {
+		if dev.UsbTransport.Stalled() {
+			Log.Error('!', "PNP %s: device stalled, resetting", addr)
+			dev.CloseReset()
+			delete(state.devByAddr, addr)
+			state.open(devDescs[addr])
+		}
+	}
+
+	// Handle disconnected devices. Normally, they are handled
+	// above as removed, but if device is visible again at the
+	// same address (i.e., reconnected quickly), reopen it
+	for addr, dev := range state.devByAddr {
+		if dev.UsbTransport.Disconnected() {
+			Log.Error('!', "PNP %s: device disconnected, reopening",
+				addr)
+			dev.Close()
+			delete(state.devByAddr, addr)
+			state.open(devDescs[addr])
+		}
+	}
+
+	// Handle devices, waiting for retry
+	for addr, tm := range state.retryByAddr {
+		if !pnpRetryExpired(tm) {
+			continue
+		}
+
+		Log.Debug('+', "PNP %s: retry", addr)
+		state.open(devDescs[addr])
+	}
+}
+
+// open creates the Device. On failure, device is scheduled
+// for initialization retry
+func (state *pnpState) open(desc UsbDeviceDesc) {
+	addr := desc.UsbAddr
+	dev, err := state.newDevice(desc)
+	StatusSet(addr, desc, dev, err)
+
+	if err == nil {
+		state.devByAddr[addr] = dev
+		delete(state.retryByAddr, addr)
+	} else {
+		Log.Error('!', "PNP %s: %s", addr, err)
+		state.retryByAddr[addr] = pnpRetryTime(err)
+	}
+}
+
+// resume handles system resume from suspend. All served devices
+// are closed and forgotten, so on the next update they will be
+// reopened as newly added
+func (state *pnpState) resume() {
+	for addr, dev := range state.devByAddr {
+		Log.Debug('-', "PNP %s: closed due to resume", addr)
+		dev.Close()
+	}
+
+	state.devices = UsbAddrList{}
+	state.devByAddr = make(map[UsbAddr]*Device)
+	state.retryByAddr = make(map[UsbAddr]time.Time)
+}
+
+// reloadLogLevels reloads log levels from the configuration
+// files and applies them to the main log and served devices
+func (state *pnpState) reloadLogLevels() {
+	err := ConfLoadLogLevels()
+	if err != nil {
+		Log.Error('!', "PNP: log levels not reloaded: %s", err)
+		return
+	}
+
+	Log.SetLevels(Conf.LogMain)
+	for _, dev := range state.devByAddr {
+		dev.Log.SetLevels(Conf.LogDevice)
+	}
+	UsbLogLevelsUpdate()
+
+	Log.Info(' ', "PNP: log levels reloaded")
+}
+
+// close gracefully shuts down and closes all served devices.
+//
+// Devices, that fail to shut down within the Conf.ShutdownTimeout,
+// because some jobs refuse to finish, are closed forcibly, so the
+// process exits in a bounded time and systemd doesn't have to kill it
+func (state *pnpState) close() {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		Conf.ShutdownTimeout)
+	defer cancel()
+
+	var done sync.WaitGroup
+
+	for _, dev := range state.devByAddr {
+		done.Add(1)
+		go func(dev *Device) {
+			if dev.Shutdown(ctx) != nil {
+				dev.CloseForce()
+			} else {
+				dev.Close()
+			}
+			done.Done()
+		}(dev)
+	}
+
+	done.Wait()
+
+	state.devByAddr = make(map[UsbAddr]*Device)
+}
+
+// PnPDevice represents device, selected by BUS:DEV
+type PnPDevice struct {
+	Addr     UsbAddr     // Device address, as selected
+	Match    UsbDevMatch // VID:PID and USB path, if resolved
+	Resolved bool        // Device is resolved
+}
+
+// PnPResolveDevices resolves addresses of devices, selected by
+// BUS:DEV, into their VID:PID and physical USB path.
+//
+// USB address changes every time device re-enumerates (i.e., after
+// reset), but physical path remains the same, so selected device is
+// tracked by path.
+//
+// Device, not present at startup or without known USB path, is
+// matched by BUS:DEV, until it is found by hotplug or rescan and
+// resolved
+func PnPResolveDevices(addrs UsbAddrList) ([]*PnPDevice, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	devDescs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		return nil, err
+	}
+
+	only := make([]*PnPDevice, 0, len(addrs))
+	for _, addr := range addrs {
+		dev := &PnPDevice{Addr: addr}
+		if desc, found := devDescs[addr]; found {
+			dev.resolve(desc)
+		} else {
+			Log.Info('!', "%s: IPP-over-USB device not found, "+
+				"waiting for it", addr)
+		}
+
+		only = append(only, dev)
+	}
+
+	return only, nil
+}
+
+// resolve resolves device into its VID:PID and USB path, if
+// path is known. Otherwise, device remains matched by BUS:DEV
+func (dev *PnPDevice) resolve(desc UsbDeviceDesc) {
+	if desc.Path == "" {
+		Log.Info('!', "%s: USB path unknown, selected by address",
+			dev.Addr)
+		return
+	}
+
+	dev.Match = UsbDevMatch{
+		Vendor:  desc.Vendor,
+		Product: desc.Product,
+		Path:    desc.Path,
+	}
+	dev.Resolved = true
+
+	Log.Debug(' ', "%s: selected as %s", dev.Addr, dev.Match)
+}
+
+// match tells if device matches the PnPDevice. Unresolved
+// PnPDevice is resolved, when device is found at its address
+func (dev *PnPDevice) match(desc UsbDeviceDesc) bool {
+	if dev.Resolved {
+		return dev.Match.Match(desc, desc.GetUsbDeviceInfo)
+	}
+
+	if desc.UsbAddr != dev.Addr {
+		return false
+	}
+
+	if desc.Path != "" {
+		dev.resolve(desc)
+	}
+
+	return true
+}
+
+// pnpMatchAny tells if device matches any of PnPDevice entries.
+// Entries don't require the serial number, so device is not opened
+func pnpMatchAny(only []*PnPDevice, desc UsbDeviceDesc) bool {
+	for _, dev := range only {
+		if dev.match(desc) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // PnPStart start PnP manager
 //
 // If exitWhenIdle is true, PnP manager will exit, when there is no more
 // devices to serve
-func PnPStart(exitWhenIdle bool) PnPExitReason {
-	devices := UsbAddrList{}
-	devByAddr := make(map[UsbAddr]*Device)
-	retryByAddr := make(map[UsbAddr]time.Time)
+//
+// If only is not empty, only devices that match any of its entries
+// are served (see PnPResolveDevices). If match is not nil, only
+// devices that match are served
+func PnPStart(exitWhenIdle bool, only []*PnPDevice,
+	match *UsbDevMatch) PnPExitReason {
+	state := newPnpState()
 	sigChan := make(chan os.Signal, 1)
+	rescanChan := make(chan os.Signal, 1)
+	logLevelsChan := make(chan os.Signal, 1)
 	ticker := time.NewTicker(DevInitRetryInterval / 4)
 	tickerRunning := true
+	resumeDone := make(chan struct{})
+	resumeChan := resumeWatch(resumeDone)
+
+	defer close(resumeDone)
 
 	signal.Notify(sigChan,
 		os.Signal(syscall.SIGINT),
 		os.Signal(syscall.SIGTERM),
 		os.Signal(syscall.SIGHUP))
 
+	signal.Notify(rescanChan, os.Signal(syscall.SIGUSR2))
+	defer signal.Stop(rescanChan)
+
+	signal.Notify(logLevelsChan, os.Signal(syscall.SIGUSR1))
+	defer signal.Stop(logLevelsChan)
+
 	// Start control socket server
 	err := CtrlsockStart()
 	if err == nil {
 		defer CtrlsockStop()
 	}
 
+	// Start the built-in test device, if enabled
+	if testdev := TestDeviceStart(); testdev != nil {
+		defer func() {
+			testdev.Close()
+			StatusDel(testdev.UsbAddr)
+		}()
+	}
+
 	// Serve PnP events until terminated
 loop:
 	for {
 		devDescs, err := UsbGetIppOverUsbDeviceDescs()
 
-		if err == nil {
-			newdevices := UsbAddrList{}
-			for _, desc := range devDescs {
-				newdevices.Add(desc.UsbAddr)
-			}
-
-			added, removed := devices.Diff(newdevices)
-			devices = newdevices
-
-			// Handle added devices
-			for _, addr := range added {
-				Log.Debug('+', "PNP %s: added", addr)
-				dev, err := NewDevice(devDescs[addr])
-				port := 0
-				if dev != nil {
-					port = dev.State.HTTPPort
-				}
-				StatusSet(addr, devDescs[addr], port, err)
-
-				if err == nil {
-					devByAddr[addr] = dev
-				} else {
-					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime(err)
+		if err == nil && len(only) != 0 {
+			for addr, desc := range devDescs {
+				if !pnpMatchAny(only, desc) {
+					delete(devDescs, addr)
 				}
 			}
+		}
 
-			// Handle removed devices
-			for _, addr := range removed {
-				Log.Debug('-', "PNP %s: removed", addr)
-				delete(retryByAddr, addr)
-				StatusDel(addr)
-
-				dev, ok := devByAddr[addr]
-				if ok {
-					dev.Close()
-					delete(devByAddr, addr)
+		// Devices already known to PnP have been matched before,
+		// so don't open them again to check serial number
+		if err == nil && match != nil {
+			for addr, desc := range devDescs {
+				if state.devices.Find(addr) < 0 &&
+					!match.Match(desc, desc.GetUsbDeviceInfo) {
+					delete(devDescs, addr)
 				}
 			}
+		}
 
-			// Handle devices, waiting for retry
-			for addr, tm := range retryByAddr {
-				if !pnpRetryExpired(tm) {
-					continue
-				}
-
-				Log.Debug('+', "PNP %s: retry", addr)
-				dev, err := NewDevice(devDescs[addr])
-				port := 0
-				if dev != nil {
-					port = dev.State.HTTPPort
-				}
-				StatusSet(addr, devDescs[addr], port, err)
-
-				if err == nil {
-					devByAddr[addr] = dev
-					delete(retryByAddr, addr)
-				} else {
-					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime(err)
-				}
-			}
+		if err == nil {
+			state.update(devDescs)
 		}
 
 		// Handle exit when idle
-		if exitWhenIdle && len(devices) == 0 {
+		if exitWhenIdle && len(state.devices) == 0 {
 			Log.Info(' ', "No IPP-over-USB devices present, exiting")
 			return PnPIdle
 		}
 
 		// Update ticker
 		switch {
-		case tickerRunning && len(retryByAddr) == 0:
+		case tickerRunning && len(state.retryByAddr) == 0:
 			ticker.Stop()
 			tickerRunning = false
-		case !tickerRunning && len(retryByAddr) != 0:
+		case !tickerRunning && len(state.retryByAddr) != 0:
 			ticker = time.NewTicker(DevInitRetryInterval / 4)
 			tickerRunning = true
 		}
@@ -153,7 +391,16 @@ loop:
 		// Wait for the next event
 		select {
 		case <-UsbHotPlugChan:
+		case <-UsbStallChan:
+		case <-rescanChan:
+			Log.Debug(' ', "PNP: rescan requested")
+		case <-logLevelsChan:
+			state.reloadLogLevels()
 		case <-ticker.C:
+		case slept := <-resumeChan:
+			Log.Info(' ', "PNP: resumed after %s of sleep, reopening devices",
+				slept.Round(time.Second))
+			state.resume()
 		case sig := <-sigChan:
 			Log.Info(' ', "%s signal received, exiting", sig)
 			break loop
@@ -161,21 +408,6 @@ loop:
 	}
 
 	// Close remaining devices
-	ctx, cancel := context.WithTimeout(context.Background(),
-		DevShutdownTimeout)
-	defer cancel()
-
-	var done sync.WaitGroup
-
-	for _, dev := range devByAddr {
-		done.Add(1)
-		go func(dev *Device) {
-			dev.Shutdown(ctx)
-			dev.Close()
-			done.Done()
-		}(dev)
-	}
-
-	done.Wait()
+	state.close()
 	return PnPTerm
 }
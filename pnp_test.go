@@ -0,0 +1,553 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * PnP manager tests: scripted hotplug sequences simulation
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pnpSim simulates USB hotplug events, using emulated devices,
+// and drives pnpState with them.
+//
+// Simulation is controlled by script, one command per line:
+//
+//	add BUS:DEV SERIAL [fail N] - connect device; first N opens fail
+//	remove BUS:DEV              - disconnect device
+//	reenum BUS:DEV BUS:DEV      - device re-enumerated with new address
+//	flap BUS:DEV N              - N times quickly disconnect/connect
+//	scan                        - let PnP manager see current devices
+//	retry                       - expire retry timers and scan
+//	resume                      - simulate system resume and scan
+//	served N                    - check that N devices are served
+//
+// Like the kernel does, the simulator doesn't reuse the address of
+// the removed device until the PnP manager has seen the removal.
+//
+// After each scan, consistency of pnpState is verified
+type pnpSim struct {
+	t       *testing.T
+	state   *pnpState
+	plugged map[UsbAddr]*pnpSimDevice // Currently connected devices
+	gone    []*pnpSimDevice           // Disconnected devices
+	unseen  map[UsbAddr]struct{}      // Removed since last scan
+	lineno  int                       // Current script line
+}
+
+// pnpSimDevice represents a simulated device
+type pnpSimDevice struct {
+	emu    *UsbEmulator // Emulated device
+	serial string       // Serial number
+	fail   int          // Count of open attempts to fail
+	opened bool         // Device was opened at least once
+}
+
+// newPnpSim creates a new pnpSim. The simulated devices are
+// closed when test completes
+func newPnpSim(t *testing.T) *pnpSim {
+	testConf(t)
+	Conf.DNSSdEnable = false
+
+	sim := &pnpSim{
+		t:       t,
+		state:   newPnpState(),
+		plugged: make(map[UsbAddr]*pnpSimDevice),
+		unseen:  make(map[UsbAddr]struct{}),
+	}
+	sim.state.newDevice = sim.newDevice
+
+	t.Cleanup(sim.state.close)
+
+	return sim
+}
+
+// newDevice creates Device on a top of simulated device
+func (sim *pnpSim) newDevice(desc UsbDeviceDesc) (*Device, error) {
+	simdev := sim.plugged[desc.UsbAddr]
+	if simdev == nil {
+		sim.t.Fatalf("line %d: %s: opened while not connected",
+			sim.lineno, desc.UsbAddr)
+	}
+
+	if simdev.fail > 0 {
+		simdev.fail--
+		return nil, errors.New("simulated failure")
+	}
+
+	if simdev.opened {
+		// Closed emulator can't be reopened, so
+		// replace it with the fresh one
+		simdev.emu = sim.newEmulator(desc.UsbAddr, simdev.serial)
+	}
+
+	simdev.opened = true
+	return NewDeviceDev(desc, simdev.emu)
+}
+
+// newEmulator creates a new emulated device
+func (sim *pnpSim) newEmulator(addr UsbAddr, serial string) *UsbEmulator {
+	return NewUsbEmulator(UsbEmuConfig{
+		Addr: addr,
+		Info: UsbDeviceInfo{SerialNumber: serial},
+	})
+}
+
+// descs returns descriptors of currently connected devices
+func (sim *pnpSim) descs() map[UsbAddr]UsbDeviceDesc {
+	descs := make(map[UsbAddr]UsbDeviceDesc)
+	for addr, simdev := range sim.plugged {
+		descs[addr] = simdev.emu.Desc()
+	}
+	return descs
+}
+
+// add connects a new device
+func (sim *pnpSim) add(addr UsbAddr, serial string, fail int) {
+	if sim.plugged[addr] != nil {
+		sim.t.Fatalf("line %d: %s: already connected", sim.lineno, addr)
+	}
+
+	// Kernel doesn't reuse USB address immediately, and PnP
+	// manager relies on it
+	if _, found := sim.unseen[addr]; found {
+		sim.t.Fatalf("line %d: %s: address reused without scan",
+			sim.lineno, addr)
+	}
+
+	sim.plugged[addr] = &pnpSimDevice{
+		emu:    sim.newEmulator(addr, serial),
+		serial: serial,
+		fail:   fail,
+	}
+}
+
+// remove disconnects the device
+func (sim *pnpSim) remove(addr UsbAddr) *pnpSimDevice {
+	simdev := sim.plugged[addr]
+	if simdev == nil {
+		sim.t.Fatalf("line %d: %s: not connected", sim.lineno, addr)
+	}
+
+	delete(sim.plugged, addr)
+	sim.gone = append(sim.gone, simdev)
+	sim.unseen[addr] = struct{}{}
+
+	return simdev
+}
+
+// scan lets the PnP manager to see the current devices and
+// then verifies its state
+func (sim *pnpSim) scan() {
+	sim.state.update(sim.descs())
+	sim.unseen = make(map[UsbAddr]struct{})
+	sim.check()
+}
+
+// check verifies consistency of the pnpState
+func (sim *pnpSim) check() {
+	ports := make(map[int]UsbAddr)
+
+	for addr, dev := range sim.state.devByAddr {
+		simdev := sim.plugged[addr]
+		if simdev == nil {
+			sim.t.Errorf("line %d: %s: served while not connected",
+				sim.lineno, addr)
+			continue
+		}
+
+		if _, found := sim.state.retryByAddr[addr]; found {
+			sim.t.Errorf("line %d: %s: both served and waiting for retry",
+				sim.lineno, addr)
+		}
+
+		port := dev.State.HTTPPort
+		if other, found := ports[port]; found {
+			sim.t.Errorf("line %d: %s and %s share HTTP port %d",
+				sim.lineno, addr, other, port)
+		}
+		ports[port] = addr
+	}
+
+	for addr := range sim.plugged {
+		_, served := sim.state.devByAddr[addr]
+		_, retry := sim.state.retryByAddr[addr]
+		if !served && !retry {
+			sim.t.Errorf("line %d: %s: neither served nor waiting for retry",
+				sim.lineno, addr)
+		}
+	}
+
+	for _, simdev := range sim.gone {
+		emu := simdev.emu
+		emu.lock.Lock()
+		leaked := simdev.opened && !emu.closed
+		emu.lock.Unlock()
+
+		if leaked {
+			sim.t.Errorf("line %d: %s: not closed after disconnect",
+				sim.lineno, emu.Desc().UsbAddr)
+		}
+	}
+}
+
+// run executes the script
+func (sim *pnpSim) run(script string) {
+	for _, line := range strings.Split(script, "\n") {
+		sim.lineno++
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		err := sim.exec(fields)
+		if err != nil {
+			sim.t.Fatalf("line %d: %q: %s", sim.lineno, line, err)
+		}
+	}
+}
+
+// exec executes the single script command
+func (sim *pnpSim) exec(fields []string) error {
+	cmd, args := fields[0], fields[1:]
+
+	// Parse arguments
+	var addrs []UsbAddr
+	var nums []int
+	var serial string
+
+	for _, arg := range args {
+		switch {
+		case strings.Contains(arg, ":"):
+			addr, err := ParseUsbAddr(arg)
+			if err != nil {
+				return err
+			}
+			addrs = append(addrs, addr)
+
+		case arg[0] >= '0' && arg[0] <= '9':
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return err
+			}
+			nums = append(nums, n)
+
+		case arg == "fail":
+			// Followed by number
+
+		default:
+			serial = arg
+		}
+	}
+
+	switch {
+	case cmd == "add" && len(addrs) == 1 && serial != "":
+		fail := 0
+		if len(nums) > 0 {
+			fail = nums[0]
+		}
+		sim.add(addrs[0], serial, fail)
+
+	case cmd == "remove" && len(addrs) == 1:
+		sim.remove(addrs[0])
+
+	case cmd == "reenum" && len(addrs) == 2:
+		simdev := sim.remove(addrs[0])
+		sim.add(addrs[1], simdev.serial, 0)
+
+	case cmd == "flap" && len(addrs) == 1 && len(nums) == 1:
+		for i := 0; i < nums[0]; i++ {
+			simdev := sim.remove(addrs[0])
+			sim.scan()
+			sim.add(addrs[0], simdev.serial, 0)
+			sim.scan()
+		}
+
+	case cmd == "scan" && len(args) == 0:
+		sim.scan()
+
+	case cmd == "retry" && len(args) == 0:
+		for addr := range sim.state.retryByAddr {
+			sim.state.retryByAddr[addr] = time.Time{}
+		}
+		sim.scan()
+
+	case cmd == "resume" && len(args) == 0:
+		sim.state.resume()
+		sim.scan()
+
+	case cmd == "served" && len(nums) == 1:
+		if n := len(sim.state.devByAddr); n != nums[0] {
+			return fmt.Errorf("%d devices served", n)
+		}
+
+	default:
+		return errors.New("invalid command")
+	}
+
+	return nil
+}
+
+// TestPnPHotplug runs hotplug simulation scripts
+func TestPnPHotplug(t *testing.T) {
+	scripts := []struct {
+		name   string
+		script string
+	}{
+		{
+			name: "add-remove",
+			script: `
+				add 1:2 S1
+				add 1:3 S2
+				scan
+				served 2
+				remove 1:2
+				scan
+				served 1
+				remove 1:3
+				scan
+				served 0
+			`,
+		},
+		{
+			name: "reenumerate",
+			script: `
+				add 1:2 S1
+				scan
+				reenum 1:2 1:5
+				scan
+				served 1
+				reenum 1:5 2:1
+				reenum 2:1 2:2
+				scan
+				served 1
+			`,
+		},
+		{
+			name: "flapping",
+			script: `
+				add 1:2 S1
+				add 1:3 S2
+				scan
+				flap 1:2 5
+				served 2
+				remove 1:2
+				add 1:7 S1
+				scan
+				served 2
+			`,
+		},
+		{
+			name: "duplicate-serials",
+			script: `
+				add 1:2 DUP
+				add 1:3 DUP
+				add 1:4 DUP
+				scan
+				served 3
+				remove 1:3
+				scan
+				add 1:3 DUP
+				scan
+				served 3
+			`,
+		},
+		{
+			name: "retry",
+			script: `
+				add 1:2 S1 fail 2
+				scan
+				served 0
+				retry
+				served 0
+				retry
+				served 1
+			`,
+		},
+		{
+			name: "remove-while-waiting-retry",
+			script: `
+				add 1:2 S1 fail 1
+				scan
+				remove 1:2
+				scan
+				retry
+				served 0
+				add 1:2 S1
+				scan
+				served 1
+			`,
+		},
+		{
+			name: "resume",
+			script: `
+				add 1:2 S1
+				add 1:3 S2 fail 1
+				scan
+				served 1
+				resume
+				served 2
+				reenum 1:2 1:4
+				resume
+				served 2
+			`,
+		},
+	}
+
+	saveLevels := Console.levels
+	Console.SetLevels(0)
+	defer Console.SetLevels(saveLevels)
+
+	for _, s := range scripts {
+		t.Run(s.name, func(t *testing.T) {
+			newPnpSim(t).run(s.script)
+		})
+	}
+}
+
+// TestPnPReloadLogLevels tests reloading of log levels at runtime
+func TestPnPReloadLogLevels(t *testing.T) {
+	sim := newPnpSim(t)
+
+	saveLogLevels := Log.levels
+	defer func() { Log.levels = saveLogLevels }()
+
+	sim.run(`
+		add 1:2 S1
+		scan
+		served 1
+	`)
+
+	// Reload log levels
+	PathConfDirList = PathLogDir
+	err := ioutil.WriteFile(filepath.Join(PathLogDir, ConfFileName),
+		[]byte("[logging]\ndevice-log = trace-http\nmain-log = error\n"),
+		0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	sim.state.reloadLogLevels()
+
+	for _, dev := range sim.state.devByAddr {
+		if dev.Log.levels&LogTraceHTTP == 0 {
+			t.Errorf("device: trace-http not enabled")
+		}
+	}
+
+	if Log.levels != LogError {
+		t.Errorf("main: expected %x, present %x", LogError, Log.levels)
+	}
+
+	// Broken configuration must not change levels
+	err = ioutil.WriteFile(filepath.Join(PathLogDir, ConfFileName),
+		[]byte("[logging]\nmain-log = nonsense\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	sim.state.reloadLogLevels()
+
+	if Log.levels != LogError {
+		t.Errorf("main: expected %x, present %x", LogError, Log.levels)
+	}
+}
+
+// TestPnPStall tests reset and reopen of the stalled device
+func TestPnPStall(t *testing.T) {
+	saveLevels := Console.levels
+	Console.SetLevels(0)
+	defer Console.SetLevels(saveLevels)
+
+	sim := newPnpSim(t)
+
+	sim.run(`
+		add 1:2 S1
+		add 1:3 S2
+		scan
+		served 2
+	`)
+
+	addr := UsbAddr{Bus: 1, Address: 2}
+	emu := sim.plugged[addr].emu
+	dev := sim.state.devByAddr[addr]
+	dev.UsbTransport.stall()
+
+	select {
+	case <-UsbStallChan:
+	default:
+		t.Errorf("UsbStallChan not signalled")
+	}
+
+	rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+	_, err := dev.UsbTransport.RoundTrip(rq)
+	if err != ErrUsbStalled {
+		t.Errorf("request to stalled device: %v", err)
+	}
+
+	sim.run(`
+		scan
+		served 2
+	`)
+
+	switch {
+	case emu.Resets() == 0:
+		t.Errorf("stalled device not reset")
+	case sim.state.devByAddr[addr] == dev:
+		t.Errorf("stalled device not reopened")
+	case sim.state.devByAddr[addr].UsbTransport.Stalled():
+		t.Errorf("reopened device still stalled")
+	}
+}
+
+// TestPnPDeviceMatch tests matching of devices, selected by BUS:DEV
+func TestPnPDeviceMatch(t *testing.T) {
+	dev := &PnPDevice{Addr: UsbAddr{Bus: 1, Address: 5}}
+	desc := UsbDeviceDesc{
+		UsbAddr: UsbAddr{Bus: 1, Address: 5},
+		Vendor:  0x04f9,
+		Product: 0x2d48,
+	}
+
+	// Unresolved device is matched by address
+	if !dev.match(desc) || dev.Resolved {
+		t.Errorf("device without path: match failed")
+	}
+
+	other := desc
+	other.Address = 6
+	if dev.match(other) {
+		t.Errorf("device at other address matched")
+	}
+
+	// Device is resolved, when seen with path, and then
+	// tracked by path
+	desc.Path = "1-1.4"
+	if !dev.match(desc) || !dev.Resolved {
+		t.Errorf("device with path: not resolved")
+	}
+
+	desc.Address = 7
+	if !dev.match(desc) {
+		t.Errorf("re-enumerated device not matched")
+	}
+
+	other.Path = "1-1.3"
+	other.Address = 5
+	if dev.match(other) {
+		t.Errorf("other device at the same address matched")
+	}
+}
@@ -0,0 +1,118 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * polkit authorization
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PolkitActionPrefix is the prefix of polkit action IDs. Action ID
+// is made of this prefix and operation name (i.e., "config"), and
+// actions are defined in the org.openprinting.ipp-usb.policy file
+const PolkitActionPrefix = "org.openprinting.ipp-usb."
+
+// polkitCheckCommand is the polkit command-line checker. It is
+// variable, so tests can replace it
+var polkitCheckCommand = "pkcheck"
+
+// PolkitCheck checks if process with the specified PID is authorized
+// by polkit to perform the operation. If authentication is required,
+// polkit agent of the user session may ask user for password, and
+// PolkitCheck waits for the answer, up to PolkitCheckTimeout
+func PolkitCheck(pid int, op AuthOps) (bool, error) {
+	action := PolkitActionPrefix + op.String()
+
+	// Process is identified by PID, start time and UID, so
+	// polkit will not authorize another process that has reused
+	// the PID (CVE-2013-4288)
+	process, err := polkitProcess(pid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", action, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		PolkitCheckTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, polkitCheckCommand,
+		"--action-id", action,
+		"--process", process,
+		"--allow-user-interaction")
+
+	err = cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("%s: timed out", action)
+	}
+
+	// pkcheck exits with 1, if not authorized, and with 2, if
+	// authentication dialog was dismissed by user. Other failures
+	// are errors
+	if exit, ok := err.(*exec.ExitError); ok {
+		status, _ := exit.Sys().(syscall.WaitStatus)
+		switch status.ExitStatus() {
+		case 1, 2:
+			return false, nil
+		}
+	}
+
+	return false, fmt.Errorf("%s: %s", action, err)
+}
+
+// polkitProcess returns the "pid,start-time,uid" process
+// specification for pkcheck
+func polkitProcess(pid int) (string, error) {
+	dir := "/proc/" + strconv.Itoa(pid)
+
+	// Start time is the 22nd field of /proc/PID/stat. The 2nd
+	// field is the command name in parentheses, which may
+	// contain spaces, so fields are counted after the last ')'
+	stat, err := ioutil.ReadFile(dir + "/stat")
+	if err != nil {
+		return "", err
+	}
+
+	i := strings.LastIndexByte(string(stat), ')')
+	fields := strings.Fields(string(stat[i+1:]))
+	if i < 0 || len(fields) < 20 {
+		return "", fmt.Errorf("%s/stat: invalid format", dir)
+	}
+
+	start := fields[19]
+
+	// Real UID is the first value of the "Uid:" line of
+	// /proc/PID/status
+	file, err := os.Open(dir + "/status")
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			return fmt.Sprintf("%d,%s,%s", pid, start, fields[1]), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s/status: UID not found", dir)
+}
@@ -0,0 +1,86 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * polkit authorization tests
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPolkitCheck tests PolkitCheck with fake pkcheck
+func TestPolkitCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	// Fake pkcheck authorizes scan, denies print, reports
+	// dismissed dialog for fax and fails otherwise. Process
+	// must be specified as pid,start-time,uid
+	script := filepath.Join(dir, "pkcheck")
+	err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+case "$4" in
+*,*,*) ;;
+*)     exit 127;;
+esac
+case "$2" in
+org.openprinting.ipp-usb.scan)  exit 0;;
+org.openprinting.ipp-usb.print) exit 1;;
+org.openprinting.ipp-usb.fax)   exit 2;;
+esac
+exit 127
+`), 0755)
+
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	saveCommand := polkitCheckCommand
+	polkitCheckCommand = script
+	defer func() { polkitCheckCommand = saveCommand }()
+
+	tests := []struct {
+		op         AuthOps
+		authorized bool
+		err        bool
+	}{
+		{AuthOpsScan, true, false},
+		{AuthOpsPrint, false, false},
+		{AuthOpsFax, false, false},
+		{AuthOpsConfig, false, true},
+	}
+
+	for _, test := range tests {
+		authorized, err := PolkitCheck(os.Getpid(), test.op)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%s: error expected", test.op)
+		case !test.err && err != nil:
+			t.Errorf("%s: %s", test.op, err)
+		case authorized != test.authorized:
+			t.Errorf("%s: authorized=%v", test.op, authorized)
+		}
+	}
+}
+
+// TestPolkitProcess tests polkitProcess
+func TestPolkitProcess(t *testing.T) {
+	pid := os.Getpid()
+	process, err := polkitProcess(pid)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := fmt.Sprintf("%d,", pid)
+	if !strings.HasPrefix(process, expected) ||
+		!strings.HasSuffix(process, fmt.Sprintf(",%d", os.Getuid())) {
+		t.Errorf("polkitProcess: %q", process)
+	}
+}
@@ -0,0 +1,401 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Logical printers, sharing the same physical device
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ConfPrinter represents a logical printer, defined by the
+// [printer NAME] section of the configuration file:
+//
+//	[printer Office B&W]
+//	  device                   = 03f0:2b17
+//	  port                     = 60100
+//	  print-color-mode-default = monochrome
+//	  sides-default            = two-sided-long-edge
+//
+// Logical printer has its own DNS-SD name and HTTP port, and
+// all requests, received on this port, are forwarded to the
+// matching device. IPP attributes, other than "device" and
+// "port", override device's attributes in the Get-Printer-Attributes
+// responses, so sites can publish policy-specific queues
+type ConfPrinter struct {
+	Name      string            // Printer name, used as DNS-SD name
+	Match     *UsbDevMatch      // Matching device
+	Port      int               // HTTP port, 0 to allocate
+	Overrides []PrinterOverride // IPP attribute overrides
+}
+
+// PrinterOverride represents IPP attribute override
+type PrinterOverride struct {
+	Name  string // Attribute name
+	Value string // Attribute value, as written in configuration
+}
+
+// LogicalPrinter is the running instance of ConfPrinter
+// on a particular device
+type LogicalPrinter struct {
+	Conf           *ConfPrinter    // Printer configuration
+	State          *DevState       // Persistent state
+	UUID           string          // Printer UUID
+	HTTPProxy      *HTTPProxy      // HTTP proxy
+	DNSSdPublisher *DNSSdPublisher // DNS-SD publisher
+	quirks         *Quirks         // Device quirks
+}
+
+// confLoadPrinter loads the [printer NAME] section record
+func confLoadPrinter(rec *IniRecord) error {
+	name := strings.TrimSpace(strings.TrimSpace(rec.Section)[len("printer"):])
+	if name == "" {
+		return rec.errBadValue("missed printer name")
+	}
+
+	var prn *ConfPrinter
+	for _, p := range Conf.Printers {
+		if p.Name == name {
+			prn = p
+			break
+		}
+	}
+
+	if prn == nil {
+		prn = &ConfPrinter{Name: name}
+		Conf.Printers = append(Conf.Printers, prn)
+	}
+
+	switch {
+	case confMatchName(rec.Key, "device"):
+		match, err := ParseUsbDevMatch(rec.Value)
+		if err != nil {
+			return rec.errBadValue("%s", err)
+		}
+		prn.Match = &match
+
+	case confMatchName(rec.Key, "port"):
+		return rec.LoadIPPort(&prn.Port)
+
+	default:
+		prn.Overrides = append(prn.Overrides,
+			PrinterOverride{rec.Key, rec.Value})
+	}
+
+	return nil
+}
+
+// confIsPrinterSection tells if section name is [printer NAME]
+func confIsPrinterSection(section string) bool {
+	fields := strings.Fields(section)
+	return len(fields) > 0 && fields[0] == "printer"
+}
+
+// confValidatePrinters validates logical printers configuration
+func confValidatePrinters() error {
+	ports := make(map[int]string)
+	if Conf.TestDevicePort != 0 {
+		ports[Conf.TestDevicePort] = "test-device"
+	}
+
+	for _, prn := range Conf.Printers {
+		if prn.Match == nil {
+			return fmt.Errorf("printer %q: missed device", prn.Name)
+		}
+
+		if prn.Port != 0 {
+			if used := ports[prn.Port]; used != "" {
+				return fmt.Errorf("printer %q: port %d already used by %s",
+					prn.Name, prn.Port, used)
+			}
+			ports[prn.Port] = fmt.Sprintf("printer %q", prn.Name)
+		}
+	}
+
+	return nil
+}
+
+// NewLogicalPrinter starts logical printer on a top of the device
+//
+// services are DNS-SD services of the device. The IPP services are
+// copied from them and advertised with the logical printer's name,
+// port and UUID.
+func NewLogicalPrinter(dev *Device, conf *ConfPrinter,
+	info UsbDeviceInfo, ippinfo *IppPrinterInfo,
+	services DNSSdServices) (*LogicalPrinter, error) {
+
+	prn := &LogicalPrinter{
+		Conf:   conf,
+		UUID:   UUIDFromName(ippinfo.UUID, conf.Name),
+		quirks: dev.UsbTransport.Quirks(),
+	}
+
+	// Load persistent state. The DNS-SD name collision
+	// resolution and port allocation works the same
+	// way, as for devices
+	prn.State = LoadDevState(
+		identSanitize(info.Ident()+"-printer-"+conf.Name),
+		info.Comment()+" printer="+conf.Name)
+
+	if prn.State.DNSSdName != conf.Name {
+		prn.State.DNSSdName = conf.Name
+		prn.State.DNSSdOverride = conf.Name
+		prn.State.Save()
+	}
+
+	// Create net.Listener
+	var listener net.Listener
+	var err error
+
+	if conf.Port != 0 {
+		listener, err = NewListener(conf.Port)
+		if err == nil && prn.State.HTTPPort != conf.Port {
+			prn.State.HTTPPort = conf.Port
+			prn.State.Save()
+		}
+	} else {
+		listener, err = prn.State.HTTPListen()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create HTTP proxy
+	prn.HTTPProxy = NewHTTPProxy(dev.Log, listener, dev.UsbTransport)
+	prn.HTTPProxy.printer = prn
+	prn.HTTPProxy.Enable()
+
+	// Build DNS-SD services
+	var prnServices DNSSdServices
+	for _, svc := range services {
+		switch svc.Type {
+		case "_ipp._tcp":
+			svc.Port = prn.State.HTTPPort
+		case "_printer._tcp":
+		default:
+			continue
+		}
+
+		txt := DNSSdTxtRecord{}
+		for _, item := range svc.Txt {
+			switch item.Key {
+			case "UUID":
+				item.Value = prn.UUID
+			case "Scan":
+				item.Value = "F"
+			}
+			txt.Add(item.Key, item.Value)
+		}
+		svc.Txt = txt
+
+		prnServices.Add(svc)
+	}
+
+	dev.Log.Info(' ', "printer %q: port %d, UUID %s",
+		conf.Name, prn.State.HTTPPort, prn.UUID)
+
+	// Start DNS-SD publisher
+	if Conf.DNSSdEnable && len(prnServices) != 0 {
+		prn.DNSSdPublisher = NewDNSSdPublisher(dev.Log, prn.State,
+			prnServices)
+		err = prn.DNSSdPublisher.Publish()
+		if err != nil {
+			prn.HTTPProxy.Close()
+			return nil, err
+		}
+	}
+
+	return prn, nil
+}
+
+// Close the LogicalPrinter
+func (prn *LogicalPrinter) Close() {
+	if prn.DNSSdPublisher != nil {
+		prn.DNSSdPublisher.Unpublish()
+		prn.DNSSdPublisher = nil
+	}
+
+	if prn.HTTPProxy != nil {
+		prn.HTTPProxy.Close()
+		prn.HTTPProxy = nil
+	}
+}
+
+// rewriteResponse applies attribute overrides to the
+// Get-Printer-Attributes response
+//
+// If response cannot be decoded, it is left as is
+func (prn *LogicalPrinter) rewriteResponse(log *Logger, session int,
+	resp *http.Response) {
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	if err != nil {
+		return
+	}
+
+	opts := goipp.DecoderOptions{}
+	if prn.quirks.GetBuggyIppRsp() == QuirkBuggyIppRspAllow {
+		opts.EnableWorkarounds = true
+	}
+
+	var msg goipp.Message
+	err = msg.DecodeBytesEx(data, opts)
+	if err == nil {
+		err = prn.rewrite(&msg)
+	}
+
+	if err == nil {
+		data, err = msg.EncodeBytes()
+	}
+
+	if err != nil {
+		log.HTTPError('!', session, "printer %q: %s", prn.Conf.Name, err)
+		return
+	}
+
+	log.HTTPDebug(' ', session, "printer %q: attributes overridden",
+		prn.Conf.Name)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+}
+
+// rewrite applies attribute overrides to the decoded
+// Get-Printer-Attributes response
+func (prn *LogicalPrinter) rewrite(msg *goipp.Message) error {
+	for i := range msg.Groups {
+		grp := &msg.Groups[i]
+		if grp.Tag != goipp.TagPrinterGroup {
+			continue
+		}
+
+		// Printer identity is always replaced, if present
+		for j := range grp.Attrs {
+			attr := &grp.Attrs[j]
+			switch attr.Name {
+			case "printer-uuid":
+				attr.Values = nil
+				attr.Values.Add(goipp.TagURI,
+					goipp.String("urn:uuid:"+prn.UUID))
+			case "printer-dns-sd-name":
+				attr.Values = nil
+				attr.Values.Add(goipp.TagName,
+					goipp.String(prn.State.DNSSdOverride))
+			}
+		}
+
+		// Apply configured overrides
+		for _, ovr := range prn.Conf.Overrides {
+			found := false
+			for j := range grp.Attrs {
+				attr := &grp.Attrs[j]
+				if attr.Name != ovr.Name || len(attr.Values) == 0 {
+					continue
+				}
+
+				found = true
+				values, err := ovr.values(attr.Values[0].T)
+				if err != nil {
+					return err
+				}
+				attr.Values = values
+			}
+
+			if !found {
+				values, err := ovr.values(ovr.guessTag())
+				if err != nil {
+					return err
+				}
+
+				grp.Attrs.Add(goipp.Attribute{Name: ovr.Name,
+					Values: values})
+			}
+		}
+	}
+
+	return nil
+}
+
+// values converts override value into goipp.Values of the
+// specified tag. Multiple values are comma-separated, except
+// for text and name attributes
+func (ovr PrinterOverride) values(tag goipp.Tag) (goipp.Values, error) {
+	strs := []string{ovr.Value}
+	switch tag {
+	case goipp.TagText, goipp.TagName:
+	default:
+		strs = strings.Split(ovr.Value, ",")
+	}
+
+	var values goipp.Values
+	for _, s := range strs {
+		s = strings.TrimSpace(s)
+
+		var v goipp.Value
+		switch tag.Type() {
+		case goipp.TypeInteger:
+			i, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				return nil, ovr.error("integer expected")
+			}
+			v = goipp.Integer(i)
+
+		case goipp.TypeBoolean:
+			switch s {
+			case "true":
+				v = goipp.Boolean(true)
+			case "false":
+				v = goipp.Boolean(false)
+			default:
+				return nil, ovr.error("true or false expected")
+			}
+
+		case goipp.TypeString:
+			v = goipp.String(s)
+
+		default:
+			return nil, ovr.error("%s values not supported", tag)
+		}
+
+		values.Add(tag, v)
+	}
+
+	return values, nil
+}
+
+// guessTag guesses tag for the attribute, missed in the
+// device's response: integer, if all values are integers,
+// and keyword otherwise
+func (ovr PrinterOverride) guessTag() goipp.Tag {
+	for _, s := range strings.Split(ovr.Value, ",") {
+		_, err := strconv.ParseInt(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return goipp.TagKeyword
+		}
+	}
+
+	return goipp.TagInteger
+}
+
+// error creates an override-related error
+func (ovr PrinterOverride) error(format string, args ...interface{}) error {
+	return errors.New(ovr.Name + ": " + fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,225 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for logical printers
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestConfLoadPrinter tests loading of the [printer NAME] sections
+func TestConfLoadPrinter(t *testing.T) {
+	testConf(t)
+
+	load := func(text string) error {
+		Conf.Printers = nil
+		err := testConfLoad(t, text)
+		if err == nil {
+			err = confValidatePrinters()
+		}
+		return err
+	}
+
+	err := load(`
+[printer Office B&W]
+  device                   = 04f9:2d48/E74512K5N
+  port                     = 60100
+  print-color-mode-default = monochrome
+  sides-default            = two-sided-long-edge
+`)
+
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(Conf.Printers) != 1 {
+		t.Fatalf("expected 1 printer, present %d", len(Conf.Printers))
+	}
+
+	prn := Conf.Printers[0]
+	match := UsbDevMatch{0x04f9, 0x2d48, "E74512K5N", ""}
+	switch {
+	case prn.Name != "Office B&W":
+		t.Errorf("name: %q", prn.Name)
+	case prn.Match == nil || *prn.Match != match:
+		t.Errorf("device: %v", prn.Match)
+	case prn.Port != 60100:
+		t.Errorf("port: %d", prn.Port)
+	case len(prn.Overrides) != 2 ||
+		prn.Overrides[1] != PrinterOverride{"sides-default",
+			"two-sided-long-edge"}:
+		t.Errorf("overrides: %v", prn.Overrides)
+	}
+
+	// Invalid configurations
+	bad := []string{
+		"[printer]\ndevice = 04f9:2d48\n",
+		"[printer X]\nport = 60100\n",
+		"[printer X]\ndevice = 2:17\n",
+		"[printer X]\ndevice = 04f9:2d48\nport = 60100\n" +
+			"[printer Y]\ndevice = 04f9:2d48\nport = 60100\n",
+	}
+
+	for _, text := range bad {
+		if load(text) == nil {
+			t.Errorf("%q: error expected", text)
+		}
+	}
+}
+
+// TestPrinterOverrideValues tests conversion of override values
+func TestPrinterOverrideValues(t *testing.T) {
+	tests := []struct {
+		value string
+		tag   goipp.Tag
+		out   goipp.Values
+		ok    bool
+	}{
+		{"monochrome", goipp.TagKeyword, goipp.Values{
+			{T: goipp.TagKeyword, V: goipp.String("monochrome")}}, true},
+		{"one-sided, two-sided-long-edge", goipp.TagKeyword, goipp.Values{
+			{T: goipp.TagKeyword, V: goipp.String("one-sided")},
+			{T: goipp.TagKeyword, V: goipp.String("two-sided-long-edge")}},
+			true},
+		{"Office, 2nd floor", goipp.TagText, goipp.Values{
+			{T: goipp.TagText, V: goipp.String("Office, 2nd floor")}}, true},
+		{"2", goipp.TagInteger, goipp.Values{
+			{T: goipp.TagInteger, V: goipp.Integer(2)}}, true},
+		{"3", goipp.TagEnum, goipp.Values{
+			{T: goipp.TagEnum, V: goipp.Integer(3)}}, true},
+		{"false", goipp.TagBoolean, goipp.Values{
+			{T: goipp.TagBoolean, V: goipp.Boolean(false)}}, true},
+		{"x", goipp.TagInteger, nil, false},
+		{"x", goipp.TagBoolean, nil, false},
+		{"x", goipp.TagResolution, nil, false},
+	}
+
+	for _, test := range tests {
+		ovr := PrinterOverride{"attr", test.value}
+		out, err := ovr.values(test.tag)
+		if (err == nil) != test.ok {
+			t.Errorf("%q %s: unexpected error status: %v",
+				test.value, test.tag, err)
+		} else if !out.Equal(test.out) {
+			t.Errorf("%q %s: expected %s, present %s",
+				test.value, test.tag, test.out, out)
+		}
+	}
+
+	if tag := (PrinterOverride{"copies-default", "2"}).guessTag(); tag != goipp.TagInteger {
+		t.Errorf("guessTag: expected %s, present %s", goipp.TagInteger, tag)
+	}
+
+	if tag := (PrinterOverride{"sides-default", "one-sided"}).guessTag(); tag != goipp.TagKeyword {
+		t.Errorf("guessTag: expected %s, present %s", goipp.TagKeyword, tag)
+	}
+}
+
+// TestLogicalPrinterProxy tests rewriting of Get-Printer-Attributes
+// responses by the logical printer proxy
+func TestLogicalPrinterProxy(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: &UsbEmuPrinter{},
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	listener, err := NewListener(0)
+	if err != nil {
+		t.Fatalf("NewListener: %s", err)
+	}
+
+	prn := &LogicalPrinter{
+		Conf: &ConfPrinter{
+			Name: "Office B&W",
+			Overrides: []PrinterOverride{
+				{"color-supported", "false"},
+				{"sides-default", "two-sided-long-edge"},
+			},
+		},
+		State:  &DevState{DNSSdOverride: "Office B&W (2)"},
+		UUID:   "0b7d1d4b-6a7c-5f4e-8a33-7d8e0c2b5a11",
+		quirks: transport.Quirks(),
+	}
+
+	proxy := NewHTTPProxy(transport.Log(), listener, transport)
+	defer proxy.Close()
+	proxy.printer = prn
+	proxy.Enable()
+
+	uri := fmt.Sprintf("http://localhost:%d/ipp/print",
+		listener.Addr().(*net.TCPAddr).Port)
+
+	// Send the IPP request and decode the response
+	request := func(op goipp.Op) *goipp.Message {
+		rq := goipp.NewRequest(goipp.DefaultVersion, op, 1)
+		rq.Operation.Add(goipp.MakeAttribute("attributes-charset",
+			goipp.TagCharset, goipp.String("utf-8")))
+		data, _ := rq.EncodeBytes()
+
+		resp, err := http.Post(uri, goipp.ContentType,
+			bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+
+		defer resp.Body.Close()
+
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+
+		if resp.ContentLength >= 0 &&
+			resp.ContentLength != int64(len(data)) {
+			t.Errorf("%s: Content-Length %d, present %d bytes",
+				op, resp.ContentLength, len(data))
+		}
+
+		msg := &goipp.Message{}
+		err = msg.DecodeBytes(data)
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+
+		return msg
+	}
+
+	// Get-Printer-Attributes is rewritten
+	attrs := newIppAttrs(request(goipp.OpGetPrinterAttributes).Printer)
+
+	expected := map[string]string{
+		"color-supported":        "false",
+		"sides-default":          "two-sided-long-edge",
+		"sides-supported":        "one-sided",
+		"printer-uuid":           "urn:uuid:" + prn.UUID,
+		"printer-make-and-model": "Emulated IPP-USB Printer",
+	}
+
+	for name, value := range expected {
+		present := attrs[name].String()
+		if present != value {
+			t.Errorf("%s: expected %q, present %q",
+				name, value, present)
+		}
+	}
+
+	// Other operations are forwarded as is
+	msg := request(goipp.OpGetJobs)
+	if goipp.Status(msg.Code) != goipp.StatusOk {
+		t.Errorf("Get-Jobs: %s", goipp.Status(msg.Code))
+	}
+}
@@ -27,6 +27,7 @@ type Quirk struct {
 	Origin    string       // file:line of definition
 	Match     string       // Match pattern
 	MatchHWID *HWIDPattern // HWID match pattern or nil
+	MatchPath string       // USB path match, "" if none
 	Name      string       // Quirk name
 	RawValue  string       // Quirk raw (not parsed) value
 	Parsed    interface{}  // Parsed Value
@@ -40,16 +41,35 @@ const (
 	QuirkNmBuggyIppResponses     = "buggy-ipp-responses"
 	QuirkNmDisableFax            = "disable-fax"
 	QuirkNmIgnoreIppStatus       = "ignore-ipp-status"
+	QuirkNmIgnoreSerial          = "ignore-serial"
 	QuirkNmInitDelay             = "init-delay"
+	QuirkNmInitReadyTimeout      = "init-ready-timeout"
 	QuirkNmInitReset             = "init-reset"
 	QuirkNmInitRetryPartial      = "init-retry-partial"
 	QuirkNmInitTimeout           = "init-timeout"
 	QuirkNmMfg                   = "mfg"
 	QuirkNmModel                 = "model"
 	QuirkNmRequestDelay          = "request-delay"
+	QuirkNmURLRewrite            = "url-rewrite"
+	QuirkNmUsbAltSetting         = "usb-alt-setting"
+	QuirkNmUsbAutosuspend        = "usb-autosuspend"
+	QuirkNmUsbClearHalt          = "usb-clear-halt"
+	QuirkNmUsbClearHaltLimit     = "usb-clear-halt-limit"
+	QuirkNmUsbConfig             = "usb-config"
+	QuirkNmUsbDetachKernelDriver = "usb-detach-kernel-driver"
+	QuirkNmUsbInterfaceOrder     = "usb-interface-order"
+	QuirkNmUsbKeepalive          = "usb-keepalive"
 	QuirkNmUsbMaxInterfaces      = "usb-max-interfaces"
+	QuirkNmUsbProbeInterfaces    = "usb-probe-interfaces"
+	QuirkNmUsbReadAlign          = "usb-read-align"
+	QuirkNmUsbReadBuffer         = "usb-read-buffer"
+	QuirkNmUsbReadTimeout        = "usb-read-timeout"
 	QuirkNmUsbSendDelayThreshold = "usb-send-delay-threshold"
 	QuirkNmUsbSendDelay          = "usb-send-delay"
+	QuirkNmUsbStallReset         = "usb-stall-reset"
+	QuirkNmUsbWatchdog           = "usb-watchdog"
+	QuirkNmUsbWriteTimeout       = "usb-write-timeout"
+	QuirkNmUserAgent             = "user-agent"
 	QuirkNmZlpRecvHack           = "zlp-recv-hack"
 	QuirkNmZlpSend               = "zlp-send"
 )
@@ -61,16 +81,35 @@ var quirkParse = map[string]func(*Quirk) error{
 	QuirkNmBuggyIppResponses:     (*Quirk).parseQuirkBuggyIppRsp,
 	QuirkNmDisableFax:            (*Quirk).parseBool,
 	QuirkNmIgnoreIppStatus:       (*Quirk).parseBool,
+	QuirkNmIgnoreSerial:          (*Quirk).parseBool,
 	QuirkNmInitDelay:             (*Quirk).parseDuration,
+	QuirkNmInitReadyTimeout:      (*Quirk).parseDuration,
 	QuirkNmInitReset:             (*Quirk).parseQuirkResetMethod,
 	QuirkNmInitRetryPartial:      (*Quirk).parseBool,
 	QuirkNmInitTimeout:           (*Quirk).parseDuration,
 	QuirkNmMfg:                   (*Quirk).parseString,
 	QuirkNmModel:                 (*Quirk).parseString,
 	QuirkNmRequestDelay:          (*Quirk).parseDuration,
+	QuirkNmURLRewrite:            (*Quirk).parseBool,
+	QuirkNmUsbAltSetting:         (*Quirk).parseQuirkAltSetting,
+	QuirkNmUsbAutosuspend:        (*Quirk).parseBool,
+	QuirkNmUsbClearHalt:          (*Quirk).parseQuirkClearHalt,
+	QuirkNmUsbClearHaltLimit:     (*Quirk).parseUint,
+	QuirkNmUsbConfig:             (*Quirk).parseUint,
+	QuirkNmUsbDetachKernelDriver: (*Quirk).parseQuirkDetach,
+	QuirkNmUsbInterfaceOrder:     (*Quirk).parseQuirkIfOrder,
+	QuirkNmUsbKeepalive:          (*Quirk).parseDuration,
 	QuirkNmUsbMaxInterfaces:      (*Quirk).parseUint,
+	QuirkNmUsbProbeInterfaces:    (*Quirk).parseDuration,
+	QuirkNmUsbReadAlign:          (*Quirk).parseUint,
+	QuirkNmUsbReadBuffer:         (*Quirk).parseUint,
+	QuirkNmUsbReadTimeout:        (*Quirk).parseDuration,
 	QuirkNmUsbSendDelay:          (*Quirk).parseDuration,
 	QuirkNmUsbSendDelayThreshold: (*Quirk).parseUint,
+	QuirkNmUsbStallReset:         (*Quirk).parseDuration,
+	QuirkNmUsbWatchdog:           (*Quirk).parseDuration,
+	QuirkNmUsbWriteTimeout:       (*Quirk).parseDuration,
+	QuirkNmUserAgent:             (*Quirk).parseString,
 	QuirkNmZlpRecvHack:           (*Quirk).parseBool,
 	QuirkNmZlpSend:               (*Quirk).parseBool,
 }
@@ -82,16 +121,35 @@ var quirkDefaultStrings = map[string]string{
 	QuirkNmBuggyIppResponses:     "reject",
 	QuirkNmDisableFax:            "false",
 	QuirkNmIgnoreIppStatus:       "false",
+	QuirkNmIgnoreSerial:          "false",
 	QuirkNmInitDelay:             "0",
+	QuirkNmInitReadyTimeout:      DevReadyTimeout.String(),
 	QuirkNmInitReset:             "none",
 	QuirkNmInitRetryPartial:      "false",
 	QuirkNmInitTimeout:           DevInitTimeout.String(),
 	QuirkNmMfg:                   "",
 	QuirkNmModel:                 "",
 	QuirkNmRequestDelay:          "0",
+	QuirkNmURLRewrite:            "true",
+	QuirkNmUsbAltSetting:         "auto",
+	QuirkNmUsbAutosuspend:        "false",
+	QuirkNmUsbClearHalt:          "never",
+	QuirkNmUsbClearHaltLimit:     "0",
+	QuirkNmUsbConfig:             "0",
+	QuirkNmUsbDetachKernelDriver: "always",
+	QuirkNmUsbInterfaceOrder:     "auto",
+	QuirkNmUsbKeepalive:          "0",
 	QuirkNmUsbMaxInterfaces:      "0",
+	QuirkNmUsbProbeInterfaces:    "0",
+	QuirkNmUsbReadAlign:          "1024",
+	QuirkNmUsbReadBuffer:         "4096",
+	QuirkNmUsbReadTimeout:        UsbReadTimeout.String(),
 	QuirkNmUsbSendDelay:          "0",
 	QuirkNmUsbSendDelayThreshold: "0",
+	QuirkNmUsbStallReset:         UsbStallResetTimeout.String(),
+	QuirkNmUsbWatchdog:           "0",
+	QuirkNmUsbWriteTimeout:       UsbWriteTimeout.String(),
+	QuirkNmUserAgent:             "ipp-usb",
 	QuirkNmZlpRecvHack:           "false",
 	QuirkNmZlpSend:               "false",
 }
@@ -120,6 +178,10 @@ func init() {
 	}
 }
 
+// quirkHTTPResponsePrefix is the name prefix of the HTTP
+// response header quirks
+const quirkHTTPResponsePrefix = "http-response-"
+
 // isHTTP reports if Quirk is the HTTP header quirk
 func (q *Quirk) isHTTP() bool {
 	return strings.HasPrefix(q.Name, "http-")
@@ -130,6 +192,23 @@ func (q *Quirk) isHWID() bool {
 	return q.MatchHWID != nil
 }
 
+// isPath reports if Quirk is matched by USB path
+func (q *Quirk) isPath() bool {
+	return q.MatchPath != ""
+}
+
+// quirksParsePathSection parses the "[usb-path PATH]" section name.
+// It returns "", if section name doesn't have this syntax
+func quirksParsePathSection(section string) string {
+	fields := strings.Fields(section)
+	if len(fields) == 2 && fields[0] == "usb-path" &&
+		usbPortPathValid(fields[1]) {
+		return fields[1]
+	}
+
+	return ""
+}
+
 // parseString parses and saves [Quirk.RawValue] as string.
 func (q *Quirk) parseString() error {
 	q.Parsed = q.RawValue
@@ -227,6 +306,89 @@ func (q *Quirk) parseQuirkResetMethod() error {
 	return nil
 }
 
+// parseQuirkClearHalt parses [Quirk.RawValue] as QuirkClearHalt.
+func (q *Quirk) parseQuirkClearHalt() error {
+	switch q.RawValue {
+	case "never":
+		q.Parsed = QuirkClearHaltNever
+	case "in":
+		q.Parsed = QuirkClearHaltIn
+	case "both":
+		q.Parsed = QuirkClearHaltBoth
+	default:
+		return fmt.Errorf("%q: must be never, in or both", q.RawValue)
+	}
+
+	return nil
+}
+
+// parseQuirkDetach parses [Quirk.RawValue] as QuirkDetach.
+func (q *Quirk) parseQuirkDetach() error {
+	switch q.RawValue {
+	case "auto":
+		q.Parsed = QuirkDetachAuto
+	case "always":
+		q.Parsed = QuirkDetachAlways
+	case "never":
+		q.Parsed = QuirkDetachNever
+	default:
+		return fmt.Errorf("%q: must be auto, always or never", q.RawValue)
+	}
+
+	return nil
+}
+
+// parseQuirkAltSetting parses [Quirk.RawValue] as alternate
+// setting number or "auto". "auto" is represented as -1.
+func (q *Quirk) parseQuirkAltSetting() error {
+	if q.RawValue == "auto" {
+		q.Parsed = -1
+		return nil
+	}
+
+	v, err := strconv.ParseUint(q.RawValue, 10, 8)
+	if err != nil {
+		return fmt.Errorf("%q: must be auto or number", q.RawValue)
+	}
+
+	q.Parsed = int(v)
+	return nil
+}
+
+// parseQuirkIfOrder parses [Quirk.RawValue] as QuirkIfOrder:
+// "auto", "descriptor" or comma-separated list of interface
+// numbers.
+func (q *Quirk) parseQuirkIfOrder() error {
+	switch q.RawValue {
+	case "auto":
+		q.Parsed = QuirkIfOrder{}
+		return nil
+	case "descriptor":
+		q.Parsed = QuirkIfOrder{Descriptor: true}
+		return nil
+	}
+
+	order := QuirkIfOrder{}
+	for _, s := range strings.Split(q.RawValue, ",") {
+		v, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil {
+			return fmt.Errorf("%q: must be auto, descriptor "+
+				"or list of interface numbers", q.RawValue)
+		}
+		order.Nums = append(order.Nums, int(v))
+	}
+
+	q.Parsed = order
+	return nil
+}
+
+// QuirkIfOrder defines preference order of IPP-over-USB interfaces
+// (see UsbDeviceDesc.OrderIfAddrs)
+type QuirkIfOrder struct {
+	Descriptor bool  // Keep the descriptor order
+	Nums       []int // Preferred interface numbers, in order
+}
+
 // QuirkResetMethod represents how to reset a device
 // during initialization
 type QuirkResetMethod int
@@ -255,6 +417,61 @@ func (m QuirkResetMethod) String() string {
 	return fmt.Sprintf("unknown (%d)", int(m))
 }
 
+// QuirkClearHalt defines, which endpoints are cleared from the
+// halted condition, when device persistently responds with
+// zero-size reads
+type QuirkClearHalt int
+
+// QuirkClearHaltNever - don't use ClearHalt
+// QuirkClearHaltIn    - clear IN endpoint only
+// QuirkClearHaltBoth  - clear both IN and OUT endpoints
+const (
+	QuirkClearHaltNever QuirkClearHalt = iota
+	QuirkClearHaltIn
+	QuirkClearHaltBoth
+)
+
+// String returns textual representation of QuirkClearHalt
+func (m QuirkClearHalt) String() string {
+	switch m {
+	case QuirkClearHaltNever:
+		return "never"
+	case QuirkClearHaltIn:
+		return "in"
+	case QuirkClearHaltBoth:
+		return "both"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(m))
+}
+
+// QuirkDetach defines, when kernel drivers (i.e., usblp) are
+// detached from the device interfaces
+type QuirkDetach int
+
+// QuirkDetachAuto   - detach, if configuration needs to be changed
+// QuirkDetachAlways - always detach
+// QuirkDetachNever  - never detach
+const (
+	QuirkDetachAuto QuirkDetach = iota
+	QuirkDetachAlways
+	QuirkDetachNever
+)
+
+// String returns textual representation of QuirkDetach
+func (m QuirkDetach) String() string {
+	switch m {
+	case QuirkDetachAuto:
+		return "auto"
+	case QuirkDetachAlways:
+		return "always"
+	case QuirkDetachNever:
+		return "never"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(m))
+}
+
 // QuirkBuggyIppRsp defines, how to handle buggy IPP responses
 type QuirkBuggyIppRsp int
 
@@ -291,6 +508,7 @@ type Quirks struct {
 	byName      map[string]*Quirk // Quirks by name
 	weights     map[string]int    // Matching weights
 	HTTPHeaders map[string]string // HTTP header override
+	HTTPRspHdrs map[string]string // HTTP response header override
 }
 
 // NewQuirks returns a new Quirks structure
@@ -299,6 +517,7 @@ func NewQuirks() *Quirks {
 		byName:      make(map[string]*Quirk),
 		weights:     make(map[string]int),
 		HTTPHeaders: make(map[string]string),
+		HTTPRspHdrs: make(map[string]string),
 	}
 }
 
@@ -306,7 +525,13 @@ func NewQuirks() *Quirks {
 func (quirks *Quirks) put(q *Quirk) {
 	quirks.byName[q.Name] = q
 
-	if q.isHTTP() {
+	switch {
+	case strings.HasPrefix(q.Name, quirkHTTPResponsePrefix):
+		// Canonicalize and save HTTP response header name
+		name := q.Name[len(quirkHTTPResponsePrefix):]
+		quirks.HTTPRspHdrs[http.CanonicalHeaderKey(name)] = q.RawValue
+
+	case q.isHTTP():
 		// Canonicalize and save HTTP header name
 		hdr := http.CanonicalHeaderKey(q.Name[5:])
 		quirks.HTTPHeaders[hdr] = q.RawValue
@@ -342,14 +567,14 @@ func (quirks *Quirks) prioritizeAndSave(q *Quirk, weight int) {
 }
 
 // PullByHWID pulls matching quirks from the QuirksDb.
-// Match is performed by HWID.
+// Match is performed by HWID and device release (bcdDevice).
 //
 // Matches quirks are saved into the receiver.
-func (quirks *Quirks) PullByHWID(qdb QuirksDb, vid, pid uint16) {
+func (quirks *Quirks) PullByHWID(qdb QuirksDb, vid, pid, rel uint16) {
 	for _, dbquirks := range qdb {
 		for _, q := range dbquirks.byName {
 			if q.isHWID() {
-				weight := q.MatchHWID.Match(vid, pid)
+				weight := q.MatchHWID.Match(vid, pid, rel)
 				if weight >= 0 {
 					quirks.prioritizeAndSave(q, weight)
 				}
@@ -358,6 +583,26 @@ func (quirks *Quirks) PullByHWID(qdb QuirksDb, vid, pid uint16) {
 	}
 }
 
+// PullByPath pulls matching quirks from the QuirksDb.
+// Match is performed by the physical USB path, as returned
+// by UsbPortPath. Path match is the most specific, so it wins
+// over HWID and model name matches.
+//
+// Matches quirks are saved into the receiver.
+func (quirks *Quirks) PullByPath(qdb QuirksDb, path string) {
+	if path == "" {
+		return
+	}
+
+	for _, dbquirks := range qdb {
+		for _, q := range dbquirks.byName {
+			if q.MatchPath == path {
+				quirks.prioritizeAndSave(q, 2000)
+			}
+		}
+	}
+}
+
 // PullByModelName pulls matching quirks from the QuirksDb.
 // Match is performed by the model name.
 //
@@ -365,7 +610,7 @@ func (quirks *Quirks) PullByHWID(qdb QuirksDb, vid, pid uint16) {
 func (quirks *Quirks) PullByModelName(qdb QuirksDb, model string) {
 	for _, dbquirks := range qdb {
 		for _, q := range dbquirks.byName {
-			if !q.isHWID() {
+			if !q.isHWID() && !q.isPath() {
 				// Note, by multiplying GlobMatch by 2,
 				// we have the following:
 				//   - Exact HWID match is the must
@@ -430,6 +675,12 @@ func (quirks *Quirks) Get(name string) *Quirk {
 	return q
 }
 
+// IsDefault tells if quirk has its default value, i.e., it is
+// not set explicitly by any of quirks files
+func (quirks *Quirks) IsDefault(name string) bool {
+	return quirks.Get(name) == quirkDefault[name]
+}
+
 // All returns all quirks in the collection. This method is
 // intended mostly for diagnostic purposes (logging, dumping,
 // testing and so on).
@@ -470,6 +721,12 @@ func (quirks *Quirks) GetIgnoreIppStatus() bool {
 	return quirks.Get(QuirkNmIgnoreIppStatus).Parsed.(bool)
 }
 
+// GetIgnoreSerial returns effective "ignore-serial" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetIgnoreSerial() bool {
+	return quirks.Get(QuirkNmIgnoreSerial).Parsed.(bool)
+}
+
 // GetInitDelay returns effective "init-delay" parameter
 // taking the whole set into consideration.
 func (quirks *Quirks) GetInitDelay() time.Duration {
@@ -482,6 +739,12 @@ func (quirks *Quirks) GetInitRetryPartial() bool {
 	return quirks.Get(QuirkNmInitRetryPartial).Parsed.(bool)
 }
 
+// GetInitReadyTimeout returns effective "init-ready-timeout" parameter
+// taking the whole set into consideration.
+func (quirks *Quirks) GetInitReadyTimeout() time.Duration {
+	return quirks.Get(QuirkNmInitReadyTimeout).Parsed.(time.Duration)
+}
+
 // GetInitReset returns effective "init-reset" parameter
 // taking the whole set into consideration.
 func (quirks *Quirks) GetInitReset() QuirkResetMethod {
@@ -512,12 +775,90 @@ func (quirks *Quirks) GetRequestDelay() time.Duration {
 	return quirks.Get(QuirkNmRequestDelay).Parsed.(time.Duration)
 }
 
+// GetURLRewrite returns effective "url-rewrite" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetURLRewrite() bool {
+	return quirks.Get(QuirkNmURLRewrite).Parsed.(bool)
+}
+
+// GetUsbAltSetting returns effective "usb-alt-setting" parameter,
+// taking the whole set into consideration. -1 means "auto".
+func (quirks *Quirks) GetUsbAltSetting() int {
+	return quirks.Get(QuirkNmUsbAltSetting).Parsed.(int)
+}
+
+// GetUsbAutosuspend returns effective "usb-autosuspend" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbAutosuspend() bool {
+	return quirks.Get(QuirkNmUsbAutosuspend).Parsed.(bool)
+}
+
+// GetUsbClearHalt returns effective "usb-clear-halt" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbClearHalt() QuirkClearHalt {
+	return quirks.Get(QuirkNmUsbClearHalt).Parsed.(QuirkClearHalt)
+}
+
+// GetUsbClearHaltLimit returns effective "usb-clear-halt-limit"
+// parameter, taking the whole set into consideration.
+func (quirks *Quirks) GetUsbClearHaltLimit() uint {
+	return quirks.Get(QuirkNmUsbClearHaltLimit).Parsed.(uint)
+}
+
+// GetUsbConfig returns effective "usb-config" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbConfig() uint {
+	return quirks.Get(QuirkNmUsbConfig).Parsed.(uint)
+}
+
+// GetUsbDetachKernelDriver returns effective "usb-detach-kernel-driver"
+// parameter, taking the whole set into consideration.
+func (quirks *Quirks) GetUsbDetachKernelDriver() QuirkDetach {
+	return quirks.Get(QuirkNmUsbDetachKernelDriver).Parsed.(QuirkDetach)
+}
+
+// GetUsbKeepalive returns effective "usb-keepalive" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbKeepalive() time.Duration {
+	return quirks.Get(QuirkNmUsbKeepalive).Parsed.(time.Duration)
+}
+
+// GetUsbInterfaceOrder returns effective "usb-interface-order"
+// parameter, taking the whole set into consideration.
+func (quirks *Quirks) GetUsbInterfaceOrder() QuirkIfOrder {
+	return quirks.Get(QuirkNmUsbInterfaceOrder).Parsed.(QuirkIfOrder)
+}
+
 // GetUsbMaxInterfaces returns effective "usb-max-interfaces" parameter,
 // taking the whole set into consideration.
 func (quirks *Quirks) GetUsbMaxInterfaces() uint {
 	return quirks.Get(QuirkNmUsbMaxInterfaces).Parsed.(uint)
 }
 
+// GetUsbProbeInterfaces returns effective "usb-probe-interfaces"
+// parameter, taking the whole set into consideration.
+func (quirks *Quirks) GetUsbProbeInterfaces() time.Duration {
+	return quirks.Get(QuirkNmUsbProbeInterfaces).Parsed.(time.Duration)
+}
+
+// GetUsbReadAlign returns effective "usb-read-align" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbReadAlign() uint {
+	return quirks.Get(QuirkNmUsbReadAlign).Parsed.(uint)
+}
+
+// GetUsbReadBuffer returns effective "usb-read-buffer" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbReadBuffer() uint {
+	return quirks.Get(QuirkNmUsbReadBuffer).Parsed.(uint)
+}
+
+// GetUsbReadTimeout returns effective "usb-read-timeout" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbReadTimeout() time.Duration {
+	return quirks.Get(QuirkNmUsbReadTimeout).Parsed.(time.Duration)
+}
+
 // GetUsbSendDelayThreshold returns effective "usb-send-delay-threshold"
 // parameter taking the whole set into consideration.
 func (quirks *Quirks) GetUsbSendDelayThreshold() uint {
@@ -530,12 +871,36 @@ func (quirks *Quirks) GetUsbSendDelay() time.Duration {
 	return quirks.Get(QuirkNmUsbSendDelay).Parsed.(time.Duration)
 }
 
+// GetUsbStallReset returns effective "usb-stall-reset" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbStallReset() time.Duration {
+	return quirks.Get(QuirkNmUsbStallReset).Parsed.(time.Duration)
+}
+
+// GetUsbWatchdog returns effective "usb-watchdog" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbWatchdog() time.Duration {
+	return quirks.Get(QuirkNmUsbWatchdog).Parsed.(time.Duration)
+}
+
+// GetUsbWriteTimeout returns effective "usb-write-timeout" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUsbWriteTimeout() time.Duration {
+	return quirks.Get(QuirkNmUsbWriteTimeout).Parsed.(time.Duration)
+}
+
 // GetZlpRecvHack returns effective "zlp-send" parameter,
 // taking the whole set into consideration.
 func (quirks *Quirks) GetZlpRecvHack() bool {
 	return quirks.Get(QuirkNmZlpRecvHack).Parsed.(bool)
 }
 
+// GetUserAgent returns effective "user-agent" parameter,
+// taking the whole set into consideration.
+func (quirks *Quirks) GetUserAgent() string {
+	return quirks.Get(QuirkNmUserAgent).Parsed.(string)
+}
+
 // GetZlpSend returns effective "zlp-send" parameter,
 // taking the whole set into consideration.
 func (quirks *Quirks) GetZlpSend() bool {
@@ -596,6 +961,7 @@ func (qdb *QuirksDb) readFile(file string) error {
 	// Load all quirks
 	var quirks *Quirks
 	var matchHWID *HWIDPattern
+	var matchPath string
 	var loadOrder int
 
 	for err == nil {
@@ -610,6 +976,7 @@ func (qdb *QuirksDb) readFile(file string) error {
 		// Get Quirks structure
 		if rec.Type == IniRecordSection {
 			matchHWID = ParseHWIDPattern(rec.Section)
+			matchPath = quirksParsePathSection(rec.Section)
 			quirks = NewQuirks()
 			qdb.Add(quirks)
 
@@ -630,6 +997,7 @@ func (qdb *QuirksDb) readFile(file string) error {
 			Origin:    origin,
 			Match:     rec.Section,
 			MatchHWID: matchHWID,
+			MatchPath: matchPath,
 			Name:      rec.Key,
 			RawValue:  rec.Value,
 			LoadOrder: loadOrder,
@@ -640,6 +1008,12 @@ func (qdb *QuirksDb) readFile(file string) error {
 		if q.isHTTP() {
 			q.Name = strings.ToLower(q.Name)
 			q.Parsed = q.RawValue
+
+			_, err := httpParseHeaderRewrite(q.RawValue)
+			if err != nil {
+				err = fmt.Errorf("%s: %s: %s", origin, q.Name, err)
+				return err
+			}
 		} else {
 			parse := quirkParse[q.Name]
 			if parse == nil {
@@ -29,6 +29,7 @@ func TestQuirksPrioritization(t *testing.T) {
 	}
 
 	type expectation struct {
+		path        string
 		hwid        string
 		model       string
 		name, value string
@@ -236,6 +237,88 @@ func TestQuirksPrioritization(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			// HWID match with and without release range
+			// Release range match wins, and only matches its range.
+			sections: []section{
+				{
+					name: "1234:5678",
+					vars: []variable{
+						{"init-timeout", "10"},
+					},
+				},
+
+				{
+					name: "1234:5678@1.10-1.20",
+					vars: []variable{
+						{"init-timeout", "20"},
+					},
+				},
+			},
+
+			expected: []expectation{
+				{
+					hwid:  "1234:5678@1.15",
+					name:  "init-timeout",
+					value: "20",
+				},
+				{
+					hwid:  "1234:5678@1.30",
+					name:  "init-timeout",
+					value: "10",
+				},
+			},
+		},
+
+		{
+			// USB path match vs HWID and model name match
+			// Path match wins, and only matches its path.
+			sections: []section{
+				{
+					name: "1234:5678",
+					vars: []variable{
+						{"init-timeout", "10"},
+					},
+				},
+
+				{
+					name: "usb-path 1-1.4",
+					vars: []variable{
+						{"init-timeout", "20"},
+					},
+				},
+
+				{
+					name: "test *",
+					vars: []variable{
+						{"init-timeout", "30"},
+					},
+				},
+			},
+
+			expected: []expectation{
+				{
+					path:  "1-1.4",
+					hwid:  "1234:5678",
+					model: "test printer",
+					name:  "init-timeout",
+					value: "20",
+				},
+				{
+					path:  "1-1.5",
+					hwid:  "1234:5678",
+					model: "test printer",
+					name:  "init-timeout",
+					value: "10",
+				},
+				{
+					model: "usb-path 1-1.4",
+					name:  "init-timeout",
+					value: DevInitTimeout.String(),
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -251,6 +334,7 @@ func TestQuirksPrioritization(t *testing.T) {
 					Origin:    "test",
 					Match:     s.name,
 					MatchHWID: ParseHWIDPattern(s.name),
+					MatchPath: quirksParsePathSection(s.name),
 					Name:      v.name,
 					RawValue:  v.value,
 					LoadOrder: loadOrder,
@@ -267,8 +351,10 @@ func TestQuirksPrioritization(t *testing.T) {
 		for _, ex := range test.expected {
 			// Lookup quirks data based
 			quirks := NewQuirks()
+			quirks.PullByPath(qdb, ex.path)
 			if hwid := ParseHWIDPattern(ex.hwid); hwid != nil {
-				quirks.PullByHWID(qdb, hwid.vid, hwid.pid)
+				quirks.PullByHWID(qdb, hwid.vid, hwid.pid,
+					hwid.relMin)
 			}
 			if ex.model != "" {
 				quirks.PullByModelName(qdb, ex.model)
@@ -292,6 +378,9 @@ func TestQuirksPrioritization(t *testing.T) {
 			fmt.Fprintf(&buf, "\n")
 
 			fmt.Fprintf(&buf, "quirks query:\n")
+			if ex.path != "" {
+				fmt.Fprintf(&buf, "  path:     %s\n", ex.path)
+			}
 			if ex.hwid != "" {
 				fmt.Fprintf(&buf, "  hwid:     %s\n", ex.hwid)
 			}
@@ -432,6 +521,61 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmURLRewrite,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetURLRewrite()
+			},
+			match:  "*",
+			value:  true,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbClearHalt,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetUsbClearHalt()
+			},
+			match:  "*",
+			value:  QuirkClearHaltNever,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbDetachKernelDriver,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetUsbDetachKernelDriver()
+			},
+			match:  "*",
+			value:  QuirkDetachAlways,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbInterfaceOrder,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetUsbInterfaceOrder()
+			},
+			match:  "*",
+			value:  QuirkIfOrder{},
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbKeepalive,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetUsbKeepalive()
+			},
+			match:  "*",
+			value:  time.Duration(0),
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmUsbMaxInterfaces,
@@ -443,6 +587,28 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbProbeInterfaces,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetUsbProbeInterfaces()
+			},
+			match:  "*",
+			value:  time.Duration(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUserAgent,
+			get: func(quirks *Quirks) interface{} {
+				return quirks.GetUserAgent()
+			},
+			match:  "*",
+			value:  "ipp-usb",
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmZlpRecvHack,
@@ -665,6 +831,25 @@ func TestQuirksParsers(t *testing.T) {
 			err:    `"invalid": must be none, soft or hard`,
 		},
 
+		// parseQuirkAltSetting
+		{
+			parser: (*Quirk).parseQuirkAltSetting,
+			input:  "auto",
+			value:  -1,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkAltSetting,
+			input:  "1",
+			value:  1,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkAltSetting,
+			input:  "256",
+			err:    `"256": must be auto or number`,
+		},
+
 		// parseUint
 		{
 			parser: (*Quirk).parseUint,
@@ -0,0 +1,78 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Quirks suggestion from observed failures
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// usbFailures counts characteristic failure signatures of the
+// device, used to suggest quirks. All fields are atomic
+type usbFailures struct {
+	zlpStorms    int32 // Storms of zero-size reads
+	badHTTP      int32 // Malformed HTTP responses
+	expectStalls int32 // Stalls of requests with Expect: 100-continue
+}
+
+// quirkSuggestion represents a single suggested quirk
+type quirkSuggestion struct {
+	name, value string // Quirk name and value
+	reason      string // Why it is suggested
+}
+
+// suggest returns quirks, suggested by the observed failures.
+// Quirks, already set for the device, are not suggested
+func (failures *usbFailures) suggest(quirks *Quirks) []quirkSuggestion {
+	var suggestions []quirkSuggestion
+
+	add := func(cnt *int32, name, value, reason string) {
+		n := atomic.LoadInt32(cnt)
+		if n >= QuirkSuggestMinFailures && quirks.IsDefault(name) {
+			suggestions = append(suggestions, quirkSuggestion{
+				name:   name,
+				value:  value,
+				reason: fmt.Sprintf("%s: %d", reason, n),
+			})
+		}
+	}
+
+	add(&failures.zlpStorms, QuirkNmUsbClearHalt, "in",
+		"zero-size read storms")
+	add(&failures.badHTTP, QuirkNmUsbMaxInterfaces, "1",
+		"malformed HTTP responses")
+	add(&failures.expectStalls, QuirkNmUsbSendDelayThreshold, "2048",
+		"stalls after Expect: 100-continue")
+	add(&failures.expectStalls, QuirkNmUsbSendDelay, "0.2ms",
+		"stalls after Expect: 100-continue")
+
+	return suggestions
+}
+
+// quirkSuggestFormat formats suggested quirks as a quirks file
+// snippet for the device model, line by line
+func quirkSuggestFormat(model string, suggestions []quirkSuggestion) []string {
+	if len(suggestions) == 0 {
+		return nil
+	}
+
+	lines := []string{"# Observed failures:"}
+	for i, s := range suggestions {
+		if i == 0 || s.reason != suggestions[i-1].reason {
+			lines = append(lines, "#   "+s.reason)
+		}
+	}
+
+	lines = append(lines, "["+model+"]")
+	for _, s := range suggestions {
+		lines = append(lines, "  "+s.name+" = "+s.value)
+	}
+
+	return lines
+}
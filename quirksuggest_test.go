@@ -0,0 +1,79 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for quirks suggestion from observed failures
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestQuirkSuggest tests quirks suggestion
+func TestQuirkSuggest(t *testing.T) {
+	const model = "HP LaserJet 1234"
+
+	// Nothing observed, nothing suggested
+	failures := &usbFailures{}
+	lines := quirkSuggestFormat(model, failures.suggest(NewQuirks()))
+	if lines != nil {
+		t.Errorf("no failures: unexpected suggestion %q", lines)
+	}
+
+	// Single failure is not enough
+	failures = &usbFailures{zlpStorms: 1, badHTTP: 2, expectStalls: 3}
+	lines = quirkSuggestFormat(model, failures.suggest(NewQuirks()))
+	expected := []string{
+		"# Observed failures:",
+		"#   malformed HTTP responses: 2",
+		"#   stalls after Expect: 100-continue: 3",
+		"[HP LaserJet 1234]",
+		"  usb-max-interfaces = 1",
+		"  usb-send-delay-threshold = 2048",
+		"  usb-send-delay = 0.2ms",
+	}
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("suggestion mismatch:\nexpected: %q\npresent:  %q",
+			expected, lines)
+	}
+
+	// Quirks, already set, are not suggested
+	dir := t.TempDir()
+
+	err := ioutil.WriteFile(filepath.Join(dir, "local.conf"), []byte(`
+[*]
+  usb-max-interfaces = 1
+  usb-send-delay = 1ms
+`), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	qdb, err := LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet: %s", err)
+	}
+
+	quirks := NewQuirks()
+	quirks.PullByModelName(qdb, model)
+
+	lines = quirkSuggestFormat(model, failures.suggest(quirks))
+	expected = []string{
+		"# Observed failures:",
+		"#   stalls after Expect: 100-continue: 3",
+		"[HP LaserJet 1234]",
+		"  usb-send-delay-threshold = 2048",
+	}
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("suggestion mismatch:\nexpected: %q\npresent:  %q",
+			expected, lines)
+	}
+}
@@ -0,0 +1,168 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Device readiness probe
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DevReadyProbe waits until device becomes ready to serve requests.
+//
+// Some devices enumerate on USB and accept HTTP requests long before
+// their IPP stack is fully booted, and respond with errors or garbage
+// during this period. If such a device is announced, CUPS marks newly
+// added queues as broken.
+//
+// So device is periodically probed with lightweight requests:
+// Get-Printer-Attributes for printer-state (if device can print)
+// and eSCL ScannerStatus (if device can scan), until device answers
+// sanely or timeout expires.
+//
+// On success, it returns nil error. Otherwise, it returns the error
+// and HTTP status (if any) of the last probe. If probe has failed
+// due to the USB I/O timeout, it is not retried.
+func DevReadyProbe(log *LogMessage, port int, caps UsbIppBasicCaps,
+	transport *UsbTransport, c *http.Client,
+	timeout time.Duration) (httpstatus int, err error) {
+
+	deadline := time.Now().Add(timeout)
+
+	for attempt := 1; ; attempt++ {
+		httpstatus, err = devReadyProbeOnce(log, port, caps,
+			transport.Quirks(), c)
+
+		if err == nil {
+			log.Debug(' ', "Device ready (probe attempt %d)", attempt)
+			return
+		}
+
+		if transport.TimeoutExpired() ||
+			time.Now().Add(DevReadyProbeInterval).After(deadline) {
+			return
+		}
+
+		log.Debug(' ', "Device not ready: %s", err)
+		log.Debug(' ', "Retrying in %s", DevReadyProbeInterval)
+		log.Flush()
+
+		time.Sleep(DevReadyProbeInterval)
+	}
+}
+
+// devReadyProbeOnce performs a single readiness probe
+func devReadyProbeOnce(log *LogMessage, port int, caps UsbIppBasicCaps,
+	quirks *Quirks, c *http.Client) (httpstatus int, err error) {
+
+	if caps&UsbIppBasicCapsPrint != 0 {
+		httpstatus, err = devReadyProbeIpp(log, port, quirks, c)
+		if err != nil {
+			return
+		}
+	}
+
+	if caps&UsbIppBasicCapsScan != 0 {
+		httpstatus, err = devReadyProbeEscl(log, port, c)
+	}
+
+	return
+}
+
+// devReadyProbeIpp probes the IPP printer state
+func devReadyProbeIpp(log *LogMessage, port int, quirks *Quirks,
+	c *http.Client) (httpstatus int, err error) {
+
+	uri := fmt.Sprintf("ipp://localhost:%d/ipp/print", port)
+	msg, httpstatus, err := ippGetPrinterAttributes(log, c, quirks, uri,
+		"printer-state")
+	if err != nil {
+		return
+	}
+
+	attrs := newIppAttrs(msg.Printer)
+	state := attrs.getInt("printer-state")
+
+	// Printer state must be one of idle(3), processing(4)
+	// or stopped(5)
+	if state < 3 || state > 5 {
+		err = errors.New("IPP: printer-state missed or invalid")
+	}
+
+	return
+}
+
+// devReadyProbeEscl probes the eSCL scanner status
+func devReadyProbeEscl(log *LogMessage, port int,
+	c *http.Client) (httpstatus int, err error) {
+
+	uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerStatus", port)
+
+	session := HTTPClientNewSession(c)
+	log.Session(session)
+	defer log.Session(-1)
+
+	rq, _ := http.NewRequest("GET", uri, nil)
+	rq = rq.WithContext(WithHTTPSession(context.Background(), session))
+
+	resp, err := c.Do(rq)
+	if err != nil {
+		if !ErrIsEOF(err) {
+			err = fmt.Errorf("eSCL: %s", err)
+		}
+		return
+	}
+
+	defer resp.Body.Close()
+
+	// Some devices list scanning in their basic capabilities,
+	// but have no eSCL scanner. Answering 404, device is
+	// obviously running, so don't wait for it
+	if resp.StatusCode == http.StatusNotFound {
+		log.Debug(' ', "eSCL ScannerStatus not found, skipped")
+		return
+	}
+
+	if resp.StatusCode/100 != 2 {
+		httpstatus = resp.StatusCode
+		err = fmt.Errorf("eSCL: HTTP status: %s", resp.Status)
+		return
+	}
+
+	xmlData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("eSCL: %s", err)
+		return
+	}
+
+	log.Add(LogTraceESCL, '<', "ESCL Scanner Status:")
+	log.LineWriter(LogTraceESCL, '<').WriteClose(xmlData)
+	log.Nl(LogTraceESCL)
+	log.Flush()
+
+	// Note, encoding/xml matches elements without namespace
+	// prefix in the struct tag against any namespace
+	var status struct {
+		State string `xml:"State"`
+	}
+
+	err = xml.Unmarshal(xmlData, &status)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("eSCL: %s", err)
+	case status.State == "":
+		err = errors.New("eSCL: missed pwg:State")
+	}
+
+	return
+}
@@ -0,0 +1,81 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Detection of system resume from suspend
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// resumeDetector detects system resume from suspend.
+//
+// Many printers renumerate or lose their interface state across
+// system suspend, so after resume all devices need to be reopened.
+//
+// Detection is based on comparison of two clocks: the Go monotonic
+// clock, which doesn't advance while system sleeps, and the clock
+// that keeps running during suspend (see resumeClock). If the
+// latter advances noticeably more, system was suspended.
+//
+// This approach doesn't depend on the logind or any other system
+// service and works on all platforms where these clocks differ.
+type resumeDetector struct {
+	mono  time.Time     // Last check, monotonic clock
+	clock time.Duration // Last check, resumeClock
+}
+
+// newResumeDetector creates a new resumeDetector
+func newResumeDetector() *resumeDetector {
+	return &resumeDetector{
+		mono:  time.Now(),
+		clock: resumeClock(),
+	}
+}
+
+// check returns how long system was suspended since the previous
+// check, or 0, if suspend was not detected
+func (rd *resumeDetector) check() time.Duration {
+	mono, clock := time.Now(), resumeClock()
+	slept := (clock - rd.clock) - mono.Sub(rd.mono)
+	rd.mono, rd.clock = mono, clock
+
+	if slept < ResumeSleepThreshold {
+		return 0
+	}
+
+	return slept
+}
+
+// resumeWatch periodically checks for system resume from suspend.
+// Detected suspend durations are sent to the returned channel.
+// Watching stops when done channel is closed
+func resumeWatch(done <-chan struct{}) <-chan time.Duration {
+	resumeChan := make(chan time.Duration, 1)
+
+	go func() {
+		ticker := time.NewTicker(ResumeCheckInterval)
+		defer ticker.Stop()
+
+		rd := newResumeDetector()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if slept := rd.check(); slept > 0 {
+					select {
+					case resumeChan <- slept:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	return resumeChan
+}
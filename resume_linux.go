@@ -0,0 +1,31 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Detection of system resume from suspend -- Linux version
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// #include <time.h>
+import "C"
+
+// resumeClock returns current value of the clock, that keeps
+// running while system is suspended.
+//
+// On Linux, it is CLOCK_BOOTTIME. Unlike wall clock, it is not
+// affected by the system time adjustments
+func resumeClock() time.Duration {
+	var ts C.struct_timespec
+	if C.clock_gettime(C.CLOCK_BOOTTIME, &ts) != 0 {
+		return time.Duration(time.Now().UnixNano())
+	}
+
+	return time.Duration(ts.tv_sec)*time.Second +
+		time.Duration(ts.tv_nsec)
+}
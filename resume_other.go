@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Detection of system resume from suspend -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// resumeClock returns current value of the clock, that keeps
+// running while system is suspended.
+//
+// The wall clock is used here. Note, system time adjustments
+// may be mistaken for suspend
+func resumeClock() time.Duration {
+	return time.Duration(time.Now().UnixNano())
+}
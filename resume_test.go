@@ -0,0 +1,35 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for detection of system resume from suspend
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestResumeDetector tests resumeDetector
+func TestResumeDetector(t *testing.T) {
+	rd := newResumeDetector()
+
+	if slept := rd.check(); slept != 0 {
+		t.Errorf("unexpected suspend detected: %s", slept)
+	}
+
+	// Simulate 1 minute of suspend
+	rd.clock -= time.Minute
+
+	slept := rd.check()
+	if slept < time.Minute-time.Second || slept > time.Minute+time.Second {
+		t.Errorf("suspend: expected %s, detected %s", time.Minute, slept)
+	}
+
+	if slept = rd.check(); slept != 0 {
+		t.Errorf("unexpected suspend detected: %s", slept)
+	}
+}
@@ -0,0 +1,95 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Sharing devices on the network
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// ConfShare represents a per-device network sharing switch, defined
+// in the [share] section of the configuration file:
+//
+//	[share]
+//	  04f9:2d48 = enable
+//
+// Shared device gets the HTTPS port, accessible from the local
+// networks (i.e., networks, directly connected to the host's
+// interfaces) even if the interface parameter of the [network]
+// section is loopback, and its secure services (_ipps._tcp and
+// _uscans._tcp) are advertised via DNS-SD on the network. Network
+// clients of this port must authenticate with password, and the
+// ACL of the device applies.
+//
+// The first matching entry wins. Devices without matching entry
+// are not shared
+type ConfShare struct {
+	Match  UsbDevMatch // Matching device
+	Enable bool        // Device is shared
+}
+
+// ShareLookup tells if device is configured to be shared
+func ShareLookup(desc UsbDeviceDesc, info UsbDeviceInfo) bool {
+	getinfo := func() (UsbDeviceInfo, error) { return info, nil }
+
+	for _, conf := range Conf.DeviceShares {
+		if conf.Match.Match(desc, getinfo) {
+			return conf.Enable
+		}
+	}
+
+	return false
+}
+
+// ShareCheck checks that configuration allows sharing of devices.
+//
+// Network clients of shared devices must authenticate with password,
+// so sharing without [auth http] rules would be either insecure
+// or useless
+func ShareCheck() error {
+	if len(Conf.ConfAuthHTTP) == 0 {
+		return errors.New("[auth http] is not configured")
+	}
+
+	return nil
+}
+
+// ShareAllowed tells if client is allowed to access the shared
+// device, i.e., it belongs to one of the local networks
+func ShareAllowed(client net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && !ipnet.IP.IsLoopback() && ipnet.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// confLoadShare loads the [share] section record
+func confLoadShare(rec *IniRecord) error {
+	match, err := ParseUsbDevMatch(rec.Key)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	conf := &ConfShare{Match: match}
+	err = rec.LoadNamedBool(&conf.Enable, "disable", "enable")
+	if err == nil {
+		Conf.DeviceShares = append(Conf.DeviceShares, conf)
+	}
+
+	return err
+}
@@ -0,0 +1,134 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Sharing devices on the network tests
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestConfLoadShare tests loading of the [share] section
+func TestConfLoadShare(t *testing.T) {
+	testConf(t)
+	Conf.DeviceShares = nil
+	Conf.ConfAuthHTTP = nil
+	if ShareCheck() == nil {
+		t.Errorf("ShareCheck: error expected without [auth http]")
+	}
+
+	err := testConfLoad(t, `
+[share]
+  04f9:2d48/CN12345 = disable
+  04f9:2d48         = enable
+
+[auth http]
+  print = office:secret
+`)
+
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err = ShareCheck(); err != nil {
+		t.Errorf("ShareCheck: %s", err)
+	}
+
+	tests := []struct {
+		vid, pid uint16
+		serial   string
+		share    bool
+	}{
+		{0x04f9, 0x2d48, "CN12345", false},
+		{0x04f9, 0x2d48, "CN67890", true},
+		{0x1234, 0x5678, "", false},
+	}
+
+	for _, test := range tests {
+		desc := UsbDeviceDesc{Vendor: test.vid, Product: test.pid}
+		info := UsbDeviceInfo{SerialNumber: test.serial}
+		if share := ShareLookup(desc, info); share != test.share {
+			t.Errorf("%4.4x:%4.4x/%s: expected %v, present %v",
+				test.vid, test.pid, test.serial, test.share, share)
+		}
+	}
+}
+
+// TestAuthShare tests authentication of network clients of the
+// shared device
+func TestAuthShare(t *testing.T) {
+	saveRules, saveUID := Conf.ConfAuthHTTP, Conf.ConfAuthUID
+	defer func() {
+		Conf.ConfAuthHTTP, Conf.ConfAuthUID = saveRules, saveUID
+	}()
+
+	rec := &IniRecord{Key: "print", Value: "office:secret"}
+	Conf.ConfAuthHTTP = nil
+	Conf.ConfAuthUID = nil
+	if err := rec.LoadAuthHTTPRules(&Conf.ConfAuthHTTP); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	server := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 60001}
+
+	tests := []struct {
+		method, path string
+		password     string
+		share        bool
+		status       int
+	}{
+		// Not shared: password is required only by rules
+		{"GET", "/eSCL/ScannerStatus", "", false, http.StatusOK},
+		{"POST", "/ipp/print", "", false, http.StatusUnauthorized},
+
+		// Shared: operations without rules are not shared
+		{"GET", "/eSCL/ScannerStatus", "", true, http.StatusForbidden},
+		{"GET", "/", "", true, http.StatusForbidden},
+		{"POST", "/ipp/print", "", true, http.StatusUnauthorized},
+		{"POST", "/ipp/print", "wrong", true, http.StatusUnauthorized},
+		{"POST", "/ipp/print", "secret", true, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rq := httptest.NewRequest(test.method, test.path, nil)
+		if test.password != "" {
+			rq.SetBasicAuth("office", test.password)
+		}
+
+		status, _ := AuthHTTPRequest(NewLogger(), client, server,
+			rq, test.share)
+		if status != test.status {
+			t.Errorf("%s %s share=%v password=%q: "+
+				"expected %d, present %d",
+				test.method, test.path, test.share,
+				test.password, test.status, status)
+		}
+	}
+}
+
+// TestShareAllowed tests checking of the shared device clients
+func TestShareAllowed(t *testing.T) {
+	if ShareAllowed(net.ParseIP("127.0.0.1")) {
+		t.Errorf("loopback client is not on the local network")
+	}
+
+	if ShareAllowed(net.ParseIP("240.0.0.1")) {
+		t.Errorf("240.0.0.1 is not on the local network")
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && !ipnet.IP.IsLoopback() && !ShareAllowed(ipnet.IP) {
+			t.Errorf("%s is on the local network", ipnet.IP)
+		}
+	}
+}
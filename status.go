@@ -10,20 +10,26 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 // statusOfDevice represents a status of the particular device
 type statusOfDevice struct {
-	desc     UsbDeviceDesc // Device descriptor
-	init     error         // Initialization error, nil if none
-	HTTPPort int           // Assigned http port for the device
+	desc     UsbDeviceDesc   // Device descriptor
+	init     error           // Initialization error, nil if none
+	HTTPPort int             // Assigned http port for the device
+	mem      *MemAcct        // Memory usage, nil if device not opened
+	usb      *UsbTransport   // USB transport, nil if device not opened
+	dnssd    *DNSSdPublisher // DNS-SD publisher, nil if none
 }
 
 var (
@@ -58,6 +64,87 @@ func StatusRetrieve() ([]byte, error) {
 	return ioutil.ReadAll(rsp.Body)
 }
 
+// StatusHoldRequest asks the running ipp-usb daemon to hold or
+// release print jobs of the device, specified as BUS:DEV or
+// VID:PID[/serial][@path]
+func StatusHoldRequest(device string, hold bool) error {
+	t := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return CtrlsockDial()
+		},
+	}
+
+	c := &http.Client{
+		Transport: t,
+	}
+
+	path := "/release"
+	if hold {
+		path = "/hold"
+	}
+
+	rsp, err := c.Post("http://localhost"+path+"?device="+
+		url.QueryEscape(device), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	text, err := ioutil.ReadAll(rsp.Body)
+	switch {
+	case err != nil:
+		return err
+	case rsp.StatusCode == http.StatusForbidden:
+		return ErrAccess
+	case rsp.StatusCode != http.StatusOK:
+		return errors.New(strings.TrimSpace(string(text)))
+	}
+
+	return nil
+}
+
+// StatusHoldDevice holds or releases print jobs of the device,
+// specified as BUS:DEV or VID:PID[/serial][@path]. If VID:PID
+// matches multiple devices, all of them are affected
+func StatusHoldDevice(device string, hold bool) error {
+	match, err := ParseUsbDevMatch(device)
+	byAddr := err != nil
+	addr, err := ParseUsbAddr(device)
+	if byAddr && err != nil {
+		return fmt.Errorf("%q: invalid device", device)
+	}
+
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	found := 0
+	for _, status := range statusTable {
+		if byAddr && status.desc.UsbAddr != addr ||
+			!byAddr && !match.Match(status.desc,
+				status.desc.GetUsbDeviceInfo) {
+			continue
+		}
+
+		if status.usb == nil {
+			continue
+		}
+
+		found++
+		if !hold {
+			status.usb.hold.Release()
+		} else if err = status.usb.hold.Hold(); err != nil {
+			return err
+		}
+	}
+
+	if found == 0 {
+		return fmt.Errorf("%s: device not found", device)
+	}
+
+	return nil
+}
+
 // StatusFormat formats ipp-usb status as a text
 func StatusFormat() []byte {
 	buf := &bytes.Buffer{}
@@ -69,6 +156,7 @@ func StatusFormat() []byte {
 	// Dump ipp-usb daemon status. If we are here, we are
 	// definitely running :-)
 	buf.WriteString("ipp-usb daemon: running\n")
+	buf.Write(LeakCheckStatus())
 
 	// Sort devices by address
 	devs := make([]*statusOfDevice, len(statusTable))
@@ -111,6 +199,44 @@ func StatusFormat() []byte {
 			}
 
 			fmt.Fprintf(buf, "      status: %s\n", s)
+
+			if status.dnssd != nil {
+				fmt.Fprintf(buf, "      dns-sd: %s\n", status.dnssd.Status())
+			}
+
+			if status.desc.Path != "" {
+				fmt.Fprintf(buf, "      path:   %s\n", status.desc.Path)
+			}
+
+			if status.mem != nil {
+				fmt.Fprintf(buf, "      memory: %s\n", status.mem)
+			}
+
+			if usb := status.usb; usb != nil {
+				fmt.Fprintf(buf, "      queue:  %d waiting, %d/%d busy\n",
+					usb.QueueDepth(), usb.connInUse(),
+					len(usb.connList))
+
+				if usb.Shared() {
+					fmt.Fprintf(buf, "      share:  enabled\n")
+				}
+
+				if s := usb.hold.Status(); s != "" {
+					fmt.Fprintf(buf, "      hold:   %s\n", s)
+				}
+
+				for _, conn := range usb.connList {
+					fmt.Fprintf(buf, "      usb[%d]: %s\n",
+						conn.index, conn.stats)
+				}
+
+				if lines := usb.SuggestQuirks(); lines != nil {
+					fmt.Fprintf(buf, "      suggested quirks:\n")
+					for _, line := range lines {
+						fmt.Fprintf(buf, "        %s\n", line)
+					}
+				}
+			}
 		}
 	}
 
@@ -118,14 +244,23 @@ func StatusFormat() []byte {
 }
 
 // StatusSet adds device to the status table or updates status
-// of the already known device
-func StatusSet(addr UsbAddr, desc UsbDeviceDesc, HTTPPort int, init error) {
-	statusLock.Lock()
-	statusTable[addr] = &statusOfDevice{
-		desc:     desc,
-		init:     init,
-		HTTPPort: HTTPPort,
+// of the already known device. The dev may be nil, if device
+// initialization has failed
+func StatusSet(addr UsbAddr, desc UsbDeviceDesc, dev *Device, init error) {
+	status := &statusOfDevice{
+		desc: desc,
+		init: init,
+	}
+
+	if dev != nil {
+		status.HTTPPort = dev.State.HTTPPort
+		status.mem = dev.UsbTransport.Mem()
+		status.usb = dev.UsbTransport
+		status.dnssd = dev.DNSSdPublisher
 	}
+
+	statusLock.Lock()
+	statusTable[addr] = status
 	statusLock.Unlock()
 }
 
@@ -11,7 +11,11 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"unsafe"
 )
@@ -44,18 +48,77 @@ func TCPClientUIDSupported() bool {
 // TCPClientUID obtains UID of client process that created
 // TCP connection over the loopback interface
 func TCPClientUID(client, server *net.TCPAddr) (int, error) {
+	uid, _, err := sockDiagQuery(client, server)
+	return uid, err
+}
+
+// TCPClientPID obtains PID of client process that owns TCP
+// connection over the loopback interface.
+//
+// The socket is looked up by inode in the /proc/PID/fd of
+// processes, owned by the socket's UID, so it requires root
+// privileges. If socket is shared between processes, the first
+// found is returned
+//
+// It is expensive, so it is only called, when PID is really needed
+func TCPClientPID(client, server *net.TCPAddr) (int, error) {
+	uid, inode, err := sockDiagQuery(client, server)
+	if err != nil {
+		return -1, err
+	}
+
+	link := fmt.Sprintf("socket:[%d]", inode)
+
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return -1, err
+	}
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+
+		// Skip processes of other users without reading
+		// their file descriptors
+		st, ok := proc.Sys().(*syscall.Stat_t)
+		if !ok || int(st.Uid) != uid {
+			continue
+		}
+
+		dir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			target, _ := os.Readlink(filepath.Join(dir, fd.Name()))
+			if target == link {
+				return pid, nil
+			}
+		}
+	}
+
+	return -1, fmt.Errorf("TCPClientPID: socket %d owner not found", inode)
+}
+
+// sockDiagQuery obtains UID and inode of client socket of the
+// TCP connection over the loopback interface
+func sockDiagQuery(client, server *net.TCPAddr) (int, uint32, error) {
 	// Obtain protocol family. Check for mismatch.
 	clientIs4 := client.IP.To4() != nil
 	serverIs4 := server.IP.To4() != nil
 
 	if clientIs4 != serverIs4 {
-		return -1, fmt.Errorf("TCPClientUID: IP4/IP6 mismatchh")
+		return -1, 0, fmt.Errorf("TCPClientUID: IP4/IP6 mismatchh")
 	}
 
 	// Open NETLINK_SOCK_DIAG socket
 	sock, err := sockDiagOpen()
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 
 	defer syscall.Close(sock)
@@ -93,7 +156,7 @@ func TCPClientUID(client, server *net.TCPAddr) (int, error) {
 	rqAddr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
 	err = syscall.Sendto(sock, rqData[:], 0, rqAddr)
 	if err != nil {
-		return -1, fmt.Errorf("sock_diag: sendto(): %s", err)
+		return -1, 0, fmt.Errorf("sock_diag: sendto(): %s", err)
 	}
 
 	// Receive responses
@@ -101,12 +164,12 @@ func TCPClientUID(client, server *net.TCPAddr) (int, error) {
 	for {
 		num, _, err := syscall.Recvfrom(sock, buf, 0)
 		if err != nil {
-			return -1, fmt.Errorf("sock_diag: recvfrom(): %s", err)
+			return -1, 0, fmt.Errorf("sock_diag: recvfrom(): %s", err)
 		}
 
 		msgs, err := syscall.ParseNetlinkMessage(buf[:num])
 		if err != nil {
-			return -1, fmt.Errorf("sock_diag: can't parse response")
+			return -1, 0, fmt.Errorf("sock_diag: can't parse response")
 		}
 
 		for _, msg := range msgs {
@@ -116,11 +179,11 @@ func TCPClientUID(client, server *net.TCPAddr) (int, error) {
 				rsp := (*C.nlmsgerr_struct)(data)
 				err = syscall.Errno(-rsp.error)
 				err = fmt.Errorf("NLMSG_ERROR: %s", err)
-				return -1, err
+				return -1, 0, err
 
 			case uint16(C.SOCK_DIAG_BY_FAMILY):
 				rsp := (*C.inet_diag_msg_struct)(data)
-				return int(rsp.idiag_uid), nil
+				return int(rsp.idiag_uid), uint32(rsp.idiag_inode), nil
 			}
 		}
 	}
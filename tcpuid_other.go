@@ -33,3 +33,11 @@ func TCPClientUID(client, server *net.TCPAddr) (int, error) {
 	// TCPClientUIDSupported returns false
 	panic("TCPClientUID not supported")
 }
+
+// TCPClientPID obtains PID of client process that owns TCP
+// connection over the loopback interface
+func TCPClientPID(client, server *net.TCPAddr) (int, error) {
+	// Note, TCPClientPID should never be called, if
+	// TCPClientUIDSupported returns false
+	panic("TCPClientPID not supported")
+}
@@ -0,0 +1,72 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Built-in test device
+ */
+
+package main
+
+import (
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestDeviceName is the DNS-SD name of the built-in test device
+const TestDeviceName = "ipp-usb Test Device"
+
+// TestDeviceStart starts the built-in test device, if enabled
+// by configuration.
+//
+// The test device is the emulated printer and scanner, served
+// by the regular HTTP proxy and advertised with DNS-SD, exactly
+// as real devices are. It responds to IPP and eSCL requests with
+// canned valid responses, so clients (CUPS, sane-airscan) setup
+// can be verified without real hardware.
+//
+// It returns nil, if test device is disabled or cannot be started
+func TestDeviceStart() *Device {
+	if Conf.TestDevicePort == 0 {
+		return nil
+	}
+
+	attrs := usbEmuPrinterAttrs()
+	attrs.Add(goipp.MakeAttribute("printer-dns-sd-name",
+		goipp.TagName, goipp.String(TestDeviceName)))
+
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Info: UsbDeviceInfo{
+			Manufacturer: "ipp-usb",
+			ProductName:  "Test Device",
+			SerialNumber: "TEST0001",
+		},
+		Handler: &UsbEmuPrinter{
+			PrinterAttrs: attrs,
+			EsclCaps:     UsbEmuEsclCaps,
+		},
+	})
+
+	desc := emu.Desc()
+	info, _ := emu.UsbDeviceInfo()
+
+	// Device normally keeps the previously allocated HTTP
+	// port, so just tell it which port to use
+	state := LoadDevState(info.Ident(), info.Comment())
+	if state.HTTPPort != Conf.TestDevicePort {
+		state.HTTPPort = Conf.TestDevicePort
+		state.Save()
+	}
+
+	dev, err := NewDeviceDev(desc, emu)
+	StatusSet(desc.UsbAddr, desc, dev, err)
+
+	if err != nil {
+		Log.Error('!', "Test device: %s", err)
+		return nil
+	}
+
+	Log.Info('+', "Test device: served at http://localhost:%d/",
+		dev.State.HTTPPort)
+
+	return dev
+}
@@ -0,0 +1,118 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for built-in test device
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestTestDevice tests printing and scanning via the built-in
+// test device
+func TestTestDevice(t *testing.T) {
+	testConf(t)
+
+	// Find a free port
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	Conf.DNSSdEnable = false
+	Conf.HTTPMinPort = 1024
+	Conf.HTTPMaxPort = 65535
+	Conf.TestDevicePort = port
+
+	dev := TestDeviceStart()
+	if dev == nil {
+		t.Fatalf("TestDeviceStart failed")
+	}
+
+	defer func() {
+		dev.Close()
+		StatusDel(dev.UsbAddr)
+	}()
+
+	if dev.State.HTTPPort != port {
+		t.Errorf("served at port %d, expected %d", dev.State.HTTPPort, port)
+	}
+
+	base := fmt.Sprintf("http://localhost:%d", dev.State.HTTPPort)
+
+	// Print
+	msg := goipp.NewRequest(goipp.DefaultVersion, goipp.OpPrintJob, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	data, _ := msg.EncodeBytes()
+	data = append(data, UsbEmuScanPDF...)
+
+	resp, err := http.Post(base+"/ipp/print", goipp.ContentType,
+		bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Print-Job: %s", err)
+	}
+
+	data, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	err = msg.DecodeBytes(data)
+	if err != nil {
+		t.Fatalf("Print-Job: %s", err)
+	}
+
+	if msg.Code != goipp.Code(goipp.StatusOk) {
+		t.Errorf("Print-Job: %s", goipp.Status(msg.Code))
+	}
+
+	// Scan
+	resp, err = http.Post(base+"/eSCL/ScanJobs", "text/xml",
+		strings.NewReader("<scan:ScanSettings/>"))
+	if err != nil {
+		t.Fatalf("ScanJobs: %s", err)
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || location == "" {
+		t.Fatalf("ScanJobs: %s, Location: %q", resp.Status, location)
+	}
+
+	resp, err = http.Get(base + location + "/NextDocument")
+	if err != nil {
+		t.Fatalf("NextDocument: %s", err)
+	}
+
+	_, err = jpeg.Decode(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("NextDocument: %s", err)
+	}
+
+	resp, err = http.Get(base + location + "/NextDocument")
+	if err != nil {
+		t.Fatalf("NextDocument: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("NextDocument after last page: %s", resp.Status)
+	}
+}
@@ -0,0 +1,164 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * TLS certificates for HTTPS listeners
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLSConfig returns tls.Config for the HTTPS listener of the device,
+// identified by ident. name is used as certificate's Common Name.
+//
+// If https-cert and https-key are configured, they are used for all
+// devices. Otherwise, the per-device self-signed certificate is used.
+// It is generated on the first use and saved into the PathCertDir,
+// so clients, that remember certificates, see the same certificate
+// next time. Saved certificate is regenerated, if it expires soon
+// or doesn't match the device name or hostname anymore
+func TLSConfig(ident, name string) (*tls.Config, error) {
+	certFile, keyFile := Conf.HTTPSCert, Conf.HTTPSKey
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	certFile = filepath.Join(PathCertDir, ident+".crt")
+	keyFile = filepath.Join(PathCertDir, ident+".key")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil && tlsCertStale(cert, name, time.Now()) {
+		err = errors.New("stale certificate")
+	}
+
+	if err != nil {
+		err = tlsGenerateCert(certFile, keyFile, name)
+		if err == nil {
+			cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// tlsCertStale tells if the self-signed certificate needs to be
+// regenerated: it expires soon, or device name or hostname has been
+// changed since certificate was generated
+func tlsCertStale(cert tls.Certificate, name string, now time.Time) bool {
+	x509cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+
+	if now.Add(HTTPSCertRenewTime).After(x509cert.NotAfter) {
+		return true
+	}
+
+	if x509cert.Subject.CommonName != name {
+		return true
+	}
+
+	present := make(map[string]bool)
+	for _, dnsname := range x509cert.DNSNames {
+		present[strings.ToLower(dnsname)] = true
+	}
+
+	for _, dnsname := range tlsCertDNSNames() {
+		if !present[strings.ToLower(dnsname)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tlsCertDNSNames returns DNS names of the self-signed certificate
+func tlsCertDNSNames() []string {
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		names = append(names, host, host+".local")
+	}
+
+	return names
+}
+
+// tlsGenerateCert generates self-signed certificate and its
+// private key and saves them into certFile and keyFile
+func tlsGenerateCert(certFile, keyFile, name string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{"ipp-usb"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(HTTPSCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              tlsCertDNSNames(),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	MakeDirectory(PathCertDir)
+
+	err = ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		0600)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0644)
+}
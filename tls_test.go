@@ -0,0 +1,84 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for TLS certificates
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTLSConfig tests generation and persistence of self-signed
+// certificates
+func TestTLSConfig(t *testing.T) {
+	testConf(t)
+
+	conf1, err := TLSConfig("test", "Test Printer")
+	if err != nil {
+		t.Fatalf("TLSConfig: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(conf1.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+
+	if cert.Subject.CommonName != "Test Printer" {
+		t.Errorf("CN: %q", cert.Subject.CommonName)
+	}
+
+	if err = cert.VerifyHostname("localhost"); err != nil {
+		t.Errorf("VerifyHostname: %s", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(PathCertDir, "test.key"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode: %o", fi.Mode().Perm())
+	}
+
+	// The second call must reuse the saved certificate
+	conf2, err := TLSConfig("test", "Test Printer")
+	if err != nil {
+		t.Fatalf("TLSConfig: %s", err)
+	}
+
+	if !bytes.Equal(conf1.Certificates[0].Certificate[0],
+		conf2.Certificates[0].Certificate[0]) {
+		t.Errorf("certificate regenerated")
+	}
+
+	// Certificate is regenerated, if device name changes
+	conf3, err := TLSConfig("test", "Renamed Printer")
+	if err != nil {
+		t.Fatalf("TLSConfig: %s", err)
+	}
+
+	if bytes.Equal(conf1.Certificates[0].Certificate[0],
+		conf3.Certificates[0].Certificate[0]) {
+		t.Errorf("certificate not regenerated after rename")
+	}
+
+	// Certificate is stale, when it expires soon
+	cert3 := conf3.Certificates[0]
+	now := time.Now()
+	if tlsCertStale(cert3, "Renamed Printer", now) {
+		t.Errorf("fresh certificate considered stale")
+	}
+
+	if !tlsCertStale(cert3, "Renamed Printer", now.Add(HTTPSCertLifetime)) {
+		t.Errorf("expiring certificate not considered stale")
+	}
+}
@@ -0,0 +1,429 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB traffic capture
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// USB capture file is the line-oriented text file. Lines
+// starting with '#' are comments. The header describes the
+// device:
+//
+//	ipp-usb-capture 1
+//	device 04f9:2b2b
+//	release 1.00
+//	manufacturer "Brother"
+//	product "MFC-L2750DW series"
+//	serial "E12345678"
+//	caps 7
+//	port 2
+//	interfaces 3
+//
+// Then bulk transfers follow, one per line:
+//
+//	0.001234 0 > 504f5354202f6970...
+//	0.004567 0 < 485454502f312e31...
+//	0.300000 1 ! context deadline exceeded
+//
+// Fields are: time since capture start in seconds, interface number,
+// direction ('>' for host to device, '<' for device to host, '!' for
+// failed receive) and transfer data in hex ('-' for the zero-length
+// packet) or error text.
+const usbCaptureMagic = "ipp-usb-capture 1"
+
+// UsbCaptureEvent represents a single captured bulk transfer
+type UsbCaptureEvent struct {
+	Time  time.Duration // Time since capture start
+	IfNum int           // Interface number
+	Dir   byte          // '>' (send), '<' (recv) or '!' (recv error)
+	Data  []byte        // Transferred data
+	Err   string        // Error text, for '!'
+}
+
+// UsbCapture represents a loaded USB capture
+type UsbCapture struct {
+	Info       UsbDeviceInfo     // Device information
+	Interfaces int               // Count of IPP-over-USB interfaces
+	Events     []UsbCaptureEvent // Captured transfers
+}
+
+// UsbCaptureLoad loads USB capture from file
+func UsbCaptureLoad(path string) (*UsbCapture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	capture, err := usbCaptureRead(file)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+	}
+
+	return capture, err
+}
+
+// usbCaptureRead reads USB capture from io.Reader
+func usbCaptureRead(in io.Reader) (*UsbCapture, error) {
+	capture := &UsbCapture{}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 64*1024*1024)
+	lineno := 0
+	magic := false
+
+	var err error
+	for err == nil && scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || line[0] == '#':
+			continue
+
+		case !magic:
+			if line != usbCaptureMagic {
+				err = errors.New("not an USB capture file")
+			}
+			magic = true
+
+		case line[0] >= '0' && line[0] <= '9':
+			var evnt UsbCaptureEvent
+			evnt, err = usbCaptureParseEvent(line)
+			if err == nil {
+				capture.Events = append(capture.Events, evnt)
+			}
+
+		default:
+			err = usbCaptureParseHeader(capture, line)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("line %d: %s", lineno, err)
+		}
+	}
+
+	if err == nil {
+		err = scanner.Err()
+	}
+
+	if err == nil && !magic {
+		err = errors.New("empty file")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if capture.Interfaces == 0 {
+		capture.Interfaces = 1
+	}
+
+	return capture, nil
+}
+
+// usbCaptureParseHeader parses header line
+func usbCaptureParseHeader(capture *UsbCapture, line string) error {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid line: %q", line)
+	}
+
+	key, val := fields[0], strings.TrimSpace(fields[1])
+	info := &capture.Info
+
+	var err error
+	var n uint64
+
+	switch key {
+	case "device":
+		_, err = fmt.Sscanf(val, "%4x:%4x", &info.Vendor, &info.Product)
+	case "release":
+		var ok bool
+		if info.Release, ok = ParseUsbRelease(val); !ok {
+			err = errors.New("invalid release")
+		}
+	case "manufacturer":
+		info.Manufacturer, err = strconv.Unquote(val)
+	case "product":
+		info.ProductName, err = strconv.Unquote(val)
+	case "serial":
+		info.SerialNumber, err = strconv.Unquote(val)
+	case "caps":
+		n, err = strconv.ParseUint(val, 10, 16)
+		info.BasicCaps = UsbIppBasicCaps(n)
+	case "port":
+		n, err = strconv.ParseUint(val, 10, 8)
+		info.PortNum = int(n)
+	case "interfaces":
+		n, err = strconv.ParseUint(val, 10, 8)
+		capture.Interfaces = int(n)
+	default:
+		// Ignore unknown keys, for future extensions
+	}
+
+	if err != nil {
+		err = fmt.Errorf("%s: invalid value %q", key, val)
+	}
+
+	return err
+}
+
+// usbCaptureParseEvent parses event line
+func usbCaptureParseEvent(line string) (UsbCaptureEvent, error) {
+	var evnt UsbCaptureEvent
+
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 || len(fields[2]) != 1 {
+		return evnt, fmt.Errorf("invalid line: %q", line)
+	}
+
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || secs < 0 {
+		return evnt, fmt.Errorf("invalid time: %q", fields[0])
+	}
+
+	evnt.Time = time.Duration(secs * float64(time.Second))
+
+	evnt.IfNum, err = strconv.Atoi(fields[1])
+	if err != nil || evnt.IfNum < 0 {
+		return evnt, fmt.Errorf("invalid interface: %q", fields[1])
+	}
+
+	evnt.Dir = fields[2][0]
+	switch evnt.Dir {
+	case '>', '<':
+		if fields[3] != "-" {
+			evnt.Data, err = hex.DecodeString(fields[3])
+			if err != nil {
+				return evnt, fmt.Errorf("invalid data: %s", err)
+			}
+		}
+
+	case '!':
+		evnt.Err = fields[3]
+
+	default:
+		return evnt, fmt.Errorf("invalid direction: %q", fields[2])
+	}
+
+	return evnt, nil
+}
+
+// usbCaptureWriter writes USB capture file
+type usbCaptureWriter struct {
+	lock  sync.Mutex    // Access lock
+	file  *os.File      // Output file
+	out   *bufio.Writer // Buffered output
+	start time.Time     // Capture start time
+}
+
+// newUsbCaptureWriter creates a new capture file and writes its header
+func newUsbCaptureWriter(path string, info UsbDeviceInfo,
+	interfaces int) (*usbCaptureWriter, error) {
+
+	MakeParentDirectory(path)
+	file, err := os.OpenFile(path,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &usbCaptureWriter{
+		file:  file,
+		out:   bufio.NewWriter(file),
+		start: time.Now(),
+	}
+
+	fmt.Fprintf(w.out, "%s\n", usbCaptureMagic)
+	fmt.Fprintf(w.out, "# Started: %s\n",
+		w.start.Format("2006-01-02 15:04:05 -0700"))
+	fmt.Fprintf(w.out, "device %4.4x:%4.4x\n", info.Vendor, info.Product)
+	fmt.Fprintf(w.out, "release %s\n", UsbReleaseString(info.Release))
+	fmt.Fprintf(w.out, "manufacturer %q\n", info.Manufacturer)
+	fmt.Fprintf(w.out, "product %q\n", info.ProductName)
+	fmt.Fprintf(w.out, "serial %q\n", info.SerialNumber)
+	fmt.Fprintf(w.out, "caps %d\n", int(info.BasicCaps))
+	fmt.Fprintf(w.out, "port %d\n", info.PortNum)
+	fmt.Fprintf(w.out, "interfaces %d\n", interfaces)
+	w.out.Flush()
+
+	return w, nil
+}
+
+// write writes an event. Events are flushed immediately, so
+// capture remains usable, if program crashes or hangs
+func (w *usbCaptureWriter) write(ifnum int, dir byte, data []byte,
+	err error) {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return
+	}
+
+	t := time.Since(w.start).Seconds()
+
+	switch {
+	case err != nil && len(data) == 0 && dir == '<':
+		fmt.Fprintf(w.out, "%.6f %d ! %s\n", t, ifnum,
+			strings.Replace(err.Error(), "\n", " ", -1))
+	case len(data) == 0:
+		fmt.Fprintf(w.out, "%.6f %d %c -\n", t, ifnum, dir)
+	default:
+		fmt.Fprintf(w.out, "%.6f %d %c %x\n", t, ifnum, dir, data)
+	}
+
+	w.out.Flush()
+}
+
+// close closes the capture file
+func (w *usbCaptureWriter) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file != nil {
+		w.out.Flush()
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// UsbCapturePath returns path to the capture file for the device
+func UsbCapturePath(info UsbDeviceInfo) string {
+	return filepath.Join(PathLogDir, info.Ident()+".usbcap")
+}
+
+// usbRecorder wraps UsbDevice and records all bulk transfers
+// into the capture file and/or the pcapng file
+type usbRecorder struct {
+	UsbDevice                   // Underlying device
+	capture   *usbCaptureWriter // Capture writer, nil if disabled
+	pcapng    *usbPcapngWriter  // Pcapng writer, nil if disabled
+}
+
+// newUsbRecorder creates a new usbRecorder. Capture formats
+// are enabled by Conf.UsbCapture and Conf.UsbCapturePcapng
+func newUsbRecorder(dev UsbDevice, info UsbDeviceInfo,
+	interfaces int) (*usbRecorder, error) {
+
+	rec := &usbRecorder{UsbDevice: dev}
+
+	var err error
+	if Conf.UsbCapture {
+		rec.capture, err = newUsbCaptureWriter(UsbCapturePath(info),
+			info, interfaces)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if Conf.UsbCapturePcapng {
+		rec.pcapng, err = newUsbPcapngWriter(
+			UsbCapturePcapngPath(info))
+		if err != nil {
+			if rec.capture != nil {
+				rec.capture.close()
+			}
+			return nil, err
+		}
+	}
+
+	return rec, nil
+}
+
+// Close the device
+func (rec *usbRecorder) Close() {
+	rec.UsbDevice.Close()
+	if rec.capture != nil {
+		rec.capture.close()
+	}
+	if rec.pcapng != nil {
+		rec.pcapng.close()
+	}
+}
+
+// OpenUsbInterface opens an interface
+func (rec *usbRecorder) OpenUsbInterface(addr UsbIfAddr,
+	quirks *Quirks) (UsbInterfaceIO, error) {
+
+	iface, err := rec.UsbDevice.OpenUsbInterface(addr, quirks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &usbRecorderInterface{iface, rec.capture, rec.pcapng,
+		addr}, nil
+}
+
+// usbRecorderInterface wraps UsbInterfaceIO and records
+// all bulk transfers into the capture files
+type usbRecorderInterface struct {
+	UsbInterfaceIO                   // Underlying interface
+	capture        *usbCaptureWriter // Capture writer, may be nil
+	pcapng         *usbPcapngWriter  // Pcapng writer, may be nil
+	addr           UsbIfAddr         // Interface address
+}
+
+// Send data to interface
+func (rec *usbRecorderInterface) Send(ctx context.Context,
+	data []byte) (int, error) {
+
+	var urbid uint64
+	if rec.pcapng != nil {
+		urbid = rec.pcapng.submit(rec.addr, false, data)
+	}
+
+	n, err := rec.UsbInterfaceIO.Send(ctx, data)
+
+	if rec.capture != nil && (n > 0 || err == nil) {
+		rec.capture.write(rec.addr.Num, '>', data[:n], nil)
+	}
+
+	if rec.pcapng != nil {
+		rec.pcapng.done(urbid, rec.addr, false, data[:n], err)
+	}
+
+	return n, err
+}
+
+// Recv data from interface
+func (rec *usbRecorderInterface) Recv(ctx context.Context,
+	data []byte) (int, error) {
+
+	var urbid uint64
+	if rec.pcapng != nil {
+		urbid = rec.pcapng.submit(rec.addr, true, data)
+	}
+
+	n, err := rec.UsbInterfaceIO.Recv(ctx, data)
+
+	if rec.capture != nil {
+		rec.capture.write(rec.addr.Num, '<', data[:n], err)
+	}
+
+	if rec.pcapng != nil {
+		rec.pcapng.done(urbid, rec.addr, true, data[:n], err)
+	}
+
+	return n, err
+}
@@ -0,0 +1,251 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB capture and replay
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// usbCaptureTestServices probes IPP and eSCL services via transport
+// and returns TXT records of discovered services
+func usbCaptureTestServices(t *testing.T,
+	transport *UsbTransport) DNSSdServices {
+
+	info := transport.UsbDeviceInfo()
+	client := &http.Client{Transport: transport}
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	var services DNSSdServices
+	ippinfo, _, err := IppService(log, &services, 60000, info,
+		transport.Quirks(), client)
+	if err != nil {
+		t.Fatalf("IppService: %s", err)
+	}
+
+	_, err = EsclService(log, &services, 60000, info, ippinfo, client)
+	if err != nil {
+		t.Fatalf("EsclService: %s", err)
+	}
+
+	return services
+}
+
+// TestUsbCaptureReplay records session with emulated device and
+// then replays it
+func TestUsbCaptureReplay(t *testing.T) {
+	saveUsbCapture := Conf.UsbCapture
+	Conf.UsbCapture = true
+	defer func() { Conf.UsbCapture = saveUsbCapture }()
+
+	// Record
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: &UsbEmuPrinter{EsclCaps: UsbEmuEsclCaps},
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	recorded := usbCaptureTestServices(t, transport)
+	transport.Close(false)
+
+	capture, err := UsbCaptureLoad(UsbCapturePath(transport.UsbDeviceInfo()))
+	if err != nil {
+		t.Fatalf("UsbCaptureLoad: %s", err)
+	}
+
+	if capture.Info.SerialNumber != "EMU0001" || capture.Interfaces != 2 {
+		t.Fatalf("capture header mismatch: %+v", capture.Info)
+	}
+
+	// Replay
+	Conf.UsbCapture = false
+	replay := NewUsbReplay(capture)
+	transport, err = NewUsbTransportDev(replay.Desc(), replay)
+	if err != nil {
+		t.Fatalf("NewUsbTransportDev: %s", err)
+	}
+
+	replayed := usbCaptureTestServices(t, transport)
+	transport.Close(false)
+
+	if len(recorded) != len(replayed) {
+		t.Fatalf("services count mismatch: %d recorded, %d replayed",
+			len(recorded), len(replayed))
+	}
+
+	for i := range recorded {
+		r1, r2 := recorded[i].Txt, replayed[i].Txt
+		if len(r1) != len(r2) {
+			t.Fatalf("%s: TXT mismatch", recorded[i].Type)
+		}
+
+		for j := range r1 {
+			if r1[j] != r2[j] {
+				t.Errorf("%s: TXT mismatch: %v != %v",
+					recorded[i].Type, r1[j], r2[j])
+			}
+		}
+	}
+}
+
+// TestUsbCapturePcapng tests USB capture in the pcapng format
+func TestUsbCapturePcapng(t *testing.T) {
+	saveUsbCapturePcapng := Conf.UsbCapturePcapng
+	Conf.UsbCapturePcapng = true
+	defer func() { Conf.UsbCapturePcapng = saveUsbCapturePcapng }()
+
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: &UsbEmuPrinter{EsclCaps: UsbEmuEsclCaps},
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	usbCaptureTestServices(t, transport)
+	transport.Close(false)
+
+	data, err := ioutil.ReadFile(
+		UsbCapturePcapngPath(transport.UsbDeviceInfo()))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Walk through blocks
+	var types []uint32
+	var sent, rcvd []byte
+	submits, dones := 0, 0
+
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block")
+		}
+
+		btype := binary.LittleEndian.Uint32(data[0:])
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if length < 12 || length%4 != 0 || length > len(data) ||
+			binary.LittleEndian.Uint32(data[length-4:]) !=
+				uint32(length) {
+			t.Fatalf("invalid block length %d", length)
+		}
+
+		body := data[8 : length-4]
+		data = data[length:]
+
+		if len(types) < 2 {
+			types = append(types, btype)
+		}
+
+		if btype != pcapngBlockEPB {
+			continue
+		}
+
+		caplen := int(binary.LittleEndian.Uint32(body[12:]))
+		pkt := body[20 : 20+caplen]
+		hdr, payload := pkt[:pcapngUsbHdrLen], pkt[pcapngUsbHdrLen:]
+
+		if int(binary.LittleEndian.Uint32(hdr[36:])) != len(payload) {
+			t.Fatalf("usbmon header: data length mismatch")
+		}
+
+		switch hdr[8] {
+		case pcapngUsbEvntSubmit:
+			submits++
+			if hdr[10]&pcapngUsbDirIn == 0 {
+				sent = append(sent, payload...)
+			}
+		case pcapngUsbEvntDone:
+			dones++
+			if hdr[10]&pcapngUsbDirIn != 0 {
+				rcvd = append(rcvd, payload...)
+			}
+		}
+	}
+
+	if len(types) != 2 || types[0] != pcapngBlockSHB ||
+		types[1] != pcapngBlockIDB {
+		t.Errorf("invalid file header: %x", types)
+	}
+
+	if submits == 0 || submits != dones {
+		t.Errorf("%d submits, %d completions", submits, dones)
+	}
+
+	if !bytes.HasPrefix(sent, []byte("POST /ipp/print HTTP/1.1")) ||
+		!bytes.HasPrefix(rcvd, []byte("HTTP/1.1 200")) {
+		t.Errorf("unexpected payload:\n%.40q\n%.40q", sent, rcvd)
+	}
+}
+
+// TestUsbCaptureRead tests usbCaptureRead
+func TestUsbCaptureRead(t *testing.T) {
+	type testData struct {
+		in  string // Input text
+		err string // Expected error, "" if none
+	}
+
+	tests := []testData{
+		{
+			in: "ipp-usb-capture 1\n" +
+				"device 04f9:2b2b\n" +
+				"product \"MFC\"\n" +
+				"interfaces 2\n" +
+				"0.5 1 > 4745\n" +
+				"0.6 1 < -\n" +
+				"0.7 1 ! timeout\n",
+		},
+		{
+			in:  "",
+			err: "empty file",
+		},
+		{
+			in:  "hello\n",
+			err: "line 1: not an USB capture file",
+		},
+		{
+			in:  "ipp-usb-capture 1\nproduct MFC\n",
+			err: `line 2: product: invalid value "MFC"`,
+		},
+		{
+			in:  "ipp-usb-capture 1\n0.5 1 > xyz\n",
+			err: "line 2: invalid data",
+		},
+		{
+			in:  "ipp-usb-capture 1\n0.5 1 ? 00\n",
+			err: `line 2: invalid direction: "?"`,
+		},
+	}
+
+	for _, test := range tests {
+		capture, err := usbCaptureRead(strings.NewReader(test.in))
+		switch {
+		case err == nil && test.err != "":
+			t.Errorf("%q: expected error %q", test.in, test.err)
+		case err != nil && !strings.HasPrefix(err.Error(), test.err):
+			t.Errorf("%q: expected error %q, got %q",
+				test.in, test.err, err)
+		case err != nil && test.err == "":
+			t.Errorf("%q: unexpected error %q", test.in, err)
+		}
+
+		if err == nil && test.err == "" {
+			if len(capture.Events) != 3 ||
+				capture.Info.Vendor != 0x04f9 ||
+				capture.Info.ProductName != "MFC" ||
+				string(capture.Events[0].Data) != "GE" ||
+				capture.Events[2].Err != "timeout" {
+				t.Errorf("%q: decoded incorrectly: %+v",
+					test.in, capture)
+			}
+		}
+	}
+}
@@ -9,13 +9,39 @@
 package main
 
 import (
-	"crypto/sha1"
+	"context"
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 )
 
+// UsbHotplug specifies, how USB devices arrival and removal
+// are detected
+type UsbHotplug int
+
+// UsbHotplug constants
+const (
+	UsbHotplugAuto   UsbHotplug = iota // libusb hotplug, if supported, else poll
+	UsbHotplugLibusb                   // libusb hotplug callbacks
+	UsbHotplugPoll                     // Periodic rescan of devices
+)
+
+// String returns UsbHotplug name, as used in the configuration file
+func (hotplug UsbHotplug) String() string {
+	switch hotplug {
+	case UsbHotplugAuto:
+		return "auto"
+	case UsbHotplugLibusb:
+		return "libusb"
+	case UsbHotplugPoll:
+		return "poll"
+	}
+
+	return fmt.Sprintf("UsbHotplug(%d)", int(hotplug))
+}
+
 // UsbAddr represents an USB device address
 type UsbAddr struct {
 	Bus     int // The bus on which the device was detected
@@ -27,6 +53,193 @@ func (addr UsbAddr) String() string {
 	return fmt.Sprintf("Bus %.3d Device %.3d", addr.Bus, addr.Address)
 }
 
+// ParseUsbAddr parses USB device address. The following syntaxes
+// are accepted:
+//
+//	BUS:DEV              - i.e., "001:005" or "1:5"
+//	/dev/bus/usb/BUS/DEV - path to the device node, i.e.,
+//	                       "/dev/bus/usb/001/005"
+func ParseUsbAddr(s string) (UsbAddr, error) {
+	var addr UsbAddr
+	var bus, dev string
+
+	const devBusUsb = "/dev/bus/usb/"
+	if strings.HasPrefix(s, devBusUsb) {
+		parts := strings.Split(s[len(devBusUsb):], "/")
+		if len(parts) == 2 {
+			bus, dev = parts[0], parts[1]
+		}
+	} else if i := strings.IndexByte(s, ':'); i >= 0 {
+		bus, dev = s[:i], s[i+1:]
+	}
+
+	if n, err := strconv.ParseUint(bus, 10, 8); err == nil {
+		addr.Bus = int(n)
+	} else {
+		goto ERROR
+	}
+
+	if n, err := strconv.ParseUint(dev, 10, 8); err == nil {
+		addr.Address = int(n)
+	} else {
+		goto ERROR
+	}
+
+	if addr.Bus < 0 || addr.Bus > 255 || addr.Address < 1 || addr.Address > 127 {
+		goto ERROR
+	}
+
+	return addr, nil
+
+ERROR:
+	return UsbAddr{}, fmt.Errorf("%q: invalid USB device address", s)
+}
+
+// UsbDevMatch selects device by its VID:PID and, optionally,
+// serial number and physical USB path, regardless of its current
+// USB address
+type UsbDevMatch struct {
+	Vendor       uint16 // USB Vendor ID
+	Product      uint16 // USB Device ID
+	SerialNumber string // Serial number, "" matches any
+	Path         string // USB path (see UsbPortPath), "" matches any
+}
+
+// ParseUsbDevMatch parses UsbDevMatch. The syntax is:
+//
+//	VID:PID[/SERIAL][@PATH] - i.e., "04f9:2d48" or "04f9:2d48/E74512K5N"
+//	@PATH                   - any device at the path, i.e., "@1-1.4.2"
+//
+// VID and PID are 4-digit hexadecimal numbers, so it cannot be
+// confused with the BUS:DEV address syntax
+func ParseUsbDevMatch(s string) (UsbDevMatch, error) {
+	var match UsbDevMatch
+	var vid, pid uint64
+	var err error
+
+	ids := s
+	if i := strings.IndexByte(ids, '@'); i >= 0 {
+		ids, match.Path = ids[:i], ids[i+1:]
+		if !usbPortPathValid(match.Path) {
+			goto ERROR
+		}
+
+		if ids == "" {
+			return match, nil
+		}
+	}
+
+	if i := strings.IndexByte(ids, '/'); i >= 0 {
+		ids, match.SerialNumber = ids[:i], ids[i+1:]
+		if match.SerialNumber == "" {
+			goto ERROR
+		}
+	}
+
+	if len(ids) != 9 || ids[4] != ':' {
+		goto ERROR
+	}
+
+	vid, err = strconv.ParseUint(ids[:4], 16, 16)
+	if err != nil {
+		goto ERROR
+	}
+
+	pid, err = strconv.ParseUint(ids[5:], 16, 16)
+	if err != nil {
+		goto ERROR
+	}
+
+	match.Vendor = uint16(vid)
+	match.Product = uint16(pid)
+
+	return match, nil
+
+ERROR:
+	return UsbDevMatch{}, fmt.Errorf("%q: invalid VID:PID[/serial][@path]", s)
+}
+
+// String returns a human-readable representation of UsbDevMatch
+func (match UsbDevMatch) String() string {
+	s := ""
+	if !match.anyID() {
+		s = fmt.Sprintf("%4.4x:%4.4x", match.Vendor, match.Product)
+	}
+	if match.SerialNumber != "" {
+		s += "/" + match.SerialNumber
+	}
+	if match.Path != "" {
+		s += "@" + match.Path
+	}
+	return s
+}
+
+// Match reports whether device matches the UsbDevMatch. The
+// getinfo callback is called to obtain the device serial number,
+// only if VID:PID and path matches and serial number is required
+func (match UsbDevMatch) Match(desc UsbDeviceDesc,
+	getinfo func() (UsbDeviceInfo, error)) bool {
+
+	if !match.anyID() &&
+		(desc.Vendor != match.Vendor || desc.Product != match.Product) {
+		return false
+	}
+
+	if match.Path != "" && desc.Path != match.Path {
+		return false
+	}
+
+	if match.SerialNumber == "" {
+		return true
+	}
+
+	info, err := getinfo()
+	return err == nil && info.SerialNumber == match.SerialNumber
+}
+
+// anyID tells if UsbDevMatch matches any VID:PID (@PATH syntax)
+func (match UsbDevMatch) anyID() bool {
+	return match.Vendor == 0 && match.Product == 0 && match.Path != ""
+}
+
+// UsbPortPath formats physical USB path of the device, in the
+// same form as Linux uses in sysfs: the bus number, followed by
+// the chain of hub port numbers, i.e., "1-1.4.2". Unlike USB
+// address, the path persists across re-plugging, as long as
+// device remains connected to the same port.
+//
+// It returns "", if ports list is empty.
+func UsbPortPath(bus int, ports []int) string {
+	if len(ports) == 0 {
+		return ""
+	}
+
+	s := make([]string, len(ports))
+	for i, port := range ports {
+		s[i] = strconv.Itoa(port)
+	}
+
+	return strconv.Itoa(bus) + "-" + strings.Join(s, ".")
+}
+
+// usbPortPathValid tells if string is syntactically valid
+// USB path, as returned by UsbPortPath
+func usbPortPathValid(path string) bool {
+	i := strings.IndexByte(path, '-')
+	if i < 0 {
+		return false
+	}
+
+	for _, n := range append([]string{path[:i]},
+		strings.Split(path[i+1:], ".")...) {
+		if _, err := strconv.ParseUint(n, 10, 8); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Less returns true, if addr is "less" that addr2, for sorting
 func (addr UsbAddr) Less(addr2 UsbAddr) bool {
 	return addr.Bus < addr2.Bus ||
@@ -133,14 +346,128 @@ func (list *UsbIfAddrList) Add(addr UsbIfAddr) {
 	*list = append(*list, addr)
 }
 
+// Interfaces returns count of distinct interfaces in the list.
+// List may contain several alternate settings of the same interface
+func (list UsbIfAddrList) Interfaces() int {
+	seen := make(map[int]struct{})
+	for _, addr := range list {
+		seen[addr.Num] = struct{}{}
+	}
+	return len(seen)
+}
+
+// SelectAlt returns the list with the single alternate setting
+// per interface, preserving order of interfaces. If interface has
+// the alternate setting alt, it is used, otherwise the first one,
+// found in the list. alt of -1 means "first one found"
+func (list UsbIfAddrList) SelectAlt(alt int) UsbIfAddrList {
+	selected := UsbIfAddrList{}
+	index := make(map[int]int)
+
+	for _, addr := range list {
+		i, found := index[addr.Num]
+		switch {
+		case !found:
+			index[addr.Num] = len(selected)
+			selected.Add(addr)
+		case addr.Alt == alt:
+			selected[i] = addr
+		}
+	}
+
+	return selected
+}
+
 // UsbDeviceDesc represents an IPP-over-USB device descriptor
 type UsbDeviceDesc struct {
-	UsbAddr               // Device address
-	Vendor  uint16        // USB Vendor ID
-	Product uint16        // USB Device ID
-	Config  int           // IPP-over-USB configuration
-	IfAddrs UsbIfAddrList // IPP-over-USB interfaces
-	IfDescs []UsbIfDesc   // Descriptors of all interfaces
+	UsbAddr                          // Device address
+	Vendor     uint16                // USB Vendor ID
+	Product    uint16                // USB Device ID
+	Release    uint16                // USB Device release (bcdDevice)
+	Config     int                   // IPP-over-USB configuration
+	IfAddrs    UsbIfAddrList         // IPP-over-USB interfaces
+	ConfigsAll map[int]UsbIfAddrList // IPP-over-USB interfaces, by config
+	IfDescs    []UsbIfDesc           // Descriptors of all interfaces
+	Path       string                // USB path (see UsbPortPath), "" if unknown
+}
+
+// SelectConfig selects configuration, that will be used to access
+// the device, and sets desc.Config and desc.IfAddrs accordingly.
+//
+// If config is 0, the configuration with the most IPP-over-USB
+// interfaces is selected. If several configurations have the same
+// count of interfaces, the lowest configuration value wins.
+//
+// It returns false, if requested configuration has no IPP-over-USB
+// interfaces. At this case, desc remains unchanged
+func (desc *UsbDeviceDesc) SelectConfig(config int) bool {
+	if config == 0 {
+		best := 0
+		for cfg, addrs := range desc.ConfigsAll {
+			n := addrs.Interfaces()
+			switch {
+			case n == 0:
+			case config == 0 || n > best || (n == best && cfg < config):
+				config, best = cfg, n
+			}
+		}
+	}
+
+	addrs := desc.ConfigsAll[config]
+	if len(addrs) == 0 {
+		return false
+	}
+
+	desc.Config = config
+	desc.IfAddrs = addrs
+
+	return true
+}
+
+// OrderIfAddrs returns desc.IfAddrs, ordered by preference. Preferred
+// interfaces are opened first, and if count of interfaces is limited,
+// the less preferred are not used.
+//
+// By default, interfaces, dedicated to IPP-over-USB, are preferred
+// over interfaces, that have also the legacy printer (7/1/1, 7/1/2)
+// alternate settings, so the legacy printing (usblp) remains available
+// as long as possible. Interfaces, explicitly listed in the order,
+// go first, in the specified order. Otherwise, descriptor order is
+// preserved.
+func (desc UsbDeviceDesc) OrderIfAddrs(order QuirkIfOrder) UsbIfAddrList {
+	list := append(UsbIfAddrList(nil), desc.IfAddrs...)
+	if order.Descriptor {
+		return list
+	}
+
+	// Find interfaces, shared with the legacy printer protocols
+	shared := make(map[int]bool)
+	for _, ifdesc := range desc.IfDescs {
+		if ifdesc.Config == desc.Config && ifdesc.Class == 7 &&
+			ifdesc.SubClass == 1 && !ifdesc.IsIppOverUsb() {
+			shared[ifdesc.IfNum] = true
+		}
+	}
+
+	rank := func(num int) int {
+		for i, n := range order.Nums {
+			if n == num {
+				return i
+			}
+		}
+
+		if shared[num] {
+			return len(order.Nums) + 1
+		}
+
+		return len(order.Nums)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return rank(list[i].Num) < rank(list[j].Num)
+	})
+
+	return list
 }
 
 // GetUsbDeviceInfo obtains UsbDeviceInfo by UsbDeviceDesc
@@ -154,6 +481,51 @@ func (desc UsbDeviceDesc) GetUsbDeviceInfo() (UsbDeviceInfo, error) {
 	return UsbDeviceInfo{}, err
 }
 
+// UsbDevice represents an opened IPP-over-USB device, as seen by
+// the UsbTransport
+//
+// It is implemented by *UsbDevHandle for real devices and by the
+// *UsbEmulator for emulated ones
+type UsbDevice interface {
+	// Configure sets device configuration, required to
+	// access IPP-over-USB interfaces
+	Configure(desc UsbDeviceDesc, quirks *Quirks) error
+
+	// Close the device
+	Close()
+
+	// Reset performs the device hard reset
+	Reset()
+
+	// UsbDeviceInfo obtains device information
+	UsbDeviceInfo() (UsbDeviceInfo, error)
+
+	// OpenUsbInterface opens an interface
+	OpenUsbInterface(addr UsbIfAddr, quirks *Quirks) (UsbInterfaceIO, error)
+}
+
+// UsbInterfaceIO represents an opened IPP-over-USB interface
+//
+// It is implemented by *UsbInterface for real devices and
+// by emulated interfaces of the *UsbEmulator
+type UsbInterfaceIO interface {
+	// Close the interface
+	Close()
+
+	// SoftReset performs interface soft reset
+	SoftReset() error
+
+	// Send data to interface
+	Send(ctx context.Context, data []byte) (int, error)
+
+	// Recv data from interface
+	Recv(ctx context.Context, data []byte) (int, error)
+
+	// ClearHalt clears "halted" condition of either input
+	// or output endpoint
+	ClearHalt(in bool) error
+}
+
 // UsbIfDesc represents an USB interface descriptor
 type UsbIfDesc struct {
 	Vendor   uint16 // USB Vendor ID
@@ -193,11 +565,60 @@ type UsbDeviceInfo struct {
 	// Fields, directly decoded from USB
 	Vendor       uint16          // Vendor ID
 	Product      uint16          // Device ID
+	Release      uint16          // Device release number (bcdDevice)
 	SerialNumber string          // Device serial number
 	Manufacturer string          // Manufacturer name
 	ProductName  string          // Product name
 	PortNum      int             // USB port number
 	BasicCaps    UsbIppBasicCaps // Device basic capabilities
+	Speed        UsbSpeed        // Connection speed
+
+	// Physical USB port path (see UsbPortPath), "" if unknown.
+	// Used to identify devices without serial number
+	PortPath string
+
+	// Duplicate is true, if another device with the same Ident
+	// is already served. PortPath is added to Ident, so these
+	// devices can be told apart
+	Duplicate bool
+}
+
+// UsbSpeed represents the USB connection speed
+type UsbSpeed int
+
+// UsbSpeed constants
+const (
+	UsbSpeedUnknown   UsbSpeed = iota // Speed is not known
+	UsbSpeedLow                       // USB 1.x Low Speed, 1.5 Mbit/s
+	UsbSpeedFull                      // USB 1.x Full Speed, 12 Mbit/s
+	UsbSpeedHigh                      // USB 2.0 High Speed, 480 Mbit/s
+	UsbSpeedSuper                     // USB 3.x SuperSpeed, 5 Gbit/s
+	UsbSpeedSuperPlus                 // USB 3.x SuperSpeed+, 10 Gbit/s
+)
+
+// String returns a human-readable representation of UsbSpeed
+func (speed UsbSpeed) String() string {
+	switch speed {
+	case UsbSpeedUnknown:
+		return "unknown"
+	case UsbSpeedLow:
+		return "low (1.5 Mbit/s)"
+	case UsbSpeedFull:
+		return "full (12 Mbit/s)"
+	case UsbSpeedHigh:
+		return "high (480 Mbit/s)"
+	case UsbSpeedSuper:
+		return "super (5 Gbit/s)"
+	case UsbSpeedSuperPlus:
+		return "super+ (10 Gbit/s)"
+	}
+
+	return fmt.Sprintf("UsbSpeed(%d)", int(speed))
+}
+
+// IsSuper tells if speed is SuperSpeed or faster
+func (speed UsbSpeed) IsSuper() bool {
+	return speed >= UsbSpeedSuper
 }
 
 // UsbIppBasicCaps represents device basic capabilities bits,
@@ -236,6 +657,20 @@ func (caps UsbIppBasicCaps) String() string {
 	return strings.Join(s, ",")
 }
 
+// UsbIppBasicCapsDecode decodes basic capabilities from the raw
+// class-specific Device Info Descriptor, as returned by device.
+//
+// USB descriptors are little-endian regardless of the host byte
+// order, so bytes are assembled explicitly here. It returns 0, if
+// descriptor is too short to contain capabilities
+func UsbIppBasicCapsDecode(desc []byte) UsbIppBasicCaps {
+	if len(desc) < 10 {
+		return 0
+	}
+
+	return UsbIppBasicCaps(uint16(desc[6]) | uint16(desc[7])<<8)
+}
+
 // CheckMissed return a error, if UsbDeviceInfo misses some
 // essential parameters.
 //
@@ -275,6 +710,11 @@ func (info UsbDeviceInfo) MakeAndModel() string {
 
 // Ident returns device identification string, suitable as
 // persistent state identifier
+//
+// Devices without serial number are identified by the physical
+// USB port path, so they remain stable across reboots, as long
+// as device is plugged into the same port. The same applies to
+// duplicates of already served devices (see Duplicate)
 func (info UsbDeviceInfo) Ident() string {
 	id := fmt.Sprintf("%4.4x-%4.4x", info.Vendor, info.Product)
 
@@ -282,11 +722,22 @@ func (info UsbDeviceInfo) Ident() string {
 		id += "-" + info.SerialNumber
 	}
 
+	if info.PortPath != "" &&
+		(info.SerialNumber == "" || info.Duplicate) {
+		id += "-port-" + info.PortPath
+	}
+
 	if model := info.MakeAndModel(); model != "" {
 		id += "-" + model
 	}
 
-	id = strings.Map(func(c rune) rune {
+	return identSanitize(id)
+}
+
+// identSanitize replaces characters, not suitable for
+// persistent state identifier, with '-'
+func identSanitize(id string) string {
+	return strings.Map(func(c rune) rune {
 		switch {
 		case '0' <= c && c <= '9':
 		case 'a' <= c && c <= 'z':
@@ -297,38 +748,27 @@ func (info UsbDeviceInfo) Ident() string {
 		}
 		return c
 	}, id)
-	return id
 }
 
 // UUID generates device UUID in a case it is not available
 // from IPP or eSCL
 func (info UsbDeviceInfo) UUID() string {
-	hash := sha1.New()
-
 	// Arbitrary namespace UUID
 	const namespace = "fe678de6-f422-467e-9f83-2354e26c3b41"
 
-	hash.Write([]byte(namespace))
-	hash.Write([]byte(info.Ident()))
-	uuid := hash.Sum(nil)
-
-	// UUID.Version = 5: Name-based with SHA1; see RFC4122, 4.1.3.
-	uuid[6] &= 0x0f
-	uuid[6] |= 0x5f
-
-	// UUID.Variant = 0b10: see RFC4122, 4.1.1.
-	uuid[8] &= 0x3F
-	uuid[8] |= 0x80
-
-	return fmt.Sprintf(
-		"%.2x%.2x%.2x%.2x-%.2x%.2x-%.2x%.2x-%.2x%.2x-%.2x%.2x%.2x%.2x%.2x%.2x",
-		uuid[0], uuid[1], uuid[2], uuid[3],
-		uuid[4], uuid[5], uuid[6], uuid[7],
-		uuid[8], uuid[9], uuid[10], uuid[11],
-		uuid[12], uuid[13], uuid[14], uuid[15])
+	return UUIDFromName(namespace, info.Ident())
 }
 
 // Comment returns a short comment, describing a device
 func (info UsbDeviceInfo) Comment() string {
+	if info.SerialNumber == "" && info.PortPath != "" {
+		return info.MakeAndModel() + " port=" + info.PortPath
+	}
+
+	if info.Duplicate && info.PortPath != "" {
+		return info.MakeAndModel() + " serial=" + info.SerialNumber +
+			" port=" + info.PortPath
+	}
+
 	return info.MakeAndModel() + " serial=" + info.SerialNumber
 }
@@ -9,6 +9,9 @@
 package main
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -107,3 +110,314 @@ func TestUsbAddrListDiff(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// Test ParseUsbAddr
+func TestParseUsbAddr(t *testing.T) {
+	type testData struct {
+		in   string
+		addr UsbAddr
+		ok   bool
+	}
+
+	tests := []testData{
+		{"001:005", UsbAddr{1, 5}, true},
+		{"2:17", UsbAddr{2, 17}, true},
+		{"/dev/bus/usb/003/012", UsbAddr{3, 12}, true},
+		{"/dev/bus/usb/003", UsbAddr{}, false},
+		{"/dev/bus/usb/003/012/1", UsbAddr{}, false},
+		{"1:0", UsbAddr{}, false},
+		{"1:x", UsbAddr{}, false},
+		{"1:5x", UsbAddr{}, false},
+		{"1", UsbAddr{}, false},
+		{"", UsbAddr{}, false},
+	}
+
+	for _, test := range tests {
+		addr, err := ParseUsbAddr(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error status: %v", test.in, err)
+		} else if addr != test.addr {
+			t.Errorf("%q: expected %s, got %s", test.in, test.addr, addr)
+		}
+	}
+}
+
+// Test ParseUsbDevMatch and UsbDevMatch.Match
+func TestUsbDevMatch(t *testing.T) {
+	type testData struct {
+		in    string
+		match UsbDevMatch
+		ok    bool
+	}
+
+	tests := []testData{
+		{"04f9:2d48", UsbDevMatch{0x04f9, 0x2d48, "", ""}, true},
+		{"04F9:2D48/E74512K5N", UsbDevMatch{0x04f9, 0x2d48, "E74512K5N", ""}, true},
+		{"04f9:2d48@1-1.4.2", UsbDevMatch{0x04f9, 0x2d48, "", "1-1.4.2"}, true},
+		{"04f9:2d48/E74512K5N@1-2", UsbDevMatch{0x04f9, 0x2d48, "E74512K5N", "1-2"}, true},
+		{"@3-1", UsbDevMatch{0, 0, "", "3-1"}, true},
+		{"04f9:2d48/", UsbDevMatch{}, false},
+		{"04f9:2d48@", UsbDevMatch{}, false},
+		{"@1", UsbDevMatch{}, false},
+		{"@1-1..2", UsbDevMatch{}, false},
+		{"@1-1.256", UsbDevMatch{}, false},
+		{"001:005", UsbDevMatch{}, false},
+		{"4f9:2d48", UsbDevMatch{}, false},
+		{"04f9-2d48", UsbDevMatch{}, false},
+		{"04f9:2dxx", UsbDevMatch{}, false},
+		{"", UsbDevMatch{}, false},
+	}
+
+	for _, test := range tests {
+		match, err := ParseUsbDevMatch(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error status: %v", test.in, err)
+		} else if match != test.match {
+			t.Errorf("%q: expected %s, got %s", test.in, test.match, match)
+		}
+	}
+
+	desc := UsbDeviceDesc{Vendor: 0x04f9, Product: 0x2d48, Path: "1-1.4.2"}
+	getinfo := func() (UsbDeviceInfo, error) {
+		return UsbDeviceInfo{SerialNumber: "E74512K5N"}, nil
+	}
+
+	matches := []struct {
+		match UsbDevMatch
+		ok    bool
+	}{
+		{UsbDevMatch{0x04f9, 0x2d48, "", ""}, true},
+		{UsbDevMatch{0x04f9, 0x2d48, "E74512K5N", ""}, true},
+		{UsbDevMatch{0x04f9, 0x2d48, "XXX", ""}, false},
+		{UsbDevMatch{0x04f9, 0x0001, "", ""}, false},
+		{UsbDevMatch{0x04f9, 0x2d48, "", "1-1.4.2"}, true},
+		{UsbDevMatch{0x04f9, 0x2d48, "", "1-1.4"}, false},
+		{UsbDevMatch{0, 0, "", "1-1.4.2"}, true},
+		{UsbDevMatch{0, 0, "", "2-1"}, false},
+	}
+
+	for _, test := range matches {
+		if ok := test.match.Match(desc, getinfo); ok != test.ok {
+			t.Errorf("%s: Match: expected %v, got %v",
+				test.match, test.ok, ok)
+		}
+	}
+}
+
+// TestUsbPortPath tests UsbPortPath
+func TestUsbPortPath(t *testing.T) {
+	tests := []struct {
+		bus   int
+		ports []int
+		path  string
+	}{
+		{1, nil, ""},
+		{1, []int{2}, "1-2"},
+		{3, []int{1, 4, 2}, "3-1.4.2"},
+	}
+
+	for _, test := range tests {
+		path := UsbPortPath(test.bus, test.ports)
+		if path != test.path {
+			t.Errorf("%d %v: expected %q, got %q",
+				test.bus, test.ports, test.path, path)
+		}
+
+		if path != "" && !usbPortPathValid(path) {
+			t.Errorf("%q: not valid", path)
+		}
+	}
+}
+
+// TestUsbDeviceInfoIdent tests UsbDeviceInfo.Ident and
+// UsbDeviceInfo.Comment
+func TestUsbDeviceInfoIdent(t *testing.T) {
+	tests := []struct {
+		serial  string
+		path    string
+		dup     bool
+		ident   string
+		comment string
+	}{
+		{
+			serial:  "ABC123",
+			path:    "1-2.3",
+			ident:   "04f9-0042-ABC123-Brother-HL-1234",
+			comment: "Brother HL-1234 serial=ABC123",
+		},
+		{
+			serial:  "",
+			path:    "1-2.3",
+			ident:   "04f9-0042-port-1-2-3-Brother-HL-1234",
+			comment: "Brother HL-1234 port=1-2.3",
+		},
+		{
+			serial:  "",
+			path:    "",
+			ident:   "04f9-0042-Brother-HL-1234",
+			comment: "Brother HL-1234 serial=",
+		},
+		{
+			serial:  "ABC123",
+			path:    "1-2.3",
+			dup:     true,
+			ident:   "04f9-0042-ABC123-port-1-2-3-Brother-HL-1234",
+			comment: "Brother HL-1234 serial=ABC123 port=1-2.3",
+		},
+	}
+
+	for _, test := range tests {
+		info := UsbDeviceInfo{
+			Vendor:       0x04f9,
+			Product:      0x0042,
+			SerialNumber: test.serial,
+			Manufacturer: "Brother",
+			ProductName:  "HL-1234",
+			PortPath:     test.path,
+			Duplicate:    test.dup,
+		}
+
+		if ident := info.Ident(); ident != test.ident {
+			t.Errorf("%q %q: Ident: expected %q, present %q",
+				test.serial, test.path, test.ident, ident)
+		}
+
+		if comment := info.Comment(); comment != test.comment {
+			t.Errorf("%q %q: Comment: expected %q, present %q",
+				test.serial, test.path, test.comment, comment)
+		}
+	}
+}
+
+// TestUsbDeviceDescSelectConfig tests UsbDeviceDesc.SelectConfig
+func TestUsbDeviceDescSelectConfig(t *testing.T) {
+	desc := UsbDeviceDesc{
+		Config: -1,
+		ConfigsAll: map[int]UsbIfAddrList{
+			// Two alternate settings of the same interface
+			1: {{Num: 0, Alt: 0}, {Num: 0, Alt: 1}},
+			2: {{Num: 0}, {Num: 1}},
+			3: {{Num: 1}, {Num: 2}},
+		},
+	}
+
+	if !desc.SelectConfig(0) || desc.Config != 2 || len(desc.IfAddrs) != 2 {
+		t.Errorf("auto: selected config %d, expected 2", desc.Config)
+	}
+
+	if !desc.SelectConfig(1) || desc.Config != 1 {
+		t.Errorf("pinned: selected config %d, expected 1", desc.Config)
+	}
+
+	if desc.SelectConfig(4) || desc.Config != 1 {
+		t.Errorf("missed: config changed to %d", desc.Config)
+	}
+
+	desc = UsbDeviceDesc{Config: -1}
+	if desc.SelectConfig(0) || desc.Config != -1 {
+		t.Errorf("empty: config changed to %d", desc.Config)
+	}
+}
+
+// TestUsbIfAddrListSelectAlt tests UsbIfAddrList.SelectAlt
+func TestUsbIfAddrListSelectAlt(t *testing.T) {
+	list := UsbIfAddrList{
+		{Num: 1, Alt: 0, In: 1},
+		{Num: 0, Alt: 0, In: 2},
+		{Num: 1, Alt: 1, In: 3},
+	}
+
+	test := func(alt int, expected string) {
+		var present []string
+		for _, addr := range list.SelectAlt(alt) {
+			present = append(present,
+				fmt.Sprintf("%d/%d", addr.Num, addr.Alt))
+		}
+
+		if strings.Join(present, " ") != expected {
+			t.Errorf("alt %d: expected %q, present %q",
+				alt, expected, present)
+		}
+	}
+
+	test(-1, "1/0 0/0")
+	test(0, "1/0 0/0")
+	test(1, "1/1 0/0")
+	test(2, "1/0 0/0")
+}
+
+// TestUsbIppBasicCapsDecode tests UsbIppBasicCapsDecode
+func TestUsbIppBasicCapsDecode(t *testing.T) {
+	type testData struct {
+		desc []byte
+		caps UsbIppBasicCaps
+	}
+
+	tests := []testData{
+		// Too short
+		{nil, 0},
+		{[]byte{9, 0x21, 0, 0, 0, 0, 0x03, 0x00, 0}, 0},
+
+		// Print + Scan
+		{[]byte{10, 0x21, 0, 0, 0, 0, 0x03, 0x00, 0, 0},
+			UsbIppBasicCapsPrint | UsbIppBasicCapsScan},
+
+		// Bits in the high byte must not be lost or swapped
+		{[]byte{10, 0x21, 0, 0, 0, 0, 0x01, 0x01, 0, 0},
+			UsbIppBasicCapsPrint | 0x100},
+
+		// Print + AnyHTTP, followed by the trailing garbage
+		{[]byte{10, 0x21, 0, 0, 0, 0, 0x11, 0x00, 0, 0, 0xff, 0xff},
+			UsbIppBasicCapsPrint | UsbIppBasicCapsAnyHTTP},
+	}
+
+	for _, test := range tests {
+		caps := UsbIppBasicCapsDecode(test.desc)
+		if caps != test.caps {
+			t.Errorf("% x: expected 0x%x, got 0x%x",
+				test.desc, int(test.caps), int(caps))
+		}
+	}
+}
+
+// TestUsbDeviceDescOrderIfAddrs tests UsbDeviceDesc.OrderIfAddrs
+func TestUsbDeviceDescOrderIfAddrs(t *testing.T) {
+	// Interface 0 is shared with the legacy printer protocol,
+	// interfaces 1 and 2 are dedicated to IPP-over-USB
+	desc := UsbDeviceDesc{
+		Config: 1,
+		IfAddrs: UsbIfAddrList{
+			{Num: 0, Alt: 1},
+			{Num: 1, Alt: 0},
+			{Num: 2, Alt: 0},
+		},
+		IfDescs: []UsbIfDesc{
+			{Config: 1, IfNum: 0, Alt: 0, Class: 7, SubClass: 1, Proto: 2},
+			{Config: 1, IfNum: 0, Alt: 1, Class: 7, SubClass: 1, Proto: 4},
+			{Config: 1, IfNum: 1, Alt: 0, Class: 7, SubClass: 1, Proto: 4},
+			{Config: 1, IfNum: 2, Alt: 0, Class: 7, SubClass: 1, Proto: 4},
+		},
+	}
+
+	tests := []struct {
+		order QuirkIfOrder
+		nums  []int
+	}{
+		{QuirkIfOrder{}, []int{1, 2, 0}},
+		{QuirkIfOrder{Descriptor: true}, []int{0, 1, 2}},
+		{QuirkIfOrder{Nums: []int{2}}, []int{2, 1, 0}},
+		{QuirkIfOrder{Nums: []int{0, 2}}, []int{0, 2, 1}},
+	}
+
+	for _, test := range tests {
+		nums := []int{}
+		for _, addr := range desc.OrderIfAddrs(test.order) {
+			nums = append(nums, addr.Num)
+		}
+
+		if !reflect.DeepEqual(nums, test.nums) {
+			t.Errorf("%+v: expected %v, present %v",
+				test.order, test.nums, nums)
+		}
+	}
+}
@@ -0,0 +1,583 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Emulated IPP-over-USB device
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// UsbEmuConfig contains configuration of the emulated device
+type UsbEmuConfig struct {
+	Addr       UsbAddr       // Emulated USB address
+	Info       UsbDeviceInfo // Emulated device information
+	Interfaces int           // Count of 7/1/4 interfaces, 0 means 2
+	Handler    http.Handler  // Device behavior, nil means UsbEmuPrinter{}
+	Dead       []int         // Interfaces that never respond
+}
+
+// UsbEmulator implements in-process emulated IPP-over-USB device.
+//
+// It exposes the configurable amount of 7/1/4 interfaces and serves
+// HTTP requests, received over emulated bulk pipes, by the provided
+// http.Handler, exactly as real device does.
+//
+// So the whole stack above the libusb level (UsbTransport, HTTP proxy,
+// IPP and eSCL probing, DNS-SD TXT records construction) can be
+// tested without hardware.
+type UsbEmulator struct {
+	conf     UsbEmuConfig                // Emulator configuration
+	lock     sync.Mutex                  // Access lock
+	ifaces   map[int]*usbEmuInterface    // Currently opened interfaces
+	resets   int                         // Count of hard resets
+	soft     int                         // Count of soft resets
+	opens    int                         // Count of interface opens
+	sendErr  error                       // Error for the failed Send
+	sendErrs int                         // Count of Sends to fail
+	zlps     int                         // Count of zero-size Recvs
+	halts    [2]int                      // Count of ClearHalt, out/in
+	hooks    []func(*http.Request) error // Request hooks
+	closed   bool                        // Device is closed
+	handler  http.Handler                // Effective handler
+}
+
+// NewUsbEmulator creates a new emulated device
+func NewUsbEmulator(conf UsbEmuConfig) *UsbEmulator {
+	if conf.Interfaces <= 0 {
+		conf.Interfaces = 2
+	}
+
+	if conf.Addr.Address == 0 {
+		conf.Addr.Address = 1
+	}
+
+	if conf.Info.Manufacturer == "" {
+		conf.Info.Manufacturer = "Emulated"
+	}
+
+	if conf.Info.ProductName == "" {
+		conf.Info.ProductName = "IPP-USB Printer"
+	}
+
+	if conf.Info.SerialNumber == "" {
+		conf.Info.SerialNumber = "EMU0001"
+	}
+
+	if conf.Info.BasicCaps == 0 {
+		conf.Info.BasicCaps = UsbIppBasicCapsPrint |
+			UsbIppBasicCapsScan |
+			UsbIppBasicCapsAnyHTTP
+	}
+
+	emu := &UsbEmulator{
+		conf:    conf,
+		ifaces:  make(map[int]*usbEmuInterface),
+		handler: conf.Handler,
+	}
+
+	if emu.handler == nil {
+		emu.handler = &UsbEmuPrinter{}
+	}
+
+	return emu
+}
+
+// Desc returns UsbDeviceDesc of the emulated device
+func (emu *UsbEmulator) Desc() UsbDeviceDesc {
+	desc := UsbDeviceDesc{
+		UsbAddr: emu.conf.Addr,
+		Vendor:  emu.conf.Info.Vendor,
+		Product: emu.conf.Info.Product,
+		Release: emu.conf.Info.Release,
+		Config:  1,
+	}
+
+	for i := 0; i < emu.conf.Interfaces; i++ {
+		desc.IfDescs = append(desc.IfDescs, UsbIfDesc{
+			Vendor:   emu.conf.Info.Vendor,
+			Product:  emu.conf.Info.Product,
+			Config:   1,
+			IfNum:    i,
+			Class:    7,
+			SubClass: 1,
+			Proto:    4,
+		})
+
+		desc.IfAddrs.Add(UsbIfAddr{
+			UsbAddr: emu.conf.Addr,
+			Num:     i,
+			In:      1 + i*2,
+			Out:     2 + i*2,
+		})
+	}
+
+	desc.ConfigsAll = map[int]UsbIfAddrList{1: desc.IfAddrs}
+
+	return desc
+}
+
+// Resets returns count of hard resets, performed on the device
+func (emu *UsbEmulator) Resets() int {
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+	return emu.resets
+}
+
+// SoftResets returns count of interface soft resets, performed
+// on the device
+func (emu *UsbEmulator) SoftResets() int {
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+	return emu.soft
+}
+
+// Opens returns count of interface opens, performed on the device
+func (emu *UsbEmulator) Opens() int {
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+	return emu.opens
+}
+
+// FailSend makes the next count Sends on any interface to fail
+// with the specified error, without sending anything, like device
+// with the transient USB error does
+func (emu *UsbEmulator) FailSend(count int, err error) {
+	emu.lock.Lock()
+	emu.sendErr, emu.sendErrs = err, count
+	emu.lock.Unlock()
+}
+
+// ZeroRecv makes the next count Recvs on any interface to return
+// zero-size data, like busy or stuck device does
+func (emu *UsbEmulator) ZeroRecv(count int) {
+	emu.lock.Lock()
+	emu.zlps = count
+	emu.lock.Unlock()
+}
+
+// ClearHalts returns count of ClearHalt requests for IN and
+// OUT endpoints
+func (emu *UsbEmulator) ClearHalts() (in, out int) {
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+	return emu.halts[1], emu.halts[0]
+}
+
+// Hook installs a hook, called for each request before it is
+// passed to the handler. If hook returns an error, the emulated
+// interface hangs up and doesn't respond anymore, like broken
+// firmware does. It is useful to test error recovery paths
+func (emu *UsbEmulator) Hook(hook func(*http.Request) error) {
+	emu.lock.Lock()
+	emu.hooks = append(emu.hooks, hook)
+	emu.lock.Unlock()
+}
+
+// Configure sets device configuration. It implements UsbDevice interface
+func (emu *UsbEmulator) Configure(desc UsbDeviceDesc,
+	quirks *Quirks) error {
+
+	return nil
+}
+
+// Close the device. It implements UsbDevice interface
+func (emu *UsbEmulator) Close() {
+	emu.lock.Lock()
+	emu.closed = true
+	ifaces := emu.ifaces
+	emu.ifaces = make(map[int]*usbEmuInterface)
+	emu.lock.Unlock()
+
+	for _, iface := range ifaces {
+		iface.shutdown()
+	}
+}
+
+// Reset performs the device hard reset. It implements UsbDevice interface
+//
+// All interfaces lose their pending data and in-flight transfers
+// fail, as with real device
+func (emu *UsbEmulator) Reset() {
+	emu.lock.Lock()
+	emu.resets++
+	ifaces := make([]*usbEmuInterface, 0, len(emu.ifaces))
+	for _, iface := range emu.ifaces {
+		ifaces = append(ifaces, iface)
+	}
+	emu.lock.Unlock()
+
+	for _, iface := range ifaces {
+		iface.abort()
+	}
+}
+
+// UsbDeviceInfo returns device information. It implements UsbDevice
+// interface
+func (emu *UsbEmulator) UsbDeviceInfo() (UsbDeviceInfo, error) {
+	info := emu.conf.Info
+	info.PortNum = int(emu.conf.Addr.Address)
+	return info, nil
+}
+
+// OpenUsbInterface opens an interface. It implements UsbDevice interface
+func (emu *UsbEmulator) OpenUsbInterface(addr UsbIfAddr,
+	quirks *Quirks) (UsbInterfaceIO, error) {
+
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+
+	switch {
+	case emu.closed:
+		return nil, UsbError{"libusb_claim_interface", UsbENoDev}
+	case addr.Num < 0 || addr.Num >= emu.conf.Interfaces:
+		return nil, UsbError{"libusb_claim_interface", UsbENotFound}
+	case emu.ifaces[addr.Num] != nil:
+		return nil, UsbError{"libusb_claim_interface", UsbEBusy}
+	}
+
+	iface := newUsbEmuInterface(emu, addr)
+	emu.ifaces[addr.Num] = iface
+	emu.opens++
+
+	return iface, nil
+}
+
+// serve handles a single request
+func (emu *UsbEmulator) serve(rq *http.Request) (*http.Response, error) {
+	emu.lock.Lock()
+	hooks := emu.hooks
+	emu.lock.Unlock()
+
+	for _, hook := range hooks {
+		err := hook(rq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := &usbEmuResponseWriter{header: make(http.Header)}
+	emu.handler.ServeHTTP(w, rq)
+
+	return w.response(rq), nil
+}
+
+// usbEmuInterface represents an opened interface of the emulated device
+type usbEmuInterface struct {
+	emu     *UsbEmulator   // Device that owns the interface
+	addr    UsbIfAddr      // Interface address
+	lock    sync.Mutex     // Access lock
+	outR    *io.PipeReader // Host->device pipe, device side
+	outW    *io.PipeWriter // Host->device pipe, host side
+	in      chan []byte    // Device->host responses
+	pending []byte         // Not yet received part of response
+	broken  bool           // Response was cut by reset
+	done    chan struct{}  // Closed when interface is closed
+	reset   chan struct{}  // Closed by device reset
+	once    sync.Once      // For shutdown
+}
+
+// newUsbEmuInterface creates a new usbEmuInterface and
+// starts its serving goroutine
+func newUsbEmuInterface(emu *UsbEmulator, addr UsbIfAddr) *usbEmuInterface {
+	iface := &usbEmuInterface{
+		emu:   emu,
+		addr:  addr,
+		in:    make(chan []byte, 1),
+		done:  make(chan struct{}),
+		reset: make(chan struct{}),
+	}
+
+	iface.outR, iface.outW = io.Pipe()
+	go iface.serve()
+
+	return iface
+}
+
+// Close the interface. It implements UsbInterfaceIO interface
+func (iface *usbEmuInterface) Close() {
+	iface.emu.lock.Lock()
+	if iface.emu.ifaces[iface.addr.Num] == iface {
+		delete(iface.emu.ifaces, iface.addr.Num)
+	}
+	iface.emu.lock.Unlock()
+
+	iface.shutdown()
+}
+
+// shutdown stops serving goroutine
+func (iface *usbEmuInterface) shutdown() {
+	iface.once.Do(func() {
+		close(iface.done)
+		iface.outW.Close()
+	})
+}
+
+// SoftReset drops all pending data and fails in-flight Recv.
+// It implements UsbInterfaceIO interface
+func (iface *usbEmuInterface) SoftReset() error {
+	iface.emu.lock.Lock()
+	iface.emu.soft++
+	iface.emu.lock.Unlock()
+
+	iface.abort()
+	return nil
+}
+
+// abort fails in-flight Recv, as device reset does, and drops
+// all pending data. If response was partially received, the next
+// Recv fails as well, so its reader doesn't wait for the rest of
+// response forever
+func (iface *usbEmuInterface) abort() {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+
+	dropped := len(iface.pending) != 0
+	iface.pending = nil
+
+	select {
+	case <-iface.in:
+		dropped = true
+	default:
+	}
+
+	// In-flight Recv, woken up here, clears the flag
+	iface.broken = dropped
+	close(iface.reset)
+	iface.reset = make(chan struct{})
+}
+
+// Send data to interface. It implements UsbInterfaceIO interface
+func (iface *usbEmuInterface) Send(ctx context.Context,
+	data []byte) (int, error) {
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	select {
+	case <-iface.done:
+		return 0, UsbError{"libusb_submit_transfer", UsbENoDev}
+	default:
+	}
+
+	iface.emu.lock.Lock()
+	if iface.emu.sendErrs > 0 {
+		iface.emu.sendErrs--
+		err := iface.emu.sendErr
+		iface.emu.lock.Unlock()
+		return 0, err
+	}
+	iface.emu.lock.Unlock()
+
+	n, err := iface.outW.Write(data)
+	if err != nil {
+		err = UsbError{"libusb_submit_transfer", UsbEIO}
+	}
+
+	return n, err
+}
+
+// Recv data from interface. It implements UsbInterfaceIO interface
+func (iface *usbEmuInterface) Recv(ctx context.Context,
+	data []byte) (int, error) {
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	iface.emu.lock.Lock()
+	if iface.emu.zlps > 0 {
+		iface.emu.zlps--
+		iface.emu.lock.Unlock()
+		return 0, nil
+	}
+	iface.emu.lock.Unlock()
+
+	// Note, lock is not held while waiting, so SoftReset
+	// can proceed in meantime
+	iface.lock.Lock()
+	pending := iface.pending
+	reset := iface.reset
+	broken := iface.broken
+	iface.broken = false
+	iface.lock.Unlock()
+
+	if broken {
+		return 0, UsbError{"libusb_submit_transfer", UsbEIO}
+	}
+
+	if len(pending) == 0 {
+		select {
+		case pending = <-iface.in:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-reset:
+			iface.lock.Lock()
+			iface.broken = false
+			iface.lock.Unlock()
+			return 0, UsbError{"libusb_submit_transfer", UsbEIO}
+		case <-iface.done:
+			return 0, UsbError{"libusb_submit_transfer", UsbENoDev}
+		}
+	}
+
+	n := copy(data, pending)
+
+	// Don't restore data, dropped by reset in meantime
+	iface.lock.Lock()
+	if iface.reset == reset {
+		iface.pending = pending[n:]
+	}
+	iface.lock.Unlock()
+
+	return n, nil
+}
+
+// ClearHalt clears "halted" condition of either input or output
+// endpoint. It implements UsbInterfaceIO interface
+func (iface *usbEmuInterface) ClearHalt(in bool) error {
+	iface.emu.lock.Lock()
+	if in {
+		iface.emu.halts[1]++
+	} else {
+		iface.emu.halts[0]++
+	}
+	iface.emu.lock.Unlock()
+
+	return nil
+}
+
+// serve reads requests from the host and sends responses back
+func (iface *usbEmuInterface) serve() {
+	reader := bufio.NewReader(iface.outR)
+
+	// Dead interface accepts data, but never responds
+	for _, num := range iface.emu.conf.Dead {
+		if num == iface.addr.Num {
+			io.Copy(ioutil.Discard, reader)
+			iface.outR.Close()
+			return
+		}
+	}
+
+	for {
+		rq, err := http.ReadRequest(reader)
+		if err != nil {
+			break
+		}
+
+		// Prefetch request body, so handler may respond
+		// without reading it
+		body, err := ioutil.ReadAll(rq.Body)
+		rq.Body.Close()
+		if err != nil {
+			break
+		}
+
+		rq.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// Handle the request
+		rsp, err := iface.emu.serve(rq)
+		if err != nil {
+			// Hang up, but keep consuming input
+			io.Copy(ioutil.Discard, reader)
+			break
+		}
+
+		buf := &bytes.Buffer{}
+		rsp.Write(buf)
+
+		select {
+		case iface.in <- buf.Bytes():
+		case <-iface.done:
+			return
+		}
+
+		if rsp.StatusCode == http.StatusSwitchingProtocols {
+			iface.echo(reader)
+			break
+		}
+	}
+
+	iface.outR.Close()
+}
+
+// echo sends all data, received from the host, back to it. It
+// emulates the upgraded protocol (i.e., WebSocket) after the
+// 101 Switching Protocols response, until interface is closed
+func (iface *usbEmuInterface) echo(reader io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			select {
+			case iface.in <- append([]byte(nil), buf[:n]...):
+			case <-iface.done:
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// usbEmuResponseWriter implements http.ResponseWriter for
+// the emulated device
+type usbEmuResponseWriter struct {
+	header http.Header  // Response header
+	status int          // HTTP status
+	body   bytes.Buffer // Response body
+}
+
+// Header returns response header. It implements http.ResponseWriter
+// interface
+func (w *usbEmuResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write writes response body. It implements http.ResponseWriter
+// interface
+func (w *usbEmuResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// WriteHeader sets HTTP status. It implements http.ResponseWriter
+// interface
+func (w *usbEmuResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// response builds http.Response
+func (w *usbEmuResponseWriter) response(rq *http.Request) *http.Response {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          ioutil.NopCloser(&w.body),
+		Request:       rq,
+	}
+}
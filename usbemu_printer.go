@@ -0,0 +1,256 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Emulated IPP-over-USB device: printer and scanner behavior
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// UsbEmuPrinter is the http.Handler, that implements behavior
+// of the typical IPP-over-USB MFP. It serves IPP requests at
+// /ipp/print (and, optionally, /ipp/faxout) and eSCL requests
+// at /eSCL/, producing a single blank page per scan job.
+//
+// Zero value is the working printer with built-in attributes
+// and without scanner. All fields are optional and allow to
+// reproduce buggy devices behavior.
+type UsbEmuPrinter struct {
+	PrinterAttrs goipp.Attributes // Printer attributes, nil for built-in
+	IppStatus    goipp.Status     // Status of IPP responses
+	HTTPStatus   int              // If not 0, all requests fail with this
+	EsclCaps     []byte           // ScannerCapabilities, nil if no scanner
+	Fax          bool             // Serve /ipp/faxout
+	Delay        time.Duration    // Delay before each response
+	jobID        int32            // Last job ID
+	lock         sync.Mutex       // Protects scan job state
+	scanJob      string           // Current scan job, "" if none
+	scanPDF      bool             // Scan job requested PDF
+	scanDone     bool             // Scan job completed
+}
+
+// UsbEmuEsclCaps contains minimal valid eSCL ScannerCapabilities,
+// suitable for UsbEmuPrinter.EsclCaps
+var UsbEmuEsclCaps = []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerCapabilities xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm" xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03">
+  <pwg:Version>2.0</pwg:Version>
+  <pwg:MakeAndModel>Emulated IPP-USB Printer</pwg:MakeAndModel>
+  <scan:UUID>5a6d7e7c-0000-1000-8000-000000000001</scan:UUID>
+  <scan:Platen>
+    <scan:PlatenInputCaps>
+      <scan:SettingProfiles>
+        <scan:SettingProfile>
+          <scan:ColorModes>
+            <scan:ColorMode>RGB24</scan:ColorMode>
+            <scan:ColorMode>Grayscale8</scan:ColorMode>
+          </scan:ColorModes>
+          <scan:DocumentFormats>
+            <pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>
+            <pwg:DocumentFormat>application/pdf</pwg:DocumentFormat>
+          </scan:DocumentFormats>
+        </scan:SettingProfile>
+      </scan:SettingProfiles>
+    </scan:PlatenInputCaps>
+  </scan:Platen>
+</scan:ScannerCapabilities>
+`)
+
+// UsbEmuScanPDF contains the scanned document, returned by
+// UsbEmuPrinter, when PDF format is requested. It is the minimal
+// valid PDF with a single empty A4 page
+var UsbEmuScanPDF = []byte(`%PDF-1.4
+1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj
+2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj
+3 0 obj << /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >> endobj
+trailer << /Root 1 0 R >>
+%%EOF
+`)
+
+// ServeHTTP handles HTTP request. It implements http.Handler interface
+func (prn *UsbEmuPrinter) ServeHTTP(w http.ResponseWriter, rq *http.Request) {
+	if prn.Delay != 0 {
+		time.Sleep(prn.Delay)
+	}
+
+	if prn.HTTPStatus != 0 {
+		w.WriteHeader(prn.HTTPStatus)
+		return
+	}
+
+	switch {
+	case rq.URL.Path == "/ipp/print",
+		rq.URL.Path == "/ipp/faxout" && prn.Fax:
+		prn.serveIpp(w, rq)
+
+	case rq.URL.Path == "/eSCL/ScannerCapabilities" && prn.EsclCaps != nil:
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write(prn.EsclCaps)
+
+	case strings.HasPrefix(rq.URL.Path, "/eSCL/") && prn.EsclCaps != nil:
+		prn.serveEscl(w, rq)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveIpp handles IPP request
+func (prn *UsbEmuPrinter) serveIpp(w http.ResponseWriter, rq *http.Request) {
+	if rq.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var msg goipp.Message
+	err := msg.Decode(rq.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rsp := goipp.NewResponse(msg.Version, prn.IppStatus, msg.RequestID)
+	rsp.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	rsp.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+
+	if prn.IppStatus == goipp.StatusOk {
+		switch goipp.Op(msg.Code) {
+		case goipp.OpGetPrinterAttributes:
+			rsp.Printer = prn.PrinterAttrs
+			if rsp.Printer == nil {
+				rsp.Printer = usbEmuPrinterAttrs()
+			}
+
+		case goipp.OpPrintJob:
+			id := atomic.AddInt32(&prn.jobID, 1)
+			rsp.Job.Add(goipp.MakeAttribute("job-id",
+				goipp.TagInteger, goipp.Integer(id)))
+			rsp.Job.Add(goipp.MakeAttribute("job-state",
+				goipp.TagEnum, goipp.Integer(9)))
+
+		case goipp.OpGetJobAttributes:
+			rsp.Job.Add(goipp.MakeAttribute("job-id",
+				goipp.TagInteger,
+				goipp.Integer(atomic.LoadInt32(&prn.jobID))))
+			rsp.Job.Add(goipp.MakeAttribute("job-state",
+				goipp.TagEnum, goipp.Integer(9)))
+
+		case goipp.OpValidateJob, goipp.OpGetJobs, goipp.OpCancelJob:
+			// Nothing to add
+
+		default:
+			rsp.Code = goipp.Code(goipp.StatusErrorOperationNotSupported)
+		}
+	}
+
+	data, _ := rsp.EncodeBytes()
+	w.Header().Set("Content-Type", goipp.ContentType)
+	w.Write(data)
+}
+
+// serveEscl handles eSCL scanning requests. Scan job produces
+// a single page, either in JPEG or PDF format, as requested
+func (prn *UsbEmuPrinter) serveEscl(w http.ResponseWriter, rq *http.Request) {
+	const jobs = "/eSCL/ScanJobs"
+
+	path := rq.URL.Path
+
+	prn.lock.Lock()
+	defer prn.lock.Unlock()
+
+	switch {
+	case path == "/eSCL/ScannerStatus" && rq.Method == "GET":
+		state := "Idle"
+		if prn.scanJob != "" {
+			state = "Processing"
+		}
+
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerStatus xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm" xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03">
+  <pwg:Version>2.0</pwg:Version>
+  <pwg:State>%s</pwg:State>
+</scan:ScannerStatus>
+`, state)
+
+	case path == jobs && rq.Method == "POST":
+		settings, _ := ioutil.ReadAll(rq.Body)
+		id := atomic.AddInt32(&prn.jobID, 1)
+
+		prn.scanJob = fmt.Sprintf("%s/%d", jobs, id)
+		prn.scanPDF = bytes.Contains(settings, []byte("application/pdf"))
+		prn.scanDone = false
+
+		w.Header().Set("Location", prn.scanJob)
+		w.WriteHeader(http.StatusCreated)
+
+	case path == prn.scanJob+"/NextDocument" && rq.Method == "GET":
+		if prn.scanDone {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		prn.scanDone = true
+		if prn.scanPDF {
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write(UsbEmuScanPDF)
+		} else {
+			img := image.NewGray(image.Rect(0, 0, 85, 110))
+			for i := range img.Pix {
+				img.Pix[i] = 0xff
+			}
+
+			w.Header().Set("Content-Type", "image/jpeg")
+			jpeg.Encode(w, img, nil)
+		}
+
+	case path == prn.scanJob && rq.Method == "DELETE":
+		prn.scanJob = ""
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// usbEmuPrinterAttrs returns built-in printer attributes
+func usbEmuPrinterAttrs() goipp.Attributes {
+	return goipp.Attributes{
+		goipp.MakeAttribute("printer-make-and-model",
+			goipp.TagText, goipp.String("Emulated IPP-USB Printer")),
+		goipp.MakeAttribute("printer-uuid",
+			goipp.TagURI, goipp.String("urn:uuid:5a6d7e7c-0000-1000-8000-000000000001")),
+		goipp.MakeAttribute("printer-device-id",
+			goipp.TagText, goipp.String("MFG:Emulated;MDL:IPP-USB Printer;CMD:PDF,URF;")),
+		goipp.MakeAttribute("printer-firmware-string-version",
+			goipp.TagText, goipp.String("1.0")),
+		goipp.MakeAttribute("color-supported",
+			goipp.TagBoolean, goipp.Boolean(true)),
+		goipp.MakeAttribute("document-format-supported",
+			goipp.TagMimeType, goipp.String("application/pdf")),
+		goipp.MakeAttribute("urf-supported",
+			goipp.TagKeyword, goipp.String("W8")),
+		goipp.MakeAttribute("sides-supported",
+			goipp.TagKeyword, goipp.String("one-sided")),
+		goipp.MakeAttribute("printer-location",
+			goipp.TagText, goipp.String("")),
+		goipp.MakeAttribute("printer-state",
+			goipp.TagEnum, goipp.Integer(3)),
+	}
+}
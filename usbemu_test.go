@@ -0,0 +1,1336 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Integration tests, using emulated IPP-over-USB device
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// usbEmuTestTransport creates UsbTransport on a top of emulated device.
+// Device logs go to the test's temporary directory
+func usbEmuTestTransport(t *testing.T, emu *UsbEmulator) *UsbTransport {
+	testConf(t)
+
+	transport, err := NewUsbTransportDev(emu.Desc(), emu)
+	if err != nil {
+		t.Fatalf("NewUsbTransportDev: %s", err)
+	}
+
+	return transport
+}
+
+// usbEmuWithQuirks installs quirks, parsed from the specified
+// text in the quirks file format, for the duration of test
+func usbEmuWithQuirks(t *testing.T, quirks string) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "local.conf"),
+		[]byte(quirks), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	saveQuirks := Conf.Quirks
+	t.Cleanup(func() { Conf.Quirks = saveQuirks })
+
+	Conf.Quirks, err = LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet: %s", err)
+	}
+}
+
+// TestUsbEmuServices tests IPP and eSCL probing over emulated device
+func TestUsbEmuServices(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: &UsbEmuPrinter{EsclCaps: UsbEmuEsclCaps},
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	info := transport.UsbDeviceInfo()
+	client := &http.Client{Transport: transport}
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	var services DNSSdServices
+	ippinfo, _, err := IppService(log, &services, 60000, info,
+		transport.Quirks(), client)
+	if err != nil {
+		t.Fatalf("IppService: %s", err)
+	}
+
+	if ippinfo.DNSSdName != "Emulated IPP-USB Printer" {
+		t.Errorf("IppService: DNSSdName: %q", ippinfo.DNSSdName)
+	}
+
+	_, err = EsclService(log, &services, 60000, info, ippinfo, client)
+	if err != nil {
+		t.Fatalf("EsclService: %s", err)
+	}
+
+	types := []string{}
+	for _, svc := range services {
+		types = append(types, svc.Type)
+	}
+
+	expected := []string{"_printer._tcp", "_ipp._tcp", "_uscan._tcp"}
+	if len(types) != len(expected) {
+		t.Fatalf("services: expected %v, present %v", expected, types)
+	}
+
+	for i := range types {
+		if types[i] != expected[i] {
+			t.Fatalf("services: expected %v, present %v",
+				expected, types)
+		}
+	}
+
+	if transport.TimeoutExpired() {
+		t.Errorf("unexpected timeout")
+	}
+}
+
+// TestUsbEmuFax tests detection and advertising of IPP FaxOut service
+func TestUsbEmuFax(t *testing.T) {
+	for _, fax := range []bool{false, true} {
+		emu := NewUsbEmulator(UsbEmuConfig{
+			Handler: &UsbEmuPrinter{Fax: fax},
+			Info: UsbDeviceInfo{
+				BasicCaps: UsbIppBasicCapsPrint |
+					UsbIppBasicCapsFax |
+					UsbIppBasicCapsAnyHTTP,
+			},
+		})
+
+		transport := usbEmuTestTransport(t, emu)
+
+		log := NewLogger().Begin()
+		var services DNSSdServices
+		ippinfo, _, err := IppService(log, &services, 60000,
+			transport.UsbDeviceInfo(), transport.Quirks(),
+			&http.Client{Transport: transport})
+		log.Commit()
+
+		transport.Close(false)
+
+		if err != nil {
+			t.Fatalf("IppService: %s", err)
+		}
+
+		svc := services[ippinfo.IppSvcIndex]
+		expected := "F"
+		subtypes := "_universal._sub._ipp._tcp"
+		if fax {
+			expected = "T"
+			subtypes += " _fax._sub._ipp._tcp"
+		}
+
+		present := ""
+		rfo := ""
+		for _, txt := range svc.Txt {
+			switch txt.Key {
+			case "Fax":
+				present = txt.Value
+			case "rfo":
+				rfo = txt.Value
+			}
+		}
+
+		switch {
+		case present != expected:
+			t.Errorf("fax=%v: Fax=%q", fax, present)
+		case fax && rfo != "ipp/faxout":
+			t.Errorf("fax=%v: rfo=%q", fax, rfo)
+		case strings.Join(svc.SubTypes, " ") != subtypes:
+			t.Errorf("fax=%v: subtypes %q", fax, svc.SubTypes)
+		}
+	}
+}
+
+// TestUsbEmuHTTPError tests that HTTP errors are passed through
+func TestUsbEmuHTTPError(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: &UsbEmuPrinter{HTTPStatus: http.StatusServiceUnavailable},
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	var services DNSSdServices
+	_, status, err := IppService(log, &services, 60000,
+		transport.UsbDeviceInfo(), transport.Quirks(),
+		&http.Client{Transport: transport})
+
+	if err == nil || status != http.StatusServiceUnavailable {
+		t.Errorf("IppService: expected HTTP 503, got %d (%v)",
+			status, err)
+	}
+}
+
+// TestUsbEmuReadyProbe tests the device readiness probe
+func TestUsbEmuReadyProbe(t *testing.T) {
+	tests := []struct {
+		prn    *UsbEmuPrinter // Emulated printer
+		status int            // Expected HTTP status
+		ok     bool           // Device expected to be ready
+	}{
+		{&UsbEmuPrinter{EsclCaps: UsbEmuEsclCaps}, 0, true},
+		{&UsbEmuPrinter{PrinterAttrs: goipp.Attributes{}}, 0, false},
+		{&UsbEmuPrinter{}, 0, true},
+		{&UsbEmuPrinter{IppStatus: goipp.StatusErrorBusy}, 0, false},
+		{&UsbEmuPrinter{HTTPStatus: http.StatusServiceUnavailable},
+			http.StatusServiceUnavailable, false},
+	}
+
+	for i, test := range tests {
+		emu := NewUsbEmulator(UsbEmuConfig{Handler: test.prn})
+		transport := usbEmuTestTransport(t, emu)
+
+		log := NewLogger().Begin()
+		status, err := DevReadyProbe(log, 60000,
+			transport.UsbDeviceInfo().BasicCaps, transport,
+			&http.Client{Transport: transport}, 0)
+		log.Commit()
+
+		transport.Close(false)
+
+		if (err == nil) != test.ok || status != test.status {
+			t.Errorf("%d: DevReadyProbe: got %d (%v), expected %d",
+				i, status, err, test.status)
+		}
+	}
+}
+
+// TestUsbEmuHeaders tests the user-agent, http-XXX and
+// http-response-XXX quirks
+func TestUsbEmuHeaders(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  user-agent  = Test/1.0
+  http-x-test = yes
+  http-x-old  = s|text/(.*)|new/$1|
+  http-response-server   = ""
+  http-response-x-device = s/^/fw-/
+`)
+
+	// Create device, serving echo of headers
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			w.Header().Set("Server", "Embedded")
+			w.Header().Set("X-Device", "1.0")
+			w.Write([]byte(rq.Header.Get("User-Agent") + " " +
+				rq.Header.Get("X-Test") + " " +
+				rq.Header.Get("X-Old")))
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	tests := []struct {
+		userAgent string // User-Agent, sent by client
+		expected  string // Headers, received by device
+	}{
+		{"", "Test/1.0 yes new/plain"},
+		{"CUPS/2.4", "CUPS/2.4 yes new/plain"},
+	}
+
+	for _, test := range tests {
+		rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+		if test.userAgent != "" {
+			rq.Header.Set("User-Agent", test.userAgent)
+		}
+		rq.Header.Set("X-Old", "text/plain")
+
+		resp, err := transport.RoundTrip(rq)
+		if err != nil {
+			t.Fatalf("%q: %s", test.userAgent, err)
+		}
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(data) != test.expected {
+			t.Errorf("%q: expected %q, present %q",
+				test.userAgent, test.expected, data)
+		}
+
+		if s := resp.Header.Get("Server"); s != "" {
+			t.Errorf("%q: Server not removed: %q", test.userAgent, s)
+		}
+
+		if s := resp.Header.Get("X-Device"); s != "fw-1.0" {
+			t.Errorf("%q: X-Device: %q", test.userAgent, s)
+		}
+	}
+
+	// Invalid rewrite rule
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "local.conf"), []byte(`
+[*]
+  http-x-test = s/(/x/
+`), 0644)
+	if err == nil {
+		_, err = LoadQuirksSet(dir)
+	}
+
+	if err == nil {
+		t.Errorf("invalid rewrite rule: error expected")
+	}
+}
+
+// TestUsbEmuHangup tests that hanged device causes timeout
+// and reset on close
+func TestUsbEmuHangup(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+	emu.Hook(func(*http.Request) error {
+		return errors.New("hang up")
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	transport.SetTimeout(100 * time.Millisecond)
+
+	_, err := (&http.Client{Transport: transport}).
+		Get("http://localhost/eSCL/ScannerCapabilities")
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	if !transport.TimeoutExpired() {
+		t.Errorf("expected timeout")
+	}
+
+	transport.Close(true)
+	if emu.Resets() == 0 {
+		t.Errorf("expected device reset")
+	}
+}
+
+// TestUsbEmuRetry tests retry of idempotent requests after
+// the transient USB error
+func TestUsbEmuRetry(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	pipe := UsbError{"libusb_submit_transfer", UsbEPipe}
+	client := &http.Client{Transport: transport}
+
+	// Get-Printer-Attributes is retried
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	emu.FailSend(1, pipe)
+	_, _, err := ippGetPrinterAttributes(log, client, transport.Quirks(),
+		"ipp://localhost/ipp/print")
+	if err != nil {
+		t.Errorf("Get-Printer-Attributes: %s", err)
+	}
+
+	// Non-idempotent request is not retried
+	emu.FailSend(1, pipe)
+	_, err = client.Post("http://localhost/ipp/print", "text/plain",
+		strings.NewReader("data"))
+	if err == nil {
+		t.Errorf("POST: error expected")
+	}
+
+	// Retry is done only once
+	emu.FailSend(2, pipe)
+	_, err = client.Get("http://localhost/")
+	if err == nil {
+		t.Errorf("GET: error expected")
+	}
+
+	// And device is still usable
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Errorf("GET: %s", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// TestUsbEmuReopen tests that persistently failing interface
+// is reopened without device reset
+func TestUsbEmuReopen(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	pipe := UsbError{"libusb_submit_transfer", UsbEPipe}
+	client := &http.Client{Transport: transport}
+	iface := transport.connList[0].iface
+
+	// Non-idempotent requests are not retried, so each
+	// of them fails
+	emu.FailSend(UsbConnReopenErrors, pipe)
+	for i := 0; i < UsbConnReopenErrors; i++ {
+		_, err := client.Post("http://localhost/ipp/print",
+			"text/plain", strings.NewReader("data"))
+		if err == nil {
+			t.Errorf("POST: error expected")
+		}
+	}
+
+	if transport.connList[0].iface == iface {
+		t.Errorf("interface not reopened")
+	}
+
+	if n := emu.Resets(); n != 0 {
+		t.Errorf("device reset: %d times", n)
+	}
+
+	if transport.Stalled() {
+		t.Errorf("transport unexpectedly stalled")
+	}
+
+	// Device is still usable
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Errorf("GET: %s", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// TestUsbEmuSoftReset tests that device is soft-reset, not
+// hard-reset, when closed with connections in use
+func TestUsbEmuSoftReset(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	conn, err := transport.usbConnGet(context.Background(), 1, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Connection is released by SOFT_RESET
+	go func() {
+		for emu.SoftResets() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		conn.put()
+	}()
+
+	transport.Close(false)
+
+	switch {
+	case emu.SoftResets() == 0:
+		t.Errorf("expected device soft reset")
+	case emu.Resets() != 0:
+		t.Errorf("unexpected device hard reset")
+	}
+}
+
+// TestUsbEmuSoftResetRecv tests that SOFT_RESET fails in-flight
+// Recv of the emulated interface, as it does with real device
+func TestUsbEmuSoftResetRecv(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+	defer emu.Close()
+
+	iface, err := emu.OpenUsbInterface(UsbIfAddr{Num: 0}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer iface.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := iface.Recv(context.Background(), make([]byte, 512))
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	iface.SoftReset()
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Errorf("Recv: error expected")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Recv not woken up by SOFT_RESET")
+	}
+}
+
+// TestUsbEmuCloseTimeout tests that Close doesn't wait forever
+// for connections, not released by the device reset
+func TestUsbEmuCloseTimeout(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+	defer emu.Close()
+
+	transport := usbEmuTestTransport(t, emu)
+
+	_, err := transport.usbConnGet(context.Background(), 1, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	start := time.Now()
+	transport.Close(false)
+	elapsed := time.Since(start)
+
+	max := UsbSoftResetTimeout + UsbCloseTimeout + UsbForceCloseTimeout
+	switch {
+	case emu.SoftResets() == 0:
+		t.Errorf("expected device soft reset")
+	case emu.Resets() == 0:
+		t.Errorf("expected device hard reset")
+	case elapsed > max+time.Second:
+		t.Errorf("Close took %s", elapsed)
+	}
+}
+
+// TestUsbEmuCloseForce tests that forced close hard-resets the
+// device and doesn't wait forever for connections in use
+func TestUsbEmuCloseForce(t *testing.T) {
+	for _, release := range []bool{true, false} {
+		emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+
+		transport := usbEmuTestTransport(t, emu)
+
+		conn, err := transport.usbConnGet(context.Background(), 1, false)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		// If release is true, connection is released by
+		// the hard reset, otherwise it is abandoned
+		if release {
+			go func() {
+				for emu.Resets() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				conn.put()
+			}()
+		}
+
+		start := time.Now()
+		transport.CloseForce()
+		elapsed := time.Since(start)
+
+		emu.lock.Lock()
+		closed := emu.closed
+		emu.lock.Unlock()
+
+		switch {
+		case emu.Resets() != 1:
+			t.Errorf("release=%v: expected device hard reset", release)
+		case emu.SoftResets() != 0:
+			t.Errorf("release=%v: unexpected device soft reset",
+				release)
+		case closed != release:
+			t.Errorf("release=%v: device closed=%v", release, closed)
+		case elapsed > UsbForceCloseTimeout+time.Second:
+			t.Errorf("release=%v: CloseForce took %s", release, elapsed)
+		}
+
+		emu.Close()
+	}
+}
+
+// TestUsbEmuDisconnect tests that device disconnection promptly
+// fails both in-flight and waiting requests
+func TestUsbEmuDisconnect(t *testing.T) {
+	release := make(chan struct{})
+	prn := &UsbEmuPrinter{}
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Interfaces: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			if rq.URL.Path == "/block" {
+				<-release
+				return
+			}
+			prn.ServeHTTP(w, rq)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+	defer close(release)
+
+	// Start in-flight request and request, waiting for connection
+	done := make(chan error, 2)
+	for _, path := range []string{"/block", "/"} {
+		go func(path string) {
+			rq, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+			resp, err := transport.RoundTrip(rq)
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}(path)
+
+		for transport.connInUse() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for transport.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Unplug the device
+	emu.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != ErrUsbNoDevice {
+				t.Errorf("expected %q, present %v", ErrUsbNoDevice, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request not failed after disconnect")
+		}
+	}
+
+	if !transport.Disconnected() {
+		t.Errorf("transport not marked as disconnected")
+	}
+
+	// New requests must fail immediately
+	rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+	_, err := transport.RoundTrip(rq)
+	if err != ErrUsbNoDevice {
+		t.Errorf("new request: expected %q, present %v",
+			ErrUsbNoDevice, err)
+	}
+}
+
+// TestUsbEmuIOTimeout tests the usb-read-timeout quirk
+func TestUsbEmuIOTimeout(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-read-timeout = 100ms
+`)
+
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+	emu.Hook(func(*http.Request) error {
+		return errors.New("hang up")
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(true)
+
+	rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+	_, err := transport.RoundTrip(rq)
+	if err != ErrUsbTimeout {
+		t.Errorf("expected %q, present %v", ErrUsbTimeout, err)
+	}
+}
+
+// TestUsbEmuProbeInterfaces tests the usb-probe-interfaces quirk
+func TestUsbEmuProbeInterfaces(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-probe-interfaces = 100ms
+`)
+
+	tests := []struct {
+		dead  []int // Dead interfaces
+		alive []int // Expected interfaces in use
+	}{
+		{nil, []int{0, 1, 2}},
+		{[]int{1}, []int{0, 2}},
+		{[]int{0, 1, 2}, []int{0, 1, 2}},
+	}
+
+	for _, test := range tests {
+		emu := NewUsbEmulator(UsbEmuConfig{
+			Interfaces: 3,
+			Dead:       test.dead,
+		})
+
+		transport := usbEmuTestTransport(t, emu)
+
+		alive := []int{}
+		for _, conn := range transport.connList {
+			alive = append(alive, conn.index)
+		}
+
+		if !reflect.DeepEqual(alive, test.alive) {
+			t.Errorf("dead %v: expected %v, present %v",
+				test.dead, test.alive, alive)
+		}
+
+		if transport.TimeoutExpired() {
+			t.Errorf("dead %v: TimeoutExpired set", test.dead)
+		}
+
+		// Requests must work over the remaining interfaces
+		if len(test.dead) < len(test.alive) {
+			client := &http.Client{Transport: transport}
+			for i := 0; i < 4; i++ {
+				resp, err := client.Get("http://localhost/")
+				if err != nil {
+					t.Errorf("dead %v: GET: %s", test.dead, err)
+					break
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}
+
+		transport.Close(true)
+	}
+}
+
+// TestUsbEmuProbeDelay tests that interface probes honor init-delay
+func TestUsbEmuProbeDelay(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-probe-interfaces = 100ms
+  init-delay = 200ms
+`)
+
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 2})
+
+	start := time.Now()
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(true)
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("probe sent after %s, before init-delay", elapsed)
+	}
+
+	if len(transport.connList) != 2 {
+		t.Errorf("%d interfaces alive, expected 2",
+			len(transport.connList))
+	}
+}
+
+// TestUsbEmuKeepalive tests the usb-keepalive quirk
+func TestUsbEmuKeepalive(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-keepalive = 20ms
+`)
+
+	// Idle connections must be probed, device remains usable
+	var probes int32
+	printer := &UsbEmuPrinter{}
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			if rq.Method == "OPTIONS" {
+				atomic.AddInt32(&probes, 1)
+			}
+			printer.ServeHTTP(w, rq)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&probes) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&probes); n < 2 {
+		t.Errorf("keep-alive: expected at least 2 probes, present %d", n)
+	}
+
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Errorf("GET: %s", err)
+	} else {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	if transport.Stalled() {
+		t.Errorf("keep-alive: transport unexpectedly stalled")
+	}
+
+	transport.Close(false)
+
+	// Channel that doesn't recover must be reopened, without
+	// device reset
+	emu = NewUsbEmulator(UsbEmuConfig{Dead: []int{1}})
+	transport = usbEmuTestTransport(t, emu)
+	opens := emu.Opens()
+
+	deadline = time.Now().Add(time.Second)
+	for emu.Opens() == opens && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if emu.Opens() == opens {
+		t.Errorf("keep-alive: dead interface: not reopened")
+	}
+
+	if transport.Stalled() || emu.Resets() != 0 {
+		t.Errorf("keep-alive: dead interface: device reset requested")
+	}
+
+	transport.Close(true)
+}
+
+// TestUsbEmuReadBuffer tests the usb-read-buffer and
+// usb-read-align quirks
+func TestUsbEmuReadBuffer(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-read-buffer = 10000
+  usb-read-align  = 512
+`)
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Interfaces: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			w.Write(body)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	// Buffer size is rounded up to the alignment
+	if n := transport.connList[0].reader.Size(); n != 10240 {
+		t.Errorf("buffer size: %d, expected 10240", n)
+	}
+
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil || !bytes.Equal(data, body) {
+		t.Errorf("body mismatch (%d bytes received): %v", len(data), err)
+	}
+}
+
+// TestUsbEmuSuperSpeed tests read buffer sizing for
+// SuperSpeed devices
+func TestUsbEmuSuperSpeed(t *testing.T) {
+	tests := []struct {
+		speed UsbSpeed // Device speed
+		size  int      // Expected buffer size
+	}{
+		{UsbSpeedUnknown, 4096},
+		{UsbSpeedHigh, 4096},
+		{UsbSpeedSuper, UsbSuperSpeedReadBuffer},
+		{UsbSpeedSuperPlus, UsbSuperSpeedReadBuffer},
+	}
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 16384)
+
+	for _, test := range tests {
+		emu := NewUsbEmulator(UsbEmuConfig{
+			Interfaces: 1,
+			Info:       UsbDeviceInfo{Speed: test.speed},
+			Handler: http.HandlerFunc(func(w http.ResponseWriter,
+				rq *http.Request) {
+				w.Write(body)
+			}),
+		})
+
+		transport := usbEmuTestTransport(t, emu)
+
+		if n := transport.connList[0].reader.Size(); n != test.size {
+			t.Errorf("%s: buffer size: %d, expected %d",
+				test.speed, n, test.size)
+		}
+
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Errorf("%s: GET: %s", test.speed, err)
+		} else {
+			data, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if err != nil || !bytes.Equal(data, body) {
+				t.Errorf("%s: body mismatch (%d bytes received): %v",
+					test.speed, len(data), err)
+			}
+		}
+
+		transport.Close(false)
+	}
+}
+
+// TestUsbEmuClearHalt tests the usb-clear-halt and
+// usb-clear-halt-limit quirks
+func TestUsbEmuClearHalt(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-clear-halt       = both
+  usb-clear-halt-limit = 1
+`)
+
+	tests := []struct {
+		zlps int   // Count of zero-size reads
+		err  error // Expected error
+	}{
+		// Device recovers after ClearHalt
+		{UsbClearHaltZlpCount, nil},
+
+		// Device doesn't recover, reset is requested
+		{1000, ErrUsbStalled},
+	}
+
+	for _, test := range tests {
+		emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+		transport := usbEmuTestTransport(t, emu)
+
+		emu.ZeroRecv(test.zlps)
+
+		rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+		resp, err := transport.RoundTrip(rq)
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		if err != test.err {
+			t.Errorf("%d zero-size reads: expected %v, present %v",
+				test.zlps, test.err, err)
+		}
+
+		if in, out := emu.ClearHalts(); in != 1 || out != 1 {
+			t.Errorf("%d zero-size reads: ClearHalt in=%d out=%d, "+
+				"expected in=1 out=1", test.zlps, in, out)
+		}
+
+		transport.Close(false)
+	}
+}
+
+// TestUsbEmuWatchdog tests the usb-watchdog quirk
+func TestUsbEmuWatchdog(t *testing.T) {
+	usbEmuWithQuirks(t, `
+[*]
+  usb-read-timeout = 0
+  usb-watchdog     = 100ms
+`)
+
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+	emu.Hook(func(*http.Request) error {
+		return errors.New("hang up")
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(true)
+
+	rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+	_, err := transport.RoundTrip(rq)
+	if err != ErrUsbWatchdog {
+		t.Errorf("expected %q, present %v", ErrUsbWatchdog, err)
+	}
+
+	// Connection must be returned to the pool
+	if n := transport.connInUse(); n != 0 {
+		t.Errorf("%d connections still in use", n)
+	}
+
+	// Slow client upload is not a device stall
+	emu = NewUsbEmulator(UsbEmuConfig{
+		Interfaces: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			ioutil.ReadAll(rq.Body)
+		}),
+	})
+
+	transport2 := usbEmuTestTransport(t, emu)
+	defer transport2.Close(true)
+
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("data"))
+		}
+		w.Close()
+	}()
+
+	rq, _ = http.NewRequest("POST", "http://localhost/ipp/print", r)
+	resp, err := transport2.RoundTrip(rq)
+	if err != nil {
+		t.Errorf("slow upload: %s", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// TestUsbEmuReservedConn tests the connection, reserved
+// for status queries
+func TestUsbEmuReservedConn(t *testing.T) {
+	release := make(chan struct{})
+	prn := &UsbEmuPrinter{}
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			if rq.URL.Path == "/block" {
+				<-release
+				return
+			}
+			prn.ServeHTTP(w, rq)
+		}),
+		Interfaces: 3,
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	// Occupy both non-reserved connections
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rq, _ := http.NewRequest("GET",
+				"http://localhost/block", nil)
+			resp, err := transport.RoundTrip(rq)
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+	}
+
+	for transport.connInUse() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Other requests must wait
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	rq, _ := http.NewRequest("GET", "http://localhost/", nil)
+	_, err := transport.RoundTrip(rq.WithContext(ctx))
+	if err != context.DeadlineExceeded {
+		t.Errorf("regular request: expected timeout, got %v", err)
+	}
+
+	// Status queries must pass
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	client := &http.Client{Transport: transport}
+	_, _, err = ippGetPrinterAttributes(log, client, transport.Quirks(),
+		"ipp://localhost/ipp/print")
+	if err != nil {
+		t.Errorf("status query: %s", err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("blocked request: %s", err)
+		}
+	}
+}
+
+// TestUsbEmuConnStats tests per-connection statistics
+func TestUsbEmuConnStats(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Interfaces: 1})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	stats := transport.connList[0].stats
+	switch {
+	case stats.transactions != 2 || stats.errors != 0:
+		t.Errorf("unexpected stats: %s", stats)
+	case stats.sent == 0 || stats.recv == 0:
+		t.Errorf("bytes not counted: %s", stats)
+	}
+}
+
+// TestUsbEmuQueue tests FIFO order of requests, waiting
+// for the USB connection
+func TestUsbEmuQueue(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler:    &UsbEmuPrinter{},
+		Interfaces: 3,
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	// Occupy both non-reserved connections
+	ctx := context.Background()
+	conn, err := transport.usbConnGet(ctx, 1, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	conn2, err := transport.usbConnGet(ctx, 0, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer conn2.put()
+
+	// Queue some requests, one by one
+	order := make(chan int, 3)
+	for session := 2; session <= 4; session++ {
+		go func(session int) {
+			conn, err := transport.usbConnGet(ctx, session, false)
+			if err != nil {
+				t.Errorf("session %d: %s", session, err)
+				order <- -1
+				return
+			}
+			order <- session
+			conn.put()
+		}(session)
+
+		for transport.QueueDepth() != session-1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Canceled request must leave the queue
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err = transport.usbConnGet(ctx2, 5, false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("canceled request: expected timeout, got %v", err)
+	}
+
+	// Status query doesn't wait in queue
+	ctrl, err := transport.usbConnGet(ctx, 6, true)
+	if err != nil {
+		t.Errorf("status query: %s", err)
+	} else {
+		ctrl.put()
+	}
+
+	if n := transport.QueueDepth(); n != 3 {
+		t.Errorf("queue depth: %d, expected 3", n)
+	}
+
+	// Now release the connection and check the order
+	conn.put()
+	for expected := 2; expected <= 4; expected++ {
+		if session := <-order; session != expected {
+			t.Errorf("session %d served, expected %d",
+				session, expected)
+		}
+	}
+}
+
+// TestUsbEmuQueuePriority tests that status queries, waiting for
+// USB connection, are served before other requests
+func TestUsbEmuQueuePriority(t *testing.T) {
+	emu := NewUsbEmulator(UsbEmuConfig{Handler: &UsbEmuPrinter{}})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	// Occupy both connections; none is reserved
+	ctx := context.Background()
+	var conns []*usbConn
+	for session := 0; session < 2; session++ {
+		conn, err := transport.usbConnGet(ctx, session, false)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	// Queue regular request, then status query
+	order := make(chan int, 2)
+	for session := 2; session <= 3; session++ {
+		go func(session int) {
+			conn, err := transport.usbConnGet(ctx, session,
+				session == 3)
+			if err != nil {
+				t.Errorf("session %d: %s", session, err)
+				order <- -1
+				return
+			}
+			order <- session
+			conn.put()
+		}(session)
+
+		for transport.QueueDepth() != session-1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Status query is served first
+	conns[0].put()
+	for _, expected := range []int{3, 2} {
+		if session := <-order; session != expected {
+			t.Errorf("session %d served, expected %d",
+				session, expected)
+		}
+	}
+
+	conns[1].put()
+}
+
+// TestUsbEmuQueueLimit tests rejection of requests, waiting
+// for USB connection, by queue length and wait time
+func TestUsbEmuQueueLimit(t *testing.T) {
+	saveQueueMax, saveQueueWait := Conf.UsbQueueMax, Conf.UsbQueueWait
+	Conf.UsbQueueMax, Conf.UsbQueueWait = 1, 10*time.Millisecond
+	defer func() {
+		Conf.UsbQueueMax, Conf.UsbQueueWait =
+			saveQueueMax, saveQueueWait
+	}()
+
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler:    &UsbEmuPrinter{},
+		Interfaces: 3,
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	// Occupy both non-reserved connections
+	ctx := context.Background()
+	conn, err := transport.usbConnGet(ctx, 1, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	conn2, err := transport.usbConnGet(ctx, 0, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer conn2.put()
+
+	// Request, waiting too long, is rejected
+	_, err = transport.usbConnGet(ctx, 2, false)
+	if err != ErrUsbBusy {
+		t.Errorf("wait: expected %q, present %v", ErrUsbBusy, err)
+	}
+
+	// Request above the queue limit is rejected immediately
+	transport.connQueueWait = 0
+	done := make(chan struct{})
+	go func() {
+		conn, err := transport.usbConnGet(ctx, 3, false)
+		if err == nil {
+			conn.put()
+		}
+		close(done)
+	}()
+
+	for transport.QueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = transport.usbConnGet(ctx, 4, false)
+	if err != ErrUsbBusy {
+		t.Errorf("queue: expected %q, present %v", ErrUsbBusy, err)
+	}
+
+	conn.put()
+	<-done
+}
+
+// TestUsbEmuTiming tests per-transaction timing summary
+func TestUsbEmuTiming(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			w.Write(body)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+
+	client := &http.Client{Transport: transport}
+
+	// Response, received completely
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Response, abandoned by client
+	resp, err = client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Read(make([]byte, 1))
+	resp.Body.Close()
+
+	for transport.connInUse() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	transport.Close(false)
+
+	// Check the log
+	data, err := ioutil.ReadFile(filepath.Join(PathLogDir,
+		transport.UsbDeviceInfo().Ident()+".log"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var received, drained int
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, "timing: queue-wait=") ||
+			strings.Contains(line, "first-byte=-") ||
+			!strings.HasSuffix(line, "; 200 OK") {
+			continue
+		}
+
+		switch {
+		case strings.Contains(line, "drain=-"):
+			received++
+		case strings.Contains(line, "body=-"):
+			drained++
+		}
+	}
+
+	if received != 1 || drained != 1 {
+		t.Errorf("timing: %d received, %d drained", received, drained)
+	}
+}
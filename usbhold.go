@@ -0,0 +1,979 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Holding of print jobs
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+const (
+	// usbHoldJobIDBase is the base of job-id, assigned to held jobs.
+	// It is far above job-ids, used by devices, so held jobs are
+	// not confused with jobs of device
+	usbHoldJobIDBase = 0x40000000
+
+	// usbHoldDoneMax is the max number of completed held jobs
+	// (sent, failed or canceled), remembered for job queries
+	usbHoldDoneMax = 100
+
+	// usbHoldRetryDelay is the delay before retrying the job,
+	// when device is busy
+	usbHoldRetryDelay = 5 * time.Second
+)
+
+// usbHold holds print jobs of the device.
+//
+// While jobs are held, Print-Job requests are spooled to disk and
+// answered on behalf of device with the job in the pending-held
+// state, but not forwarded to device, so it remains idle. When hold
+// is released, held jobs are sent to device in order of arrival.
+// Jobs, arrived while held jobs are being sent, are spooled after
+// them, so order is preserved.
+//
+// Held job has its own job-id, until it is sent. Job operations
+// (Get-Job-Attributes, Cancel-Job and so on) with held job-id are
+// answered on behalf of device while job is held, and forwarded to
+// device with device's own job-id after job is sent. Get-Jobs
+// response of device is supplemented with held jobs. Jobs, rejected
+// by device when sent, remain visible as aborted.
+//
+// Create-Job is rejected with server-error-busy while jobs are held,
+// as its documents come in separate requests, that cannot be answered
+// on behalf of device. Clients retry it later. Other requests (i.e.,
+// printer status queries and scanning) are forwarded to device as
+// usual.
+//
+// Spooled jobs and the hold state are kept in the device state
+// directory, so they survive ipp-usb restart and device reconnect.
+// Restored jobs remain held until released
+type usbHold struct {
+	transport *UsbTransport       // Transport that owns usbHold
+	dir       string              // Spool directory
+	lock      sync.Mutex          // Access lock
+	held      bool                // Jobs are held
+	draining  bool                // Held jobs are being sent to device
+	queue     []*usbHeldJob       // Jobs to be sent, in order of arrival
+	done      []*usbHeldJob       // Completed jobs, oldest first
+	jobs      map[int]*usbHeldJob // All known jobs, by job-id
+	jobID     int                 // Last assigned job-id
+	wg        sync.WaitGroup      // Drain goroutine completion
+}
+
+// usbHeldJob represents a single held job
+type usbHeldJob struct {
+	id      int          // Assigned job-id
+	session int          // HTTP session of the job, 0 if restored
+	path    string       // HTTP request path (i.e., "/ipp/print")
+	file    string       // Spool file
+	size    int64        // Request body size
+	name    string       // job-name, "" if unknown
+	user    string       // requesting-user-name, "" if unknown
+	state   usbHeldState // Job state
+	devID   int          // Device job-id, once sent
+	devURI  string       // Device job-uri, once sent
+	message string       // Why job failed
+}
+
+// usbHeldState represents state of the held job
+type usbHeldState int
+
+const (
+	usbHeldQueued   usbHeldState = iota // Spooled, not sent yet
+	usbHeldSending                      // Being sent to device
+	usbHeldSent                         // Accepted by device
+	usbHeldFailed                       // Rejected by device
+	usbHeldCanceled                     // Canceled while held
+)
+
+// usbHoldCtxKey is the context.Context key that marks requests,
+// already handled by usbHold, so they are not handled again
+type usbHoldCtxKey struct{}
+
+// newUsbHold creates a new usbHold and restores jobs, spooled
+// before ipp-usb restart or device reconnect
+func newUsbHold(transport *UsbTransport) *usbHold {
+	hold := &usbHold{
+		transport: transport,
+		dir: filepath.Join(PathDevStateDir,
+			transport.info.Ident()+".hold"),
+		jobs:  make(map[int]*usbHeldJob),
+		jobID: usbHoldJobIDBase,
+	}
+
+	hold.restore()
+	return hold
+}
+
+// restore restores held jobs from the spool directory
+func (hold *usbHold) restore() {
+	log := hold.transport.log
+
+	files, err := ioutil.ReadDir(hold.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error('!', "HOLD: %s", err)
+		}
+		return
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if name == "held" {
+			hold.held = true
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".job"))
+		if err != nil || !strings.HasSuffix(name, ".job") {
+			continue
+		}
+
+		job := &usbHeldJob{
+			id:   id,
+			file: filepath.Join(hold.dir, name),
+		}
+
+		err = job.load()
+		if err != nil {
+			log.Error('!', "HOLD: %s", err)
+			continue
+		}
+
+		hold.queue = append(hold.queue, job)
+		hold.jobs[id] = job
+		if id > hold.jobID {
+			hold.jobID = id
+		}
+	}
+
+	sort.Slice(hold.queue, func(i, j int) bool {
+		return hold.queue[i].id < hold.queue[j].id
+	})
+
+	if len(hold.queue) != 0 {
+		hold.held = true
+		log.Info('!', "HOLD: %d held jobs restored", len(hold.queue))
+	}
+
+	if hold.held {
+		log.Info('!', "HOLD: print jobs are held")
+	}
+}
+
+// Hold starts holding of print jobs
+func (hold *usbHold) Hold() error {
+	hold.lock.Lock()
+	defer hold.lock.Unlock()
+
+	if hold.held {
+		return nil
+	}
+
+	err := os.MkdirAll(hold.dir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(hold.dir, "held"), nil, 0644)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("hold: %s", err)
+		hold.transport.log.Error('!', "HOLD: %s", err)
+		return err
+	}
+
+	hold.held = true
+	hold.transport.log.Info('!', "HOLD: print jobs are held")
+
+	return nil
+}
+
+// Release releases held print jobs and stops holding of new jobs
+func (hold *usbHold) Release() {
+	hold.lock.Lock()
+	defer hold.lock.Unlock()
+
+	if !hold.held {
+		return
+	}
+
+	os.Remove(filepath.Join(hold.dir, "held"))
+	hold.held = false
+	hold.transport.log.Info('!', "HOLD: released, %d jobs to send",
+		len(hold.queue))
+
+	hold.kick()
+}
+
+// kick starts sending of held jobs, if they are not held and not
+// being sent yet. Must be called under the hold.lock
+func (hold *usbHold) kick() {
+	if !hold.held && !hold.draining && len(hold.queue) != 0 {
+		hold.draining = true
+		hold.wg.Add(1)
+		go hold.drain()
+	}
+}
+
+// Status returns hold status, for the status output, or "", if
+// jobs are not held and there are no failed jobs
+func (hold *usbHold) Status() string {
+	hold.lock.Lock()
+	defer hold.lock.Unlock()
+
+	failed := 0
+	for _, job := range hold.done {
+		if job.state == usbHeldFailed {
+			failed++
+		}
+	}
+
+	s := ""
+	switch {
+	case hold.held:
+		s = fmt.Sprintf("held, %d jobs", len(hold.queue))
+	case hold.draining:
+		s = fmt.Sprintf("releasing, %d jobs", len(hold.queue))
+	}
+
+	if failed != 0 {
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d failed", failed)
+	}
+
+	return s
+}
+
+// active tells if request needs to be handled by usbHold
+func (hold *usbHold) active(rq *http.Request) bool {
+	if rq.Context().Value(usbHoldCtxKey{}) != nil {
+		return false
+	}
+
+	ct, _, _ := mime.ParseMediaType(rq.Header.Get("Content-Type"))
+	if rq.Method != "POST" || ct != goipp.ContentType || rq.Body == nil {
+		return false
+	}
+
+	hold.lock.Lock()
+	defer hold.lock.Unlock()
+
+	return hold.held || len(hold.jobs) != 0
+}
+
+// queued tells if new jobs must be queued. Must be called under
+// the hold.lock
+func (hold *usbHold) queued() bool {
+	return hold.held || len(hold.queue) != 0
+}
+
+// RoundTripWithSession handles IPP request, while jobs are held
+// or there are known held jobs. Requests, not related to held jobs,
+// are forwarded to device
+func (hold *usbHold) RoundTripWithSession(session int,
+	rq *http.Request) (*http.Response, error) {
+
+	transport := hold.transport
+
+	// IPP message starts with version-number (2 bytes),
+	// operation-id (2 bytes) and request-id (4 bytes)
+	hdr := make([]byte, 8)
+	n, _ := io.ReadFull(rq.Body, hdr)
+	hdr = hdr[:n]
+
+	op := goipp.Op(0)
+	if n == len(hdr) {
+		op = goipp.Op(binary.BigEndian.Uint16(hdr[2:4]))
+	}
+
+	var msg *goipp.Message
+
+	switch op {
+	case 0, goipp.OpGetPrinterAttributes:
+		// Forward as is
+
+	case goipp.OpPrintJob:
+		hold.lock.Lock()
+		queued := hold.queued()
+		hold.lock.Unlock()
+
+		if queued {
+			return hold.spool(session, rq, hdr)
+		}
+
+	case goipp.OpCreateJob:
+		hold.lock.Lock()
+		queued := hold.queued()
+		hold.lock.Unlock()
+
+		if queued {
+			transport.log.HTTPRqParams(LogDebug, '>', session, rq)
+			transport.log.Info('!',
+				"HTTP[%3.3d]: HOLD: Create-Job rejected", session)
+			rq.Body.Close()
+			return hold.response(rq, hdr, goipp.StatusErrorBusy,
+				nil), nil
+		}
+
+	default:
+		// Decode the request, to see which job it relates to
+		buf := &bytes.Buffer{}
+		msg = &goipp.Message{}
+		err := msg.Decode(io.TeeReader(
+			io.MultiReader(bytes.NewReader(hdr), rq.Body), buf))
+		hdr = buf.Bytes()
+
+		if err != nil {
+			msg = nil
+		}
+	}
+
+	contentLength := rq.ContentLength
+	if msg != nil {
+		rsp, data := hold.jobRequest(session, rq, msg)
+		if rsp != nil {
+			transport.log.HTTPRqParams(LogDebug, '>', session, rq)
+			rq.Body.Close()
+			return rsp, nil
+		}
+
+		if data != nil {
+			if contentLength >= 0 {
+				contentLength += int64(len(data) - len(hdr))
+			}
+			hdr = data
+		}
+	}
+
+	// Forward to device
+	outreq := rq.WithContext(context.WithValue(rq.Context(),
+		usbHoldCtxKey{}, true))
+	outreq.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(hdr), rq.Body), rq.Body}
+	outreq.ContentLength = contentLength
+
+	rsp, err := transport.RoundTripWithSession(session, outreq)
+	if err == nil && op == goipp.OpGetJobs && msg != nil {
+		hold.getJobs(session, msg, rsp)
+	}
+
+	return rsp, err
+}
+
+// spool spools Print-Job request and answers it on behalf of device.
+// hdr is the already consumed part of the request body
+func (hold *usbHold) spool(session int, rq *http.Request,
+	hdr []byte) (*http.Response, error) {
+
+	transport := hold.transport
+	log := transport.log
+	log.HTTPRqParams(LogDebug, '>', session, rq)
+
+	defer rq.Body.Close()
+
+	hold.lock.Lock()
+	hold.jobID++
+	job := &usbHeldJob{
+		id:      hold.jobID,
+		session: session,
+		path:    rq.URL.Path,
+		file:    filepath.Join(hold.dir, fmt.Sprintf("%d.job", hold.jobID)),
+	}
+	hold.lock.Unlock()
+
+	err := job.save(io.MultiReader(bytes.NewReader(hdr), rq.Body))
+	if err != nil {
+		log.HTTPError('!', session, "HOLD: %s", err)
+		return hold.response(rq, hdr, goipp.StatusErrorBusy, nil), nil
+	}
+
+	hold.lock.Lock()
+	hold.queue = append(hold.queue, job)
+	hold.jobs[job.id] = job
+	n := len(hold.queue)
+	attrs := hold.jobAttrs(rq, job)
+	hold.kick()
+	hold.lock.Unlock()
+
+	log.Info('!', "HTTP[%3.3d]: HOLD: job %d spooled (%d bytes), "+
+		"%d jobs in queue", session, job.id, job.size, n)
+
+	return hold.response(rq, hdr, goipp.StatusOk, attrs), nil
+}
+
+// jobRequest handles IPP request, that may refer a held job.
+//
+// If request is answered on behalf of device, the response is
+// returned. If request needs to be forwarded to device with device's
+// job-id, the re-encoded request is returned. Otherwise, request is
+// forwarded as is
+func (hold *usbHold) jobRequest(session int, rq *http.Request,
+	msg *goipp.Message) (*http.Response, []byte) {
+
+	// Find job-id or job-uri operation attribute
+	var jobAttr *goipp.Attribute
+	id := 0
+
+	for _, grp := range msg.Groups {
+		if grp.Tag != goipp.TagOperationGroup {
+			continue
+		}
+
+		for i := range grp.Attrs {
+			attr := &grp.Attrs[i]
+			if len(attr.Values) != 1 {
+				continue
+			}
+
+			s := attr.Values[0].V.String()
+			switch attr.Name {
+			case "job-id":
+			case "job-uri":
+				s = s[strings.LastIndex(s, "/")+1:]
+			default:
+				continue
+			}
+
+			if n, err := strconv.Atoi(s); err == nil {
+				jobAttr, id = attr, n
+			}
+		}
+	}
+
+	if id <= usbHoldJobIDBase {
+		return nil, nil
+	}
+
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:2], uint16(msg.Version))
+	binary.BigEndian.PutUint32(hdr[4:8], msg.RequestID)
+
+	hold.lock.Lock()
+	defer hold.lock.Unlock()
+
+	job := hold.jobs[id]
+	if job == nil {
+		return hold.response(rq, hdr, goipp.StatusErrorNotFound,
+			nil), nil
+	}
+
+	op := goipp.Op(msg.Code)
+
+	// Job is sent: forward request with device's job-id
+	if job.state == usbHeldSent {
+		if jobAttr.Name == "job-uri" {
+			if job.devURI == "" {
+				return hold.response(rq, hdr,
+					goipp.StatusErrorNotFound, nil), nil
+			}
+			jobAttr.Values[0].V = goipp.String(job.devURI)
+		} else {
+			jobAttr.Values[0].V = goipp.Integer(job.devID)
+		}
+
+		data, err := msg.EncodeBytes()
+		if err != nil {
+			return hold.response(rq, hdr,
+				goipp.StatusErrorInternal, nil), nil
+		}
+
+		hold.transport.log.HTTPDebug(' ', session,
+			"HOLD: %s: job %d is job %d of device",
+			op, job.id, job.devID)
+
+		return nil, data
+	}
+
+	// Job is not sent: answer on behalf of device
+	status := goipp.StatusErrorNotPossible
+
+	switch op {
+	case goipp.OpGetJobAttributes:
+		return hold.response(rq, hdr, goipp.StatusOk,
+			hold.jobAttrs(rq, job)), nil
+
+	case goipp.OpCancelJob:
+		if job.state == usbHeldQueued {
+			hold.cancel(job)
+			hold.transport.log.Info('!',
+				"HTTP[%3.3d]: HOLD: job %d canceled",
+				session, job.id)
+			status = goipp.StatusOk
+		}
+	}
+
+	return hold.response(rq, hdr, status, nil), nil
+}
+
+// getJobs adds held jobs to the Get-Jobs response
+func (hold *usbHold) getJobs(session int, msg *goipp.Message,
+	rsp *http.Response) {
+
+	// Which jobs are requested?
+	completed := false
+	for _, attr := range msg.Operation {
+		if attr.Name == "which-jobs" && len(attr.Values) == 1 {
+			completed = attr.Values[0].V.String() == "completed"
+		}
+	}
+
+	// Collect held jobs
+	var groups goipp.Groups
+
+	hold.lock.Lock()
+	jobs := hold.queue
+	if completed {
+		jobs = hold.done
+	}
+
+	for _, job := range jobs {
+		if job.state != usbHeldSent {
+			groups.Add(goipp.Group{
+				Tag:   goipp.TagJobGroup,
+				Attrs: hold.jobAttrs(rsp.Request, job),
+			})
+		}
+	}
+	hold.lock.Unlock()
+
+	if groups == nil {
+		return
+	}
+
+	// Add them to the response
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	var rspmsg goipp.Message
+	if err == nil {
+		err = rspmsg.DecodeBytes(data)
+	}
+
+	if err == nil && goipp.Status(rspmsg.Code) <= goipp.StatusOkEventsComplete {
+		rspmsg.Groups = append(rspmsg.AttrGroups(), groups...)
+		var data2 []byte
+		data2, err = rspmsg.EncodeBytes()
+		if err == nil {
+			data = data2
+		}
+	}
+
+	if err != nil {
+		hold.transport.log.HTTPDebug(' ', session,
+			"HOLD: Get-Jobs: %s", err)
+	}
+
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	rsp.ContentLength = int64(len(data))
+	rsp.TransferEncoding = nil
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+}
+
+// jobAttrs returns attributes of the held job. Must be called
+// under the hold.lock
+func (hold *usbHold) jobAttrs(rq *http.Request,
+	job *usbHeldJob) goipp.Attributes {
+
+	var attrs goipp.Attributes
+
+	uri := fmt.Sprintf("ipp://%s%s/%d", rq.Host, job.path, job.id)
+	attrs.Add(goipp.MakeAttribute("job-id",
+		goipp.TagInteger, goipp.Integer(job.id)))
+	attrs.Add(goipp.MakeAttribute("job-uri",
+		goipp.TagURI, goipp.String(uri)))
+
+	if job.name != "" {
+		attrs.Add(goipp.MakeAttribute("job-name",
+			goipp.TagName, goipp.String(job.name)))
+	}
+
+	if job.user != "" {
+		attrs.Add(goipp.MakeAttribute("job-originating-user-name",
+			goipp.TagName, goipp.String(job.user)))
+	}
+
+	state, reason := 3, "job-queued" // pending
+	switch {
+	case job.state == usbHeldQueued && hold.held:
+		state, reason = 4, "job-hold-until-specified" // pending-held
+	case job.state == usbHeldFailed:
+		state, reason = 8, "aborted-by-system" // aborted
+	case job.state == usbHeldCanceled:
+		state, reason = 7, "job-canceled-by-user" // canceled
+	}
+
+	attrs.Add(goipp.MakeAttribute("job-state",
+		goipp.TagEnum, goipp.Integer(state)))
+	attrs.Add(goipp.MakeAttribute("job-state-reasons",
+		goipp.TagKeyword, goipp.String(reason)))
+
+	if job.message != "" {
+		attrs.Add(goipp.MakeAttribute("job-state-message",
+			goipp.TagText, goipp.String(job.message)))
+	}
+
+	return attrs
+}
+
+// response makes IPP response to the request on behalf of device.
+// hdr is the beginning of the IPP request, at least 8 bytes, if
+// known. attrs, if not nil, are added as job attributes
+func (hold *usbHold) response(rq *http.Request, hdr []byte,
+	status goipp.Status, attrs goipp.Attributes) *http.Response {
+
+	version := goipp.DefaultVersion
+	reqid := uint32(1)
+	if len(hdr) >= 8 {
+		version = goipp.Version(binary.BigEndian.Uint16(hdr[0:2]))
+		reqid = binary.BigEndian.Uint32(hdr[4:8])
+	}
+
+	msg := goipp.NewResponse(version, status, reqid)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Job = attrs
+
+	body, _ := msg.EncodeBytes()
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {goipp.ContentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       rq,
+	}
+}
+
+// cancel cancels the queued job. Must be called under the hold.lock
+func (hold *usbHold) cancel(job *usbHeldJob) {
+	for i := range hold.queue {
+		if hold.queue[i] == job {
+			copy(hold.queue[i:], hold.queue[i+1:])
+			hold.queue = hold.queue[:len(hold.queue)-1]
+			break
+		}
+	}
+
+	os.Remove(job.file)
+	hold.complete(job, usbHeldCanceled, "")
+}
+
+// complete moves job to the list of completed jobs. Must be called
+// under the hold.lock
+func (hold *usbHold) complete(job *usbHeldJob, state usbHeldState,
+	message string) {
+
+	job.state = state
+	job.message = message
+	hold.done = append(hold.done, job)
+
+	if len(hold.done) > usbHoldDoneMax {
+		delete(hold.jobs, hold.done[0].id)
+		hold.done = hold.done[1:]
+	}
+
+	if len(hold.queue) == 0 && !hold.held {
+		os.Remove(hold.dir)
+	}
+}
+
+// drain sends held jobs to device, until there are no more jobs,
+// jobs are held again or transport is shut down
+func (hold *usbHold) drain() {
+	defer hold.wg.Done()
+
+	transport := hold.transport
+	leak := transport.leaks.Track(LeakGoroutine, "HOLD release")
+	defer leak.Release()
+
+	for {
+		hold.lock.Lock()
+		if hold.held || len(hold.queue) == 0 {
+			hold.draining = false
+			hold.lock.Unlock()
+			return
+		}
+
+		job := hold.queue[0]
+		job.state = usbHeldSending
+		hold.lock.Unlock()
+
+		status, attrs, delivered, err := hold.send(job)
+
+		// If job was not delivered (i.e., device is disconnected),
+		// it remains spooled, and jobs are held again
+		if !delivered {
+			transport.log.Error('!', "HOLD: job %d: %s", job.id, err)
+
+			hold.lock.Lock()
+			job.state = usbHeldQueued
+			hold.draining = false
+			hold.lock.Unlock()
+
+			hold.Hold()
+			return
+		}
+
+		if err == nil && (status == goipp.StatusErrorBusy ||
+			status == goipp.StatusErrorServiceUnavailable) {
+			transport.log.Info('!', "HOLD: job %d: %s, retrying",
+				job.id, status)
+
+			hold.lock.Lock()
+			job.state = usbHeldQueued
+			hold.lock.Unlock()
+
+			select {
+			case <-transport.shutdown:
+			case <-time.After(usbHoldRetryDelay):
+			}
+			continue
+		}
+
+		hold.lock.Lock()
+		hold.queue = hold.queue[1:]
+		os.Remove(job.file)
+
+		switch {
+		case err != nil:
+			transport.log.Error('!', "HOLD: job %d: %s", job.id, err)
+			hold.complete(job, usbHeldFailed, err.Error())
+
+		case status > goipp.StatusOkEventsComplete:
+			transport.log.Error('!', "HOLD: job %d: rejected by device: %s",
+				job.id, status)
+			hold.complete(job, usbHeldFailed,
+				"Rejected by printer: "+status.String())
+
+		default:
+			for _, attr := range attrs {
+				if len(attr.Values) != 1 {
+					continue
+				}
+
+				switch attr.Name {
+				case "job-id":
+					job.devID, _ = strconv.Atoi(
+						attr.Values[0].V.String())
+				case "job-uri":
+					job.devURI = attr.Values[0].V.String()
+				}
+			}
+
+			transport.log.Info('!', "HOLD: job %d sent as job %d",
+				job.id, job.devID)
+			hold.complete(job, usbHeldSent, "")
+		}
+		hold.lock.Unlock()
+	}
+}
+
+// send sends the held job to device. It returns IPP status and job
+// attributes of the device response. delivered is false, if job
+// has not reached device and can be sent again
+func (hold *usbHold) send(job *usbHeldJob) (status goipp.Status,
+	attrs goipp.Attributes, delivered bool, err error) {
+
+	transport := hold.transport
+
+	f, err := os.Open(job.file)
+	if err != nil {
+		return 0, nil, true, err
+	}
+
+	defer f.Close()
+
+	body := bufio.NewReader(f)
+	body.ReadString('\n') // Skip the path line
+
+	rq, err := http.NewRequest("POST", "http://localhost"+job.path,
+		ioutil.NopCloser(body))
+	if err != nil {
+		return 0, nil, true, err
+	}
+
+	rq = rq.WithContext(context.WithValue(context.Background(),
+		usbHoldCtxKey{}, true))
+	rq.Header.Set("Content-Type", goipp.ContentType)
+	rq.ContentLength = job.size
+
+	session := job.session
+	if session == 0 {
+		session = transport.NewSession()
+	}
+
+	rsp, err := transport.RoundTripWithSession(session, rq)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	defer rsp.Body.Close()
+
+	var msg goipp.Message
+	err = msg.Decode(rsp.Body)
+	io.Copy(ioutil.Discard, rsp.Body)
+
+	if err != nil {
+		return 0, nil, true, err
+	}
+
+	return goipp.Status(msg.Code), msg.Job, true, nil
+}
+
+// wait waits until the job sending goroutine finishes. As transport
+// is shut down before, the remaining jobs stay spooled and only the
+// job being sent is waited for. If ctx expires before, wait returns
+// the Context's error
+func (hold *usbHold) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		hold.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close closes usbHold. Jobs, not sent yet, remain spooled, so
+// they are restored next time device is opened
+func (hold *usbHold) close() {
+	hold.lock.Lock()
+	n := len(hold.queue)
+	hold.lock.Unlock()
+
+	if n != 0 {
+		hold.transport.log.Info('!', "HOLD: %d jobs remain spooled", n)
+	}
+}
+
+// save writes the job's spool file. The first line of the file
+// is the HTTP request path, followed by the request body
+func (job *usbHeldJob) save(body io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(job.file), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := job.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	var msg goipp.Message
+	err = msg.Decode(io.TeeReader(body, buf))
+	if err == nil {
+		job.name, job.user = usbHoldJobNames(&msg)
+	}
+
+	_, err = fmt.Fprintf(f, "%s\n", job.path)
+	if err == nil {
+		job.size, err = io.Copy(f, io.MultiReader(buf, body))
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, job.file)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// load loads the job's parameters from its spool file
+func (job *usbHeldJob) load() error {
+	f, err := os.Open(job.file)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	body := bufio.NewReader(f)
+	path, err := body.ReadString('\n')
+	if err != nil || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s: invalid spool file", job.file)
+	}
+
+	job.path = strings.TrimSuffix(path, "\n")
+	job.size = fi.Size() - int64(len(path))
+
+	var msg goipp.Message
+	if msg.Decode(body) == nil {
+		job.name, job.user = usbHoldJobNames(&msg)
+	}
+
+	return nil
+}
+
+// usbHoldJobNames returns job-name and requesting-user-name of
+// the Print-Job request
+func usbHoldJobNames(msg *goipp.Message) (name, user string) {
+	for _, attr := range msg.Operation {
+		if len(attr.Values) != 1 {
+			continue
+		}
+
+		switch attr.Name {
+		case "job-name":
+			name = attr.Values[0].V.String()
+		case "requesting-user-name":
+			user = attr.Values[0].V.String()
+		}
+	}
+
+	return
+}
@@ -0,0 +1,243 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Holding of print jobs test
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestUsbHold tests holding and releasing of print jobs
+func TestUsbHold(t *testing.T) {
+	testConf(t)
+
+	var lock sync.Mutex
+	var printed []string
+	var queried []int
+
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			var msg goipp.Message
+			msg.Decode(rq.Body)
+			doc, _ := ioutil.ReadAll(rq.Body)
+
+			rsp := goipp.NewResponse(msg.Version, goipp.StatusOk,
+				msg.RequestID)
+
+			lock.Lock()
+			switch goipp.Op(msg.Code) {
+			case goipp.OpPrintJob:
+				if string(doc) == "reject" {
+					rsp.Code = goipp.Code(
+						goipp.StatusErrorDocumentFormatNotSupported)
+					break
+				}
+
+				printed = append(printed, string(doc))
+				rsp.Job.Add(goipp.MakeAttribute("job-id",
+					goipp.TagInteger, goipp.Integer(100+len(printed))))
+
+			case goipp.OpGetJobAttributes:
+				for _, attr := range msg.Operation {
+					if attr.Name == "job-id" {
+						id := int(attr.Values[0].V.(goipp.Integer))
+						queried = append(queried, id)
+					}
+				}
+				rsp.Job.Add(goipp.MakeAttribute("job-state",
+					goipp.TagEnum, goipp.Integer(9)))
+
+			case goipp.OpGetJobs:
+				rsp.Job.Add(goipp.MakeAttribute("job-id",
+					goipp.TagInteger, goipp.Integer(1)))
+			}
+			lock.Unlock()
+
+			data, _ := rsp.EncodeBytes()
+			w.Header().Set("Content-Type", goipp.ContentType)
+			w.Write(data)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	client := &http.Client{Transport: transport}
+
+	// send sends IPP request and returns the response
+	send := func(op goipp.Op, jobID int, doc string) *goipp.Message {
+		msg := goipp.NewRequest(goipp.DefaultVersion, op, 1)
+		if jobID != 0 {
+			msg.Operation.Add(goipp.MakeAttribute("job-id",
+				goipp.TagInteger, goipp.Integer(jobID)))
+		}
+
+		data, _ := msg.EncodeBytes()
+		data = append(data, doc...)
+
+		rq, _ := http.NewRequest("POST", "http://localhost/ipp/print",
+			bytes.NewReader(data))
+		rq.Header.Set("Content-Type", goipp.ContentType)
+
+		resp, err := client.Do(rq)
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+		defer resp.Body.Close()
+
+		var rsp goipp.Message
+		err = rsp.Decode(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %s", op, err)
+		}
+
+		return &rsp
+	}
+
+	// jobAttr returns job attribute from the response
+	jobAttr := func(rsp *goipp.Message, name string) string {
+		for _, attr := range rsp.Job {
+			if attr.Name == name {
+				return attr.Values.String()
+			}
+		}
+		return ""
+	}
+
+	// check checks status of the response and the job-state
+	check := func(what string, rsp *goipp.Message,
+		status goipp.Status, state string) {
+		if goipp.Status(rsp.Code) != status {
+			t.Errorf("%s: expected %s, present %s",
+				what, status, goipp.Status(rsp.Code))
+		}
+
+		if s := jobAttr(rsp, "job-state"); s != state {
+			t.Errorf("%s: job-state: expected %q, present %q",
+				what, state, s)
+		}
+	}
+
+	received := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), printed...)
+	}
+
+	err := transport.hold.Hold()
+	if err != nil {
+		t.Fatalf("Hold: %s", err)
+	}
+
+	// Print-Job is spooled and answered on behalf of device
+	job1 := usbHoldJobIDBase + 1
+	job2 := usbHoldJobIDBase + 2
+	job3 := usbHoldJobIDBase + 3
+
+	for i, doc := range []string{"job 1", "job 2", "reject"} {
+		rsp := send(goipp.OpPrintJob, 0, doc)
+		check("Print-Job", rsp, goipp.StatusOk, "4")
+
+		id := usbHoldJobIDBase + i + 1
+		if s := jobAttr(rsp, "job-id"); s != goipp.Integer(id).String() {
+			t.Errorf("Print-Job: job-id: expected %d, present %s",
+				id, s)
+		}
+	}
+
+	// Held jobs are known to Get-Job-Attributes and Cancel-Job
+	check("Get-Job-Attributes",
+		send(goipp.OpGetJobAttributes, job1, ""), goipp.StatusOk, "4")
+	check("Cancel-Job",
+		send(goipp.OpCancelJob, job2, ""), goipp.StatusOk, "")
+	check("Get-Job-Attributes",
+		send(goipp.OpGetJobAttributes, job2, ""), goipp.StatusOk, "7")
+	check("Cancel-Job",
+		send(goipp.OpCancelJob, job2, ""), goipp.StatusErrorNotPossible, "")
+	check("Get-Job-Attributes",
+		send(goipp.OpGetJobAttributes, job3+1, ""),
+		goipp.StatusErrorNotFound, "")
+
+	// Get-Jobs returns jobs of device and held jobs
+	rsp := send(goipp.OpGetJobs, 0, "")
+	jobs := 0
+	for _, grp := range rsp.Groups {
+		if grp.Tag == goipp.TagJobGroup {
+			jobs++
+		}
+	}
+
+	if jobs != 3 {
+		t.Errorf("Get-Jobs: expected 3 jobs, present %d", jobs)
+	}
+
+	// Create-Job is rejected, other requests are passed to device
+	check("Create-Job", send(goipp.OpCreateJob, 0, ""),
+		goipp.StatusErrorBusy, "")
+	check("Get-Printer-Attributes", send(goipp.OpGetPrinterAttributes, 0, ""),
+		goipp.StatusOk, "")
+
+	if jobs := received(); len(jobs) != 0 {
+		t.Errorf("%d jobs sent to device while held", len(jobs))
+	}
+
+	if s := transport.hold.Status(); s != "held, 2 jobs" {
+		t.Errorf("Status: %q", s)
+	}
+
+	// Spooled jobs survive restart
+	restored := newUsbHold(transport)
+	if !restored.held || len(restored.queue) != 2 ||
+		restored.queue[0].id != job1 || restored.queue[1].id != job3 {
+		t.Errorf("restored jobs: held=%v, %d jobs",
+			restored.held, len(restored.queue))
+	}
+
+	// Released jobs are sent to device in order
+	transport.hold.Release()
+
+	for i := 0; transport.hold.Status() != "1 failed" && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s := transport.hold.Status(); s != "1 failed" {
+		t.Errorf("Status: %q", s)
+	}
+
+	if jobs := received(); len(jobs) != 1 || jobs[0] != "job 1" {
+		t.Errorf("released jobs: %q", jobs)
+	}
+
+	// Sent job is queried from device with device's job-id,
+	// rejected job remains visible as aborted
+	check("Get-Job-Attributes",
+		send(goipp.OpGetJobAttributes, job1, ""), goipp.StatusOk, "9")
+	check("Get-Job-Attributes",
+		send(goipp.OpGetJobAttributes, job3, ""), goipp.StatusOk, "8")
+
+	lock.Lock()
+	if len(queried) != 1 || queried[0] != 101 {
+		t.Errorf("Get-Job-Attributes sent to device: %v", queried)
+	}
+	lock.Unlock()
+
+	// Not held anymore
+	check("Print-Job", send(goipp.OpPrintJob, 0, "job 4"),
+		goipp.StatusOk, "")
+	if jobs := received(); len(jobs) != 2 {
+		t.Errorf("job 4 not sent to device")
+	}
+}
@@ -0,0 +1,55 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Registry of device identities in use
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// usbIdents tracks Idents of devices, currently served, so
+// identical devices (same VID/PID and same, often bogus, serial
+// number) can be told apart
+var usbIdents = struct {
+	sync.Mutex
+	owners map[string]UsbAddr
+}{owners: make(map[string]UsbAddr)}
+
+// usbIdentClaim claims device Ident for the device at addr.
+//
+// If Ident is already claimed by another device and USB port path
+// of the device is known, info is marked as duplicate, so port path
+// becomes a part of the Ident, and true is returned
+func usbIdentClaim(addr UsbAddr, info *UsbDeviceInfo) bool {
+	usbIdents.Lock()
+	defer usbIdents.Unlock()
+
+	dup := false
+	if owner, found := usbIdents.owners[info.Ident()]; found &&
+		owner != addr && info.PortPath != "" {
+		info.Duplicate = true
+		dup = true
+	}
+
+	ident := info.Ident()
+	if _, found := usbIdents.owners[ident]; !found {
+		usbIdents.owners[ident] = addr
+	}
+
+	return dup
+}
+
+// usbIdentRelease releases Ident, previously claimed by usbIdentClaim
+func usbIdentRelease(addr UsbAddr, info UsbDeviceInfo) {
+	usbIdents.Lock()
+	ident := info.Ident()
+	if usbIdents.owners[ident] == addr {
+		delete(usbIdents.owners, ident)
+	}
+	usbIdents.Unlock()
+}
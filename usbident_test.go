@@ -0,0 +1,73 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for registry of device identities in use
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestUsbIdentClaim tests usbIdentClaim and usbIdentRelease
+func TestUsbIdentClaim(t *testing.T) {
+	newInfo := func(path string) UsbDeviceInfo {
+		return UsbDeviceInfo{
+			Vendor:       0x04f9,
+			Product:      0x0042,
+			SerialNumber: "0000000000",
+			Manufacturer: "Brother",
+			ProductName:  "HL-1234",
+			PortPath:     path,
+		}
+	}
+
+	addr1 := UsbAddr{Bus: 1, Address: 5}
+	addr2 := UsbAddr{Bus: 1, Address: 6}
+	addr3 := UsbAddr{Bus: 1, Address: 7}
+
+	info1 := newInfo("1-1")
+	info2 := newInfo("1-2")
+
+	if usbIdentClaim(addr1, &info1) {
+		t.Errorf("first device: unexpectedly marked as duplicate")
+	}
+
+	if !usbIdentClaim(addr2, &info2) {
+		t.Errorf("second device: not marked as duplicate")
+	}
+
+	if info1.Ident() == info2.Ident() {
+		t.Errorf("Idents not disambiguated: %q", info1.Ident())
+	}
+
+	// Re-claiming by the same device is not a conflict
+	again := newInfo("1-1")
+	if usbIdentClaim(addr1, &again) {
+		t.Errorf("re-claim: unexpectedly marked as duplicate")
+	}
+
+	// Without port path, devices cannot be told apart
+	info3 := newInfo("")
+	if usbIdentClaim(addr3, &info3) {
+		t.Errorf("no port path: unexpectedly marked as duplicate")
+	}
+
+	// After release, Ident becomes available again
+	usbIdentRelease(addr1, info1)
+	usbIdentRelease(addr2, info2)
+	usbIdentRelease(addr3, info3)
+
+	info2 = newInfo("1-2")
+	if usbIdentClaim(addr2, &info2) {
+		t.Errorf("after release: unexpectedly marked as duplicate")
+	}
+	usbIdentRelease(addr2, info2)
+
+	if n := len(usbIdents.owners); n != 0 {
+		t.Errorf("%d Idents leaked", n)
+	}
+}
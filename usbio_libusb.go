@@ -10,9 +10,10 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,6 +26,7 @@ import (
 // int libusbHotplugCallback (libusb_context *ctx, libusb_device *device,
 //     libusb_hotplug_event event, void *user_data);
 // void libusbTransferCallback (struct libusb_transfer *transfer);
+// void libusbLogCallback (libusb_context *ctx, int level, char *str);
 //
 // typedef struct libusb_device_descriptor libusb_device_descriptor_struct;
 // typedef struct libusb_config_descriptor libusb_config_descriptor_struct;
@@ -42,6 +44,52 @@ import (
 // libusb_strerror_wrapper (int code) {
 //     return libusb_strerror(code);
 // }
+//
+// // libusb_wrap_sys_device and LIBUSB_OPTION_NO_DEVICE_DISCOVERY
+// // appeared in libusb 1.0.24. Also, libusb_set_option is variadic,
+// // which is not supported by cgo.
+// static inline int
+// libusb_no_device_discovery_wrapper (void) {
+// #if LIBUSB_API_VERSION >= 0x01000108
+//     return libusb_set_option(NULL, LIBUSB_OPTION_NO_DEVICE_DISCOVERY);
+// #else
+//     return LIBUSB_ERROR_NOT_SUPPORTED;
+// #endif
+// }
+//
+// static inline int
+// libusb_wrap_sys_device_wrapper (libusb_context *ctx, intptr_t fd,
+//         libusb_device_handle **devhandle) {
+// #if LIBUSB_API_VERSION >= 0x01000108
+//     return libusb_wrap_sys_device(ctx, fd, devhandle);
+// #else
+//     return LIBUSB_ERROR_NOT_SUPPORTED;
+// #endif
+// }
+//
+// // libusb_set_log_cb appeared in libusb 1.0.23. Its callback
+// // receives const char*, which cgo cannot export
+// #if LIBUSB_API_VERSION >= 0x01000107
+// static void
+// libusb_log_cb_wrapper (libusb_context *ctx, enum libusb_log_level level,
+//         const char *str) {
+//     libusbLogCallback(ctx, (int) level, (char*) str);
+// }
+// #endif
+//
+// static inline void
+// libusb_set_log_cb_wrapper (libusb_context *ctx) {
+// #if LIBUSB_API_VERSION >= 0x01000107
+//     libusb_set_log_cb(ctx, libusb_log_cb_wrapper, LIBUSB_LOG_CB_CONTEXT);
+// #endif
+// }
+//
+// static inline void
+// libusb_set_log_level_wrapper (libusb_context *ctx, int level) {
+// #if LIBUSB_API_VERSION >= 0x01000107
+//     libusb_set_option(ctx, LIBUSB_OPTION_LOG_LEVEL, level);
+// #endif
+// }
 import "C"
 
 // UsbError represents USB error
@@ -106,8 +154,25 @@ var (
 	// the libusbTransferDoneMap
 	libusbTransferDoneLock sync.Mutex
 
+	// libusbDetachedMap contains interfaces, kernel driver was
+	// detached from, per device handle, so drivers can be
+	// re-attached when device is closed
+	libusbDetachedMap = make(map[*C.libusb_device_handle][]int)
+
+	// libusbDetachedLock protects libusbDetachedMap
+	libusbDetachedLock sync.Mutex
+
 	// UsbHotPlugChan receives USB hotplug event notifications
 	UsbHotPlugChan = make(chan struct{}, 1)
+
+	// libusbSysDevFd, if not -1, is the file descriptor of
+	// already opened USB device, passed to us from outside
+	// (i.e., by termux-usb on Android). See UsbInitFd
+	libusbSysDevFd = -1
+
+	// libusbSysDevHandle is the libusb_device_handle, that
+	// wraps libusbSysDevFd
+	libusbSysDevHandle *C.libusb_device_handle
 )
 
 // UsbInit initializes low-level USB I/O
@@ -116,6 +181,19 @@ func UsbInit(nopnp bool) error {
 	return err
 }
 
+// UsbInitFd initializes low-level USB I/O to work with a single
+// device, specified by the already opened file descriptor.
+//
+// This is used on Android, where applications cannot enumerate
+// and open USB devices by itself, but may obtain a file descriptor
+// of the device from the system (i.e., via termux-usb). Devices
+// enumeration and hotplug are disabled at this case.
+func UsbInitFd(fd int) error {
+	libusbSysDevFd = fd
+	_, err := libusbContext(true)
+	return err
+}
+
 // libusbContext returns libusb_context. It
 // initializes context on demand.
 func libusbContext(nopnp bool) (*C.libusb_context, error) {
@@ -126,26 +204,41 @@ func libusbContext(nopnp bool) (*C.libusb_context, error) {
 	libusbContextLock.Lock()
 	defer libusbContextLock.Unlock()
 
+	// Disable devices enumeration, if working with
+	// externally opened device
+	if libusbSysDevFd >= 0 {
+		rc := C.libusb_no_device_discovery_wrapper()
+		if rc != 0 {
+			return nil, UsbError{"libusb_set_option", UsbErrCode(rc)}
+		}
+	}
+
 	// Obtain libusb_context
 	rc := C.libusb_init(&libusbContextPtr)
 	if rc != 0 {
 		return nil, UsbError{"libusb_init", UsbErrCode(rc)}
 	}
 
+	// Route libusb own messages to our logs
+	C.libusb_set_log_cb_wrapper(libusbContextPtr)
+	libusbSetLogLevel()
+
+	// Wrap externally opened device
+	if libusbSysDevFd >= 0 {
+		rc = C.libusb_wrap_sys_device_wrapper(libusbContextPtr,
+			C.intptr_t(libusbSysDevFd), &libusbSysDevHandle)
+		if rc != 0 {
+			return nil, UsbError{"libusb_wrap_sys_device", UsbErrCode(rc)}
+		}
+	}
+
 	// Subscribe to hotplug events
 	if !nopnp {
-		C.libusb_hotplug_register_callback(
-			libusbContextPtr, // libusb_context
-			C.LIBUSB_HOTPLUG_EVENT_DEVICE_ARRIVED| // events mask
-				C.LIBUSB_HOTPLUG_EVENT_DEVICE_LEFT,
-			C.LIBUSB_HOTPLUG_NO_FLAGS,  // flags
-			C.LIBUSB_HOTPLUG_MATCH_ANY, // vendor_id
-			C.LIBUSB_HOTPLUG_MATCH_ANY, // product_id
-			C.LIBUSB_HOTPLUG_MATCH_ANY, // dev_class
-			C.libusb_hotplug_callback_fn(unsafe.Pointer(C.libusbHotplugCallback)),
-			nil, // callback's data
-			nil, // deregister handle
-		)
+		err := libusbHotplugStart()
+		if err != nil {
+			C.libusb_exit(libusbContextPtr)
+			return nil, err
+		}
 	}
 
 	// Start libusb thread (required for hotplug and asynchronous I/O)
@@ -186,6 +279,152 @@ func libusbHotplugCallback(ctx *C.libusb_context, dev *C.libusb_device,
 	return 0
 }
 
+// UsbLogLevelsUpdate updates libusb log level, after log levels
+// were reloaded
+func UsbLogLevelsUpdate() {
+	if atomic.LoadInt32(&libusbContextOk) != 0 {
+		libusbSetLogLevel()
+	}
+}
+
+// libusbSetLogLevel sets libusb log level. Debug messages are
+// requested only if somebody wants them, as libusb is quite
+// verbose at this level
+func libusbSetLogLevel() {
+	level := C.LIBUSB_LOG_LEVEL_WARNING
+	if (Conf.LogMain|Conf.LogDevice)&LogTraceUSB != 0 {
+		level = C.LIBUSB_LOG_LEVEL_DEBUG
+	}
+	C.libusb_set_log_level_wrapper(libusbContextPtr, C.int(level))
+}
+
+// libusbLog contains loggers of opened devices, for routing
+// of libusb messages
+var libusbLog struct {
+	lock sync.Mutex          // Access lock
+	devs map[UsbAddr]*Logger // Device loggers
+}
+
+// UsbLogAttach makes libusb messages, related to the device,
+// go to the device's Logger
+//
+// libusb doesn't tell which device its messages are related to,
+// so we guess: if message mentions the device file name, or if
+// there is only one device opened, message goes to the device
+// Logger, otherwise to the main Log
+func UsbLogAttach(addr UsbAddr, log *Logger) {
+	libusbLog.lock.Lock()
+	if libusbLog.devs == nil {
+		libusbLog.devs = make(map[UsbAddr]*Logger)
+	}
+	libusbLog.devs[addr] = log
+	libusbLog.lock.Unlock()
+}
+
+// UsbLogDetach reverts UsbLogAttach
+func UsbLogDetach(addr UsbAddr) {
+	libusbLog.lock.Lock()
+	delete(libusbLog.devs, addr)
+	libusbLog.lock.Unlock()
+}
+
+// libusbLogTarget chooses Logger for the libusb message
+func libusbLogTarget(msg string) *Logger {
+	libusbLog.lock.Lock()
+	defer libusbLog.lock.Unlock()
+
+	for addr, log := range libusbLog.devs {
+		if len(libusbLog.devs) == 1 ||
+			strings.Contains(msg, fmt.Sprintf("/dev/bus/usb/%3.3d/%3.3d",
+				addr.Bus, addr.Address)) {
+			return log
+		}
+	}
+
+	return Log
+}
+
+// Called by libusb to write its own log messages
+//
+//export libusbLogCallback
+func libusbLogCallback(ctx *C.libusb_context, level C.int, str *C.char) {
+	msg := strings.TrimSpace(C.GoString(str))
+	if msg == "" {
+		return
+	}
+
+	log := libusbLogTarget(msg)
+
+	// Errors and warnings go to the debug level, so they are
+	// visible in the normal logs, libusb debug messages to the
+	// trace-usb level
+	switch level {
+	case C.LIBUSB_LOG_LEVEL_ERROR, C.LIBUSB_LOG_LEVEL_WARNING:
+		log.Debug('!', "%s", msg)
+	default:
+		log.Add(LogTraceUSB, ' ', "%s", msg)
+	}
+}
+
+// libusbHotplugStart starts detection of USB devices arrival and
+// removal, using method, selected by configuration
+//
+// If libusb doesn't support hotplug on this platform (i.e., on some
+// BSDs or without udev inside the container), and method is "auto",
+// it falls back to periodic polling of devices
+func libusbHotplugStart() error {
+	hotplug := Conf.UsbHotplug
+	rc := C.int(C.LIBUSB_ERROR_NOT_SUPPORTED)
+
+	if hotplug != UsbHotplugPoll &&
+		C.libusb_has_capability(C.LIBUSB_CAP_HAS_HOTPLUG) != 0 {
+		rc = C.libusb_hotplug_register_callback(
+			libusbContextPtr, // libusb_context
+			C.LIBUSB_HOTPLUG_EVENT_DEVICE_ARRIVED| // events mask
+				C.LIBUSB_HOTPLUG_EVENT_DEVICE_LEFT,
+			C.LIBUSB_HOTPLUG_NO_FLAGS,  // flags
+			C.LIBUSB_HOTPLUG_MATCH_ANY, // vendor_id
+			C.LIBUSB_HOTPLUG_MATCH_ANY, // product_id
+			C.LIBUSB_HOTPLUG_MATCH_ANY, // dev_class
+			C.libusb_hotplug_callback_fn(unsafe.Pointer(C.libusbHotplugCallback)),
+			nil, // callback's data
+			nil, // deregister handle
+		)
+
+		if rc == 0 {
+			Log.Debug(' ', "HOTPLUG: using libusb hotplug callbacks")
+			return nil
+		}
+	}
+
+	switch hotplug {
+	case UsbHotplugLibusb:
+		return UsbError{"libusb_hotplug_register_callback", UsbErrCode(rc)}
+	case UsbHotplugAuto:
+		Log.Debug(' ', "HOTPLUG: not supported, polling every %s",
+			UsbHotPlugPollInterval)
+	default:
+		Log.Debug(' ', "HOTPLUG: polling every %s",
+			UsbHotPlugPollInterval)
+	}
+
+	go libusbHotplugPoll()
+	return nil
+}
+
+// libusbHotplugPoll periodically wakes up PnP manager on platforms
+// without hotplug support, so it can rescan the list of devices
+func libusbHotplugPoll() {
+	for {
+		time.Sleep(UsbHotPlugPollInterval)
+
+		select {
+		case UsbHotPlugChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // Called by libusb on libusb_transfer completion
 //
 //export libusbTransferCallback
@@ -294,6 +533,18 @@ func UsbGetIppOverUsbDeviceDescs() (map[UsbAddr]UsbDeviceDesc, error) {
 		return nil, err
 	}
 
+	// Handle externally opened device
+	if libusbSysDevHandle != nil {
+		descs := make(map[UsbAddr]UsbDeviceDesc)
+		dev := C.libusb_get_device(libusbSysDevHandle)
+		desc, err := libusbBuildUsbDeviceDesc(dev)
+		if err == nil && len(desc.IfAddrs) >= 2 {
+			descs[desc.UsbAddr] = desc
+		}
+
+		return descs, err
+	}
+
 	// Obtain list of devices
 	var devlist **C.libusb_device
 	cnt := C.libusb_get_device_list(ctx, &devlist)
@@ -341,17 +592,29 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 	desc.Config = -1
 	desc.Vendor = uint16(cDesc.idVendor)
 	desc.Product = uint16(cDesc.idProduct)
+	desc.Release = uint16(cDesc.bcdDevice)
+
+	// Obtain physical USB path. USB allows at most 7 tiers
+	var cPorts [7]C.uint8_t
+	rc = C.libusb_get_port_numbers(dev, &cPorts[0], C.int(len(cPorts)))
+	if rc > 0 {
+		ports := make([]int, rc)
+		for i := range ports {
+			ports[i] = int(cPorts[i])
+		}
+		desc.Path = UsbPortPath(desc.Bus, ports)
+	}
+
+	// Roll over configs/interfaces/alt settings/endpoins.
+	//
+	// Some devices expose IPP-over-USB interfaces not in their
+	// first configuration, so all configurations are scanned
+	desc.ConfigsAll = make(map[int]UsbIfAddrList)
 
-	// Roll over configs/interfaces/alt settings/endpoins
 	for cfgNum := 0; cfgNum < int(cDesc.bNumConfigurations); cfgNum++ {
 		var conf *C.libusb_config_descriptor_struct
 		rc = C.libusb_get_config_descriptor(dev, C.uint8_t(cfgNum), &conf)
 		if rc == 0 {
-			// Make sure we use the same configuration for all interfaces
-			if desc.Config >= 0 && desc.Config != int(conf.bConfigurationValue) {
-				continue
-			}
-
 			ifcnt := conf.bNumInterfaces
 			ifaces := (*[256]C.libusb_interface_struct)(
 				unsafe.Pointer(conf._interface))[:ifcnt:ifcnt]
@@ -402,7 +665,7 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 
 						// Build and append UsbIfAddr
 						if in >= 0 && out >= 0 {
-							desc.Config = int(conf.bConfigurationValue)
+							cfg := int(conf.bConfigurationValue)
 							addr := UsbIfAddr{
 								UsbAddr: desc.UsbAddr,
 								Num:     int(alt.bInterfaceNumber),
@@ -410,7 +673,9 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 								In:      in,
 								Out:     out,
 							}
-							desc.IfAddrs.Add(addr)
+							addrs := desc.ConfigsAll[cfg]
+							addrs.Add(addr)
+							desc.ConfigsAll[cfg] = addrs
 						}
 					}
 				}
@@ -420,6 +685,10 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 		}
 	}
 
+	// Select configuration with the most IPP-over-USB interfaces.
+	// It may be overridden later by the usb-config quirk
+	desc.SelectConfig(0)
+
 	return desc, nil
 }
 
@@ -434,6 +703,19 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 		return nil, err
 	}
 
+	// Handle externally opened device
+	if libusbSysDevHandle != nil {
+		dev := C.libusb_get_device(libusbSysDevHandle)
+		bus := int(C.libusb_get_bus_number(dev))
+		address := int(C.libusb_get_device_address(dev))
+
+		if desc.Bus == bus && desc.Address == address {
+			return (*UsbDevHandle)(libusbSysDevHandle), nil
+		}
+
+		return nil, UsbError{"libusb_wrap_sys_device", UsbENotFound}
+	}
+
 	// Obtain list of devices
 	var devlist **C.libusb_device
 	cnt := C.libusb_get_device_list(ctx, &devlist)
@@ -467,12 +749,37 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 
 // Configure prepares the device for further work:
 //   - set proper USB configuration
-//   - detach kernel driver
-func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
+//   - detach kernel driver, according to the usb-detach-kernel-driver
+//     quirk
+func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc,
+	quirks *Quirks) error {
+
+	detach := quirks.GetUsbDetachKernelDriver()
+
+	// Externally opened device usually comes from the unprivileged
+	// environment, where kernel driver cannot be detached and
+	// configuration cannot be changed. So don't touch anything,
+	// if device is already in the proper configuration.
+	//
+	// Unless kernel drivers must be always detached, the same is
+	// true for other devices, so the legacy (non-IPP) interfaces
+	// remain owned by usblp, and /dev/usb/lp* remains available
+	if (*C.libusb_device_handle)(devhandle) == libusbSysDevHandle ||
+		detach != QuirkDetachAlways {
+		var config C.int
+		rc := C.libusb_get_configuration(
+			(*C.libusb_device_handle)(devhandle), &config)
+		if rc == 0 && int(config) == desc.Config {
+			return nil
+		}
+	}
+
 	// Detach kernel driver
-	err := (*UsbDevHandle)(devhandle).detachKernelDriver()
-	if err != nil {
-		return err
+	if detach != QuirkDetachNever {
+		err := devhandle.detachKernelDriver()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Set configuration
@@ -504,17 +811,39 @@ func (devhandle *UsbDevHandle) detachKernelDriver() error {
 		rc := C.libusb_detach_kernel_driver(
 			(*C.libusb_device_handle)(devhandle), C.int(ifnum))
 		if rc == C.LIBUSB_ERROR_NOT_FOUND {
-			rc = 0
+			continue
 		}
 
 		if rc < 0 {
 			return UsbError{"libusb_detach_kernel_driver", UsbErrCode(rc)}
 		}
+
+		libusbDetachedLock.Lock()
+		libusbDetachedMap[(*C.libusb_device_handle)(devhandle)] = append(
+			libusbDetachedMap[(*C.libusb_device_handle)(devhandle)],
+			ifnum)
+		libusbDetachedLock.Unlock()
 	}
 
 	return nil
 }
 
+// attachKernelDriver re-attaches kernel driver to interfaces,
+// it was detached from by detachKernelDriver
+func (devhandle *UsbDevHandle) attachKernelDriver() {
+	libusbDetachedLock.Lock()
+	ifnums := libusbDetachedMap[(*C.libusb_device_handle)(devhandle)]
+	delete(libusbDetachedMap, (*C.libusb_device_handle)(devhandle))
+	libusbDetachedLock.Unlock()
+
+	for _, ifnum := range ifnums {
+		// Errors are ignored here, as device may be already
+		// unplugged or its configuration may be changed
+		C.libusb_attach_kernel_driver(
+			(*C.libusb_device_handle)(devhandle), C.int(ifnum))
+	}
+}
+
 // libusbCurrentInterfaces builds list of interfaces in current configuration
 func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
 	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
@@ -572,8 +901,17 @@ func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
 }
 
 // Close a device
+//
+// Kernel drivers, detached by Configure, are re-attached.
+//
+// Note, externally opened device is never closed, as it cannot
+// be reopened again
 func (devhandle *UsbDevHandle) Close() {
-	C.libusb_close((*C.libusb_device_handle)(devhandle))
+	devhandle.attachKernelDriver()
+
+	if (*C.libusb_device_handle)(devhandle) != libusbSysDevHandle {
+		C.libusb_close((*C.libusb_device_handle)(devhandle))
+	}
 }
 
 // Reset a device
@@ -597,6 +935,7 @@ func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 	// Decode device descriptor
 	info.Vendor = uint16(cDesc.idVendor)
 	info.Product = uint16(cDesc.idProduct)
+	info.Release = uint16(cDesc.bcdDevice)
 	info.BasicCaps = devhandle.usbIppBasicCaps()
 
 	buf := make([]byte, 256)
@@ -619,15 +958,38 @@ func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 		)
 
 		if rc > 0 {
-			*s.str = string(buf[:rc])
+			*s.str = usbStringSanitize(string(buf[:rc]))
 		}
 	}
 
 	info.PortNum = int(C.libusb_get_port_number(dev))
+	info.Speed = libusbSpeed(dev)
 
 	return info, nil
 }
 
+// libusbSpeed returns device connection speed
+func libusbSpeed(dev *C.libusb_device) UsbSpeed {
+	speed := C.libusb_get_device_speed(dev)
+
+	// Note, LIBUSB_SPEED_SUPER_PLUS and faster speeds are
+	// missed in older libusb versions, so compared numerically
+	switch {
+	case speed == C.LIBUSB_SPEED_LOW:
+		return UsbSpeedLow
+	case speed == C.LIBUSB_SPEED_FULL:
+		return UsbSpeedFull
+	case speed == C.LIBUSB_SPEED_HIGH:
+		return UsbSpeedHigh
+	case speed == C.LIBUSB_SPEED_SUPER:
+		return UsbSpeedSuper
+	case speed > C.LIBUSB_SPEED_SUPER:
+		return UsbSpeedSuperPlus
+	}
+
+	return UsbSpeedUnknown
+}
+
 // usbIppBasicCaps reads and decodes printer's
 // Class-specific Device Info Descriptor to obtain device
 // capabilities; see IPP USB specification, section 4.3 for details
@@ -659,24 +1021,19 @@ func (devhandle *UsbDevHandle) usbIppBasicCaps() (caps UsbIppBasicCaps) {
 		return
 	}
 
-	if rc < 10 {
-		// Malformed response, fall back to default
-		return
-	}
-
 	// Decode basic capabilities bits
-	bits := binary.LittleEndian.Uint16(buf[6:8])
+	bits := UsbIppBasicCapsDecode(buf[:rc])
 	if bits == 0 {
-		// Paranoia. If no caps, return default
+		// Malformed response or no caps; fall back to default
 		return
 	}
 
-	return UsbIppBasicCaps(bits)
+	return bits
 }
 
 // OpenUsbInterface opens an interface
 func (devhandle *UsbDevHandle) OpenUsbInterface(addr UsbIfAddr,
-	quirks *Quirks) (*UsbInterface, error) {
+	quirks *Quirks) (UsbInterfaceIO, error) {
 
 	// Claim the interface
 	rc := C.libusb_claim_interface(
@@ -702,10 +1059,26 @@ func (devhandle *UsbDevHandle) OpenUsbInterface(addr UsbIfAddr,
 		return nil, UsbError{"libusb_set_interface_alt_setting", UsbErrCode(rc)}
 	}
 
+	// Some versions of Linux kernel don't allow bulk transfers to
+	// be larger that 16kb per URB, and libusb uses some smart-ass
+	// mechanism to avoid this limitation.
+	//
+	// This mechanism seems not to work very reliable on Raspberry Pi
+	// (see #3 for details). So limit bulk reads to 16kb, except for
+	// SuperSpeed devices, that need larger reads to reach the full
+	// speed and are attached to the xHCI controllers, not affected
+	// by this problem
+	maxRead := 16384
+	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
+	if libusbSpeed(dev).IsSuper() {
+		maxRead = UsbSuperSpeedReadBuffer
+	}
+
 	return &UsbInterface{
 		devhandle: devhandle,
 		addr:      addr,
 		quirks:    quirks,
+		maxRead:   maxRead,
 	}, nil
 }
 
@@ -714,6 +1087,7 @@ type UsbInterface struct {
 	devhandle *UsbDevHandle // Device handle
 	addr      UsbIfAddr     // Interface address
 	quirks    *Quirks       // Device quirks
+	maxRead   int           // Max size of the single bulk read
 }
 
 // Close the interface
@@ -833,15 +1207,9 @@ func (iface *UsbInterface) Recv(ctx context.Context,
 		return 0, ctx.Err()
 	}
 
-	// Some versions of Linux kernel don't allow bulk transfers to
-	// be larger that 16kb per URB, and libusb uses some smart-ass
-	// mechanism to avoid this limitation.
-	//
-	// This mechanism seems not to work very reliable on Raspberry Pi
-	// (see #3 for details). So just limit bulk reads to 16kb
-	const MaxBulkRead = 16384
-	if len(data) > MaxBulkRead {
-		data = data[0:MaxBulkRead]
+	// Limit size of the bulk read (see OpenUsbInterface)
+	if len(data) > iface.maxRead {
+		data = data[0:iface.maxRead]
 	}
 
 	// Allocate a libusb_transfer.
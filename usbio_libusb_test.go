@@ -0,0 +1,51 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * libusb-based USB I/O tests
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestUsbLogTarget tests routing of libusb messages to device loggers
+func TestUsbLogTarget(t *testing.T) {
+	addr1 := UsbAddr{Bus: 1, Address: 5}
+	addr2 := UsbAddr{Bus: 2, Address: 17}
+	log1 := NewLogger()
+	log2 := NewLogger()
+
+	const msg1 = "libusb: error [op_open] open /dev/bus/usb/001/005 failed"
+	const msg2 = "libusb: error [op_open] open /dev/bus/usb/002/017 failed"
+	const msg = "libusb: debug [handle_events] event triggered"
+
+	// No devices: everything goes to the main Log
+	if libusbLogTarget(msg1) != Log {
+		t.Errorf("no devices: main Log expected")
+	}
+
+	// Single device: everything goes to its Logger
+	UsbLogAttach(addr1, log1)
+	defer UsbLogDetach(addr1)
+
+	if libusbLogTarget(msg) != log1 {
+		t.Errorf("single device: device Logger expected")
+	}
+
+	// Many devices: only messages that mention the device
+	UsbLogAttach(addr2, log2)
+	defer UsbLogDetach(addr2)
+
+	switch {
+	case libusbLogTarget(msg1) != log1:
+		t.Errorf("%q: wrong Logger", msg1)
+	case libusbLogTarget(msg2) != log2:
+		t.Errorf("%q: wrong Logger", msg2)
+	case libusbLogTarget(msg) != Log:
+		t.Errorf("%q: main Log expected", msg)
+	}
+}
@@ -0,0 +1,212 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * usbmon cross-check: kernel's view of USB traffic in the device trace
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// UsbMon reads the kernel's usbmon text stream for the device's
+// bus and interleaves events of the device into the device log,
+// so discrepancies between what libusb reports and what the kernel
+// saw become visible.
+//
+// Events are logged at the LogTraceUSB level, errors at LogDebug
+type UsbMon struct {
+	file   io.ReadCloser // usbmon stream
+	closed int32         // Atomic non-zero, if closed
+}
+
+// usbmonEvent represents a single parsed usbmon event.
+// See Documentation/usb/usbmon.rst in the Linux kernel
+// sources for the format description
+type usbmonEvent struct {
+	Tag    string // URB tag, to match submission and completion
+	Type   byte   // 'S' - submission, 'C' - completion, 'E' - error
+	Xfer   string // Transfer type and direction: Ci, Co, Bi, Bo, ...
+	Bus    int    // USB bus
+	Dev    int    // Device address on the bus
+	Ep     int    // Endpoint number
+	Setup  bool   // Control setup packet, no status
+	Status int    // URB status, if not Setup
+	Length int    // Data length, -1 if missing
+}
+
+// usbmonErrno contains names of URB status codes, commonly
+// seen in the usbmon stream
+var usbmonErrno = map[int]string{
+	-2:   "ENOENT",      // Unlinked synchronously
+	-19:  "ENODEV",      // Device removed
+	-32:  "EPIPE",       // Endpoint stalled
+	-71:  "EPROTO",      // Protocol error
+	-75:  "EOVERFLOW",   // Babble
+	-104: "ECONNRESET",  // Unlinked asynchronously
+	-108: "ESHUTDOWN",   // Host controller shut down
+	-110: "ETIMEDOUT",   // Timed out
+	-115: "EINPROGRESS", // Submitted, not completed
+	-121: "EREMOTEIO",   // Short packet
+}
+
+// UsbMonStart starts usbmon cross-check for the device, if enabled
+// by configuration. It returns nil, if not enabled or usbmon is
+// not available
+func UsbMonStart(log *Logger, addr UsbAddr) *UsbMon {
+	if !Conf.UsbMon {
+		return nil
+	}
+
+	file, err := usbmonOpen(addr.Bus)
+	if err != nil {
+		log.Info('?', "usbmon: %s", err)
+		return nil
+	}
+
+	mon := &UsbMon{file: file}
+	log.Debug(' ', "usbmon: started for %s", addr)
+
+	go mon.read(log, addr)
+
+	return mon
+}
+
+// Close stops the usbmon cross-check
+//
+// usbmon stream cannot be polled, so reading goroutine may
+// remain blocked until the next event on the bus, but it
+// will not log anything after Close
+func (mon *UsbMon) Close() {
+	if mon != nil {
+		atomic.StoreInt32(&mon.closed, 1)
+		mon.file.Close()
+	}
+}
+
+// read reads the usbmon stream and logs events of the device
+func (mon *UsbMon) read(log *Logger, addr UsbAddr) {
+	scanner := bufio.NewScanner(mon.file)
+	for scanner.Scan() && atomic.LoadInt32(&mon.closed) == 0 {
+		evnt, ok := usbmonParse(scanner.Text())
+		if ok && evnt.Bus == addr.Bus && evnt.Dev == addr.Address {
+			evnt.log(log)
+		}
+	}
+}
+
+// usbmonParse parses a line of the usbmon text stream, in the
+// "u" format:
+//
+//	ffff8a2c4b0b3000 3575914555 S Bo:1:005:2 -115 31 = 55534243 ...
+//	ffff8a2c4b0b3000 3575914560 C Bo:1:005:2 0 31 >
+//	ffff8a2c4b0b3c00 3575914570 S Ci:1:005:0 s 80 06 0300 0000 00ff 255 <
+func usbmonParse(line string) (evnt usbmonEvent, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return
+	}
+
+	evnt.Tag = fields[0]
+
+	if len(fields[2]) != 1 || strings.IndexByte("SCE", fields[2][0]) < 0 {
+		return
+	}
+	evnt.Type = fields[2][0]
+
+	addr := strings.Split(fields[3], ":")
+	if len(addr) != 4 || len(addr[0]) != 2 {
+		return
+	}
+
+	evnt.Xfer = addr[0]
+
+	var err error
+	for i, out := range []*int{&evnt.Bus, &evnt.Dev, &evnt.Ep} {
+		*out, err = strconv.Atoi(addr[i+1])
+		if err != nil {
+			return
+		}
+	}
+
+	// Setup packet: "s" followed by 5 words of setup
+	// data, then length. Isochronous and interrupt
+	// transfers may have "status:interval..." here, only
+	// the status part is interesting
+	rest := fields[4:]
+	if rest[0] == "s" {
+		evnt.Setup = true
+		if len(rest) < 6 {
+			return
+		}
+		rest = rest[6:]
+	} else {
+		status := rest[0]
+		if i := strings.IndexByte(status, ':'); i >= 0 {
+			status = status[:i]
+		}
+
+		evnt.Status, err = strconv.Atoi(status)
+		if err != nil {
+			return
+		}
+		rest = rest[1:]
+	}
+
+	evnt.Length = -1
+	if len(rest) > 0 {
+		if n, err := strconv.Atoi(rest[0]); err == nil {
+			evnt.Length = n
+		}
+	}
+
+	return evnt, true
+}
+
+// IsError tells if event reports an error
+func (evnt usbmonEvent) IsError() bool {
+	switch {
+	case evnt.Type == 'E':
+		return true
+	case evnt.Type == 'C' && !evnt.Setup:
+		return evnt.Status != 0
+	}
+
+	return false
+}
+
+// String formats usbmonEvent for logging
+func (evnt usbmonEvent) String() string {
+	s := fmt.Sprintf("usbmon: %c %s ep %d urb %s", evnt.Type,
+		evnt.Xfer, evnt.Ep, evnt.Tag)
+
+	if !evnt.Setup && (evnt.Type != 'S' || evnt.Status != -115) {
+		s += " status " + strconv.Itoa(evnt.Status)
+		if name := usbmonErrno[evnt.Status]; name != "" {
+			s += " (" + name + ")"
+		}
+	}
+
+	if evnt.Length >= 0 {
+		s += " len " + strconv.Itoa(evnt.Length)
+	}
+
+	return s
+}
+
+// log writes usbmonEvent to the log
+func (evnt usbmonEvent) log(log *Logger) {
+	if evnt.IsError() {
+		log.Debug('!', "%s", evnt)
+	} else {
+		log.Add(LogTraceUSB, ' ', "%s", evnt)
+	}
+}
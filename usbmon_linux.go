@@ -0,0 +1,28 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * usbmon cross-check -- Linux version
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// usbmonOpen opens usbmon text stream for the USB bus
+func usbmonOpen(bus int) (io.ReadCloser, error) {
+	path := fmt.Sprintf("/sys/kernel/debug/usb/usbmon/%du", bus)
+	file, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("%s (is debugfs mounted and usbmon module loaded?)",
+			err)
+		return nil, err
+	}
+
+	return file, nil
+}
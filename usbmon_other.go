@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * usbmon cross-check -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// usbmonOpen opens usbmon text stream for the USB bus
+//
+// usbmon is the Linux kernel facility. There is nothing
+// similar on other platforms
+func usbmonOpen(bus int) (io.ReadCloser, error) {
+	return nil, errors.New("not available on this platform")
+}
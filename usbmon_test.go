@@ -0,0 +1,78 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * usbmon cross-check test
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestUsbmonParse tests parsing and formatting of usbmon events
+func TestUsbmonParse(t *testing.T) {
+	type testData struct {
+		line string // Input line
+		out  string // Expected output, "" if invalid
+		err  bool   // Expected IsError
+	}
+
+	tests := []testData{
+		{
+			line: "ffff8a2c4b0b3000 3575914555 S Bo:1:005:2 -115 31 = 55534243 01000000",
+			out:  "usbmon: S Bo ep 2 urb ffff8a2c4b0b3000 len 31",
+		},
+		{
+			line: "ffff8a2c4b0b3000 3575914560 C Bo:1:005:2 0 31 >",
+			out:  "usbmon: C Bo ep 2 urb ffff8a2c4b0b3000 status 0 len 31",
+		},
+		{
+			line: "ffff8a2c4b0b3000 3575914570 C Bi:1:005:1 -32 0",
+			out:  "usbmon: C Bi ep 1 urb ffff8a2c4b0b3000 status -32 (EPIPE) len 0",
+			err:  true,
+		},
+		{
+			line: "ffff8a2c4b0b3c00 3575914580 S Ci:1:005:0 s 80 06 0300 0000 00ff 255 <",
+			out:  "usbmon: S Ci ep 0 urb ffff8a2c4b0b3c00 len 255",
+		},
+		{
+			line: "ffff8a2c4b0b3c00 3575914590 E Bo:1:005:2 -19 0",
+			out:  "usbmon: E Bo ep 2 urb ffff8a2c4b0b3c00 status -19 (ENODEV) len 0",
+			err:  true,
+		},
+		{
+			line: "ffff8a2c4b0b3c00 3575914600 C Ii:1:005:3 -2:8:0 0",
+			out:  "usbmon: C Ii ep 3 urb ffff8a2c4b0b3c00 status -2 (ENOENT) len 0",
+			err:  true,
+		},
+		{line: "ffff8a2c4b0b3c00 3575914600 X Bo:1:005:2 0 0"},
+		{line: "ffff8a2c4b0b3c00 3575914600 S Bo:1:005 0 0"},
+		{line: "ffff8a2c4b0b3c00 3575914600 S Bo:1:005:2 x 0"},
+		{line: "ffff8a2c4b0b3c00 3575914600 S Ci:1:005:0 s 80 06"},
+		{line: ""},
+	}
+
+	for _, test := range tests {
+		evnt, ok := usbmonParse(test.line)
+		switch {
+		case ok != (test.out != ""):
+			t.Errorf("%q: parse status: expected %v, present %v",
+				test.line, test.out != "", ok)
+		case ok && evnt.String() != test.out:
+			t.Errorf("%q:\nexpected: %s\npresent:  %s",
+				test.line, test.out, evnt)
+		case ok && evnt.IsError() != test.err:
+			t.Errorf("%q: IsError: expected %v, present %v",
+				test.line, test.err, evnt.IsError())
+		}
+	}
+
+	evnt, _ := usbmonParse(tests[0].line)
+	if evnt.Bus != 1 || evnt.Dev != 5 {
+		t.Errorf("usbmonParse: address: expected 1:5, present %d:%d",
+			evnt.Bus, evnt.Dev)
+	}
+}
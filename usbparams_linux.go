@@ -0,0 +1,62 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB stack parameters -- Linux version
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Dump USB stack parameters to the UsbTransport's log
+func (transport *UsbTransport) dumpUSBparams(log *Logger) {
+	const usbParamsDir = "/sys/module/usbcore/parameters"
+
+	// Obtain list of parameter names (file names)
+	dir, err := os.Open(usbParamsDir)
+	if err != nil {
+		return
+	}
+
+	files, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return
+	}
+
+	sort.Strings(files)
+	if len(files) == 0 {
+		return
+	}
+
+	// Compute max width of parameter names
+	wid := 0
+	for _, file := range files {
+		if wid < len(file) {
+			wid = len(file)
+		}
+	}
+
+	wid++
+
+	// Write the table
+	log.Debug(' ', "USB stack parameters")
+
+	for _, file := range files {
+		p, _ := ioutil.ReadFile(usbParamsDir + "/" + file)
+		if p == nil {
+			p = []byte("-")
+		} else {
+			p = bytes.TrimSpace(p)
+		}
+
+		log.Debug(' ', "  %*s  %s", -wid, file+":", p)
+	}
+}
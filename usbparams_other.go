@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB stack parameters -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+// Dump USB stack parameters to the UsbTransport's log
+//
+// USB stack parameters are exposed by Linux kernel via sysfs.
+// There is nothing similar on other platforms, so this is no-op
+func (transport *UsbTransport) dumpUSBparams(log *Logger) {
+}
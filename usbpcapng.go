@@ -0,0 +1,241 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB traffic capture in the pcapng format
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pcapng block types
+const (
+	pcapngBlockSHB = 0x0a0d0d0a // Section Header Block
+	pcapngBlockIDB = 0x00000001 // Interface Description Block
+	pcapngBlockEPB = 0x00000006 // Enhanced Packet Block
+)
+
+// Section Header Block constants
+const (
+	pcapngByteOrder  = 0x1a2b3c4d // Byte-order magic
+	pcapngSectionLen = ^uint64(0) // Section length: not specified
+)
+
+// pcapngLinkTypeUsbLinux is the LINKTYPE_USB_LINUX_MMAPPED link
+// type: USB packets, prefixed with the 64-byte Linux usbmon header
+const pcapngLinkTypeUsbLinux = 220
+
+// Linux usbmon pseudo-header constants
+const (
+	pcapngUsbHdrLen     = 64   // Size of pseudo-header
+	pcapngUsbXferBulk   = 3    // Bulk transfer type
+	pcapngUsbDirIn      = 0x80 // Endpoint direction: device to host
+	pcapngUsbEvntSubmit = 'S'  // URB submission event
+	pcapngUsbEvntDone   = 'C'  // URB completion event
+	pcapngUsbNoSetup    = '-'  // No setup packet
+	pcapngUsbNoData     = '<'  // No data in the packet
+	pcapngUsbInProgress = -115 // -EINPROGRESS, status of submission
+	pcapngUsbErrIO      = -5   // -EIO, generic I/O error
+	pcapngUsbErrUnlink  = -2   // -ENOENT, URB cancelled (timeout)
+	pcapngUsbErrNone    = 0    // Success
+	pcapngUsbSnapLen    = 0    // Snapshot length: unlimited
+)
+
+// usbPcapngWriter writes USB capture in the pcapng format, that
+// can be opened by Wireshark and similar tools
+//
+// Each bulk transfer is written as a pair of Linux usbmon events
+// (URB submission and completion), exactly as Wireshark sees them
+// when capturing on the usbmonX interface
+type usbPcapngWriter struct {
+	lock  sync.Mutex    // Access lock
+	file  *os.File      // Output file
+	out   *bufio.Writer // Buffered output
+	urbid uint64        // Last used URB ID
+}
+
+// UsbCapturePcapngPath returns path to the pcapng capture file
+// for the device
+func UsbCapturePcapngPath(info UsbDeviceInfo) string {
+	return filepath.Join(PathLogDir, info.Ident()+".pcapng")
+}
+
+// newUsbPcapngWriter creates a new pcapng file and writes its header
+func newUsbPcapngWriter(path string) (*usbPcapngWriter, error) {
+	MakeParentDirectory(path)
+	file, err := os.OpenFile(path,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &usbPcapngWriter{
+		file: file,
+		out:  bufio.NewWriter(file),
+	}
+
+	// Section Header Block
+	var shb [16]byte
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // Major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // Minor version
+	binary.LittleEndian.PutUint64(shb[8:], pcapngSectionLen)
+	w.block(pcapngBlockSHB, shb[:])
+
+	// Interface Description Block
+	var idb [8]byte
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeUsbLinux)
+	binary.LittleEndian.PutUint32(idb[4:], pcapngUsbSnapLen)
+	w.block(pcapngBlockIDB, idb[:])
+
+	err = w.out.Flush()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// submit writes the URB submission event and returns URB ID
+// for the subsequent done call. For host to device transfers
+// data is the data being sent, for device to host transfers
+// data is the receive buffer and is not written
+func (w *usbPcapngWriter) submit(addr UsbIfAddr, in bool,
+	data []byte) uint64 {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.urbid++
+	if in {
+		w.event(w.urbid, pcapngUsbEvntSubmit, addr, in,
+			pcapngUsbInProgress, len(data), nil)
+	} else {
+		w.event(w.urbid, pcapngUsbEvntSubmit, addr, in,
+			pcapngUsbInProgress, len(data), data)
+	}
+
+	return w.urbid
+}
+
+// done writes the URB completion event. For device to host
+// transfers data is the received data, for host to device
+// transfers it is not written
+func (w *usbPcapngWriter) done(urbid uint64, addr UsbIfAddr, in bool,
+	data []byte, err error) {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	status := pcapngUsbErrNone
+	switch err {
+	case nil:
+	case context.DeadlineExceeded, context.Canceled:
+		status = pcapngUsbErrUnlink
+	default:
+		status = pcapngUsbErrIO
+	}
+
+	if in {
+		w.event(urbid, pcapngUsbEvntDone, addr, in,
+			status, len(data), data)
+	} else {
+		w.event(urbid, pcapngUsbEvntDone, addr, in,
+			status, len(data), nil)
+	}
+}
+
+// event writes an usbmon event as the Enhanced Packet Block.
+// Events are flushed immediately, so capture remains usable,
+// if program crashes or hangs
+//
+// Must be called under the lock
+func (w *usbPcapngWriter) event(urbid uint64, evnt byte, addr UsbIfAddr,
+	in bool, status, urblen int, data []byte) {
+
+	if w.file == nil {
+		return
+	}
+
+	now := time.Now()
+	usec := uint64(now.UnixNano() / int64(time.Microsecond))
+	caplen := pcapngUsbHdrLen + len(data)
+
+	pkt := make([]byte, 20+caplen)
+
+	// EPB header
+	binary.LittleEndian.PutUint32(pkt[0:], 0) // Interface ID
+	binary.LittleEndian.PutUint32(pkt[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(pkt[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(pkt[12:], uint32(caplen))
+	binary.LittleEndian.PutUint32(pkt[16:], uint32(caplen))
+
+	// usbmon pseudo-header
+	hdr := pkt[20 : 20+pcapngUsbHdrLen]
+	ep := byte(addr.Out)
+	if in {
+		ep = byte(addr.In) | pcapngUsbDirIn
+	}
+
+	flagData := byte(0)
+	if len(data) == 0 {
+		flagData = pcapngUsbNoData
+	}
+
+	binary.LittleEndian.PutUint64(hdr[0:], urbid)
+	hdr[8] = evnt
+	hdr[9] = pcapngUsbXferBulk
+	hdr[10] = ep
+	hdr[11] = byte(addr.Address)
+	binary.LittleEndian.PutUint16(hdr[12:], uint16(addr.Bus))
+	hdr[14] = pcapngUsbNoSetup
+	hdr[15] = flagData
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(int32(status)))
+	binary.LittleEndian.PutUint32(hdr[32:], uint32(urblen))
+	binary.LittleEndian.PutUint32(hdr[36:], uint32(len(data)))
+
+	copy(pkt[20+pcapngUsbHdrLen:], data)
+
+	w.block(pcapngBlockEPB, pkt)
+	w.out.Flush()
+}
+
+// block writes pcapng block. Body is padded to 32 bits
+func (w *usbPcapngWriter) block(btype uint32, body []byte) {
+	pad := (4 - len(body)%4) % 4
+	length := uint32(12 + len(body) + pad)
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:], btype)
+	binary.LittleEndian.PutUint32(hdr[4:], length)
+
+	w.out.Write(hdr[:])
+	w.out.Write(body)
+	w.out.Write(make([]byte, pad))
+	w.out.Write(hdr[4:])
+}
+
+// close closes the capture file
+func (w *usbPcapngWriter) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file != nil {
+		w.out.Flush()
+		w.file.Close()
+		w.file = nil
+	}
+}
@@ -0,0 +1,132 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Pipelined reading of large request bodies
+ */
+
+package main
+
+import (
+	"io"
+)
+
+// usbPipelinedBody wraps large request body and reads it ahead
+// in background, using double buffering. So the next chunk of
+// data is received from the client while the previous one is
+// in flight on USB.
+//
+// Without it, client and USB transfers alternate, and each of
+// them waits for another, which is noticeable on slow printers
+type usbPipelinedBody struct {
+	body    io.ReadCloser          // Underlying body
+	mem     *MemAcct               // Memory accounting
+	full    chan usbPipelinedChunk // Chunks, received from client
+	free    chan []byte            // Buffers, available for reading
+	done    chan struct{}          // Closed by Close
+	exited  chan struct{}          // Closed when reader exits
+	cur     usbPipelinedChunk      // Current chunk
+	curBuf  []byte                 // Buffer of the current chunk
+	curLeft []byte                 // Not consumed part of cur.data
+	closed  bool                   // Close has been called
+}
+
+// usbPipelinedChunk represents a chunk of data, received from
+// the client
+type usbPipelinedChunk struct {
+	data []byte // Received data
+	err  error  // Read error, if any
+}
+
+// newUsbPipelinedBody creates a new usbPipelinedBody and starts
+// reading in background
+func newUsbPipelinedBody(body io.ReadCloser, mem *MemAcct) *usbPipelinedBody {
+	pipe := &usbPipelinedBody{
+		body:   body,
+		mem:    mem,
+		full:   make(chan usbPipelinedChunk, UsbPipelineBuffers),
+		free:   make(chan []byte, UsbPipelineBuffers),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	for i := 0; i < UsbPipelineBuffers; i++ {
+		pipe.free <- make([]byte, UsbPipelineBufferSize)
+	}
+
+	mem.Add(MemBodies, UsbPipelineBuffers*UsbPipelineBufferSize)
+
+	go pipe.reader()
+
+	return pipe
+}
+
+// reader reads the underlying body in background
+func (pipe *usbPipelinedBody) reader() {
+	defer close(pipe.exited)
+
+	for {
+		var buf []byte
+		select {
+		case buf = <-pipe.free:
+		case <-pipe.done:
+			return
+		}
+
+		n, err := pipe.body.Read(buf)
+		chunk := usbPipelinedChunk{data: buf[:n], err: err}
+
+		select {
+		case pipe.full <- chunk:
+		case <-pipe.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read from usbPipelinedBody
+func (pipe *usbPipelinedBody) Read(buf []byte) (int, error) {
+	for len(pipe.curLeft) == 0 {
+		if pipe.cur.err != nil {
+			return 0, pipe.cur.err
+		}
+
+		// Return consumed buffer to the reader
+		if pipe.curBuf != nil {
+			pipe.free <- pipe.curBuf
+		}
+
+		pipe.cur = <-pipe.full
+		pipe.curBuf = pipe.cur.data[:cap(pipe.cur.data)]
+		pipe.curLeft = pipe.cur.data
+	}
+
+	n := copy(buf, pipe.curLeft)
+	pipe.curLeft = pipe.curLeft[n:]
+
+	return n, nil
+}
+
+// Close usbPipelinedBody
+//
+// Note, if background reader is waiting for data from the client,
+// Close waits until the wait is completed, so the underlying body
+// is never used after Close returns
+func (pipe *usbPipelinedBody) Close() error {
+	if pipe.closed {
+		return nil
+	}
+
+	pipe.closed = true
+	close(pipe.done)
+	<-pipe.exited
+
+	pipe.mem.Sub(MemBodies, UsbPipelineBuffers*UsbPipelineBufferSize)
+
+	return pipe.body.Close()
+}
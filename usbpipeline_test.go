@@ -0,0 +1,71 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Pipelined reading of large request bodies test
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// TestUsbPipelinedBody tests usbPipelinedBody
+func TestUsbPipelinedBody(t *testing.T) {
+	data := make([]byte, 5*UsbPipelineBufferSize+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	// Data must pass unchanged, regardless of how it is
+	// fragmented by the source
+	sources := []io.Reader{
+		bytes.NewReader(data),
+		iotest.HalfReader(bytes.NewReader(data)),
+		iotest.DataErrReader(bytes.NewReader(data)),
+	}
+
+	for i, src := range sources {
+		mem := &MemAcct{}
+		pipe := newUsbPipelinedBody(ioutil.NopCloser(src), mem)
+
+		out, err := ioutil.ReadAll(pipe)
+		if err != nil {
+			t.Errorf("%d: ReadAll: %s", i, err)
+		}
+
+		if !bytes.Equal(out, data) {
+			t.Errorf("%d: data mismatch", i)
+		}
+
+		pipe.Close()
+		if mem.Total() != 0 {
+			t.Errorf("%d: %d bytes not released", i, mem.Total())
+		}
+	}
+
+	// Close in a middle of reading must stop background reader
+	mem := &MemAcct{}
+	pipe := newUsbPipelinedBody(ioutil.NopCloser(bytes.NewReader(data)),
+		mem)
+
+	buf := make([]byte, 100)
+	pipe.Read(buf)
+	pipe.Close()
+
+	select {
+	case <-pipe.exited:
+	default:
+		t.Errorf("background reader not stopped")
+	}
+
+	if mem.Total() != 0 {
+		t.Errorf("%d bytes not released", mem.Total())
+	}
+}
@@ -0,0 +1,95 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB autosuspend management
+ */
+
+package main
+
+// usbPowerSysfsDir is the sysfs directory with USB devices,
+// used for autosuspend management on Linux
+var usbPowerSysfsDir = "/sys/bus/usb/devices"
+
+// usbPower manages the USB autosuspend of the device
+//
+// If enabled by quirks, device is allowed to autosuspend, while
+// idle, and held awake, while any of its connections is in use
+// (i.e., job or scan is in flight). Otherwise, power management
+// of the device is not touched at all
+//
+// Kernel doesn't suspend device, while its usbfs file is opened,
+// unless it is explicitly allowed with USBDEVFS_ALLOW_SUSPEND, so
+// both the sysfs power/control setting and the usbfs file are
+// managed
+//
+// The original setting is restored when device is closed
+type usbPower struct {
+	log   *Logger // Device's logger
+	addr  UsbAddr // USB address of the device
+	path  string  // USB path of the device
+	saved string  // Saved setting, "" if not managed
+	busy  bool    // Device is held awake
+}
+
+// newUsbPower creates a new usbPower and allows device to
+// autosuspend, if enabled. If autosuspend cannot be managed
+// on this platform, usbPower does nothing
+func newUsbPower(log *Logger, addr UsbAddr, path string,
+	auto bool) *usbPower {
+
+	power := &usbPower{log: log, addr: addr, path: path}
+
+	if !auto || path == "" {
+		return power
+	}
+
+	saved, err := usbPowerControlGet(path)
+	if err != nil {
+		log.Debug(' ', "USB: autosuspend not managed: %s", err)
+		return power
+	}
+
+	power.saved = saved
+	power.set()
+
+	return power
+}
+
+// Busy notifies usbPower that device becomes busy or idle
+func (power *usbPower) Busy(busy bool) {
+	if power.busy != busy {
+		power.busy = busy
+		power.set()
+	}
+}
+
+// Close restores the original setting
+func (power *usbPower) Close() {
+	if power.saved != "" {
+		usbPowerControlSet(power.path, power.saved)
+		power.saved = ""
+	}
+}
+
+// set updates the device power control setting
+func (power *usbPower) set() {
+	if power.saved == "" {
+		return
+	}
+
+	value := "auto"
+	if power.busy {
+		value = "on"
+	}
+
+	err := usbPowerControlSet(power.path, value)
+	if err == nil {
+		err = usbPowerSuspendAllow(power.addr, !power.busy)
+	}
+
+	if err != nil {
+		power.log.Debug(' ', "USB: autosuspend: %s", err)
+	}
+}
@@ -0,0 +1,93 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB autosuspend management -- Linux version
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// usbfs ioctls for the runtime power management, from
+// <linux/usbdevice_fs.h>. Defined here, because older
+// kernel headers don't have them
+const (
+	usbdevfsForbidSuspend = 0x5521 // _IO('U', 33)
+	usbdevfsAllowSuspend  = 0x5522 // _IO('U', 34)
+)
+
+// usbPowerControlGet returns current power/control setting
+// of the device ("auto" or "on")
+func usbPowerControlGet(path string) (string, error) {
+	data, err := ioutil.ReadFile(usbPowerControlPath(path))
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(data)), nil
+}
+
+// usbPowerControlSet sets power/control setting of the device
+func usbPowerControlSet(path, value string) error {
+	return ioutil.WriteFile(usbPowerControlPath(path),
+		[]byte(value), 0644)
+}
+
+// usbPowerControlPath returns path to the sysfs power/control
+// file of the device
+func usbPowerControlPath(path string) string {
+	return filepath.Join(usbPowerSysfsDir, path, "power", "control")
+}
+
+// usbPowerSuspendAllow allows or forbids the kernel to suspend the
+// device, while its usbfs file, opened by libusb, remains open
+func usbPowerSuspendAllow(addr UsbAddr, allow bool) error {
+	fd, err := usbPowerUsbfsFd(addr)
+	if err != nil {
+		return err
+	}
+
+	rq := uintptr(usbdevfsForbidSuspend)
+	if allow {
+		rq = usbdevfsAllowSuspend
+	}
+
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), rq, 0)
+	if e != 0 {
+		return fmt.Errorf("usbfs ioctl: %s", e)
+	}
+
+	return nil
+}
+
+// usbPowerUsbfsFd finds the file descriptor of the device's usbfs
+// file. libusb doesn't expose it, so it is looked up among file
+// descriptors of our process
+func usbPowerUsbfsFd(addr UsbAddr) (int, error) {
+	dev := fmt.Sprintf("/dev/bus/usb/%3.3d/%3.3d", addr.Bus, addr.Address)
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1, err
+	}
+
+	for _, fd := range fds {
+		target, _ := os.Readlink(filepath.Join("/proc/self/fd",
+			fd.Name()))
+		if target == dev {
+			return strconv.Atoi(fd.Name())
+		}
+	}
+
+	return -1, fmt.Errorf("%s: not opened", dev)
+}
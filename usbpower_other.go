@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB autosuspend management -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+import (
+	"errors"
+)
+
+// usbPowerControlGet returns current power/control setting
+// of the device
+//
+// Autosuspend is controlled via Linux sysfs. There is nothing
+// similar on other platforms
+func usbPowerControlGet(path string) (string, error) {
+	return "", errors.New("not available on this platform")
+}
+
+// usbPowerControlSet sets power/control setting of the device
+func usbPowerControlSet(path, value string) error {
+	return errors.New("not available on this platform")
+}
+
+// usbPowerSuspendAllow allows or forbids the kernel to suspend
+// the device
+func usbPowerSuspendAllow(addr UsbAddr, allow bool) error {
+	return errors.New("not available on this platform")
+}
@@ -0,0 +1,108 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB autosuspend management tests
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestUsbPower tests USB autosuspend management
+func TestUsbPower(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sysfs is Linux-only")
+	}
+
+	dir := t.TempDir()
+
+	saveUsbPowerSysfsDir := usbPowerSysfsDir
+	usbPowerSysfsDir = dir
+	defer func() { usbPowerSysfsDir = saveUsbPowerSysfsDir }()
+
+	const path = "1-2"
+	control := filepath.Join(dir, path, "power", "control")
+	os.MkdirAll(filepath.Dir(control), 0755)
+	ioutil.WriteFile(control, []byte("on\n"), 0644)
+
+	check := func(when, expected string) {
+		data, _ := ioutil.ReadFile(control)
+		if string(data) != expected {
+			t.Errorf("%s: power/control is %q, expected %q",
+				when, data, expected)
+		}
+	}
+
+	// Autosuspend is disabled by default, so enable it
+	usbEmuWithQuirks(t, `
+[*]
+  usb-autosuspend = true
+`)
+
+	// Setup the transport
+	testConf(t)
+
+	emu := NewUsbEmulator(UsbEmuConfig{})
+	desc := emu.Desc()
+	desc.Path = path
+
+	transport, err := NewUsbTransportDev(desc, emu)
+	if err != nil {
+		t.Fatalf("NewUsbTransportDev: %s", err)
+	}
+
+	check("idle", "auto")
+
+	// Device is held awake while connection is in use
+	conn, err := transport.usbConnGet(context.Background(), 1, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	check("busy", "on")
+	conn.put()
+	check("released", "auto")
+
+	// Original setting is restored on close
+	transport.Close(false)
+	check("closed", "on")
+}
+
+// TestUsbPowerDisabled tests that device power management is not
+// touched, if autosuspend is not enabled
+func TestUsbPowerDisabled(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sysfs is Linux-only")
+	}
+
+	dir := t.TempDir()
+
+	saveUsbPowerSysfsDir := usbPowerSysfsDir
+	usbPowerSysfsDir = dir
+	defer func() { usbPowerSysfsDir = saveUsbPowerSysfsDir }()
+
+	const path = "1-2"
+	control := filepath.Join(dir, path, "power", "control")
+	os.MkdirAll(filepath.Dir(control), 0755)
+	ioutil.WriteFile(control, []byte("auto\n"), 0644)
+
+	log := NewLogger()
+	power := newUsbPower(log, UsbAddr{1, 2}, path, false)
+	power.Busy(true)
+	power.Busy(false)
+	power.Close()
+
+	data, _ := ioutil.ReadFile(control)
+	if string(data) != "auto\n" {
+		t.Errorf("power/control modified: %q", data)
+	}
+}
@@ -0,0 +1,324 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB traffic replay
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// UsbReplay implements UsbDevice, that plays back the device
+// side of the recorded USB capture.
+//
+// The capture is split into exchanges: the sequence of transfers
+// from host to device (request), followed by transfers from device
+// to host (response). Exchanges are replayed in the recorded order,
+// regardless of the interface they were recorded on, as the proxy
+// may distribute requests between interfaces differently.
+//
+// Data, sent by host, is not compared against the recorded data;
+// it only drives the replay forward.
+type UsbReplay struct {
+	// Hangup, if set, makes device to look disconnected, when
+	// recorded response is exhausted, instead of silent waiting.
+	// It saves a time on request timeouts, when the capture is
+	// known to be incomplete (i.e., in fuzz tests)
+	Hangup bool
+
+	capture   *UsbCapture                 // Loaded capture
+	lock      sync.Mutex                  // Access lock
+	exchanges []*usbReplayExchange        // Not yet replayed exchanges
+	ifaces    map[int]*usbReplayInterface // Opened interfaces
+	closed    bool                        // Device is closed
+}
+
+// usbReplayExchange represents a single recorded exchange
+type usbReplayExchange struct {
+	evnts []UsbCaptureEvent // Device side of exchange ('<' and '!')
+}
+
+// NewUsbReplay creates a new UsbReplay
+func NewUsbReplay(capture *UsbCapture) *UsbReplay {
+	replay := &UsbReplay{
+		capture: capture,
+		ifaces:  make(map[int]*usbReplayInterface),
+	}
+
+	// Split events into exchanges, per interface. Exchanges
+	// are ordered by time of the first request transfer
+	type started struct {
+		exchange *usbReplayExchange
+		sending  bool
+	}
+
+	current := make(map[int]*started)
+
+	for _, evnt := range capture.Events {
+		cur := current[evnt.IfNum]
+
+		if evnt.Dir == '>' {
+			if cur == nil || !cur.sending {
+				cur = &started{&usbReplayExchange{}, true}
+				current[evnt.IfNum] = cur
+				replay.exchanges = append(replay.exchanges,
+					cur.exchange)
+			}
+			continue
+		}
+
+		if cur == nil {
+			// Device sent something without request. Ignore it.
+			continue
+		}
+
+		cur.sending = false
+		cur.exchange.evnts = append(cur.exchange.evnts, evnt)
+	}
+
+	return replay
+}
+
+// Desc returns UsbDeviceDesc of the replayed device
+func (replay *UsbReplay) Desc() UsbDeviceDesc {
+	info := replay.capture.Info
+	addr := UsbAddr{Bus: 0, Address: 1}
+	desc := UsbDeviceDesc{
+		UsbAddr: addr,
+		Vendor:  info.Vendor,
+		Product: info.Product,
+		Release: info.Release,
+		Config:  1,
+	}
+
+	for i := 0; i < replay.capture.Interfaces; i++ {
+		desc.IfDescs = append(desc.IfDescs, UsbIfDesc{
+			Vendor:   info.Vendor,
+			Product:  info.Product,
+			Config:   1,
+			IfNum:    i,
+			Class:    7,
+			SubClass: 1,
+			Proto:    4,
+		})
+
+		desc.IfAddrs.Add(UsbIfAddr{UsbAddr: addr, Num: i})
+	}
+
+	return desc
+}
+
+// Configure sets device configuration. It implements UsbDevice interface
+func (replay *UsbReplay) Configure(desc UsbDeviceDesc,
+	quirks *Quirks) error {
+
+	return nil
+}
+
+// Close the device. It implements UsbDevice interface
+func (replay *UsbReplay) Close() {
+	replay.lock.Lock()
+	replay.closed = true
+	for _, iface := range replay.ifaces {
+		iface.shutdown()
+	}
+	replay.lock.Unlock()
+}
+
+// Reset performs the device hard reset. It implements UsbDevice interface
+func (replay *UsbReplay) Reset() {
+}
+
+// UsbDeviceInfo returns device information. It implements UsbDevice
+// interface
+func (replay *UsbReplay) UsbDeviceInfo() (UsbDeviceInfo, error) {
+	return replay.capture.Info, nil
+}
+
+// OpenUsbInterface opens an interface. It implements UsbDevice interface
+func (replay *UsbReplay) OpenUsbInterface(addr UsbIfAddr,
+	quirks *Quirks) (UsbInterfaceIO, error) {
+
+	replay.lock.Lock()
+	defer replay.lock.Unlock()
+
+	if replay.closed {
+		return nil, UsbError{"libusb_claim_interface", UsbENoDev}
+	}
+
+	iface := &usbReplayInterface{
+		replay: replay,
+		done:   make(chan struct{}),
+	}
+	replay.ifaces[addr.Num] = iface
+
+	return iface, nil
+}
+
+// next returns next exchange to be replayed, nil if none left
+func (replay *UsbReplay) next() *usbReplayExchange {
+	replay.lock.Lock()
+	defer replay.lock.Unlock()
+
+	if len(replay.exchanges) == 0 {
+		return nil
+	}
+
+	exchange := replay.exchanges[0]
+	replay.exchanges = replay.exchanges[1:]
+
+	return exchange
+}
+
+// usbReplayInterface represents an opened interface of UsbReplay
+type usbReplayInterface struct {
+	replay    *UsbReplay         // Device that owns the interface
+	exchange  *usbReplayExchange // Current exchange, nil if none
+	receiving bool               // Host started to receive response
+	pending   []byte             // Not yet received part of transfer
+	done      chan struct{}      // Closed when interface is closed
+	once      sync.Once          // For shutdown
+}
+
+// Close the interface. It implements UsbInterfaceIO interface
+func (iface *usbReplayInterface) Close() {
+	iface.shutdown()
+}
+
+// shutdown wakes up all waiters
+func (iface *usbReplayInterface) shutdown() {
+	iface.once.Do(func() { close(iface.done) })
+}
+
+// SoftReset performs interface soft reset. It implements
+// UsbInterfaceIO interface
+func (iface *usbReplayInterface) SoftReset() error {
+	iface.exchange = nil
+	iface.pending = nil
+	return nil
+}
+
+// Send data to interface. It implements UsbInterfaceIO interface
+//
+// The first transfer after response starts the next exchange
+func (iface *usbReplayInterface) Send(ctx context.Context,
+	data []byte) (int, error) {
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	if iface.exchange == nil || iface.receiving {
+		iface.exchange = iface.replay.next()
+		iface.receiving = false
+		iface.pending = nil
+	}
+
+	return len(data), nil
+}
+
+// Recv data from interface. It implements UsbInterfaceIO interface
+//
+// When recorded response is exhausted, it waits, like silent
+// device does
+func (iface *usbReplayInterface) Recv(ctx context.Context,
+	data []byte) (int, error) {
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	iface.receiving = true
+
+	if len(iface.pending) == 0 && iface.exchange != nil &&
+		len(iface.exchange.evnts) != 0 {
+
+		evnt := iface.exchange.evnts[0]
+		iface.exchange.evnts = iface.exchange.evnts[1:]
+
+		switch {
+		case evnt.Dir == '!':
+			return iface.wait(ctx)
+
+		case len(evnt.Data) == 0:
+			return 0, nil
+		}
+
+		iface.pending = evnt.Data
+	}
+
+	if len(iface.pending) == 0 {
+		return iface.wait(ctx)
+	}
+
+	n := copy(data, iface.pending)
+	iface.pending = iface.pending[n:]
+
+	return n, nil
+}
+
+// wait waits until context expiration or interface close
+func (iface *usbReplayInterface) wait(ctx context.Context) (int, error) {
+	if iface.replay.Hangup {
+		return 0, UsbError{"libusb_submit_transfer", UsbENoDev}
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-iface.done:
+		return 0, UsbError{"libusb_submit_transfer", UsbENoDev}
+	}
+}
+
+// ClearHalt clears "halted" condition of either input or output
+// endpoint. It implements UsbInterfaceIO interface
+func (iface *usbReplayInterface) ClearHalt(in bool) error {
+	return nil
+}
+
+// ReplayRun loads USB capture and serves the replayed device
+// until terminating signal is received
+func ReplayRun(path string) error {
+	capture, err := UsbCaptureLoad(path)
+	if err != nil {
+		return err
+	}
+
+	replay := NewUsbReplay(capture)
+	desc := replay.Desc()
+
+	Log.Info(' ', "Replaying %s: %d transfers, %d exchanges",
+		path, len(capture.Events), len(replay.exchanges))
+
+	dev, err := NewDeviceDev(desc, replay)
+	StatusSet(desc.UsbAddr, desc, dev, err)
+
+	if err != nil {
+		return fmt.Errorf("replay: %s", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan,
+		os.Signal(syscall.SIGINT),
+		os.Signal(syscall.SIGTERM),
+		os.Signal(syscall.SIGHUP))
+	defer signal.Stop(sigChan)
+
+	sig := <-sigChan
+	Log.Info(' ', "%s signal received, exiting", sig)
+
+	dev.Close()
+	StatusDel(desc.UsbAddr)
+
+	return nil
+}
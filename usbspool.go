@@ -0,0 +1,62 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Spooling of large request bodies to disk
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// usbSpoolNeeded tells if request body of the specified length
+// needs to be spooled. Length of chunked body is -1
+func usbSpoolNeeded(length int64) bool {
+	return Conf.UsbSpoolThreshold > 0 &&
+		(length < 0 || length >= Conf.UsbSpoolThreshold)
+}
+
+// usbSpoolBody copies request body into the temporary file in
+// the Conf.UsbSpoolDir directory (or system temporary directory)
+// and returns the file, positioned to the beginning, and its size.
+//
+// The file is unlinked immediately after creation, so it disappears
+// when closed or if ipp-usb terminates.
+//
+// If file cannot be created, the returned error is wrapped into
+// the usbSpoolCreateError, so caller may continue without spooling
+func usbSpoolBody(body io.Reader) (*os.File, int64, error) {
+	file, err := ioutil.TempFile(Conf.UsbSpoolDir, "ipp-usb-spool-")
+	if err != nil {
+		return nil, 0, usbSpoolCreateError{err}
+	}
+
+	os.Remove(file.Name())
+
+	size, err := io.Copy(file, body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, size, nil
+}
+
+// usbSpoolCreateError represents failure to create spool file
+type usbSpoolCreateError struct {
+	err error // Underlying error
+}
+
+// Error returns error string. It implements error interface
+func (e usbSpoolCreateError) Error() string {
+	return "spool: " + e.err.Error()
+}
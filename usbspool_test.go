@@ -0,0 +1,114 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Spooling of large request bodies to disk test
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// TestUsbSpoolBody tests spooling of request body
+func TestUsbSpoolBody(t *testing.T) {
+	dir := testConf(t)
+
+	Conf.UsbSpoolDir = dir
+	Conf.UsbSpoolThreshold = 1000
+
+	tests := []struct {
+		length int64
+		needed bool
+	}{
+		{0, false},
+		{999, false},
+		{1000, true},
+		{-1, true},
+	}
+
+	for _, test := range tests {
+		if usbSpoolNeeded(test.length) != test.needed {
+			t.Errorf("usbSpoolNeeded(%d): expected %v",
+				test.length, test.needed)
+		}
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	file, size, err := usbSpoolBody(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("usbSpoolBody: %s", err)
+	}
+	defer file.Close()
+
+	if size != int64(len(data)) {
+		t.Errorf("size: expected %d, present %d", len(data), size)
+	}
+
+	out, _ := ioutil.ReadAll(file)
+	if !bytes.Equal(out, data) {
+		t.Errorf("data mismatch")
+	}
+
+	// Spool file must be unlinked
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spool file not unlinked")
+	}
+
+	// Inaccessible spool directory
+	Conf.UsbSpoolDir = dir + "/missed"
+	_, _, err = usbSpoolBody(bytes.NewReader(data))
+	if _, ok := err.(usbSpoolCreateError); !ok {
+		t.Errorf("usbSpoolCreateError expected, got %v", err)
+	}
+}
+
+// TestUsbSpoolTransport tests that spooled body is sent to
+// device with Content-Length
+func TestUsbSpoolTransport(t *testing.T) {
+	testConf(t)
+	Conf.UsbSpoolThreshold = 1000
+
+	var length int64
+	var received []byte
+
+	emu := NewUsbEmulator(UsbEmuConfig{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			rq *http.Request) {
+			length = rq.ContentLength
+			received, _ = ioutil.ReadAll(rq.Body)
+		}),
+	})
+
+	transport := usbEmuTestTransport(t, emu)
+	defer transport.Close(false)
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	client := &http.Client{Transport: transport}
+
+	// Body of unknown size, sent as chunked
+	rq, _ := http.NewRequest("POST", "http://localhost/",
+		ioutil.NopCloser(bytes.NewReader(data)))
+	rq.ContentLength = -1
+
+	resp, err := client.Do(rq)
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if length != int64(len(data)) {
+		t.Errorf("Content-Length: expected %d, present %d",
+			len(data), length)
+	}
+
+	if !bytes.Equal(received, data) {
+		t.Errorf("data mismatch")
+	}
+}
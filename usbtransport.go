@@ -12,35 +12,63 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"mime"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/OpenPrinting/goipp"
 )
 
+// UsbStallChan receives notifications when some device stalls
+// and requires reset (see UsbTransport.Stalled), or disconnects
+// (see UsbTransport.Disconnected)
+var UsbStallChan = make(chan struct{}, 1)
+
 // UsbTransport implements HTTP transport functionality over USB
 type UsbTransport struct {
-	addr           UsbAddr       // Device address
-	info           UsbDeviceInfo // USB device info
-	log            *Logger       // Device's own logger
-	dev            *UsbDevHandle // Underlying USB device
-	doneHardReset  bool          // True, if done hard reset
-	connPool       chan *usbConn // Pool of idle connections
-	connList       []*usbConn    // List of all connections
-	connReleased   chan struct{} // Signalled when connection released
-	shutdown       chan struct{} // Closed by Shutdown()
-	connstate      *usbConnState // Connections state tracker
-	quirks         *Quirks       // Device quirks
-	timeout        time.Duration // Timeout for requests (0 is none)
-	timeoutExpired uint32        // Atomic non-zero, if timeout expired
+	addr           UsbAddr          // Device address
+	info           UsbDeviceInfo    // USB device info
+	log            *Logger          // Device's own logger
+	dev            UsbDevice        // Underlying USB device
+	doneHardReset  bool             // True, if done hard reset
+	connLock       sync.Mutex       // Protects connIdle and connQueue
+	connIdle       []*usbConn       // Idle connections
+	connQueue      []*usbConnWaiter // Requests, waiting for connection
+	connQueueMax   int              // Max len(connQueue), 0 if unlimited
+	connQueueWait  time.Duration    // Max wait in connQueue, 0 if unlimited
+	connList       []*usbConn       // List of all connections
+	power          *usbPower        // Autosuspend management
+	connReleased   chan struct{}    // Signalled when connection released
+	shutdown       chan struct{}    // Closed by Shutdown()
+	connstate      *usbConnState    // Connections state tracker
+	quirks         *Quirks          // Device quirks
+	timeout        time.Duration    // Timeout for requests (0 is none)
+	timeoutExpired uint32           // Atomic non-zero, if timeout expired
+	stalled        uint32           // Atomic non-zero, if device stalled
+	disconnected   uint32           // Atomic non-zero, if device is gone
+	goneCtx        context.Context  // Canceled when device is gone
+	goneCancel     func()           // Cancels goneCtx
+	sessionID      int32            // Per-transport HTTP session counter
+	leaks          *LeakOwner       // Resources tracker, for leak check
+	httpLimit      *httpLimiter     // Concurrent HTTP requests limit
+	httpCache      *httpCache       // Capabilities cache, nil if none
+	hold           *usbHold         // Held print jobs
+	acl            ACL              // Allowed clients, nil if all
+	share          bool             // Device is shared on the network
+	upgrades       int32            // Atomic count of upgraded connections
+	failures       usbFailures      // Failures, for quirks suggestion
+	usbmon         *UsbMon          // usbmon cross-check, if enabled
+	mem            MemAcct          // Memory usage accounting
 }
 
 // NewUsbTransport creates new http.RoundTripper backed by IPP-over-USB
@@ -48,9 +76,24 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	// Open the device
 	dev, err := UsbOpenDevice(desc)
 	if err != nil {
+		if usberr, ok := err.(UsbError); ok && usberr.Code == UsbEAccess {
+			MACDiagnose(Log, fmt.Sprintf("/dev/bus/usb/%.3d/%.3d",
+				desc.Bus, desc.Address))
+		}
 		return nil, err
 	}
 
+	return NewUsbTransportDev(desc, dev)
+}
+
+// NewUsbTransportDev creates new http.RoundTripper on a top of
+// already opened UsbDevice. The transport takes ownership of
+// the device and closes it on error
+func NewUsbTransportDev(desc UsbDeviceDesc, dev UsbDevice) (
+	*UsbTransport, error) {
+
+	var err error
+
 	// Create UsbTransport
 	transport := &UsbTransport{
 		addr:         desc.UsbAddr,
@@ -60,6 +103,9 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		shutdown:     make(chan struct{}),
 	}
 
+	transport.goneCtx, transport.goneCancel =
+		context.WithCancel(context.Background())
+
 	// Setup logging.
 	//
 	// At this stage, device identification is not yet available,
@@ -73,6 +119,9 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	// all buffered logs will be flushed to the main log.
 	transport.log.Cc(Console)
 	transport.log.SetLevels(Conf.LogDevice)
+	if Conf.LogTraceBuffer > 0 {
+		transport.log.TraceRing(int(Conf.LogTraceBuffer))
+	}
 
 	defer func() {
 		if !transport.log.HasDestination() {
@@ -83,16 +132,18 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	}()
 
 	transport.log.Debug(' ', "===============================")
-	transport.log.Info('+', "Found new device. VID:PID = %4.4x:%4.4x",
-		desc.Vendor, desc.Product)
+	transport.log.Info('+',
+		"Found new device. VID:PID = %4.4x:%4.4x, release %s",
+		desc.Vendor, desc.Product, UsbReleaseString(desc.Release))
 
-	// Obtain quirks by HWID.
+	// Obtain quirks by USB path and HWID.
 	//
 	// Do it early, so we can reset the device before querying
 	// its UsbDeviceInfo. Some devices are not reliable on
 	// returning UsbDeviceInfo before reset.
 	quirks := NewQuirks()
-	quirks.PullByHWID(Conf.Quirks, desc.Vendor, desc.Product)
+	quirks.PullByPath(Conf.Quirks, desc.Path)
+	quirks.PullByHWID(Conf.Quirks, desc.Vendor, desc.Product, desc.Release)
 	quirks.WriteLog("HWID quirks", transport.log)
 	transport.log.Nl(LogDebug)
 
@@ -122,6 +173,18 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		if err == nil {
 			err = transport.info.CheckMissed()
 		}
+
+		// Some cheap devices don't have serial number at all.
+		// Accept them, if they can be identified by the USB
+		// port path
+		if err != nil && desc.Path != "" &&
+			transport.info.SerialNumber == "" &&
+			transport.info.Manufacturer != "" &&
+			transport.info.ProductName != "" {
+			transport.log.Debug(' ',
+				"No serial number, identified by USB port path")
+			err = nil
+		}
 	}
 
 	if err != nil {
@@ -129,6 +192,8 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		return nil, err
 	}
 
+	transport.info.PortPath = desc.Path
+
 	// Honor mfg and model parameters from the HWID quirks, if present.
 	if mfg := quirks.GetMfg(); mfg != "" {
 		transport.info.Manufacturer = mfg
@@ -144,21 +209,71 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	quirks.PullByModelName(Conf.Quirks, model)
 	transport.quirks = quirks
 
+	// Honor the ignore-serial quirk. Device will be identified
+	// by the USB port path
+	if quirks.GetIgnoreSerial() && transport.info.SerialNumber != "" {
+		transport.log.Debug(' ', "Serial number %q ignored",
+			transport.info.SerialNumber)
+		transport.info.SerialNumber = ""
+	}
+
+	// Identical devices share the same Ident, hence the same
+	// state and log files. Disambiguate by USB port path
+	if usbIdentClaim(transport.addr, &transport.info) {
+		transport.log.Info(' ', "%s: duplicate device, identified "+
+			"by USB port path %s", transport.addr, desc.Path)
+	}
+
 	transport.quirks.WriteLog("Device quirks", transport.log)
 	transport.log.Nl(LogDebug)
 
+	// Honor the usb-config quirk
+	if config := int(transport.quirks.GetUsbConfig()); config != 0 &&
+		config != desc.Config {
+		if desc.SelectConfig(config) {
+			transport.log.Debug(' ',
+				"usb-config = %d: configuration selected", config)
+		} else {
+			transport.log.Error('!',
+				"usb-config = %d: no IPP-over-USB interfaces", config)
+		}
+	}
+
+	// Order interfaces by preference, honoring the
+	// usb-interface-order quirk
+	desc.IfAddrs = desc.OrderIfAddrs(transport.quirks.GetUsbInterfaceOrder())
+
+	// Use the single alternate setting per interface, honoring
+	// the usb-alt-setting quirk
+	alt := transport.quirks.GetUsbAltSetting()
+	if alt >= 0 {
+		transport.log.Debug(' ', "usb-alt-setting = %d", alt)
+	}
+	desc.IfAddrs = desc.IfAddrs.SelectAlt(alt)
+
 	// Write device info to the log
-	transport.log.Begin().
+	log := transport.log.Begin().
 		Info('+', "%s: opened %s", transport.addr, transport.info.ProductName).
 		Debug(' ', "Device info:").
-		Debug(' ', "  USB Port:      %d", transport.info.PortNum).
-		Debug(' ', "  Ident:         %s", transport.info.Ident()).
+		Debug(' ', "  USB Port:      %d", transport.info.PortNum)
+
+	if desc.Path != "" {
+		log.Debug(' ', "  USB Path:      %s", desc.Path)
+	}
+
+	log.Debug(' ', "  Ident:         %s", transport.info.Ident()).
 		Debug(' ', "  Manufacturer:  %s", transport.info.Manufacturer).
 		Debug(' ', "  Product:       %s", transport.info.ProductName).
 		Debug(' ', "  SerialNumber:  %s", transport.info.SerialNumber).
-		Debug(' ', "  BasicCaps:     %s", transport.info.BasicCaps).
-		Nl(LogDebug).
-		Commit()
+		Debug(' ', "  Release:       %s",
+			UsbReleaseString(transport.info.Release)).
+		Debug(' ', "  BasicCaps:     %s", transport.info.BasicCaps)
+
+	if transport.info.Speed != UsbSpeedUnknown {
+		log.Debug(' ', "  Speed:         %s", transport.info.Speed)
+	}
+
+	log.Nl(LogDebug).Commit()
 
 	transport.dumpUSBparams(transport.log)
 	transport.log.Nl(LogDebug)
@@ -178,13 +293,47 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	}
 	transport.log.Nl(LogDebug)
 
-	// Finish with logging initialization
-	transport.log.ToDevFile(transport.info)
+	// Finish with logging initialization. If journal is
+	// not available, ToJournal leaves log without destination
+	if Conf.LogJournal {
+		transport.log.ToJournal(transport.info.Ident())
+	}
+
+	if !transport.log.HasDestination() {
+		transport.log.ToDevFile(transport.info)
+	}
+	transport.log.ToRemote()
 	transport.log.Flush()
 
-	// We will need this variable a dozen of lines later,
-	// but have to declare it now, so we can goto ERROR
+	// Start USB capture, if enabled
+	if Conf.UsbCapture || Conf.UsbCapturePcapng {
+		rec, err := newUsbRecorder(dev, transport.info,
+			len(desc.IfAddrs))
+		if err == nil {
+			transport.dev = rec
+			if rec.capture != nil {
+				transport.log.Info(' ', "USB capture: %s",
+					UsbCapturePath(transport.info))
+			}
+			if rec.pcapng != nil {
+				transport.log.Info(' ', "USB capture: %s",
+					UsbCapturePcapngPath(transport.info))
+			}
+		} else {
+			transport.log.Error('!', "USB capture: %s", err)
+		}
+	}
+
+	// Start usbmon cross-check for real devices, if enabled
+	if _, real := dev.(*UsbDevHandle); real {
+		transport.usbmon = UsbMonStart(transport.log, desc.UsbAddr)
+		UsbLogAttach(desc.UsbAddr, transport.log)
+	}
+
+	// We will need these variables a dozen of lines later,
+	// but have to declare them now, so we can goto ERROR
 	var maxconn uint
+	var reserved int
 
 	// The 'blacklist' and 'init-reset' quirks were already
 	// applied by HWID, but now we have loaded quirks by
@@ -204,7 +353,7 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	}
 
 	// Configure the device
-	err = dev.Configure(desc)
+	err = dev.Configure(desc, transport.quirks)
 	if err != nil {
 		goto ERROR
 	}
@@ -230,11 +379,56 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		}
 	}
 
-	transport.connPool = make(chan *usbConn, len(transport.connList))
 	transport.connstate = newUsbConnState(len(desc.IfAddrs))
 
-	for _, conn := range transport.connList {
-		transport.connPool <- conn
+	// Probe interfaces, if requested, and exclude broken ones
+	if timeout := transport.quirks.GetUsbProbeInterfaces(); timeout > 0 {
+		transport.probeConns(timeout)
+	}
+
+	// If there are enough connections, reserve one for the
+	// lightweight status queries, so long-running jobs, that
+	// occupy all other connections, don't block them.
+	//
+	// With only 2 connections, reservation would serialize all
+	// print and scan traffic on the remaining one, so it is
+	// done only with 3 or more connections
+	if len(transport.connList) >= 3 {
+		reserved = 1
+	}
+
+	for i, conn := range transport.connList {
+		conn.reserved = i >= len(transport.connList)-reserved
+	}
+
+	transport.connIdle = append([]*usbConn(nil), transport.connList...)
+	transport.power = newUsbPower(transport.log, transport.addr,
+		desc.Path, transport.quirks.GetUsbAutosuspend())
+
+	transport.leaks = NewLeakOwner(transport.addr.String())
+	transport.httpLimit = newHTTPLimiter(Conf.HTTPMaxSessions,
+		Conf.HTTPMaxQueue)
+	transport.httpCache = newHTTPCache(Conf.HTTPCacheTTL)
+	transport.hold = newUsbHold(transport)
+	transport.connQueueMax = int(Conf.UsbQueueMax)
+	transport.connQueueWait = Conf.UsbQueueWait
+	transport.acl = ACLLookup(desc, transport.info)
+	if transport.acl != nil {
+		transport.log.Debug(' ', "Allowed clients: %s", transport.acl)
+	}
+
+	if ShareLookup(desc, transport.info) {
+		if err := ShareCheck(); err != nil {
+			transport.log.Error('!', "Network sharing disabled: %s", err)
+		} else {
+			transport.share = true
+			transport.log.Info(' ', "Shared on the network")
+		}
+	}
+
+	// Start keep-alive probing of idle connections, if enabled
+	if interval := transport.quirks.GetUsbKeepalive(); interval > 0 {
+		go transport.keepalive(interval)
 	}
 
 	return transport, nil
@@ -245,7 +439,10 @@ ERROR:
 		conn.destroy()
 	}
 
-	dev.Close()
+	transport.dev.Close()
+	transport.usbmon.Close()
+	UsbLogDetach(desc.UsbAddr)
+	usbIdentRelease(transport.addr, transport.info)
 	return nil, err
 }
 
@@ -254,59 +451,26 @@ func (transport *UsbTransport) hardReset(reason string, force bool) {
 	if !transport.doneHardReset || force {
 		transport.log.Debug(' ', "Doing USB HARD RESET: %s", reason)
 		transport.dev.Reset()
+		transport.httpCache.invalidate()
 		transport.doneHardReset = true
 	}
 }
 
-// Dump USB stack parameters to the UsbTransport's log
-func (transport *UsbTransport) dumpUSBparams(log *Logger) {
-	const usbParamsDir = "/sys/module/usbcore/parameters"
-
-	// Obtain list of parameter names (file names)
-	dir, err := os.Open(usbParamsDir)
-	if err != nil {
-		return
-	}
-
-	files, err := dir.Readdirnames(-1)
-	dir.Close()
-	if err != nil {
-		return
-	}
-
-	sort.Strings(files)
-	if len(files) == 0 {
-		return
-	}
-
-	// Compute max width of parameter names
-	wid := 0
-	for _, file := range files {
-		if wid < len(file) {
-			wid = len(file)
-		}
-	}
-
-	wid++
-
-	// Write the table
-	log.Debug(' ', "USB stack parameters")
-
-	for _, file := range files {
-		p, _ := ioutil.ReadFile(usbParamsDir + "/" + file)
-		if p == nil {
-			p = []byte("-")
-		} else {
-			p = bytes.TrimSpace(p)
-		}
-
-		log.Debug(' ', "  %*s  %s", -wid, file+":", p)
-	}
-}
-
 // Get count of connections still in use
 func (transport *UsbTransport) connInUse() int {
-	return cap(transport.connPool) - len(transport.connPool)
+	transport.connLock.Lock()
+	n := len(transport.connList) - len(transport.connIdle)
+	transport.connLock.Unlock()
+	return n
+}
+
+// QueueDepth returns count of HTTP requests, waiting for
+// the USB connection
+func (transport *UsbTransport) QueueDepth() int {
+	transport.connLock.Lock()
+	n := len(transport.connQueue)
+	transport.connLock.Unlock()
+	return n
 }
 
 // SetTimeout sets the timeout for all subsequent requests.
@@ -326,6 +490,52 @@ func (transport *UsbTransport) TimeoutExpired() bool {
 	return atomic.LoadUint32(&transport.timeoutExpired) != 0
 }
 
+// Stalled returns true if device has stalled and needs to be
+// reset and reopened. Stalled transport refuses new requests
+func (transport *UsbTransport) Stalled() bool {
+	return atomic.LoadUint32(&transport.stalled) != 0
+}
+
+// stall marks transport as stalled and notifies PnP manager
+// via UsbStallChan
+func (transport *UsbTransport) stall() {
+	if atomic.CompareAndSwapUint32(&transport.stalled, 0, 1) {
+		transport.httpCache.invalidate()
+		select {
+		case UsbStallChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Disconnected returns true if device has disappeared from the bus
+// (i.e., unplugged) while being served
+func (transport *UsbTransport) Disconnected() bool {
+	return atomic.LoadUint32(&transport.disconnected) != 0
+}
+
+// disconnect marks transport as disconnected, when USB I/O fails
+// with the LIBUSB_ERROR_NO_DEVICE error.
+//
+// All in-flight transactions are aborted and all requests, waiting
+// for connection, are rejected, so clients get prompt response instead
+// of waiting for USB I/O timeout. PnP manager is notified via
+// UsbStallChan, and closes the device
+func (transport *UsbTransport) disconnect() {
+	if atomic.CompareAndSwapUint32(&transport.disconnected, 0, 1) {
+		transport.log.Error('-', "%s: %s: device disconnected",
+			transport.addr, transport.info.ProductName)
+
+		transport.goneCancel()
+		transport.httpCache.invalidate()
+
+		select {
+		case UsbStallChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // closeShutdownChan closes the transport.shutdown, which effectively
 // disables connections allocation (usbConnGet will return ErrShutdown)
 //
@@ -352,6 +562,15 @@ func (transport *UsbTransport) closeShutdownChan() {
 func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 	transport.closeShutdownChan()
 
+	// Wait for the released job being sent, so its connection
+	// is accounted below
+	err := transport.hold.wait(ctx)
+	if err != nil {
+		transport.log.Error('-', "%s: %s: shutdown timeout expired",
+			transport.addr, transport.info.ProductName)
+		return err
+	}
+
 	for {
 		n := transport.connInUse()
 		if n == 0 {
@@ -374,25 +593,160 @@ func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 }
 
 // Close the transport
+//
+// If device needs reset (connections still in use or reset is
+// requested), the IPP-over-USB class-specific SOFT_RESET is tried
+// first, because hard reset causes some devices to drop queued jobs.
+// Hard reset is used, if device is known to be hung or stalled, or
+// if SOFT_RESET doesn't help.
+//
+// Close doesn't wait forever: if connections are not released
+// after UsbCloseTimeout, device is hard-reset, and if it doesn't
+// help either, connections are abandoned, as in CloseForce
 func (transport *UsbTransport) Close(reset bool) {
-	// Reset the device, if required
-	if transport.connInUse() > 0 || reset {
+	// Reset the device, if required. Disconnected device
+	// cannot be reset
+	hardReset := false
+	if (transport.connInUse() > 0 || reset) && !transport.Disconnected() {
 		transport.log.Info('-', "%s: resetting %s",
 			transport.addr, transport.info.ProductName)
+
+		if transport.Stalled() || transport.TimeoutExpired() ||
+			!transport.softReset() {
+			transport.log.Debug(' ', "Doing USB HARD RESET")
+			transport.dev.Reset()
+			hardReset = true
+		}
+	}
+
+	// Wait until all connections become inactive. If they are
+	// not released in time, hard reset aborts pending transfers
+	ctx, cancel := context.WithTimeout(context.Background(),
+		UsbCloseTimeout)
+	err := transport.Shutdown(ctx)
+	cancel()
+
+	if err != nil && !hardReset && !transport.Disconnected() {
+		transport.log.Debug(' ', "Doing USB HARD RESET")
 		transport.dev.Reset()
+
+		ctx, cancel = context.WithTimeout(context.Background(),
+			UsbForceCloseTimeout)
+		err = transport.Shutdown(ctx)
+		cancel()
+	}
+
+	if err != nil {
+		transport.log.Error('-', "%s: %d connections abandoned",
+			transport.addr, transport.connInUse())
+	}
+
+	transport.release(err == nil)
+}
+
+// CloseForce closes the transport, when graceful shutdown has
+// failed, because some jobs refuse to finish.
+//
+// Unlike Close, it doesn't try SOFT_RESET. Device is hard-reset
+// at once, which aborts all pending transfers, and if connections are still
+// not released after UsbForceCloseTimeout, they are abandoned: the
+// USB device is left open and the transport closes without it.
+// It is only safe when the process is about to exit
+func (transport *UsbTransport) CloseForce() {
+	transport.closeShutdownChan()
+
+	n := transport.connInUse()
+	if n == 0 {
+		transport.Close(false)
+		return
+	}
+
+	transport.log.Info('-', "%s: forcing shutdown of %s, %d connections in use",
+		transport.addr, transport.info.ProductName, n)
+
+	transport.log.Debug(' ', "Doing USB HARD RESET")
+	transport.dev.Reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		UsbForceCloseTimeout)
+	err := transport.Shutdown(ctx)
+	cancel()
+
+	if err != nil {
+		transport.log.Error('-', "%s: %d connections abandoned",
+			transport.addr, transport.connInUse())
 	}
 
-	// Wait until all connections become inactive
-	transport.Shutdown(context.Background())
+	transport.release(err == nil)
+}
 
+// release releases resources, owned by the transport, after all
+// connections are released. If closeDev is false, connections and
+// the USB device are left open, because they are still in use
+func (transport *UsbTransport) release(closeDev bool) {
 	// Destroy all connections and close the USB device
-	for _, conn := range transport.connList {
-		conn.destroy()
+	if closeDev {
+		for _, conn := range transport.connList {
+			conn.destroy()
+		}
+	}
+
+	transport.power.Close()
+	if closeDev {
+		transport.dev.Close()
+	}
+	transport.usbmon.Close()
+	UsbLogDetach(transport.addr)
+	transport.hold.close()
+	transport.leaks.Close()
+	usbIdentRelease(transport.addr, transport.info)
+
+	if lines := transport.SuggestQuirks(); lines != nil {
+		log := transport.log.Begin()
+		log.Info('!', "%s: failures observed, suggested quirks:",
+			transport.addr)
+		for _, line := range lines {
+			log.Info(' ', "  %s", line)
+		}
+		log.Commit()
 	}
 
-	transport.dev.Close()
 	transport.log.Info('-', "%s: closed %s",
 		transport.addr, transport.info.ProductName)
+	transport.log.TraceRing(0)
+	transport.log.Sync()
+}
+
+// softReset performs SOFT_RESET of all interfaces and waits
+// until all connections are released. It returns false, if
+// hard reset is required
+func (transport *UsbTransport) softReset() bool {
+	transport.log.Debug(' ', "Doing USB SOFT_RESET")
+	transport.httpCache.invalidate()
+
+	for _, conn := range transport.connList {
+		err := conn.iface.SoftReset()
+		if err != nil {
+			transport.log.Info('?', "USB[%d]: SOFT_RESET: %s",
+				conn.index, err)
+			return false
+		}
+	}
+
+	timer := time.NewTimer(UsbSoftResetTimeout)
+	defer timer.Stop()
+
+	for transport.connInUse() > 0 {
+		select {
+		case <-transport.connReleased:
+		case <-timer.C:
+			transport.log.Info('?', "%s: connections not released "+
+				"after SOFT_RESET", transport.addr)
+			return false
+		}
+	}
+
+	return true
 }
 
 // Log returns device's own logger
@@ -411,22 +765,86 @@ func (transport *UsbTransport) Quirks() *Quirks {
 	return transport.quirks
 }
 
+// Shared tells if device is shared on the network
+func (transport *UsbTransport) Shared() bool {
+	return transport.share
+}
+
+// Mem returns device's memory usage accounting
+func (transport *UsbTransport) Mem() *MemAcct {
+	return &transport.mem
+}
+
 // RoundTrip implements http.RoundTripper interface
+//
+// If request Context was created by WithHTTPSession, the specified
+// session number is used, otherwise the new session is allocated
 func (transport *UsbTransport) RoundTrip(r *http.Request) (
 	*http.Response, error) {
-	session := int(atomic.AddInt32(&httpSessionID, 1)-1) % 1000
+	session, ok := r.Context().Value(usbSessionCtxKey{}).(int)
+	if !ok || session < 0 {
+		session = transport.NewSession()
+	}
 
 	return transport.RoundTripWithSession(session, r)
 }
 
+// usbSessionCtxKey is the context.Context key for the HTTP session
+// number, see WithHTTPSession
+type usbSessionCtxKey struct{}
+
+// WithHTTPSession returns a copy of the Context that makes
+// UsbTransport.RoundTrip to use the specified HTTP session number.
+//
+// It allows the http.Client user to tag its own log lines (i.e.,
+// IPP decode) with the same session, as lines of the transaction
+func WithHTTPSession(ctx context.Context, session int) context.Context {
+	return context.WithValue(ctx, usbSessionCtxKey{}, session)
+}
+
+// HTTPClientNewSession allocates a new HTTP session number, using
+// http.Client's Transport. It returns -1, if Transport doesn't
+// allocate sessions
+func HTTPClientNewSession(c *http.Client) int {
+	if t, ok := c.Transport.(interface{ NewSession() int }); ok {
+		return t.NewSession()
+	}
+	return -1
+}
+
+// NewSession allocates a new HTTP session number, used for logging.
+//
+// Session numbers are normally global, so they are unique across
+// devices. In deterministic logging mode they are counted per
+// transport, so they don't depend on activity of other devices
+func (transport *UsbTransport) NewSession() int {
+	counter := &httpSessionID
+	if Conf.LogDeterministic {
+		counter = &transport.sessionID
+	}
+
+	return int(atomic.AddInt32(counter, 1)-1) % 1000
+}
+
 // RoundTripWithSession executes a single HTTP transaction, returning
 // a Response for the provided Request. Session number, for logging,
 // provided as a separate parameter
 func (transport *UsbTransport) RoundTripWithSession(session int,
 	rq *http.Request) (*http.Response, error) {
 
+	// Let usbHold handle requests, related to print jobs
+	if transport.hold.active(rq) {
+		return transport.hold.RoundTripWithSession(session, rq)
+	}
+
 	// Log the request
 	transport.log.HTTPRqParams(LogDebug, '>', session, rq)
+	timing := &usbTiming{
+		start:       time.Now(),
+		method:      rq.Method,
+		target:      rq.URL.RequestURI(),
+		traceparent: rq.Header.Get("Traceparent"),
+	}
 
 	// Prevent request from being canceled from outside
 	// We cannot do it on USB: closing USB connection
@@ -436,24 +854,22 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	outreq.Cancel = nil
 
 	// Remove Expect: 100-continue, if any
+	expect := strings.EqualFold(outreq.Header.Get("Expect"),
+		"100-continue")
 	outreq.Header.Del("Expect")
 
 	// Apply quirks
-	for name, value := range transport.quirks.HTTPHeaders {
-		if value != "" {
-			outreq.Header.Set(name, value)
-		} else {
-			outreq.Header.Del(name)
-		}
-	}
+	httpApplyHeaderRules(outreq.Header, transport.quirks.HTTPHeaders)
 
 	// Don't let Go's stdlib to add Connection: close header
 	// automatically
 	outreq.Close = false
 
-	// Add User-Agent, if missed. It is just cosmetic
+	// Add User-Agent, if missed. Empty value prevents Go's
+	// stdlib from adding its own User-Agent
 	if _, found := outreq.Header["User-Agent"]; !found {
-		outreq.Header["User-Agent"] = []string{"ipp-usb"}
+		outreq.Header["User-Agent"] = []string{
+			transport.quirks.GetUserAgent()}
 	}
 
 	// Wrap request body
@@ -467,12 +883,55 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 
 	// Prepare to correctly handle HTTP transaction, in a case
 	// client drops request in a middle of reading body
+	prefetched := 0
+	statusOp := goipp.Op(0)
+	var body []byte
+	var pipe *usbPipelinedBody
+	var spool *os.File
+
+	// Spool large body to disk, if configured, so slow client
+	// doesn't occupy USB connection while uploading
+	if outreq.Body != nil && usbSpoolNeeded(outreq.ContentLength) {
+		var size int64
+		var err error
+
+		spool, size, err = usbSpoolBody(outreq.Body)
+		switch err.(type) {
+		case nil:
+			outreq.Body.Close()
+			outreq.Body = spool
+			outreq.ContentLength = size
+
+			transport.log.HTTPDebug('>', session,
+				"body spooled to disk (%d bytes)", size)
+
+			if size == 0 {
+				spool.Close()
+				spool = nil
+				outreq.Body = nil
+			}
+
+		case usbSpoolCreateError:
+			transport.log.HTTPError('!', session,
+				"%s; sending without spooling", err)
+
+		default:
+			transport.log.HTTPError('!', session,
+				"spool: %s", err)
+			return nil, err
+		}
+	}
+
 	switch {
 	case outreq.ContentLength <= 0:
-		// Nothing to do
-		if outreq.ContentLength < 0 {
+		// Body is chunked or empty. Chunked body is read ahead,
+		// so client and USB transfers overlap
+		if outreq.ContentLength < 0 && outreq.Body != nil {
 			transport.log.HTTPDebug('>', session,
-				"body is chunked, sending as is")
+				"body is chunked, sending as is, pipelined")
+			pipe = newUsbPipelinedBody(outreq.Body,
+				&transport.mem)
+			outreq.Body = pipe
 		} else {
 			transport.log.HTTPDebug('>', session,
 				"body is empty, sending as is")
@@ -487,20 +946,34 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 		}
 
 		outreq.Body.Close()
-		outreq.Body = ioutil.NopCloser(buf)
+		body = buf.Bytes()
+		statusOp = usbPeekIppOp(outreq, body)
+
+		prefetched = buf.Cap()
+		transport.mem.Add(MemBodies, prefetched)
 
 		transport.log.HTTPDebug('>', session,
 			"body is small (%d bytes), prefetched before sending",
 			buf.Len())
 
+	case spool != nil:
+		// Body is spooled, so client can't drop request in
+		// a middle of reading body
+		transport.log.HTTPDebug('>', session,
+			"body is spooled (%d bytes), sending as is",
+			outreq.ContentLength)
+
 	default:
 		// Force chunked encoding, so if client drops request,
-		// we still be able to correctly handle HTTP transaction
+		// we still be able to correctly handle HTTP transaction.
+		// Body is read ahead, so client and USB transfers overlap
 		transport.log.HTTPDebug('>', session,
-			"body is large (%d bytes), sending as chunked",
+			"body is large (%d bytes), sending as chunked, pipelined",
 			outreq.ContentLength)
 
 		outreq.ContentLength = -1
+		pipe = newUsbPipelinedBody(outreq.Body, &transport.mem)
+		outreq.Body = pipe
 	}
 
 	// Log request details
@@ -509,12 +982,39 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 		Commit()
 
 	// Allocate USB connection
-	conn, err := transport.usbConnGet(rq.Context())
+	control := usbIsStatusQuery(outreq, statusOp)
+	if control {
+		transport.log.HTTPDebug(' ', session,
+			"status query, may use reserved connection")
+	}
+
+	// Idempotent requests are retried once after the transient
+	// USB error, so client doesn't see the error (CUPS disables
+	// the queue on it). Request body, if any, must be prefetched,
+	// so it can be resent
+	retry := usbIsIdempotent(outreq, statusOp) &&
+		(outreq.ContentLength == 0 || body != nil)
+
+RETRY:
+	if body != nil {
+		outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	conn, err := transport.usbConnGet(rq.Context(), session, control)
 	if err != nil {
+		transport.mem.Sub(MemBodies, prefetched)
+		if pipe != nil {
+			pipe.Close()
+		}
+		if spool != nil {
+			spool.Close()
+		}
 		return nil, err
 	}
 
 	transport.log.HTTPDebug(' ', session, "connection %d allocated", conn.index)
+	timing.queued = time.Now()
+	conn.timing = timing
 
 	// Make an inter-request (or initial) delay, if needed
 	if delay := conn.delayUntil.Sub(time.Now()); delay > 0 {
@@ -532,7 +1032,7 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	// not always used, so for simplicity I'd better initialize it
 	// to the dummy function rather that to compare it with nil
 	// every time it is called.
-	rwctx := context.Background()
+	rwctx := transport.goneCtx
 	cleanupCtx := context.CancelFunc(func() {})
 
 	if transport.timeout != 0 {
@@ -540,17 +1040,42 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 			transport.timeout)
 	}
 
-	conn.setRWCtx(rwctx)
+	conn.setRWCtx(conn.startWatchdog(rwctx))
 
 	// Send request and receive a response
 	err = outreq.Write(conn)
+	transport.mem.Sub(MemBodies, prefetched)
+	prefetched = 0
+
+	switch {
+	case err != nil && transport.Disconnected():
+		err = ErrUsbNoDevice
+	case err != nil && conn.TimedOut():
+		err = ErrUsbTimeout
+	case err != nil && conn.WatchdogFired():
+		err = ErrUsbWatchdog
+	}
+
+	if err != nil {
+		transport.countFailure(conn, err, expect)
+	}
+
+	if err != nil && retry && conn.retryable(err) {
+		retry = false
+		cleanupCtx()
+		goto RETRY
+	}
+
 	if err != nil {
 		transport.log.HTTPError('!', session, "%s", err)
+		timing.finish(transport.log, session, err.Error())
 		conn.put()
 		cleanupCtx()
 		return nil, err
 	}
 
+	timing.sent = time.Now()
+
 	resp, err := http.ReadResponse(conn.reader, outreq)
 	if err != nil {
 		// If the latest conn.Read has returned io.EOF, the only
@@ -565,21 +1090,58 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 			err = io.EOF
 		}
 
+		// The same for USB I/O timeout and watchdog, so HTTP
+		// proxy may report it as HTTP 504 Gateway Timeout, and
+		// for disconnected device (HTTP 502 Bad Gateway)
+		switch {
+		case transport.Disconnected():
+			err = ErrUsbNoDevice
+		case conn.TimedOut():
+			err = ErrUsbTimeout
+		case conn.WatchdogFired():
+			err = ErrUsbWatchdog
+		}
+
+		transport.countFailure(conn, err, expect)
+
+		if retry && conn.retryable(err) {
+			retry = false
+			cleanupCtx()
+			goto RETRY
+		}
+
 		transport.log.HTTPError('!', session, "%s", err)
+		timing.finish(transport.log, session, err.Error())
 		conn.put()
 		cleanupCtx()
 		return nil, err
 	}
 
-	// Wrap response body
-	resp.Body = &usbResponseBodyWrapper{
-		log:        transport.log,
-		session:    session,
-		body:       resp.Body,
-		conn:       conn,
-		cleanupCtx: cleanupCtx,
+	timing.code = resp.StatusCode
+
+	// Wrap response body. If device has switched protocols, as
+	// requested, the body becomes the upgraded connection
+	if resp.StatusCode == http.StatusSwitchingProtocols &&
+		outreq.Header.Get("Upgrade") != "" {
+		resp.Body.Close()
+		resp.Body = newUsbUpgradedBody(transport.log, session,
+			conn, timing, resp.Status)
+		cleanupCtx()
+	} else {
+		resp.Body = &usbResponseBodyWrapper{
+			log:        transport.log,
+			session:    session,
+			body:       resp.Body,
+			conn:       conn,
+			status:     resp.Status,
+			timing:     timing,
+			cleanupCtx: cleanupCtx,
+		}
 	}
 
+	// Apply response header quirks
+	httpApplyHeaderRules(resp.Header, transport.quirks.HTTPRspHdrs)
+
 	// Optionally sanitize IPP response
 	if transport.quirks.GetBuggyIppRsp() == QuirkBuggyIppRspSanitize &&
 		resp.Header.Get("Content-Type") == "application/ipp" {
@@ -597,6 +1159,35 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	return resp, nil
 }
 
+// countFailure updates statistics of the characteristic failures,
+// used to suggest quirks, after the failed HTTP transaction. expect
+// tells if request had Expect: 100-continue header
+func (transport *UsbTransport) countFailure(conn *usbConn, err error,
+	expect bool) {
+
+	switch {
+	case err == ErrUsbTimeout || err == ErrUsbWatchdog:
+		if expect {
+			atomic.AddInt32(&transport.failures.expectStalls, 1)
+		}
+
+	case err == io.EOF || err == ErrUsbNoDevice:
+	case conn.ioFailed || conn.rwctx.Err() != nil:
+
+	case conn.cntRecv != 0:
+		// Device has responded, but not with valid HTTP
+		atomic.AddInt32(&transport.failures.badHTTP, 1)
+	}
+}
+
+// SuggestQuirks returns quirks file snippet, that may help with
+// failures, observed on the device, line by line, or nil, if there
+// is nothing to suggest
+func (transport *UsbTransport) SuggestQuirks() []string {
+	return quirkSuggestFormat(transport.info.MakeAndModel(),
+		transport.failures.suggest(transport.quirks))
+}
+
 // sanitizeIppResponse attempts to sanitize IPP response from device
 func (transport *UsbTransport) sanitizeIppResponse(session int,
 	resp *http.Response) {
@@ -647,6 +1238,8 @@ func (transport *UsbTransport) sanitizeIppResponse(session int,
 REPLACE:
 	wrap := resp.Body.(*usbResponseBodyWrapper)
 	wrap.preBody = buf
+	wrap.preBodySize = buf.Cap()
+	transport.mem.Add(MemBodies, wrap.preBodySize)
 }
 
 // usbRequestBodyWrapper wraps http.Request.Body, adding
@@ -687,14 +1280,17 @@ func (wrap *usbRequestBodyWrapper) Close() error {
 // usbResponseBodyWrapper wraps http.Response.Body and guarantees
 // that connection will be always drained before closed
 type usbResponseBodyWrapper struct {
-	log        *Logger            // Device's logger
-	session    int                // HTTP session, for logging
-	preBody    *bytes.Buffer      // Data inserted before body, if not nil
-	body       io.ReadCloser      // Response.body
-	conn       *usbConn           // Underlying USB connection
-	count      int                // Total count of received bytes
-	drained    bool               // EOF or error has been seen
-	cleanupCtx context.CancelFunc // Cancel function for I/O Context
+	log         *Logger            // Device's logger
+	session     int                // HTTP session, for logging
+	preBody     *bytes.Buffer      // Data inserted before body, if not nil
+	preBodySize int                // preBody size, for memory accounting
+	body        io.ReadCloser      // Response.body
+	conn        *usbConn           // Underlying USB connection
+	count       int                // Total count of received bytes
+	drained     bool               // EOF or error has been seen
+	status      string             // Response status, for logging
+	timing      *usbTiming         // Transaction timing
+	cleanupCtx  context.CancelFunc // Cancel function for I/O Context
 }
 
 // Read from usbResponseBodyWrapper
@@ -710,6 +1306,7 @@ func (wrap *usbResponseBodyWrapper) Read(buf []byte) (int, error) {
 		wrap.log.HTTPDebug('<', wrap.session,
 			"response body: got %d bytes; %s", wrap.count, err)
 		wrap.drained = true
+		wrap.timing.received = time.Now()
 	}
 	return n, err
 }
@@ -724,7 +1321,11 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 
 	// Otherwise, we need to drain USB connection
 	wrap.log.HTTPDebug('<', wrap.session, "client has gone; draining response from USB")
+	leak := wrap.conn.transport.leaks.Track(LeakGoroutine,
+		fmt.Sprintf("HTTP[%3.3d] response drain", wrap.session))
+
 	go func() {
+		defer leak.Release()
 		defer func() {
 			v := recover()
 			if v != nil {
@@ -733,6 +1334,7 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 		}()
 
 		io.Copy(ioutil.Discard, wrap.body)
+		wrap.timing.drained = time.Now()
 		wrap.cleanup()
 	}()
 
@@ -743,6 +1345,8 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 // after use.
 func (wrap *usbResponseBodyWrapper) cleanup() {
 	wrap.body.Close()
+	wrap.timing.finish(wrap.log, wrap.session, wrap.status)
+	wrap.conn.transport.mem.Sub(MemBodies, wrap.preBodySize)
 	wrap.conn.put()
 
 	// Cleanup I/O context.Context, if any
@@ -753,39 +1357,258 @@ func (wrap *usbResponseBodyWrapper) cleanup() {
 	wrap.log.HTTPDebug('<', wrap.session, "done with response body")
 }
 
-// usbConn implements an USB connection
-type usbConn struct {
-	transport     *UsbTransport   // Transport that owns the connection
-	index         int             // Connection index (for logging)
-	iface         *UsbInterface   // Underlying interface
-	reader        *bufio.Reader   // For http.ReadResponse
-	rwctx         context.Context // For usbConn.Read and usbConn.Write
-	delayUntil    time.Time       // Delay till this time before next request
-	delayInterval time.Duration   // Pause between requests
-	cntRecv       int             // Total bytes received
-	cntSent       int             // Total bytes sent
-	eofSeen       bool            // Last usbConn.Read has returned io.EOF
+// usbUpgradedBody replaces http.Response.Body of the 101 Switching
+// Protocols response. Like in the net/http client, it implements
+// io.ReadWriteCloser and carries the upgraded protocol (i.e.,
+// WebSocket) over the USB connection, dedicated to it until closed.
+//
+// Close may be called concurrently with Read and Write, and aborts
+// them, like net.Conn.Close does
+type usbUpgradedBody struct {
+	log         *Logger            // Device's logger
+	session     int                // HTTP session, for logging
+	conn        *usbConn           // Underlying USB connection
+	status      string             // Response status, for logging
+	timing      *usbTiming         // Transaction timing
+	readTimeout time.Duration      // Saved conn.readTimeout
+	cancel      context.CancelFunc // Aborts USB I/O
+	lock        sync.RWMutex       // Read-locked by Read and Write
+	closed      bool               // Body is closed
 }
 
-// Open usbConn
-func (transport *UsbTransport) openUsbConn(
-	index int, ifaddr UsbIfAddr, quirks *Quirks) (*usbConn, error) {
+// newUsbUpgradedBody creates a new usbUpgradedBody
+func newUsbUpgradedBody(log *Logger, session int, conn *usbConn,
+	timing *usbTiming, status string) *usbUpgradedBody {
 
-	dev := transport.dev
+	transport := conn.transport
 
-	transport.log.Debug(' ', "USB[%d]: open: %s", index, ifaddr)
+	// Upgraded connection may remain idle for a long time,
+	// so neither watchdog nor read timeout are applicable
+	if conn.watchdogStop != nil {
+		conn.watchdogStop()
+		conn.watchdogStop = nil
+	}
 
-	// Initialize connection structure
-	conn := &usbConn{
-		transport:     transport,
-		index:         index,
-		delayUntil:    time.Now().Add(quirks.GetInitDelay()),
-		delayInterval: quirks.GetRequestDelay(),
+	ctx, cancel := context.WithCancel(transport.goneCtx)
+	conn.setRWCtx(ctx)
+
+	body := &usbUpgradedBody{
+		log:         log,
+		session:     session,
+		conn:        conn,
+		status:      status,
+		timing:      timing,
+		readTimeout: conn.readTimeout,
+		cancel:      cancel,
 	}
 
-	conn.reader = bufio.NewReader(conn)
+	conn.readTimeout = 0
 
-	// Obtain interface
+	// Abort I/O at transport shutdown, so upgraded connection
+	// doesn't block it forever
+	leak := transport.leaks.Track(LeakGoroutine,
+		fmt.Sprintf("HTTP[%3.3d] USB[%d] upgraded", session, conn.index))
+
+	go func() {
+		defer leak.Release()
+		select {
+		case <-transport.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	log.HTTPDebug(' ', session, "USB[%d]: connection upgraded", conn.index)
+
+	return body
+}
+
+// Read from usbUpgradedBody
+func (body *usbUpgradedBody) Read(buf []byte) (int, error) {
+	body.lock.RLock()
+	defer body.lock.RUnlock()
+
+	if body.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	return body.conn.reader.Read(buf)
+}
+
+// Write to usbUpgradedBody
+func (body *usbUpgradedBody) Write(buf []byte) (int, error) {
+	body.lock.RLock()
+	defer body.lock.RUnlock()
+
+	if body.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	return body.conn.Write(buf)
+}
+
+// Close usbUpgradedBody and release the USB connection
+func (body *usbUpgradedBody) Close() error {
+	// Abort pending I/O and wait until it returns
+	body.cancel()
+
+	body.lock.Lock()
+	defer body.lock.Unlock()
+
+	if body.closed {
+		return nil
+	}
+
+	body.closed = true
+
+	// Device doesn't know that upgraded protocol is done, and
+	// may still send its data. SOFT_RESET drops it, so the
+	// connection may be reused for HTTP
+	conn := body.conn
+	body.log.HTTPDebug(' ', body.session,
+		"USB[%d]: upgraded connection closed, doing SOFT_RESET",
+		conn.index)
+
+	err := conn.iface.SoftReset()
+	if err != nil {
+		body.log.Info('?', "USB[%d]: SOFT_RESET: %s", conn.index, err)
+	}
+
+	conn.readTimeout = body.readTimeout
+	body.timing.received = time.Now()
+	body.timing.finish(body.log, body.session, body.status)
+	conn.put()
+
+	return nil
+}
+
+// usbTiming records the lifecycle of the single HTTP transaction.
+// Unreached stages have zero time
+type usbTiming struct {
+	start       time.Time // Transaction started
+	queued      time.Time // USB connection allocated
+	sent        time.Time // Request sent
+	firstByte   time.Time // First byte of response received
+	received    time.Time // Response body received by client
+	drained     time.Time // Response body drained after client has gone
+	method      string    // HTTP request method
+	target      string    // HTTP request target (path and query)
+	traceparent string    // W3C traceparent request header, if any
+	code        int       // HTTP response status code, 0 if none
+}
+
+// finish is called when transaction is done. It writes the
+// timing summary to the log and exports it as OTLP spans,
+// if enabled
+func (timing *usbTiming) finish(log *Logger, session int, status string) {
+	timing.log(log, session, status)
+	OtlpExportTiming(timing, log.ident, session, status)
+}
+
+// log writes the timing summary as a single log line. Stages are
+// reported as time offsets from the transaction start.
+//
+// In deterministic logging mode all times are reported as zero
+func (timing *usbTiming) log(log *Logger, session int, status string) {
+	stage := func(name string, tm time.Time) string {
+		switch {
+		case tm.IsZero():
+			return name + "=-"
+		case Conf.LogDeterministic:
+			return name + "=0s"
+		}
+
+		return name + "=" + tm.Sub(timing.start).Round(time.Microsecond).String()
+	}
+
+	log.HTTPDebug(' ', session, "timing: %s %s %s %s %s; %s",
+		stage("queue-wait", timing.queued),
+		stage("write", timing.sent),
+		stage("first-byte", timing.firstByte),
+		stage("body", timing.received),
+		stage("drain", timing.drained),
+		status)
+}
+
+// usbConn implements an USB connection
+type usbConn struct {
+	transport     *UsbTransport   // Transport that owns the connection
+	index         int             // Connection index (for logging)
+	iface         UsbInterfaceIO  // Underlying interface
+	ifaddr        UsbIfAddr       // Interface address, for reopen
+	reader        *bufio.Reader   // For http.ReadResponse
+	rwctx         context.Context // For usbConn.Read and usbConn.Write
+	delayUntil    time.Time       // Delay till this time before next request
+	delayInterval time.Duration   // Pause between requests
+	cntRecv       int             // Total bytes received
+	cntSent       int             // Total bytes sent
+	eofSeen       bool            // Last usbConn.Read has returned io.EOF
+	timing        *usbTiming      // Timing of the current transaction
+	reserved      bool            // Reserved for status queries
+	session       int             // HTTP session, -1 if not allocated
+	readAlign     int             // Read buffer alignment
+	readTimeout   time.Duration   // Read timeout, 0 if none
+	writeTimeout  time.Duration   // Write timeout, 0 if none
+	timedOut      bool            // Read or Write has timed out
+	ioFailed      bool            // USB I/O error in this transaction
+	failures      int             // Subsequent failed transactions
+	watchdog      time.Duration   // Watchdog interval, 0 if disabled
+	watchdogStop  func()          // Stops watchdog, nil if not running
+	watchdogFired uint32          // Atomic non-zero, if watchdog fired
+	lastIO        int64           // Time of last I/O progress, atomic
+	pendingIO     int32           // Count of pending transfers, atomic
+	stats         *usbConnStats   // Cumulative statistics
+}
+
+// Open usbConn
+func (transport *UsbTransport) openUsbConn(
+	index int, ifaddr UsbIfAddr, quirks *Quirks) (*usbConn, error) {
+
+	dev := transport.dev
+
+	transport.log.Debug(' ', "USB[%d]: open: %s", index, ifaddr)
+
+	// Initialize connection structure
+	conn := &usbConn{
+		transport:     transport,
+		index:         index,
+		ifaddr:        ifaddr,
+		delayUntil:    time.Now().Add(quirks.GetInitDelay()),
+		delayInterval: quirks.GetRequestDelay(),
+		session:       -1,
+		readAlign:     int(quirks.GetUsbReadAlign()),
+		readTimeout:   quirks.GetUsbReadTimeout(),
+		writeTimeout:  quirks.GetUsbWriteTimeout(),
+		watchdog:      quirks.GetUsbWatchdog(),
+		lastIO:        time.Now().UnixNano(),
+		stats:         &usbConnStats{},
+	}
+
+	// Read buffer size must be multiple of alignment
+	if conn.readAlign == 0 {
+		conn.readAlign = 1
+	}
+
+	// SuperSpeed devices transfer data in bursts of up to 16
+	// 1024-byte packets, and small reads don't let them reach
+	// the full speed. So use larger buffer, unless usb-read-buffer
+	// is set explicitly
+	bufsize := int(quirks.GetUsbReadBuffer())
+	if transport.info.Speed.IsSuper() &&
+		quirks.IsDefault(QuirkNmUsbReadBuffer) {
+		bufsize = UsbSuperSpeedReadBuffer
+	}
+
+	bufsize += conn.readAlign - 1
+	bufsize -= bufsize % conn.readAlign
+
+	if bufsize == 0 {
+		bufsize = conn.readAlign
+	}
+
+	conn.reader = bufio.NewReaderSize(conn, bufsize)
+
+	// Obtain interface
 	var err error
 	conn.iface, err = dev.OpenUsbInterface(ifaddr, quirks)
 	if err != nil {
@@ -802,6 +1625,8 @@ func (transport *UsbTransport) openUsbConn(
 		}
 	}
 
+	transport.mem.Add(MemBuffers, conn.reader.Size())
+
 	return conn, nil
 
 	// Error: cleanup and exit
@@ -814,16 +1639,320 @@ ERROR:
 	return nil, err
 }
 
+// probeConns probes all opened connections and excludes connections
+// that don't respond.
+//
+// Some devices advertise more 7/1/4 interfaces than actually work.
+// Request, sent to the dead interface, hangs until timeout, and as
+// connections are chosen in the round-robin manner, this looks like
+// the intermittent request hangs.
+//
+// If all connections fail, they are kept as is: there is nothing
+// to choose from, and device initialization will report the problem
+func (transport *UsbTransport) probeConns(timeout time.Duration) {
+	var good, bad []*usbConn
+
+	for _, conn := range transport.connList {
+		err := conn.probe(timeout)
+		if err == nil {
+			transport.log.Debug(' ', "USB[%d]: probe OK", conn.index)
+			good = append(good, conn)
+		} else {
+			transport.log.Info('?', "USB[%d]: probe failed: %s",
+				conn.index, err)
+			bad = append(bad, conn)
+		}
+	}
+
+	// Probe failure is not a transaction timeout
+	atomic.StoreUint32(&transport.timeoutExpired, 0)
+
+	switch {
+	case len(bad) == 0:
+		return
+	case len(good) == 0:
+		transport.log.Info('?', "USB: all interfaces failed, using them anyway")
+		return
+	}
+
+	for _, conn := range bad {
+		transport.log.Info('!', "USB[%d]: interface excluded", conn.index)
+		conn.destroy()
+	}
+
+	transport.connList = good
+}
+
+// probe sends a lightweight OPTIONS request to the connection
+// and checks that device responds with something that looks like
+// HTTP response
+//
+// Probe is a request like any other, so it honors the initial and
+// inter-request delays
+func (conn *usbConn) probe(timeout time.Duration) error {
+	if delay := conn.delayUntil.Sub(time.Now()); delay > 0 {
+		conn.transport.log.Debug(' ', "USB[%d]: pausing for %s",
+			conn.index, delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn.setRWCtx(ctx)
+	defer conn.setRWCtx(context.Background())
+
+	defer func() {
+		conn.reader.Reset(conn)
+		conn.delayUntil = time.Now().Add(conn.delayInterval)
+		conn.cntRecv = 0
+		conn.cntSent = 0
+		conn.timedOut = false
+	}()
+
+	rq, _ := http.NewRequest("OPTIONS", "http://localhost/", nil)
+	rq.Header.Set("User-Agent", conn.transport.quirks.GetUserAgent())
+
+	err := rq.Write(conn)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(conn.reader, rq)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return err
+}
+
+// keepalive periodically probes connections, that were idle for
+// the keep-alive interval or longer, until transport is shut down.
+//
+// Some devices silently lose IPP-over-USB channel state after long
+// idle periods, and the first real request after that fails. If probe
+// fails, the channel is reinitialized with SOFT_RESET, and if it
+// doesn't help, the interface is reopened, so the next real request
+// finds device working. Other interfaces are not affected
+func (transport *UsbTransport) keepalive(interval time.Duration) {
+	timeout := UsbKeepaliveTimeout
+	if timeout > interval {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-transport.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		// Take idle connections one by one, so concurrent
+		// requests are not blocked by the probing
+		for range transport.connList {
+			conn := transport.keepaliveGet(interval)
+			if conn == nil {
+				break
+			}
+
+			transport.keepaliveProbe(conn, timeout)
+		}
+	}
+}
+
+// keepaliveGet takes the idle connection, that needs keep-alive
+// probe, or returns nil, if there is none or transport is shut down
+func (transport *UsbTransport) keepaliveGet(interval time.Duration) *usbConn {
+	transport.connLock.Lock()
+	defer transport.connLock.Unlock()
+
+	select {
+	case <-transport.shutdown:
+		return nil
+	default:
+	}
+
+	for i, conn := range transport.connIdle {
+		last := time.Unix(0, atomic.LoadInt64(&conn.lastIO))
+		if time.Since(last) >= interval {
+			idle := transport.connIdle
+			copy(idle[i:], idle[i+1:])
+			transport.connIdle = idle[:len(idle)-1]
+
+			// Hold device awake while connection is in use
+			transport.power.Busy(true)
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// keepaliveProbe probes the idle connection, taken by keepaliveGet,
+// reinitializes the channel, if probe fails, and releases the
+// connection
+func (transport *UsbTransport) keepaliveProbe(conn *usbConn,
+	timeout time.Duration) {
+
+	transport.log.Debug(' ', "USB[%d]: keep-alive probe", conn.index)
+
+	err := conn.probe(timeout)
+	if err != nil && !transport.Disconnected() {
+		transport.log.Info('?', "USB[%d]: keep-alive probe failed: %s",
+			conn.index, err)
+
+		transport.log.Debug(' ', "USB[%d]: doing SOFT_RESET", conn.index)
+		err = conn.iface.SoftReset()
+		if err == nil {
+			err = conn.probe(timeout)
+		}
+
+		if err != nil {
+			transport.log.Error('!', "USB[%d]: keep-alive: channel "+
+				"not recovered: %s", conn.index, err)
+			conn.reopen()
+		} else {
+			transport.log.Info('+', "USB[%d]: keep-alive: channel "+
+				"recovered", conn.index)
+		}
+	}
+
+	// Failed probe doesn't update conn.lastIO, so update
+	// it here, to avoid probing every tick
+	atomic.StoreInt64(&conn.lastIO, time.Now().UnixNano())
+	transport.connHandOver(conn)
+}
+
 // setRWCtx sets context.Context for subsequent Read and Write operations
 func (conn *usbConn) setRWCtx(ctx context.Context) {
 	conn.rwctx = ctx
 }
 
+// ioCtx returns context.Context for the single Read or Write
+// operation, limited by the specified I/O timeout (0 means none)
+func (conn *usbConn) ioCtx(timeout time.Duration) (context.Context,
+	context.CancelFunc) {
+
+	if timeout == 0 {
+		return conn.rwctx, func() {}
+	}
+
+	return context.WithTimeout(conn.rwctx, timeout)
+}
+
+// startWatchdog starts the transaction watchdog, if enabled.
+//
+// Watchdog aborts the transaction, if no data has been transferred
+// in either direction for the watchdog interval, by canceling the
+// returned Context, derived from ctx. Watchdog is stopped by
+// usbConn.put
+//
+// Only time, spent in pending USB transfers, is counted, so slow
+// HTTP client (i.e., slow upload of print data or slow reading of
+// the response) is not considered a device stall
+func (conn *usbConn) startWatchdog(ctx context.Context) context.Context {
+	atomic.StoreInt64(&conn.lastIO, time.Now().UnixNano())
+	if conn.watchdog == 0 {
+		return ctx
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	conn.watchdogStop = func() {
+		close(done)
+		cancel()
+	}
+
+	transport := conn.transport
+	session := conn.session
+	leak := transport.leaks.Track(LeakGoroutine,
+		fmt.Sprintf("HTTP[%3.3d] USB[%d] watchdog", session, conn.index))
+
+	go func() {
+		defer leak.Release()
+
+		ticker := time.NewTicker(conn.watchdog / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if atomic.LoadInt32(&conn.pendingIO) == 0 {
+				continue
+			}
+
+			last := atomic.LoadInt64(&conn.lastIO)
+			idle := time.Since(time.Unix(0, last))
+			if idle >= conn.watchdog {
+				transport.log.Begin().Session(session).
+					Error('!', "USB[%d]: watchdog: no data "+
+						"transferred for %s, aborting",
+						conn.index, idle.Round(time.Millisecond)).
+					Error('!', "USB[%d]: connections state: %s",
+						conn.index, transport.connstate).
+					Commit()
+
+				atomic.StoreUint32(&conn.watchdogFired, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return ctx
+}
+
+// beginIO notifies the connection, that USB transfer is started.
+// When the first transfer becomes pending, the watchdog idle
+// time starts counting from now
+func (conn *usbConn) beginIO() {
+	if atomic.AddInt32(&conn.pendingIO, 1) == 1 {
+		atomic.StoreInt64(&conn.lastIO, time.Now().UnixNano())
+	}
+}
+
+// doneIO notifies the connection, that USB transfer is done
+func (conn *usbConn) doneIO() {
+	atomic.AddInt32(&conn.pendingIO, -1)
+}
+
+// WatchdogFired reports if the current transaction has been
+// aborted by the watchdog
+func (conn *usbConn) WatchdogFired() bool {
+	return atomic.LoadUint32(&conn.watchdogFired) != 0
+}
+
+// checkIOTimeout checks if USB I/O error is caused by expiration
+// of the I/O timeout, rather that of the request timeout, and
+// sets conn.timedOut, if so
+func (conn *usbConn) checkIOTimeout(err error, timeout time.Duration) {
+	if err == context.DeadlineExceeded && conn.rwctx.Err() == nil {
+		conn.transport.log.Begin().Session(conn.session).
+			Error('!', "USB[%d]: device doesn't respond within %s",
+				conn.index, timeout).
+			Commit()
+		conn.timedOut = true
+	}
+}
+
 // Read from USB
 func (conn *usbConn) Read(b []byte) (int, error) {
 	conn.transport.connstate.beginRead(conn)
 	defer conn.transport.connstate.doneRead(conn)
 
+	conn.beginIO()
+	defer conn.doneIO()
+
 	// Drop conn.eofSeenn flag
 	conn.eofSeen = false
 
@@ -831,15 +1960,16 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 	// from libusb, input buffer size must always
 	// be aligned by 1024 bytes for USB 3.0, 512 bytes
 	// for USB 2.0, so 1024 bytes alignment is safe for
-	// both
+	// both. The alignment is configurable via the
+	// usb-read-align quirk
 	//
-	// However if caller requests less that 1024 bytes, we
+	// However if caller requests less that alignment, we
 	// can't align here simply by shrinking the buffer,
 	// because it will result a zero-size buffer. At
 	// this case we assume caller knows what it is
 	// doing (actually bufio never behaves this way)
-	if n := len(b); n >= 1024 {
-		n &= ^1023
+	if n := len(b); n >= conn.readAlign {
+		n -= n % conn.readAlign
 		b = b[0:n]
 	}
 
@@ -847,21 +1977,59 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 	zlpRecvHack := conn.transport.quirks.GetZlpRecvHack()
 	zlpRecv := false
 
-	// Setup deadline
+	// Setup deadline. Note, zero-size reads don't extend it
+	ctx, cancel := conn.ioCtx(conn.readTimeout)
+	defer cancel()
+
+	// Device, that persistently responds with zero-size
+	// reads, is considered stalled
+	stallReset := conn.transport.quirks.GetUsbStallReset()
+	stallStart := time.Now()
+
+	// ClearHalt recovery of zero-size reads, if enabled
+	clearHalt := conn.transport.quirks.GetUsbClearHalt()
+	clearHaltLimit := int(conn.transport.quirks.GetUsbClearHaltLimit())
+	zlpCount := 0
+
 	backoff := time.Millisecond * 10
 	for {
-		n, err := conn.iface.Recv(conn.rwctx, b)
+		n, err := conn.iface.Recv(ctx, b)
 		conn.cntRecv += n
+		atomic.AddInt64(&conn.stats.recv, int64(n))
+		if n != 0 {
+			atomic.StoreInt64(&conn.lastIO, time.Now().UnixNano())
+		}
 
-		conn.transport.log.Add(LogTraceHTTP, '<',
+		log := conn.transport.log.Begin().Session(conn.session)
+		log.Add(LogTraceHTTP, '<',
 			"USB[%d]: read: wanted %d got %d total %d",
 			conn.index, len(b), n, conn.cntRecv)
 
-		conn.transport.log.HexDump(LogTraceUSB, '<', b[:n])
+		log.HexDump(LogTraceUSB, '<', b[:n])
+
+		if n != 0 && conn.timing != nil && conn.timing.firstByte.IsZero() {
+			conn.timing.firstByte = time.Now()
+		}
+
+		if err == context.Canceled {
+			// I/O was aborted on purpose (i.e., upgraded
+			// connection is closed), it is not a device error
+			log.Debug(' ', "USB[%d]: recv: %s", conn.index, err)
+			log.Commit()
+			return n, err
+		}
 
 		if err != nil {
-			conn.transport.log.Error('!',
-				"USB[%d]: recv: %s", conn.index, err)
+			log.Error('!', "USB[%d]: recv: %s", conn.index, err)
+			log.Commit()
+
+			if _, ok := err.(UsbError); ok {
+				conn.ioFailed = true
+			}
+
+			if usbErrIsNoDev(err) {
+				conn.transport.disconnect()
+			}
 
 			if err == context.DeadlineExceeded {
 				// If we've got read timeout preceded
@@ -872,18 +2040,57 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 					return 0, io.EOF
 				}
 
+				conn.checkIOTimeout(err, conn.readTimeout)
 				atomic.StoreUint32(
 					&conn.transport.timeoutExpired, 1)
 			}
+
+			atomic.AddInt64(&conn.stats.errors, 1)
+			conn.transport.log.TraceDump("USB recv error")
+			return n, err
 		}
 
-		if n != 0 || err != nil {
+		if n != 0 {
+			log.Commit()
 			return n, err
 		}
 
 		zlpRecv = true
-		conn.transport.log.Debug(' ',
-			"USB[%d]: zero-size read", conn.index)
+		zlpCount++
+		if zlpCount == UsbClearHaltZlpCount {
+			atomic.AddInt32(&conn.transport.failures.zlpStorms, 1)
+		}
+		log.Debug(' ', "USB[%d]: zero-size read", conn.index)
+
+		if stall := time.Since(stallStart); stallReset != 0 &&
+			stall >= stallReset {
+			log.Error('!', "USB[%d]: device stalled for %s, reset requested",
+				conn.index, stall.Round(time.Second))
+			log.Commit()
+
+			conn.transport.stall()
+			conn.transport.log.TraceDump("USB stall")
+			return 0, ErrUsbStalled
+		}
+
+		if clearHalt != QuirkClearHaltNever &&
+			zlpCount%UsbClearHaltZlpCount == 0 {
+			attempt := zlpCount / UsbClearHaltZlpCount
+			if clearHaltLimit != 0 && attempt > clearHaltLimit {
+				log.Error('!', "USB[%d]: ClearHalt didn't help "+
+					"after %d attempts, reset requested",
+					conn.index, clearHaltLimit)
+				log.Commit()
+
+				conn.transport.stall()
+				conn.transport.log.TraceDump("USB stall")
+				return 0, ErrUsbStalled
+			}
+
+			conn.clearHalt(log, clearHalt)
+		}
+
+		log.Commit()
 
 		time.Sleep(backoff)
 		backoff += backoff / 4 // The same as backoff *= 1.25
@@ -893,68 +2100,446 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 	}
 }
 
+// clearHalt clears halted condition of the connection's endpoints,
+// according to the usb-clear-halt quirk
+func (conn *usbConn) clearHalt(log *LogMessage, policy QuirkClearHalt) {
+	log.Debug(' ', "USB[%d]: ClearHalt (%s)", conn.index, policy)
+
+	err := conn.iface.ClearHalt(true)
+	if err == nil && policy == QuirkClearHaltBoth {
+		err = conn.iface.ClearHalt(false)
+	}
+
+	if err != nil {
+		log.Error('!', "USB[%d]: ClearHalt: %s", conn.index, err)
+	}
+}
+
 // Write to USB
 func (conn *usbConn) Write(b []byte) (int, error) {
 	conn.transport.connstate.beginWrite(conn)
 	defer conn.transport.connstate.doneWrite(conn)
 
-	n, err := conn.iface.Send(conn.rwctx, b)
+	conn.beginIO()
+	defer conn.doneIO()
+
+	ctx, cancel := conn.ioCtx(conn.writeTimeout)
+	n, err := conn.iface.Send(ctx, b)
+	cancel()
 	conn.cntSent += n
+	atomic.AddInt64(&conn.stats.sent, int64(n))
+	if n != 0 {
+		atomic.StoreInt64(&conn.lastIO, time.Now().UnixNano())
+	}
 
-	conn.transport.log.Add(LogTraceHTTP, '>',
+	log := conn.transport.log.Begin().Session(conn.session)
+	log.Add(LogTraceHTTP, '>',
 		"USB[%d]: write: wanted %d sent %d total %d",
 		conn.index, len(b), n, conn.cntSent)
 
-	conn.transport.log.HexDump(LogTraceUSB, '>', b[:n])
+	log.HexDump(LogTraceUSB, '>', b[:n])
+
+	if err != nil {
+		log.Error('!', "USB[%d]: send: %s", conn.index, err)
+	}
+
+	log.Commit()
 
 	if err != nil {
-		conn.transport.log.Error('!',
-			"USB[%d]: send: %s", conn.index, err)
+		if _, ok := err.(UsbError); ok {
+			conn.ioFailed = true
+		}
+
+		if usbErrIsNoDev(err) {
+			conn.transport.disconnect()
+		}
 
 		if err == context.DeadlineExceeded {
+			conn.checkIOTimeout(err, conn.writeTimeout)
 			atomic.StoreUint32(
 				&conn.transport.timeoutExpired, 1)
 		}
+
+		atomic.AddInt64(&conn.stats.errors, 1)
+		conn.transport.log.TraceDump("USB send error")
 	}
 
 	return n, err
 }
 
+// usbErrIsNoDev tells if error is LIBUSB_ERROR_NO_DEVICE, that
+// means device has disappeared from the bus
+func usbErrIsNoDev(err error) bool {
+	usberr, ok := err.(UsbError)
+	return ok && usberr.Code == UsbENoDev
+}
+
 // EOFSeen reports of the latest usbConn.Read has returned io.EOF
 func (conn *usbConn) EOFSeen() bool {
 	return conn.eofSeen
 }
 
-// Allocate a connection
-func (transport *UsbTransport) usbConnGet(ctx context.Context) (*usbConn, error) {
-	select {
-	case <-transport.shutdown:
-		return nil, ErrShutdown
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case conn := <-transport.connPool:
-		transport.connstate.gotConn(conn)
-		transport.log.Debug(' ', "USB[%d]: connection allocated, %s",
-			conn.index, transport.connstate)
+// TimedOut reports if usbConn.Read or usbConn.Write has failed
+// due to the USB I/O timeout during the current transaction
+func (conn *usbConn) TimedOut() bool {
+	return conn.timedOut
+}
+
+// usbConnWaiter represents HTTP request, waiting in the
+// queue for the USB connection
+type usbConnWaiter struct {
+	control bool          // Status query, may use reserved connection
+	ready   chan *usbConn // Receives the allocated connection
+}
+
+// Allocate a connection for the HTTP session
+//
+// Status queries (control is true) may use the reserved
+// connection, other requests may not
+//
+// If there is no suitable idle connection, request waits in
+// the FIFO queue, so concurrent requests are served in order
+// of arrival and a burst of status queries cannot starve
+// the print job
+//
+// If queue is full, or request waits too long, ErrUsbBusy
+// is returned
+func (transport *UsbTransport) usbConnGet(ctx context.Context,
+	session int, control bool) (*usbConn, error) {
+
+	transport.connLock.Lock()
+	conn := transport.connIdleGet(control)
+	var waiter *usbConnWaiter
+	if conn != nil {
+		// Hold device awake while connection is in use
+		transport.power.Busy(true)
+	} else if transport.connQueueMax > 0 &&
+		len(transport.connQueue) >= transport.connQueueMax {
+		transport.connLock.Unlock()
+
+		transport.log.Begin().Session(session).
+			Debug(' ', "USB: queue is full, request rejected").
+			Commit()
+
+		return nil, ErrUsbBusy
+	} else {
+		waiter = &usbConnWaiter{
+			control: control,
+			ready:   make(chan *usbConn, 1),
+		}
+		transport.connQueue = append(transport.connQueue, waiter)
+	}
+	depth := len(transport.connQueue)
+	transport.connLock.Unlock()
+
+	if waiter != nil {
+		transport.log.Begin().Session(session).
+			Debug(' ', "USB: waiting for connection, %d in queue",
+				depth).
+			Commit()
+
+		var timeout <-chan time.Time
+		if transport.connQueueWait > 0 {
+			timer := time.NewTimer(transport.connQueueWait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case conn = <-waiter.ready:
+		case <-timeout:
+			err = ErrUsbBusy
+		case <-transport.shutdown:
+			err = ErrShutdown
+		case <-transport.goneCtx.Done():
+			err = ErrUsbNoDevice
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			// If connection was handed to us concurrently,
+			// pass it to the next waiter
+			transport.connLock.Lock()
+			queued := transport.connQueueDel(waiter)
+			transport.connLock.Unlock()
+
+			if !queued {
+				transport.connHandOver(<-waiter.ready)
+			}
+
+			return nil, err
+		}
+	}
+
+	if transport.Stalled() {
+		transport.connHandOver(conn)
+		return nil, ErrUsbStalled
+	}
+
+	if transport.Disconnected() {
+		transport.connHandOver(conn)
+		return nil, ErrUsbNoDevice
+	}
+
+	conn.session = session
+	transport.connstate.gotConn(conn)
+	transport.log.Begin().Session(session).
+		Debug(' ', "USB[%d]: connection allocated, %s",
+			conn.index, transport.connstate).
+		Commit()
+
+	return conn, nil
+}
+
+// connIdleGet takes the idle connection, suitable for the request,
+// or returns nil, if there is none. Regular connection is preferred,
+// so the reserved one remains free as long as possible
+//
+// Note, idle connection exists only if there are no waiters,
+// that may use it, so taking it doesn't break the queue order
+//
+// Must be called under transport.connLock
+func (transport *UsbTransport) connIdleGet(control bool) *usbConn {
+	found := -1
+	for i, conn := range transport.connIdle {
+		if !conn.reserved {
+			found = i
+			break
+		}
+
+		if control && found < 0 {
+			found = i
+		}
+	}
+
+	if found < 0 {
+		return nil
+	}
+
+	conn := transport.connIdle[found]
+	copy(transport.connIdle[found:], transport.connIdle[found+1:])
+	transport.connIdle = transport.connIdle[:len(transport.connIdle)-1]
+
+	return conn
+}
+
+// connQueueDel removes waiter from the queue. It returns false,
+// if waiter is not in the queue anymore (i.e., connection was
+// already handed to it)
+//
+// Must be called under transport.connLock
+func (transport *UsbTransport) connQueueDel(waiter *usbConnWaiter) bool {
+	for i, w := range transport.connQueue {
+		if w == waiter {
+			queue := transport.connQueue
+			copy(queue[i:], queue[i+1:])
+			transport.connQueue = queue[:len(queue)-1]
+			return true
+		}
+	}
+
+	return false
+}
+
+// connHandOver hands the released connection to the first
+// waiter, that may use it, or returns it to the idle list
+//
+// Status queries have priority over other waiters, so they
+// are not stuck in the queue behind the long-running jobs,
+// even if there is no reserved connection
+func (transport *UsbTransport) connHandOver(conn *usbConn) {
+	transport.connLock.Lock()
+	defer transport.connLock.Unlock()
+
+	var next *usbConnWaiter
+	for _, waiter := range transport.connQueue {
+		if waiter.control {
+			next = waiter
+			break
+		}
+
+		if next == nil && !conn.reserved {
+			next = waiter
+		}
+	}
+
+	if next != nil {
+		transport.connQueueDel(next)
+		next.ready <- conn
+		return
+	}
+
+	transport.connIdle = append(transport.connIdle, conn)
+	if len(transport.connIdle) == len(transport.connList) {
+		transport.power.Busy(false)
+	}
+}
+
+// UpgradeAcquire reserves the USB connection for the upgraded
+// protocol (i.e., WebSocket). It returns false, if there is no
+// connection to reserve.
+//
+// Upgraded connections are long-living, so at least one regular
+// connection is always left for other requests, and connection,
+// reserved for status queries, is never used for upgrade
+func (transport *UsbTransport) UpgradeAcquire() bool {
+	max := int32(-1)
+	for _, conn := range transport.connList {
+		if !conn.reserved {
+			max++
+		}
+	}
+
+	if atomic.AddInt32(&transport.upgrades, 1) > max {
+		atomic.AddInt32(&transport.upgrades, -1)
+		return false
+	}
+
+	return true
+}
+
+// UpgradeRelease releases reservation, made by UpgradeAcquire
+func (transport *UsbTransport) UpgradeRelease() {
+	atomic.AddInt32(&transport.upgrades, -1)
+}
+
+// usbPeekIppOp returns IPP operation of the request with the
+// prefetched body, or 0, if request is not IPP request
+func usbPeekIppOp(rq *http.Request, body []byte) goipp.Op {
+	ct, _, _ := mime.ParseMediaType(rq.Header.Get("Content-Type"))
+	if rq.Method != "POST" || ct != goipp.ContentType || len(body) < 4 {
+		return 0
+	}
+
+	// IPP message starts with version-number (2 bytes),
+	// followed by operation-id (2 bytes)
+	return goipp.Op(binary.BigEndian.Uint16(body[2:4]))
+}
+
+// usbIsStatusQuery reports if request is the lightweight status
+// query, allowed to use the reserved connection. op is the IPP
+// operation of the request, or 0, if request is not IPP request
+func usbIsStatusQuery(rq *http.Request, op goipp.Op) bool {
+	switch rq.Method {
+	case "GET", "HEAD":
+		switch rq.URL.Path {
+		case "/eSCL/ScannerStatus", "/eSCL/ScannerCapabilities":
+			return true
+		}
+
+	case "POST":
+		switch op {
+		case goipp.OpGetPrinterAttributes, goipp.OpGetJobs,
+			goipp.OpGetJobAttributes:
+			return true
+		}
+	}
+
+	return false
+}
+
+// usbIsIdempotent reports if request may be safely retried:
+// GET or HEAD without body or the status query. op is the IPP
+// operation of the request, or 0, if request is not IPP request
+func usbIsIdempotent(rq *http.Request, op goipp.Op) bool {
+	switch rq.Method {
+	case "GET", "HEAD":
+		return rq.ContentLength == 0
+	}
+
+	return usbIsStatusQuery(rq, op)
+}
+
+// retryable checks if the failed idempotent request may be
+// retried: USB error is transient and no response bytes were
+// received yet. If so, the connection is soft-reset, to clear
+// possible stall condition, and released
+func (conn *usbConn) retryable(err error) bool {
+	usberr, ok := err.(UsbError)
+	if !ok || conn.cntRecv != 0 {
+		return false
+	}
+
+	switch usberr.Code {
+	case UsbEPipe, UsbEIO, UsbEOverflow, UsbEIntr:
+	default:
+		return false
+	}
 
-		return conn, nil
+	transport := conn.transport
+	transport.log.Begin().Session(conn.session).
+		Debug(' ', "USB[%d]: %s; retrying", conn.index, err).
+		Commit()
+
+	err = conn.iface.SoftReset()
+	if err != nil {
+		transport.log.Info('?', "USB[%d]: SOFT_RESET: %s",
+			conn.index, err)
 	}
+
+	conn.put()
+	return true
 }
 
 // Release the connection
 func (conn *usbConn) put() {
 	transport := conn.transport
 
+	// Stop the watchdog. If it has fired, synchronization with
+	// device is probably lost, so try to recover the interface
+	if conn.watchdogStop != nil {
+		conn.watchdogStop()
+		conn.watchdogStop = nil
+	}
+
+	if atomic.LoadUint32(&conn.watchdogFired) != 0 {
+		transport.log.Debug(' ', "USB[%d]: doing SOFT_RESET after watchdog",
+			conn.index)
+		err := conn.iface.SoftReset()
+		if err != nil {
+			transport.log.Info('?', "USB[%d]: SOFT_RESET: %s",
+				conn.index, err)
+		}
+
+		atomic.StoreUint32(&conn.watchdogFired, 0)
+	}
+
+	atomic.AddInt64(&conn.stats.transactions, 1)
+
+	// Interface, that persistently fails, is reopened, so other
+	// interfaces continue to work without device reset
+	if conn.ioFailed {
+		conn.failures++
+	} else {
+		conn.failures = 0
+	}
+
+	if conn.failures >= UsbConnReopenErrors && !transport.Disconnected() {
+		transport.log.Info('!', "USB[%d]: %d transactions failed",
+			conn.index, conn.failures)
+		conn.reopen()
+		conn.failures = 0
+	}
+
+	conn.ioFailed = false
+
 	conn.reader.Reset(conn)
 	conn.delayUntil = time.Now().Add(conn.delayInterval)
 	conn.cntRecv = 0
 	conn.cntSent = 0
+	conn.timing = nil
+	conn.timedOut = false
 
 	transport.connstate.putConn(conn)
-	transport.log.Debug(' ', "USB[%d]: connection released, %s",
-		conn.index, transport.connstate)
+	transport.log.Begin().Session(conn.session).
+		Debug(' ', "USB[%d]: connection released, %s",
+			conn.index, transport.connstate).
+		Commit()
+	conn.session = -1
 
-	transport.connPool <- conn
+	transport.connHandOver(conn)
 
 	select {
 	case transport.connReleased <- struct{}{}:
@@ -962,10 +2547,55 @@ func (conn *usbConn) put() {
 	}
 }
 
+// reopen closes and reopens the connection's interface
+//
+// If interface cannot be reopened, device reset is requested
+func (conn *usbConn) reopen() {
+	transport := conn.transport
+
+	transport.log.Info('!', "USB[%d]: reopening interface", conn.index)
+	transport.httpCache.invalidate()
+
+	conn.iface.Close()
+	iface, err := transport.dev.OpenUsbInterface(conn.ifaddr,
+		transport.quirks)
+
+	if err != nil {
+		transport.log.Error('!', "USB[%d]: reopen: %s, reset requested",
+			conn.index, err)
+		transport.stall()
+		return
+	}
+
+	conn.iface = iface
+}
+
 // Destroy USB connection
 func (conn *usbConn) destroy() {
 	conn.transport.log.Debug(' ', "USB[%d]: closed", conn.index)
 	conn.iface.Close()
+	conn.transport.mem.Sub(MemBuffers, conn.reader.Size())
+}
+
+// usbConnStats contains cumulative per-connection statistics,
+// for status. Unlike usbConn.cntSent and usbConn.cntRecv, it is
+// not reset between transactions. All fields are atomic
+type usbConnStats struct {
+	sent         int64 // Total bytes sent
+	recv         int64 // Total bytes received
+	transactions int64 // Count of completed transactions
+	errors       int64 // Count of USB I/O errors
+}
+
+// String formats usbConnStats for status, as following:
+//
+//	12 transactions, 0 errors, sent 20K, received 1.5M
+func (stats *usbConnStats) String() string {
+	return fmt.Sprintf("%d transactions, %d errors, sent %s, received %s",
+		atomic.LoadInt64(&stats.transactions),
+		atomic.LoadInt64(&stats.errors),
+		memAcctFormat(atomic.LoadInt64(&stats.sent)),
+		memAcctFormat(atomic.LoadInt64(&stats.recv)))
 }
 
 // usbConnState tracks connections state, for logging
@@ -3,13 +3,15 @@
  * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
  * See LICENSE for license terms and conditions
  *
- * UUID normalizer
+ * UUID normalizer and generator
  */
 
 package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"fmt"
 )
 
 // UUIDNormalize parses an UUID and then reformats it into
@@ -55,3 +57,28 @@ func UUIDNormalize(uuid string) string {
 		string(buf[16:20]) + "-" +
 		string(buf[20:32])
 }
+
+// UUIDFromName generates name-based UUID (version 5, SHA-1)
+// from the namespace and name strings
+func UUIDFromName(namespace, name string) string {
+	hash := sha1.New()
+
+	hash.Write([]byte(namespace))
+	hash.Write([]byte(name))
+	uuid := hash.Sum(nil)
+
+	// UUID.Version = 5: Name-based with SHA1; see RFC4122, 4.1.3.
+	uuid[6] &= 0x0f
+	uuid[6] |= 0x5f
+
+	// UUID.Variant = 0b10: see RFC4122, 4.1.1.
+	uuid[8] &= 0x3F
+	uuid[8] |= 0x80
+
+	return fmt.Sprintf(
+		"%.2x%.2x%.2x%.2x-%.2x%.2x-%.2x%.2x-%.2x%.2x-%.2x%.2x%.2x%.2x%.2x%.2x",
+		uuid[0], uuid[1], uuid[2], uuid[3],
+		uuid[4], uuid[5], uuid[6], uuid[7],
+		uuid[8], uuid[9], uuid[10], uuid[11],
+		uuid[12], uuid[13], uuid[14], uuid[15])
+}